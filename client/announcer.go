@@ -0,0 +1,128 @@
+package client
+
+// Will handle announcing a started torrent to its trackers for as long as it runs
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	defaultAnnounceInterval = 30 * time.Minute // used when the trackers don't say how often to announce
+	announceRetryInterval   = time.Minute      // wait after an announce no tracker answered, doubled on every failure
+	stoppedTimeout          = 15 * time.Second // how long the stopped event may hold up stopping a torrent
+)
+
+// An announceResult holds what a tracker answered an announce with
+type announceResult struct {
+	interval    time.Duration // how long to wait before announcing again
+	minInterval time.Duration // announces must be at least this far apart, even those with an event
+	trackerID   string        // to be sent back with the next announce
+	peers       []string
+	peerIDs     map[string]string // ids of the peers the tracker listed with one, by address
+}
+
+// announcer announces the torrent with the started event, and then again every interval the trackers ask for.
+// The completed event is sent once the download finishes, and the stopped event once the torrent is stopped.
+func (torrent *Torrent) announcer() {
+	defer close(torrent.announced)
+
+	if len(torrent.trackers) == 0 {
+		return
+	}
+
+	requests := torrent.swarmRequests(torrent.Data.CreateTrackerRequest(torrent.Hash))
+	finished := torrent.completed
+	select {
+	case <-finished:
+		// The torrent was complete when it was started, so there is no download to report as completed
+		finished = nil
+	default:
+	}
+	event := started
+	next := time.Now()
+	retry := announceRetryInterval
+	var last time.Time
+	var minInterval time.Duration
+
+	for {
+		select {
+		case <-time.After(time.Until(next)):
+		case <-finished:
+			finished = nil
+			// A torrent that finishes before the started event got through reports left=0 with that instead
+			if event == "" {
+				event = completed
+				next = last.Add(minInterval)
+			}
+			continue
+		case <-torrent.stop:
+			// Trackers that never heard of us don't need to hear we're gone
+			if !last.IsZero() {
+				torrent.updateRequests(requests, stopped, expireAfter(stoppedTimeout))
+				torrent.announceSwarms(requests)
+			}
+			return
+		}
+
+		torrent.updateRequests(requests, event, torrent.stop)
+		result, err := torrent.announceSwarms(requests)
+		if err != nil {
+			fmt.Printf("Unable to announce torrent: %s \n", err.Error())
+
+			// The event is kept, so it is sent with the next attempt
+			next = time.Now().Add(retry)
+			if retry *= 2; retry > defaultAnnounceInterval {
+				retry = defaultAnnounceInterval
+			}
+			continue
+		}
+
+		last = time.Now()
+		event = ""
+		retry = announceRetryInterval
+		minInterval = result.minInterval
+
+		interval := result.interval
+		if interval <= 0 {
+			interval = defaultAnnounceInterval
+		}
+		if interval < minInterval {
+			interval = minInterval
+		}
+		next = last.Add(interval)
+	}
+}
+
+// updateRequests prepares the requests for the next announce with the event and our current transfer totals.
+// Once cancel is closed, the announce gives up on trackers that are slow to answer.
+func (torrent *Torrent) updateRequests(requests []*TrackerRequest, event string, cancel <-chan struct{}) {
+	torrent.mu.Lock()
+	defer torrent.mu.Unlock()
+
+	// Summed from the pieces rather than the files, as v2 pieces don't cover the padding between files
+	left := 0
+	for i := range torrent.Pieces {
+		if !torrent.have.Test(i) {
+			left += torrent.Pieces[i].Length
+		}
+	}
+
+	for _, request := range requests {
+		request.Event = event
+		request.Uploaded = int(torrent.uploaded)
+		request.Downloaded = int(torrent.downloaded)
+		request.Left = left
+		request.cancel = cancel
+	}
+}
+
+// expireAfter returns a channel that is closed once the duration has passed
+func expireAfter(duration time.Duration) <-chan struct{} {
+	expired := make(chan struct{})
+	time.AfterFunc(duration, func() {
+		close(expired)
+	})
+
+	return expired
+}
@@ -0,0 +1,170 @@
+package client
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"goTorrent/tracker"
+)
+
+func TestLeftSkipsPadding(t *testing.T) {
+	files := testV2Files()
+	torrent := loadTestV2(t, testV2MetaInfo(2*merkleBlockSize, files...))
+	if torrent.Data.Info.TotalLength() == len(files[0].data)+len(files[1].data) {
+		t.Fatal("torrent has no padding between its files, so it doesn't test anything")
+	}
+
+	left := func() int {
+		requests := []*TrackerRequest{{}}
+		torrent.updateRequests(requests, "", nil)
+		return requests[0].Left
+	}
+
+	if got, want := left(), len(files[0].data)+len(files[1].data); got != want {
+		t.Fatalf("left is %v with nothing downloaded, want the %v bytes of the files", got, want)
+	}
+
+	torrent.have.Set(0)
+	if got, want := left(), len(files[0].data)+len(files[1].data)-torrent.Pieces[0].Length; got != want {
+		t.Fatalf("left is %v with the first piece downloaded, want %v", got, want)
+	}
+
+	for i := range torrent.Pieces {
+		torrent.have.Set(i)
+	}
+	if got := left(); got != 0 {
+		t.Fatalf("left is %v with every piece downloaded, want 0", got)
+	}
+}
+
+// A testAnnounce is an announce a tracker got, and when
+type testAnnounce struct {
+	event string
+	left  string
+	at    time.Time
+}
+
+// startAnnouncer runs the announcer of a torrent with nothing downloaded, against a tracker asking for
+// announces at least interval apart. The announces the tracker gets are passed on.
+func startAnnouncer(t *testing.T, interval time.Duration, complete bool) (*Torrent, <-chan testAnnounce) {
+	t.Helper()
+
+	announces := make(chan testAnnounce, 10)
+	server := tracker.New(tracker.Config{Interval: interval, MinInterval: interval})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		announces <- testAnnounce{query.Get("event"), query.Get("left"), time.Now()}
+		server.ServeHTTP(w, r)
+	}))
+	t.Cleanup(ts.Close)
+
+	torrent := newTestTorrent(t, make([]byte, 4*blockSize), NewMemoryStorage())
+	torrent.Data.Announce = ts.URL + "/announce"
+	torrent.loadTrackers()
+	torrent.completed = make(chan struct{})
+	if complete {
+		completeTorrent(torrent)
+	}
+	torrent.announced = make(chan struct{})
+	torrent.mu.Lock()
+	torrent.stopped()
+	torrent.mu.Unlock()
+
+	go torrent.announcer()
+	t.Cleanup(func() {
+		torrent.Stop()
+		<-torrent.announced
+	})
+
+	return torrent, announces
+}
+
+// completeTorrent marks every piece as had and closes Done, the way the download loop does
+func completeTorrent(torrent *Torrent) {
+	torrent.mu.Lock()
+	for i := range torrent.Pieces {
+		torrent.have.Set(i)
+	}
+	torrent.mu.Unlock()
+	close(torrent.completed)
+}
+
+func nextAnnounce(t *testing.T, announces <-chan testAnnounce) testAnnounce {
+	t.Helper()
+
+	select {
+	case announce := <-announces:
+		return announce
+	case <-time.After(5 * time.Second):
+		t.Fatal("tracker got no announce")
+	}
+
+	return testAnnounce{}
+}
+
+func TestAnnouncerEvents(t *testing.T) {
+	torrent, announces := startAnnouncer(t, time.Second, false)
+	total := strconv.Itoa(4 * blockSize)
+
+	first := nextAnnounce(t, announces)
+	if first.event != started || first.left != total {
+		t.Fatalf("first announce has event %q and left %s, want %q and %s", first.event, first.left, started, total)
+	}
+
+	// Finishing is reported right away, as far as the min interval lets it
+	completeTorrent(torrent)
+	done := nextAnnounce(t, announces)
+	if done.event != completed || done.left != "0" {
+		t.Fatalf("announce after finishing has event %q and left %s, want %q and 0", done.event, done.left, completed)
+	}
+	if waited := done.at.Sub(first.at); waited < 900*time.Millisecond {
+		t.Fatalf("completed event was sent %v after the last announce, within the min interval", waited)
+	}
+
+	// Then the torrent is announced every interval, without an event
+	regular := nextAnnounce(t, announces)
+	if regular.event != "" || regular.left != "0" {
+		t.Fatalf("regular announce has event %q and left %s", regular.event, regular.left)
+	}
+	if waited := regular.at.Sub(done.at); waited < 900*time.Millisecond {
+		t.Fatalf("regular announce was sent %v after the last one, before the interval", waited)
+	}
+
+	// Stopping doesn't wait for the interval
+	stopping := time.Now()
+	torrent.Stop()
+	<-torrent.announced
+	stop := nextAnnounce(t, announces)
+	if stop.event != stopped || stop.at.Sub(stopping) > 500*time.Millisecond {
+		t.Fatalf("announce after stopping has event %q and was sent %v later", stop.event, stop.at.Sub(stopping))
+	}
+
+	select {
+	case extra := <-announces:
+		t.Fatalf("tracker got an announce with event %q after the stopped event", extra.event)
+	default:
+	}
+}
+
+func TestAnnouncerCompleteAtStart(t *testing.T) {
+	torrent, announces := startAnnouncer(t, time.Second, true)
+
+	first := nextAnnounce(t, announces)
+	if first.event != started || first.left != "0" {
+		t.Fatalf("first announce has event %q and left %s, want %q and 0", first.event, first.left, started)
+	}
+
+	// A torrent that was never downloaded doesn't report being completed
+	if regular := nextAnnounce(t, announces); regular.event != "" {
+		t.Fatalf("second announce has event %q, want none", regular.event)
+	}
+
+	torrent.Stop()
+	<-torrent.announced
+	if stop := nextAnnounce(t, announces); stop.event != stopped {
+		t.Fatalf("got an announce with event %q, want %q", stop.event, stopped)
+	}
+}
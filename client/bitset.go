@@ -0,0 +1,99 @@
+package client
+
+// Will handle sets of pieces, stored one bit per piece the way the bitfield message sends them
+
+import (
+	"fmt"
+	"math/bits"
+)
+
+// A Bitset holds one bit for every piece of a torrent. The high bit of the first byte is piece 0,
+// which makes the bytes of the set the payload of a bitfield message.
+type Bitset struct {
+	bits   []byte
+	length int
+}
+
+// NewBitset creates an empty set for the given amount of pieces
+func NewBitset(length int) Bitset {
+	return Bitset{bits: make([]byte, (length+7)/8), length: length}
+}
+
+// DecodeBitset reads the payload of a bitfield message for a torrent with the given amount of pieces.
+// The payload must have exactly enough bytes for every piece, and the spare bits at the end must be cleared.
+func DecodeBitset(data []byte, length int) (Bitset, error) {
+	if len(data) != (length+7)/8 {
+		return Bitset{}, fmt.Errorf("bitfield of %v bytes doesn't fit %v pieces", len(data), length)
+	}
+
+	if spare := length % 8; spare != 0 && data[len(data)-1]&(0xff>>uint(spare)) != 0 {
+		return Bitset{}, fmt.Errorf("bitfield has spare bits set")
+	}
+
+	return Bitset{bits: append([]byte(nil), data...), length: length}, nil
+}
+
+// Len returns the amount of pieces the set is for
+func (set *Bitset) Len() int {
+	return set.length
+}
+
+// Set adds piece i to the set. Pieces out of range are ignored.
+func (set *Bitset) Set(i int) {
+	if i >= 0 && i < set.length {
+		set.bits[i/8] |= 0x80 >> uint(i%8)
+	}
+}
+
+// Clear removes piece i from the set
+func (set *Bitset) Clear(i int) {
+	if i >= 0 && i < set.length {
+		set.bits[i/8] &^= 0x80 >> uint(i%8)
+	}
+}
+
+// Test reports whether piece i is in the set
+func (set *Bitset) Test(i int) bool {
+	return i >= 0 && i < set.length && set.bits[i/8]&(0x80>>uint(i%8)) != 0
+}
+
+// Count returns the amount of pieces in the set
+func (set *Bitset) Count() int {
+	count := 0
+	for _, b := range set.bits {
+		count += bits.OnesCount8(b)
+	}
+
+	return count
+}
+
+// Iterate calls f with every piece in the set, in order, until f returns false
+func (set *Bitset) Iterate(f func(i int) bool) {
+	for n, b := range set.bits {
+		for b != 0 {
+			i := n*8 + bits.LeadingZeros8(b)
+			if !f(i) {
+				return
+			}
+			b &^= 0x80 >> uint(i%8)
+		}
+	}
+}
+
+// AndNot returns the pieces that are in the set, but not in other
+func (set *Bitset) AndNot(other *Bitset) Bitset {
+	result := NewBitset(set.length)
+	for n := range result.bits {
+		result.bits[n] = set.bits[n]
+		if n < len(other.bits) {
+			result.bits[n] &^= other.bits[n]
+		}
+	}
+
+	return result
+}
+
+// Bytes returns the set as the payload of a bitfield message
+func (set *Bitset) Bytes() []byte {
+	return append([]byte(nil), set.bits...)
+}
@@ -0,0 +1,143 @@
+package client
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+// members returns the pieces in the set, in the order Iterate hands them out
+func members(set *Bitset) []int {
+	var pieces []int
+	set.Iterate(func(i int) bool {
+		pieces = append(pieces, i)
+		return true
+	})
+
+	return pieces
+}
+
+func TestBitset(t *testing.T) {
+	set := NewBitset(11)
+	if set.Len() != 11 || len(set.Bytes()) != 2 || set.Count() != 0 {
+		t.Fatalf("new set of 11 pieces has length %v, %v bytes and %v pieces", set.Len(), len(set.Bytes()), set.Count())
+	}
+
+	for _, i := range []int{0, 7, 8, 10, 10} {
+		set.Set(i)
+	}
+	// Pieces out of range are ignored
+	set.Set(-1)
+	set.Set(11)
+	set.Set(16)
+
+	if want := []byte{0x81, 0xa0}; !bytes.Equal(set.Bytes(), want) {
+		t.Fatalf("set is %08b, want %08b", set.Bytes(), want)
+	}
+	if set.Count() != 4 {
+		t.Fatalf("set counts %v pieces, want 4", set.Count())
+	}
+	for i := -1; i <= 16; i++ {
+		want := i == 0 || i == 7 || i == 8 || i == 10
+		if set.Test(i) != want {
+			t.Errorf("piece %v is in the set: %v, want %v", i, set.Test(i), want)
+		}
+	}
+
+	if got, want := members(&set), []int{0, 7, 8, 10}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("iterated over %v, want %v", got, want)
+	}
+
+	// Iterate stops once f returns false
+	var first []int
+	set.Iterate(func(i int) bool {
+		first = append(first, i)
+		return len(first) < 2
+	})
+	if want := []int{0, 7}; !reflect.DeepEqual(first, want) {
+		t.Fatalf("iterated over %v before stopping, want %v", first, want)
+	}
+
+	set.Clear(7)
+	set.Clear(9)
+	set.Clear(11)
+	if got, want := members(&set), []int{0, 8, 10}; !reflect.DeepEqual(got, want) || set.Count() != 3 {
+		t.Fatalf("set is %v after clearing, want %v", got, want)
+	}
+
+	// Bytes is a copy
+	set.Bytes()[0] = 0xff
+	if set.Test(1) {
+		t.Fatal("changing the bytes of the set changed the set")
+	}
+}
+
+func TestBitsetAndNot(t *testing.T) {
+	have := NewBitset(10)
+	for _, i := range []int{1, 2, 5, 9} {
+		have.Set(i)
+	}
+	peer := NewBitset(10)
+	for _, i := range []int{0, 1, 2, 3, 9} {
+		peer.Set(i)
+	}
+
+	// What the peer has that we don't
+	missing := peer.AndNot(&have)
+	if got, want := members(&missing), []int{0, 3}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("peer has %v we don't, want %v", got, want)
+	}
+	if got, want := members(&peer), []int{0, 1, 2, 3, 9}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("AndNot changed the set to %v", got)
+	}
+
+	// A set we know nothing about yet takes nothing away
+	var empty Bitset
+	if all := peer.AndNot(&empty); !reflect.DeepEqual(members(&all), members(&peer)) {
+		t.Fatalf("AndNot an empty set is %v, want %v", members(&all), members(&peer))
+	}
+}
+
+func TestDecodeBitset(t *testing.T) {
+	set, err := DecodeBitset([]byte{0x81, 0xa0}, 11)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := members(&set), []int{0, 7, 8, 10}; !reflect.DeepEqual(got, want) || set.Len() != 11 {
+		t.Fatalf("decoded %v of %v pieces, want %v of 11", got, set.Len(), want)
+	}
+
+	// The payload is copied
+	data := []byte{0x80}
+	set, err = DecodeBitset(data, 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[0] = 0
+	if !set.Test(0) {
+		t.Fatal("changing the payload changed the decoded set")
+	}
+
+	cases := map[string]struct {
+		data   []byte
+		length int
+	}{
+		"too short":        {[]byte{0xff}, 11},
+		"too long":         {[]byte{0xff, 0x00, 0x00}, 11},
+		"empty":            {nil, 1},
+		"last spare bit":   {[]byte{0xff, 0x01}, 11},
+		"first spare bit":  {[]byte{0xff, 0x10}, 11},
+		"one piece, spare": {[]byte{0x40}, 1},
+	}
+	for name, c := range cases {
+		_, err := DecodeBitset(c.data, c.length)
+		if err == nil {
+			t.Errorf("%s: bitfield %08b for %v pieces was accepted", name, c.data, c.length)
+		}
+	}
+
+	// Whole bytes have no spare bits
+	if _, err := DecodeBitset([]byte{0xff, 0xff}, 16); err != nil {
+		t.Fatalf("full bitfield of 16 pieces: %s", err)
+	}
+}
@@ -0,0 +1,149 @@
+package client
+
+// Will handle deciding which peers we upload to: tit-for-tat with an optimistic unchoke
+
+import (
+	"math/rand"
+	"sort"
+	"time"
+)
+
+const (
+	chokeInterval      = 10 * time.Second
+	optimisticInterval = 30 * time.Second
+	snubTimeout        = 60 * time.Second // a peer that sent us nothing for this long while we wanted something snubs us
+)
+
+// choker rechokes every chokeInterval until the torrent is stopped, and picks a new optimistic unchoke every optimisticInterval
+func (torrent *Torrent) choker() {
+	ticker := time.NewTicker(chokeInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			torrent.rechoke(time.Now())
+		case <-torrent.stop:
+			return
+		}
+	}
+}
+
+// rechoke unchokes the Settings.UploadSlots interested peers that gave us the most since the last round,
+// or that took the most from us once we are seeding. One more peer is unchoked optimistically, so new
+// peers get a chance to show what they can do. Peers that snub us are only ever unchoked optimistically.
+func (torrent *Torrent) rechoke(now time.Time) {
+	torrent.mu.Lock()
+
+	seeding := !torrent.missingPieces()
+	rates := map[*Peer]int64{}
+	var candidates []*Peer
+
+	for _, peer := range torrent.livePeers {
+		rates[peer] = peer.downloaded - peer.chokeDownloaded
+		if seeding {
+			rates[peer] = peer.uploaded - peer.chokeUploaded
+		}
+		peer.chokeDownloaded = peer.downloaded
+		peer.chokeUploaded = peer.uploaded
+
+		if peer.Interested == 1 && !peer.snubs(now) {
+			candidates = append(candidates, peer)
+		}
+	}
+
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return rates[candidates[i]] > rates[candidates[j]]
+	})
+
+	unchoked := map[*Peer]bool{}
+	for i := 0; i < len(candidates) && i < Settings.UploadSlots; i++ {
+		unchoked[candidates[i]] = true
+	}
+
+	torrent.chooseOptimistic(now, unchoked)
+	if torrent.optimistic != nil {
+		unchoked[torrent.optimistic] = true
+	}
+
+	var outgoing []outgoingMessage
+	for _, peer := range torrent.livePeers {
+		var msg Message
+		if unchoked[peer] {
+			msg = peer.unchoke()
+		} else {
+			msg = peer.choke()
+		}
+
+		if msg != nil {
+			outgoing = append(outgoing, outgoingMessage{peer, msg})
+		}
+	}
+
+	torrent.mu.Unlock()
+
+	for _, out := range outgoing {
+		out.peer.send(out.msg)
+	}
+}
+
+// chooseOptimistic keeps the optimistic unchoke for optimisticInterval, after which a random interested
+// peer that isn't unchoked yet takes its place
+func (torrent *Torrent) chooseOptimistic(now time.Time, unchoked map[*Peer]bool) {
+	current := torrent.optimistic
+	if current != nil && current.Interested == 1 && torrent.isLive(current) && now.Sub(torrent.optimisticSince) < optimisticInterval {
+		return
+	}
+
+	var choices []*Peer
+	for _, peer := range torrent.livePeers {
+		if peer.Interested == 1 && !unchoked[peer] {
+			choices = append(choices, peer)
+		}
+	}
+
+	torrent.optimistic = nil
+	if len(choices) > 0 {
+		torrent.optimistic = choices[rand.Intn(len(choices))]
+		torrent.optimisticSince = now
+	}
+}
+
+// isLive reports whether we are still connected to the peer
+func (torrent *Torrent) isLive(peer *Peer) bool {
+	for _, live := range torrent.livePeers {
+		if live == peer {
+			return true
+		}
+	}
+
+	return false
+}
+
+// snubs reports whether the peer left us waiting for a block for longer than snubTimeout while we were interested
+func (peer *Peer) snubs(now time.Time) bool {
+	return peer.amInterested && now.Sub(peer.lastBlock) > snubTimeout
+}
+
+// hasFreeSlot reports whether fewer peers are unchoked than the choker would allow, regular and optimistic slots together
+func (torrent *Torrent) hasFreeSlot() bool {
+	unchoked := 0
+	for _, peer := range torrent.livePeers {
+		if !peer.amChoking {
+			unchoked++
+		}
+	}
+
+	return unchoked < Settings.UploadSlots+1
+}
+
+// missingPieces reports whether pieces of the files we want are still missing. The torrent must be locked.
+func (torrent *Torrent) missingPieces() bool {
+	for i := range torrent.Pieces {
+		if !torrent.have.Test(i) && torrent.picker.wanted(i) {
+			return true
+		}
+	}
+
+	return false
+}
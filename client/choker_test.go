@@ -0,0 +1,208 @@
+package client
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestSnubClock(t *testing.T) {
+	torrent, peers := newTestSwarm(1, []int{1, 1})
+	peer := peers[0]
+	longAgo := time.Now().Add(-2 * snubTimeout)
+
+	// A peer we had no interest in for a long while doesn't snub us the moment we become interested
+	peer.lastBlock = longAgo
+	if msg := torrent.updateInterest(peer); msg == nil {
+		t.Fatal("didn't become interested in a peer with pieces we want")
+	}
+	if peer.snubs(time.Now()) {
+		t.Fatal("peer snubs us right after we became interested")
+	}
+	if !peer.snubs(time.Now().Add(snubTimeout + time.Second)) {
+		t.Fatal("peer that sent nothing for snubTimeout doesn't snub us")
+	}
+
+	// Nor does it when it is first sent requests after having none to answer
+	peer.lastBlock = longAgo
+	now := time.Now()
+	if requests := torrent.fillPipeline(peer, now, false); len(requests) == 0 {
+		t.Fatal("peer wasn't asked for anything")
+	}
+	if peer.lastBlock != now || peer.snubs(now) {
+		t.Fatal("first request didn't start the snub clock")
+	}
+
+	// Topping up the pipeline doesn't restart it
+	torrent.forgetRequest(peer, blockRequest{index: 0, begin: 0, length: blockSize})
+	later := now.Add(time.Second)
+	torrent.fillPipeline(peer, later, false)
+	if peer.lastBlock != now {
+		t.Fatal("more requests restarted the snub clock")
+	}
+}
+
+// newChokerSwarm sets up a torrent with a peer for every rate, each interested in us and choked, connected
+// through a pipe whose far end is drained. The rate is what the peer sent us since the last round, or what
+// we sent it once seeding.
+func newChokerSwarm(t *testing.T, seeding bool, rates ...int64) (*Torrent, []*Peer) {
+	t.Helper()
+
+	slots := Settings.UploadSlots
+	t.Cleanup(func() { Settings.UploadSlots = slots })
+	Settings.UploadSlots = 3
+
+	bitfields := make([][]int, len(rates))
+	for i := range bitfields {
+		bitfields[i] = []int{1, 1}
+	}
+	torrent, peers := newTestSwarm(1, bitfields...)
+	if seeding {
+		torrent.have.Set(0)
+		torrent.have.Set(1)
+	}
+
+	for i, peer := range peers {
+		local, remote := net.Pipe()
+		go io.Copy(ioutil.Discard, remote)
+		t.Cleanup(func() {
+			local.Close()
+			remote.Close()
+		})
+
+		peer.address = "peer " + strconv.Itoa(i)
+		peer.conn = &local
+		peer.amChoking = true
+		peer.Interested = 1
+		if seeding {
+			peer.uploaded = rates[i]
+		} else {
+			peer.downloaded = rates[i]
+		}
+	}
+
+	return torrent, peers
+}
+
+// unchokedPeers returns the indexes of the peers we don't choke
+func unchokedPeers(peers []*Peer) map[int]bool {
+	unchoked := map[int]bool{}
+	for i, peer := range peers {
+		if !peer.amChoking {
+			unchoked[i] = true
+		}
+	}
+
+	return unchoked
+}
+
+// checkRegularUnchokes checks that the peers with the indexes in want are unchoked, plus one other
+// interested peer as the optimistic unchoke
+func checkRegularUnchokes(t *testing.T, torrent *Torrent, peers []*Peer, want ...int) {
+	t.Helper()
+
+	unchoked := unchokedPeers(peers)
+	for _, i := range want {
+		if !unchoked[i] {
+			t.Errorf("peer %v is choked, want the peers %v unchoked", i, want)
+		}
+		delete(unchoked, i)
+	}
+
+	if len(unchoked) != 1 {
+		t.Fatalf("peers %v are unchoked besides %v, want just the optimistic unchoke", unchoked, want)
+	}
+	for i := range unchoked {
+		if peers[i] != torrent.optimistic || peers[i].Interested != 1 {
+			t.Fatalf("peer %v is unchoked, but isn't the optimistic unchoke", i)
+		}
+	}
+}
+
+func TestRechokeByDownloadRate(t *testing.T) {
+	torrent, peers := newChokerSwarm(t, false, 500, 100, 900, 0, 700, 300, 1000)
+
+	// The fastest peer isn't interested, and the third fastest snubs us
+	peers[6].Interested = 0
+	now := time.Now()
+	peers[4].amInterested = true
+	peers[4].lastBlock = now.Add(-2 * snubTimeout)
+
+	torrent.rechoke(now)
+	checkRegularUnchokes(t, torrent, peers, 2, 0, 5)
+	if torrent.optimistic == peers[6] {
+		t.Fatal("peer that isn't interested was unchoked optimistically")
+	}
+
+	// The next round goes by what peers sent since this one. It comes late enough for a new optimistic unchoke,
+	// which would otherwise stay where it is even if its peer earned a regular slot.
+	peers[4].lastBlock = now
+	for i, rate := range []int64{10, 20, 0, 40, 50, 0, 60} {
+		peers[i].downloaded += rate
+	}
+	torrent.rechoke(now.Add(optimisticInterval))
+	checkRegularUnchokes(t, torrent, peers, 4, 3, 1)
+}
+
+func TestRechokeByUploadRateWhileSeeding(t *testing.T) {
+	torrent, peers := newChokerSwarm(t, true, 100, 800, 200, 600, 400)
+
+	// What peers sent us doesn't count once we have everything
+	for i, rate := range []int64{900, 0, 800, 0, 700} {
+		peers[i].downloaded = rate
+	}
+
+	torrent.rechoke(time.Now())
+	checkRegularUnchokes(t, torrent, peers, 1, 3, 4)
+}
+
+func TestOptimisticUnchokeRotation(t *testing.T) {
+	torrent, peers := newChokerSwarm(t, false, 0, 0, 0, 0, 0, 0, 0, 0)
+	Settings.UploadSlots = 0
+
+	start := time.Now()
+	torrent.rechoke(start)
+	first := torrent.optimistic
+	if first == nil || len(unchokedPeers(peers)) != 1 {
+		t.Fatalf("%v peers are unchoked, want one optimistic unchoke", len(unchokedPeers(peers)))
+	}
+
+	// It keeps its slot for optimisticInterval
+	for _, later := range []time.Duration{chokeInterval, 2 * chokeInterval, optimisticInterval - time.Second} {
+		torrent.rechoke(start.Add(later))
+		if torrent.optimistic != first || first.amChoking {
+			t.Fatalf("optimistic unchoke changed after %v", later)
+		}
+	}
+
+	// Then another peer is picked, though it may be the same one by chance, which the since time tells apart
+	rotated := start.Add(optimisticInterval)
+	torrent.rechoke(rotated)
+	if torrent.optimistic == nil || !torrent.optimisticSince.Equal(rotated) {
+		t.Fatalf("optimistic unchoke wasn't picked again after %v", optimisticInterval)
+	}
+	if unchoked := unchokedPeers(peers); len(unchoked) != 1 || torrent.optimistic.amChoking {
+		t.Fatalf("peers %v are unchoked, want just the new optimistic unchoke", unchoked)
+	}
+
+	// Over many rotations every peer gets its turn
+	picked := map[*Peer]bool{}
+	for i := 2; i < 200; i++ {
+		torrent.rechoke(start.Add(time.Duration(i) * optimisticInterval))
+		picked[torrent.optimistic] = true
+	}
+	if len(picked) != len(peers) {
+		t.Fatalf("%v of %v peers were unchoked optimistically", len(picked), len(peers))
+	}
+
+	// A peer that loses interest loses the slot right away
+	current := torrent.optimistic
+	current.Interested = 0
+	torrent.rechoke(start.Add(200*optimisticInterval + time.Second))
+	if torrent.optimistic == current || !current.amChoking {
+		t.Fatal("optimistic unchoke kept its slot after losing interest")
+	}
+}
@@ -11,7 +11,6 @@ import (
 	"encoding/binary"
 	"math/rand"
 	"net"
-	"net/url"
 	"strconv"
 	"time"
 )
@@ -20,21 +19,28 @@ var (
 	// MyPeerID is generated at startup to be used to identify the client to trackers and peers
 	MyPeerID    []byte
 	clientState Client
+
+	// Settings is the configuration torrents are added with
+	Settings = Config{
+		DownloadDir:    ".",
+		PipelineSize:   10,
+		RequestTimeout: 30 * time.Second,
+
+		RandomFirstPieces: 4,
+		UploadSlots:       4,
+	}
 )
 
 const (
-	port = 4242
+	port         = 4242
+	clientPrefix = "-GT0001-" // Azureus-style client id at the start of our peer id
 )
 
 func init() {
 	MyPeerID = generatePeerID()
 	portString := strconv.Itoa(port)
 
-	laddr := []byte(":")
-
-	copy(laddr[1:], []byte(portString))
-
-	listeningPort, err := net.ResolveTCPAddr("tcp", string(laddr))
+	listeningPort, err := net.ResolveTCPAddr("tcp", net.JoinHostPort("", portString))
 	if err != nil {
 		panic(err)
 	}
@@ -43,6 +49,29 @@ func init() {
 
 }
 
+// addTorrent makes the torrent known to the client, so peers connecting to us can join it
+func (client *Client) addTorrent(torrent *Torrent) {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+
+	client.torrents = append(client.torrents, torrent)
+}
+
+// torrentFor returns the torrent a 20-byte info-hash received in a handshake belongs to, or nil
+func (client *Client) torrentFor(infoHash []byte) *Torrent {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+
+	for _, torrent := range client.torrents {
+		if torrent.ownsInfoHash(infoHash) {
+			return torrent
+		}
+	}
+
+	return nil
+}
+
+// generatePeerID creates the 20-byte id we use in handshakes and announces: our client prefix followed by random bytes
 func generatePeerID() []byte {
 	hash := sha1.New()
 	r := rand.New(rand.NewSource(time.Now().UnixNano()))
@@ -51,7 +80,32 @@ func generatePeerID() []byte {
 
 	hash.Write(hashed)
 
-	peerID := []byte(url.QueryEscape(string(hash.Sum(nil))))
+	peerID := hash.Sum(nil)
+	copy(peerID, clientPrefix)
 
 	return peerID
 }
+
+// publicIPv6 returns a global IPv6 address of one of our interfaces, or nil if we have none
+func publicIPv6() net.IP {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil
+	}
+
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok || ipNet.IP.To4() != nil || !ipNet.IP.IsGlobalUnicast() {
+			continue
+		}
+
+		// Unique local addresses (fc00::/7) can't be reached from the internet
+		if ipNet.IP[0]&0xfe == 0xfc {
+			continue
+		}
+
+		return ipNet.IP
+	}
+
+	return nil
+}
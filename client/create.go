@@ -0,0 +1,330 @@
+package client
+
+// Will handle creating .torrent files from data on disk
+
+import (
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/zeebo/bencode"
+)
+
+const (
+	minPieceLength    = 16 * 1024
+	maxPieceLength    = 16 * 1024 * 1024
+	targetPieceAmount = 1500
+)
+
+// A Builder describes a torrent to be created from a file or a directory
+type Builder struct {
+	Path         string     // File or directory the torrent describes
+	PieceLength  int        // Power of two of at least 16 KiB. If 0, one is chosen based on the total size
+	AnnounceList [][]string // Tiers of tracker URLs. The first tracker of the first tier also becomes the announce URL
+	WebSeeds     []string   // URLs the data can also be downloaded from (BEP 19)
+	Private      bool       // Private torrents only get their peers from trackers
+	Comment      string
+	CreatedBy    string    // Defaults to "goTorrent"
+	CreationDate time.Time // Defaults to the time Build is called
+	Workers      int       // Amount of goroutines hashing pieces. Defaults to the amount of CPUs
+}
+
+// A builderFile is a file found while walking the Builder's path
+type builderFile struct {
+	path   string   // where the file is read from
+	parts  []string // path of the file relative to the torrent's root
+	length int64
+}
+
+// Build walks the Builder's path, hashes the pieces and returns the resulting MetaInfo
+func (b *Builder) Build() (*MetaInfo, error) {
+	root, err := filepath.Abs(b.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	stat, err := os.Stat(root)
+	if err != nil {
+		return nil, err
+	}
+
+	files, err := collectFiles(root, stat)
+	if err != nil {
+		return nil, err
+	}
+
+	var total int64
+	for _, file := range files {
+		total += file.length
+	}
+
+	if total == 0 {
+		return nil, fmt.Errorf("%s contains no data", b.Path)
+	}
+
+	pieceLength := b.PieceLength
+	if pieceLength == 0 {
+		pieceLength = choosePieceLength(total)
+	}
+
+	if pieceLength < minPieceLength || pieceLength&(pieceLength-1) != 0 {
+		return nil, fmt.Errorf("piece length %v is not a power of two of at least %v bytes", pieceLength, minPieceLength)
+	}
+
+	pieces, err := b.hashPieces(files, total, pieceLength)
+	if err != nil {
+		return nil, err
+	}
+
+	info := InfoDictionary{
+		Name:        stat.Name(),
+		PieceLength: pieceLength,
+		Pieces:      pieces,
+	}
+
+	if b.Private {
+		info.Private = 1
+	}
+
+	if stat.IsDir() {
+		for _, file := range files {
+			info.Files = append(info.Files, File{Path: file.parts, Length: int(file.length)})
+		}
+	} else {
+		info.Length = int(total)
+	}
+
+	metaInfo := MetaInfo{
+		Comment:   b.Comment,
+		CreatedBy: b.CreatedBy,
+		URLList:   b.WebSeeds,
+		Info:      info,
+	}
+
+	if metaInfo.CreatedBy == "" {
+		metaInfo.CreatedBy = "goTorrent"
+	}
+
+	creationDate := b.CreationDate
+	if creationDate.IsZero() {
+		creationDate = time.Now()
+	}
+	metaInfo.CreationDate = int(creationDate.Unix())
+
+	trackers := 0
+	for _, tier := range b.AnnounceList {
+		if len(tier) == 0 {
+			continue
+		}
+		if metaInfo.Announce == "" {
+			metaInfo.Announce = tier[0]
+		}
+		metaInfo.AnnounceList = append(metaInfo.AnnounceList, tier)
+		trackers += len(tier)
+	}
+
+	// announce-list is only needed when there is more than the one tracker in announce
+	if trackers < 2 {
+		metaInfo.AnnounceList = nil
+	}
+
+	metaInfo.rawInfo, err = bencode.EncodeBytes(metaInfo.Info)
+	if err != nil {
+		return nil, err
+	}
+
+	return &metaInfo, nil
+}
+
+// collectFiles returns the regular files that make up the torrent, in the order they are stored in it
+func collectFiles(root string, stat os.FileInfo) ([]builderFile, error) {
+	if !stat.IsDir() {
+		return []builderFile{{path: root, length: stat.Size()}}, nil
+	}
+
+	var files []builderFile
+
+	// filepath.Walk visits files in lexical order, which gives us a stable file order
+	err := filepath.Walk(root, func(path string, fileInfo os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if !fileInfo.Mode().IsRegular() {
+			return nil
+		}
+
+		relative, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+
+		files = append(files, builderFile{
+			path:   path,
+			parts:  strings.Split(filepath.ToSlash(relative), "/"),
+			length: fileInfo.Size(),
+		})
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(files) == 0 {
+		return nil, fmt.Errorf("%s contains no files", root)
+	}
+
+	return files, nil
+}
+
+// choosePieceLength picks the smallest power of two that keeps the amount of pieces around targetPieceAmount
+func choosePieceLength(total int64) int {
+	pieceLength := minPieceLength
+	for pieceLength < maxPieceLength && total/int64(pieceLength) > targetPieceAmount {
+		pieceLength *= 2
+	}
+
+	return pieceLength
+}
+
+// A pieceJob is a piece read from disk waiting to be hashed
+type pieceJob struct {
+	index int
+	data  []byte
+}
+
+// hashPieces reads the files back to back as one stream, cuts it into pieces and hashes them in parallel.
+// The hashes are concatenated in piece order.
+func (b *Builder) hashPieces(files []builderFile, total int64, pieceLength int) (string, error) {
+	workers := b.Workers
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+
+	amountOfPieces := int((total + int64(pieceLength) - 1) / int64(pieceLength))
+	hashes := make([]byte, 20*amountOfPieces)
+
+	jobs := make(chan pieceJob, workers)
+	// Buffers are handed back once hashed so only a few pieces are held in memory at a time
+	buffers := make(chan []byte, 2*workers)
+	for i := 0; i < 2*workers; i++ {
+		buffers <- make([]byte, pieceLength)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range jobs {
+				hash := sha1.Sum(job.data)
+				copy(hashes[20*job.index:], hash[:])
+				buffers <- job.data[:cap(job.data)]
+			}
+		}()
+	}
+
+	err := readPieces(files, pieceLength, buffers, jobs)
+	close(jobs)
+	wg.Wait()
+
+	if err != nil {
+		return "", err
+	}
+
+	return string(hashes), nil
+}
+
+// readPieces fills buffers with consecutive pieces of the files and sends them off to be hashed
+func readPieces(files []builderFile, pieceLength int, buffers chan []byte, jobs chan pieceJob) error {
+	index := 0
+	filled := 0
+	buf := <-buffers
+
+	for _, file := range files {
+		f, err := os.Open(file.path)
+		if err != nil {
+			return err
+		}
+
+		var read int64
+		for {
+			n, err := io.ReadFull(f, buf[filled:])
+			filled += n
+			read += int64(n)
+
+			if filled == pieceLength {
+				jobs <- pieceJob{index: index, data: buf}
+				index++
+				filled = 0
+				buf = <-buffers
+			}
+
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				break
+			}
+			if err != nil {
+				f.Close()
+				return err
+			}
+		}
+		f.Close()
+
+		if read != file.length {
+			return fmt.Errorf("%s changed size while it was being hashed", file.path)
+		}
+	}
+
+	if filled > 0 {
+		jobs <- pieceJob{index: index, data: buf[:filled]}
+	}
+
+	return nil
+}
+
+// Bytes returns the bencoded .torrent file. The info dictionary is written exactly as it was read or built.
+func (info *MetaInfo) Bytes() ([]byte, error) {
+	stream, err := bencode.EncodeBytes(info)
+	if err != nil {
+		return nil, err
+	}
+
+	rawInfo := info.RawInfo()
+	if rawInfo == nil {
+		return nil, errors.New("unable to encode info dictionary")
+	}
+
+	dictionary := map[string]interface{}{}
+	err = bencode.DecodeBytes(stream, &dictionary)
+	if err != nil {
+		return nil, err
+	}
+	dictionary["info"] = bencode.RawMessage(rawInfo)
+
+	// Trackerless torrents leave announce out instead of storing an empty URL
+	if info.Announce == "" {
+		delete(dictionary, "announce")
+	}
+
+	return bencode.EncodeBytes(dictionary)
+}
+
+// Save writes the bencoded .torrent file to path
+func (info *MetaInfo) Save(path string) error {
+	stream, err := info.Bytes()
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(path, stream, 0644)
+}
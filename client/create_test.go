@@ -0,0 +1,230 @@
+package client
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// writeBuilderFiles writes the files of a torrent named multi under dir, returning their data back to back
+func writeBuilderFiles(t *testing.T, dir string) []byte {
+	t.Helper()
+
+	files := []struct {
+		path   string
+		length int
+	}{
+		// In the order the builder walks them
+		{"a.txt", minPieceLength + 100},
+		{"b/c.bin", 3*minPieceLength - 7},
+		{"b/e.txt", 0},
+		{"d.bin", 500},
+	}
+
+	var data []byte
+	random := rand.New(rand.NewSource(3))
+	for _, file := range files {
+		contents := make([]byte, file.length)
+		random.Read(contents)
+		data = append(data, contents...)
+
+		path := filepath.Join(dir, "multi", filepath.FromSlash(file.path))
+		err := os.MkdirAll(filepath.Dir(path), 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = ioutil.WriteFile(path, contents, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return data
+}
+
+// checkPieceHashes checks the pieces of the info dictionary are the hashes of the data
+func checkPieceHashes(t *testing.T, info InfoDictionary, data []byte) {
+	t.Helper()
+
+	var want []byte
+	for offset := 0; offset < len(data); offset += info.PieceLength {
+		end := offset + info.PieceLength
+		if end > len(data) {
+			end = len(data)
+		}
+		hash := sha1.Sum(data[offset:end])
+		want = append(want, hash[:]...)
+	}
+
+	if info.Pieces != string(want) {
+		t.Fatalf("pieces are %x, want %x", info.Pieces, want)
+	}
+}
+
+func TestBuildRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	data := writeBuilderFiles(t, dir)
+
+	builder := Builder{
+		Path:         filepath.Join(dir, "multi"),
+		PieceLength:  minPieceLength,
+		AnnounceList: [][]string{{"http://a.example/announce", "http://b.example/announce"}, {}, {"udp://c.example:6969"}},
+		WebSeeds:     []string{"http://seed.example/"},
+		Private:      true,
+		Comment:      "a comment",
+		CreationDate: time.Unix(1600000000, 0),
+		Workers:      3,
+	}
+	built, err := builder.Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(dir, "multi.torrent")
+	err = built.Save(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := ParseMetaInfo(stream)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(parsed.HashInfo(), built.HashInfo()) {
+		t.Fatalf("info-hash is %x after saving, was %x", parsed.HashInfo(), built.HashInfo())
+	}
+
+	info := parsed.Info
+	wantFiles := []File{
+		{Path: []string{"a.txt"}, Length: minPieceLength + 100},
+		{Path: []string{"b", "c.bin"}, Length: 3*minPieceLength - 7},
+		{Path: []string{"b", "e.txt"}, Length: 0},
+		{Path: []string{"d.bin"}, Length: 500},
+	}
+	if info.Name != "multi" || info.Length != 0 || info.Private != 1 || !reflect.DeepEqual(info.Files, wantFiles) {
+		t.Fatalf("info dictionary is %+v", info)
+	}
+	if len(info.Pieces) != 20*5 {
+		t.Fatalf("got %v piece hashes, want 5", len(info.Pieces)/20)
+	}
+	checkPieceHashes(t, info, data)
+
+	// The empty tier is dropped, and the first tracker is also the announce URL
+	wantTiers := [][]string{{"http://a.example/announce", "http://b.example/announce"}, {"udp://c.example:6969"}}
+	if parsed.Announce != "http://a.example/announce" || !reflect.DeepEqual(parsed.AnnounceList, wantTiers) {
+		t.Errorf("announce is %q and announce-list %v", parsed.Announce, parsed.AnnounceList)
+	}
+	if parsed.Comment != "a comment" || parsed.CreatedBy != "goTorrent" || parsed.CreationDate != 1600000000 {
+		t.Errorf("comment is %q, created by %q on %v", parsed.Comment, parsed.CreatedBy, parsed.CreationDate)
+	}
+	if !reflect.DeepEqual([]string(parsed.URLList), builder.WebSeeds) {
+		t.Errorf("web seeds are %v, want %v", parsed.URLList, builder.WebSeeds)
+	}
+
+	// And the data the torrent was built from checks out as complete
+	torrent := &Torrent{Data: *parsed}
+	err = torrent.loadInfo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(backend Storage) { Settings.Storage = backend }(Settings.Storage)
+	Settings.Storage = NewFileStorage(dir)
+	err = torrent.openStorage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer torrent.storage.Close()
+	if torrent.completePieces() != len(torrent.Pieces) {
+		t.Fatalf("recheck found %v of %v pieces", torrent.completePieces(), len(torrent.Pieces))
+	}
+}
+
+func TestBuildSingleFile(t *testing.T) {
+	dir := t.TempDir()
+	data := make([]byte, 2*minPieceLength+1)
+	rand.New(rand.NewSource(4)).Read(data)
+	path := filepath.Join(dir, "single.bin")
+	err := ioutil.WriteFile(path, data, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	built, err := (&Builder{Path: path, AnnounceList: [][]string{{"http://a.example/announce"}}}).Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream, err := built.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := ParseMetaInfo(stream)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	info := parsed.Info
+	if info.Name != "single.bin" || info.Length != len(data) || info.Files != nil || info.Private != 0 {
+		t.Fatalf("info dictionary is %+v", info)
+	}
+	if info.PieceLength != choosePieceLength(int64(len(data))) {
+		t.Fatalf("piece length is %v", info.PieceLength)
+	}
+	checkPieceHashes(t, info, data)
+
+	// One tracker needs no announce-list
+	if parsed.Announce != "http://a.example/announce" || parsed.AnnounceList != nil {
+		t.Errorf("announce is %q and announce-list %v", parsed.Announce, parsed.AnnounceList)
+	}
+}
+
+func TestBuildErrors(t *testing.T) {
+	dir := t.TempDir()
+	writeBuilderFiles(t, dir)
+	empty := filepath.Join(dir, "empty")
+	err := os.MkdirAll(filepath.Join(empty, "sub"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := map[string]Builder{
+		"missing path":        {Path: filepath.Join(dir, "missing")},
+		"no files":            {Path: empty},
+		"small piece length":  {Path: filepath.Join(dir, "multi"), PieceLength: minPieceLength / 2},
+		"uneven piece length": {Path: filepath.Join(dir, "multi"), PieceLength: minPieceLength + 1},
+	}
+	for name, builder := range cases {
+		_, err := builder.Build()
+		if err == nil {
+			t.Errorf("%s: torrent was built", name)
+		}
+	}
+}
+
+func TestChoosePieceLength(t *testing.T) {
+	cases := []struct {
+		total       int64
+		pieceLength int
+	}{
+		{1, minPieceLength},
+		{targetPieceAmount * minPieceLength, minPieceLength},
+		{targetPieceAmount*minPieceLength + minPieceLength, 2 * minPieceLength},
+		{targetPieceAmount * 1024 * 1024, 1024 * 1024},
+		{1 << 50, maxPieceLength},
+	}
+
+	for _, c := range cases {
+		if got := choosePieceLength(c.total); got != c.pieceLength {
+			t.Errorf("piece length for %v bytes is %v, want %v", c.total, got, c.pieceLength)
+		}
+	}
+}
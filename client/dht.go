@@ -0,0 +1,97 @@
+package client
+
+// Will handle finding the peers of torrents through the DHT, and telling peers where our DHT node listens
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+)
+
+const dhtAnnounceInterval = 15 * time.Minute // nodes forget peers that don't announce again within 30 minutes
+
+// usesDHT reports whether the torrent finds peers through the DHT. Private torrents only get their peers from trackers.
+func (torrent *Torrent) usesDHT() bool {
+	return Settings.DHT != nil && torrent.Data.Info.Private != 1
+}
+
+// dhtHashes returns the info-hashes the torrent is found under in the DHT: like with trackers, a hybrid
+// torrent is in the swarm of its truncated v2 info-hash too
+func (torrent *Torrent) dhtHashes() [][]byte {
+	hashes := [][]byte{torrent.Hash}
+	if torrent.isHybrid() {
+		hashes = append(hashes, torrent.HashV2[:20])
+	}
+
+	return hashes
+}
+
+// dhtAnnouncer announces the torrent to the DHT every dhtAnnounceInterval until it is stopped, and adds
+// the peers the lookups find
+func (torrent *Torrent) dhtAnnouncer() {
+	if !torrent.usesDHT() {
+		return
+	}
+
+	for {
+		next := dhtAnnounceInterval
+
+		for _, hash := range torrent.dhtHashes() {
+			var infoHash [20]byte
+			copy(infoHash[:], hash)
+
+			peers, err := Settings.DHT.Announce(infoHash, port)
+			if err != nil {
+				fmt.Printf("DHT announce failed: %s \n", err.Error())
+				next = announceRetryInterval
+				continue
+			}
+
+			fmt.Printf("The DHT knows %v peers. \n", len(peers))
+			torrent.addPeers(peers, nil, hash)
+		}
+
+		select {
+		case <-time.After(next):
+		case <-torrent.stop:
+			return
+		}
+	}
+}
+
+// lookupDHT adds the peers the DHT knows of, without announcing the torrent
+func (torrent *Torrent) lookupDHT() {
+	if !torrent.usesDHT() {
+		return
+	}
+
+	for _, hash := range torrent.dhtHashes() {
+		var infoHash [20]byte
+		copy(infoHash[:], hash)
+
+		peers, err := Settings.DHT.GetPeers(infoHash)
+		if err != nil {
+			fmt.Printf("DHT lookup failed: %s \n", err.Error())
+			continue
+		}
+
+		torrent.addPeers(peers, nil, hash)
+	}
+}
+
+// sendDHTPort tells a peer that runs a DHT node too which port our node listens on
+func (peer *Peer) sendDHTPort() {
+	if peer.torrent.usesDHT() && peer.supportsDHT() {
+		peer.send(&PortMessage{Port: uint16(Settings.DHT.Port())})
+	}
+}
+
+// processPort adds the DHT node of the peer to our routing table, if it answers
+func (peer *Peer) processPort(msg *PortMessage) {
+	if !peer.torrent.usesDHT() || msg.Port == 0 {
+		return
+	}
+
+	Settings.DHT.AddNode(net.JoinHostPort(peerIP(peer.address), strconv.Itoa(int(msg.Port))))
+}
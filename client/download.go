@@ -0,0 +1,492 @@
+package client
+
+// Will handle keeping peers busy with block requests and assembling the blocks they send into pieces
+
+import (
+	"fmt"
+	"net"
+	"time"
+)
+
+const (
+	blockSize         = 16384
+	updateInterval    = time.Second
+	keepAliveInterval = 2 * time.Minute
+	maxHashFailures   = 3 // failed pieces a peer may contribute to before it is banned
+)
+
+// A blockRequest identifies a block we asked a peer for
+type blockRequest struct {
+	index  int
+	begin  int
+	length int
+}
+
+// An outgoingMessage is a message decided on while holding the torrent's lock, to be sent once it is released
+type outgoingMessage struct {
+	peer *Peer
+	msg  Message
+}
+
+// download runs Update until the torrent is stopped. Besides every updateInterval, it runs as soon as
+// something happens that may let us send new requests. Once every piece is in, the torrent keeps
+// running so peers can download from us.
+func (torrent *Torrent) download() {
+	ticker := time.NewTicker(updateInterval)
+	defer ticker.Stop()
+
+	done := !torrent.torrentNotComplete()
+
+	for {
+		torrent.Update()
+
+		if !done && !torrent.torrentNotComplete() {
+			done = true
+			fmt.Println("Torrent is done!")
+			close(torrent.completed)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-torrent.wake:
+		case <-torrent.stop:
+			return
+		}
+	}
+}
+
+// wakeUp makes the download loop run Update right away, e.g. after a peer unchoked us
+func (torrent *Torrent) wakeUp() {
+	select {
+	case torrent.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Update checks torrent state then sends appropriate request to peers for missing pieces
+func (torrent *Torrent) Update() {
+	torrent.mu.Lock()
+
+	var outgoing []outgoingMessage
+	now := time.Now()
+	endgame := torrent.inEndgame()
+
+	for _, peer := range torrent.livePeers {
+		sent := len(outgoing)
+
+		outgoing = append(outgoing, torrent.expireRequests(peer, now)...)
+
+		if msg := torrent.updateInterest(peer); msg != nil {
+			outgoing = append(outgoing, outgoingMessage{peer, msg})
+		}
+
+		// Requests are only answered while the peer isn't choking us
+		if peer.amInterested && peer.Choking == 0 {
+			for _, request := range torrent.fillPipeline(peer, now, endgame) {
+				outgoing = append(outgoing, outgoingMessage{peer, &RequestMessage{
+					Index:  request.index,
+					Begin:  request.begin,
+					Length: request.length,
+				}})
+			}
+		}
+
+		if len(outgoing) == sent && now.Sub(peer.lastSent) > keepAliveInterval {
+			outgoing = append(outgoing, outgoingMessage{peer, nil})
+		}
+
+		if len(outgoing) > sent {
+			peer.lastSent = now
+		}
+	}
+
+	torrent.mu.Unlock()
+
+	for _, out := range outgoing {
+		out.peer.send(out.msg)
+	}
+}
+
+// send writes a message to the peer. A connection we can't write to is closed, which ends its read loop and drops the peer.
+// The error is returned for callers that only account for messages that went out.
+func (peer *Peer) send(msg Message) error {
+	err := WriteMessage(*peer.conn, msg)
+	if err != nil {
+		fmt.Printf("Could not send message to %s: %s \n", peer.address, err.Error())
+		(*peer.conn).Close()
+	}
+
+	return err
+}
+
+// fillPipeline picks blocks to request from the peer until it has Settings.PipelineSize requests outstanding
+// In endgame, blocks other peers are already asked for are requested as well.
+func (torrent *Torrent) fillPipeline(peer *Peer, now time.Time, endgame bool) []blockRequest {
+	if peer.requests == nil {
+		peer.requests = map[blockRequest]time.Time{}
+	}
+
+	idle := len(peer.requests) == 0
+
+	var requests []blockRequest
+	for len(peer.requests) < Settings.PipelineSize {
+		request, ok := torrent.nextRequest(peer)
+		if !ok && endgame {
+			request, ok = torrent.endgameRequest(peer)
+		}
+		if !ok {
+			break
+		}
+
+		peer.requests[request] = now
+		requests = append(requests, request)
+	}
+
+	// The snub clock starts when the peer has requests of ours to answer, not while it had none
+	if idle && len(requests) > 0 {
+		peer.lastBlock = now
+	}
+
+	return requests
+}
+
+// nextRequest finds a block of a piece the peer has that nobody is downloading yet.
+// Pieces that were already started are finished first, before the picker chooses a new one.
+func (torrent *Torrent) nextRequest(peer *Peer) (blockRequest, bool) {
+	for i := range torrent.Pieces {
+		piece := &torrent.Pieces[i]
+		if !piece.started() || !torrent.canDownload(piece) || !peer.hasPiece(piece.Index) {
+			continue
+		}
+
+		if request, ok := piece.nextRequest(); ok {
+			return request, true
+		}
+	}
+
+	index := torrent.picker.pick(func(index int) bool {
+		piece := &torrent.Pieces[index]
+		return !piece.started() && torrent.canDownload(piece) && peer.hasPiece(index)
+	}, torrent.completePieces() < Settings.RandomFirstPieces)
+
+	if index == -1 {
+		return blockRequest{}, false
+	}
+
+	return torrent.Pieces[index].nextRequest()
+}
+
+// nextRequest marks the first block of the piece that is neither received nor requested as requested
+func (piece *Piece) nextRequest() (blockRequest, bool) {
+	for j := range piece.Blocks {
+		block := &piece.Blocks[j]
+		if block.Data == nil && block.requests == 0 {
+			block.requests++
+			return blockRequest{index: piece.Index, begin: block.Offset, length: block.Length}, true
+		}
+	}
+
+	return blockRequest{}, false
+}
+
+// started reports whether any block of the piece was requested or received
+func (piece *Piece) started() bool {
+	for _, block := range piece.Blocks {
+		if block.requests > 0 || block.Data != nil {
+			return true
+		}
+	}
+
+	return false
+}
+
+// completePieces counts the pieces we have
+func (torrent *Torrent) completePieces() int {
+	return torrent.have.Count()
+}
+
+// inEndgame reports whether every missing block has been requested. From then on the remaining blocks are
+// requested from every peer that has them, so the download doesn't wait on the slowest of them.
+func (torrent *Torrent) inEndgame() bool {
+	for i := range torrent.Pieces {
+		piece := &torrent.Pieces[i]
+		if !torrent.canDownload(piece) {
+			continue
+		}
+
+		for _, block := range piece.Blocks {
+			if block.Data == nil && block.requests == 0 {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+// endgameRequest finds a missing block of a piece the peer has that another peer was asked for, but this one wasn't
+func (torrent *Torrent) endgameRequest(peer *Peer) (blockRequest, bool) {
+	for i := range torrent.Pieces {
+		piece := &torrent.Pieces[i]
+		if !torrent.canDownload(piece) || !peer.hasPiece(piece.Index) {
+			continue
+		}
+
+		for j := range piece.Blocks {
+			block := &piece.Blocks[j]
+			request := blockRequest{index: piece.Index, begin: block.Offset, length: block.Length}
+			if _, asked := peer.requests[request]; block.Data == nil && !asked {
+				block.requests++
+				return request, true
+			}
+		}
+	}
+
+	return blockRequest{}, false
+}
+
+// cancelDuplicates withdraws the requests other peers still have for a block that just arrived
+func (torrent *Torrent) cancelDuplicates(request blockRequest) []outgoingMessage {
+	var cancels []outgoingMessage
+
+	for _, peer := range torrent.livePeers {
+		if _, ok := peer.requests[request]; ok {
+			torrent.forgetRequest(peer, request)
+			cancels = append(cancels, outgoingMessage{peer, &CancelMessage{
+				Index:  request.index,
+				Begin:  request.begin,
+				Length: request.length,
+			}})
+		}
+	}
+
+	return cancels
+}
+
+// canDownload reports whether the piece is still missing, belongs to a file we want and can be verified once
+// it is downloaded. Pieces of v2 files whose piece layer hasn't arrived yet have no hash to check against.
+func (torrent *Torrent) canDownload(piece *Piece) bool {
+	return !torrent.have.Test(piece.Index) && torrent.picker.wanted(piece.Index) && (piece.Hash != nil || piece.HashV2 != nil)
+}
+
+// wantsFrom reports whether the peer has any piece we still need
+func (torrent *Torrent) wantsFrom(peer *Peer) bool {
+	wants := false
+
+	missing := peer.Bitfield.AndNot(&torrent.have)
+	missing.Iterate(func(i int) bool {
+		wants = torrent.canDownload(&torrent.Pieces[i])
+		return !wants
+	})
+
+	return wants
+}
+
+// updateInterest works out whether we want anything the peer has. If that changed, it returns the
+// interested or not interested message that tells the peer.
+func (torrent *Torrent) updateInterest(peer *Peer) Message {
+	wants := torrent.wantsFrom(peer)
+	if wants == peer.amInterested {
+		return nil
+	}
+
+	peer.amInterested = wants
+	if wants {
+		// The peer can't have snubbed us while we didn't want anything from it
+		peer.lastBlock = time.Now()
+		return &InterestedMessage{}
+	}
+	return &NotInterestedMessage{}
+}
+
+// announcePiece tells every peer about a piece we just verified, and drops our interest in peers
+// that have nothing else we want. With Settings.SuppressHaves, peers that have the piece aren't told.
+func (torrent *Torrent) announcePiece(index int) []outgoingMessage {
+	var outgoing []outgoingMessage
+
+	for _, peer := range torrent.livePeers {
+		if !Settings.SuppressHaves || !peer.Bitfield.Test(index) {
+			outgoing = append(outgoing, outgoingMessage{peer, &HaveMessage{Index: index}})
+		}
+
+		if msg := torrent.updateInterest(peer); msg != nil {
+			outgoing = append(outgoing, outgoingMessage{peer, msg})
+		}
+	}
+
+	return outgoing
+}
+
+// hasPiece reports whether the peer told us it has the piece
+func (peer *Peer) hasPiece(index int) bool {
+	return peer.Bitfield.Test(index)
+}
+
+// expireRequests forgets requests the peer left unanswered for longer than Settings.RequestTimeout,
+// so their blocks can be requested again. The peer is sent a cancel for each, so it doesn't spend its
+// upload on blocks we are getting elsewhere.
+func (torrent *Torrent) expireRequests(peer *Peer, now time.Time) []outgoingMessage {
+	var cancels []outgoingMessage
+
+	for request, sent := range peer.requests {
+		if now.Sub(sent) > Settings.RequestTimeout {
+			torrent.forgetRequest(peer, request)
+			cancels = append(cancels, outgoingMessage{peer, &CancelMessage{
+				Index:  request.index,
+				Begin:  request.begin,
+				Length: request.length,
+			}})
+		}
+	}
+
+	return cancels
+}
+
+// releaseRequests forgets every request outstanding with the peer, after it choked us or went away
+func (torrent *Torrent) releaseRequests(peer *Peer) {
+	for request := range peer.requests {
+		torrent.forgetRequest(peer, request)
+	}
+}
+
+// forgetRequest removes a request from those outstanding with the peer
+func (torrent *Torrent) forgetRequest(peer *Peer, request blockRequest) {
+	if _, ok := peer.requests[request]; ok {
+		delete(peer.requests, request)
+		torrent.releaseBlock(request)
+	}
+}
+
+// releaseBlock makes a requested block available to be requested again, once no other peer is asked for it either
+func (torrent *Torrent) releaseBlock(request blockRequest) {
+	block := torrent.block(request.index, request.begin)
+	if block != nil && block.requests > 0 {
+		block.requests--
+	}
+}
+
+// block returns the block of the piece at index that starts at begin, or nil if there is no such block
+func (torrent *Torrent) block(index, begin int) *Block {
+	if index < 0 || index >= len(torrent.Pieces) || begin < 0 || begin%blockSize != 0 {
+		return nil
+	}
+
+	piece := &torrent.Pieces[index]
+	if begin/blockSize >= len(piece.Blocks) {
+		return nil
+	}
+
+	return &piece.Blocks[begin/blockSize]
+}
+
+// hasAllBlocks reports whether every block of the piece has been received
+func (piece *Piece) hasAllBlocks() bool {
+	for _, block := range piece.Blocks {
+		if block.Data == nil {
+			return false
+		}
+	}
+
+	return true
+}
+
+// assemble puts the received blocks of the piece together
+func (piece *Piece) assemble() []byte {
+	data := make([]byte, piece.Length)
+	for _, block := range piece.Blocks {
+		copy(data[block.Offset:], block.Data)
+	}
+
+	return data
+}
+
+// resetBlocks drops the data of every block, so the piece is downloaded again
+func (piece *Piece) resetBlocks() {
+	for i := range piece.Blocks {
+		piece.Blocks[i].Data = nil
+		piece.Blocks[i].peer = nil
+	}
+}
+
+// contributors returns every peer that sent a block of the piece
+func (piece *Piece) contributors() []*Peer {
+	var peers []*Peer
+	seen := map[*Peer]bool{}
+
+	for _, block := range piece.Blocks {
+		if block.peer != nil && !seen[block.peer] {
+			seen[block.peer] = true
+			peers = append(peers, block.peer)
+		}
+	}
+
+	return peers
+}
+
+// completePiece verifies a piece whose blocks have all arrived and stores it, reporting whether that worked.
+// A piece that fails its hash check counts against every peer that contributed to it, and is downloaded again.
+func (torrent *Torrent) completePiece(piece *Piece) bool {
+	data := piece.assemble()
+
+	if !piece.verify(data, torrent.Data.Info.PieceLength) {
+		fmt.Printf("Piece %v failed its hash check \n", piece.Index)
+
+		for _, peer := range piece.contributors() {
+			peer.hashFailures++
+			if peer.hashFailures >= maxHashFailures {
+				torrent.ban(peer)
+			}
+		}
+
+		piece.resetBlocks()
+		return false
+	}
+
+	err := torrent.writePiece(piece, data)
+	if err != nil {
+		fmt.Printf("Unable to store piece %v: %s \n", piece.Index, err.Error())
+		piece.resetBlocks()
+		return false
+	}
+
+	torrent.have.Set(piece.Index)
+	// The data is in storage now, so the blocks don't have to hold on to it
+	for i := range piece.Blocks {
+		piece.Blocks[i].Data = nil
+		piece.Blocks[i].peer = nil
+	}
+
+	return true
+}
+
+// ban disconnects a peer that keeps sending bad data and refuses any further connection from its IP address
+func (torrent *Torrent) ban(peer *Peer) {
+	fmt.Printf("Banning peer %s after %v failed pieces \n", peer.address, peer.hashFailures)
+
+	if torrent.banned == nil {
+		torrent.banned = map[string]bool{}
+	}
+	torrent.banned[peerIP(peer.address)] = true
+
+	if peer.conn != nil {
+		(*peer.conn).Close()
+	}
+}
+
+// isBanned reports whether the peer at address was banned
+func (torrent *Torrent) isBanned(address string) bool {
+	torrent.mu.Lock()
+	defer torrent.mu.Unlock()
+
+	return torrent.banned[peerIP(address)]
+}
+
+// peerIP returns the IP part of a host:port address. Peers that connect to us do so from a random port.
+func peerIP(address string) string {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return address
+	}
+
+	return host
+}
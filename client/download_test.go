@@ -0,0 +1,369 @@
+package client
+
+import (
+	"net"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// newPipePeer is a peer of the torrent connected through a pipe, returning the end of the pipe the peer is at
+func newPipePeer(t *testing.T, torrent *Torrent, address string) (*Peer, net.Conn) {
+	t.Helper()
+
+	ours, theirs := net.Pipe()
+	t.Cleanup(func() { theirs.Close() })
+
+	peer := &Peer{address: address, torrent: torrent, requests: map[blockRequest]time.Time{}}
+	peer.recordHandshake(newHandshake(torrent.Hash), ours)
+
+	return peer, theirs
+}
+
+// sendBlock has the peer send block of piece index of the data, corrupted if bad is set, and reports whether
+// that completed the piece
+func sendBlock(torrent *Torrent, peer *Peer, index, block int, data []byte, bad bool) bool {
+	start := index*torrent.Data.Info.PieceLength + block*blockSize
+	payload := append([]byte(nil), data[start:start+blockSize]...)
+	if bad {
+		payload[0] ^= 0xff
+	}
+
+	torrent.mu.Lock()
+	defer torrent.mu.Unlock()
+
+	return torrent.receiveBlock(peer, &PieceMessage{Index: index, Begin: block * blockSize, Block: payload})
+}
+
+func TestHashFailureBan(t *testing.T) {
+	data := make([]byte, 4*blockSize)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	torrent := newTestTorrent(t, data, NewMemoryStorage())
+	bad, badConn := newPipePeer(t, torrent, "10.0.0.1:6881")
+	good, _ := newPipePeer(t, torrent, "10.0.0.2:6881")
+
+	// A piece that fails its check counts against every peer that sent part of it, and is downloaded again
+	sendBlock(torrent, good, 0, 0, data, false)
+	if sendBlock(torrent, bad, 0, 1, data, true) {
+		t.Fatal("piece with a corrupted block was completed")
+	}
+	if bad.hashFailures != 1 || good.hashFailures != 1 {
+		t.Fatalf("peers have %v and %v hash failures, want 1 each", bad.hashFailures, good.hashFailures)
+	}
+	for _, block := range torrent.Pieces[0].Blocks {
+		if block.Data != nil || block.peer != nil {
+			t.Fatal("blocks of the failed piece were kept")
+		}
+	}
+	if torrent.have.Test(0) {
+		t.Fatal("failed piece is marked as had")
+	}
+
+	// The peer is banned once it reaches the limit, and only that one
+	for failures := 2; failures <= maxHashFailures; failures++ {
+		if torrent.isBanned(bad.address) {
+			t.Fatalf("peer was banned after %v failures", bad.hashFailures)
+		}
+		sendBlock(torrent, bad, 1, 0, data, false)
+		sendBlock(torrent, bad, 1, 1, data, true)
+	}
+	if bad.hashFailures != maxHashFailures {
+		t.Fatalf("peer has %v hash failures, want %v", bad.hashFailures, maxHashFailures)
+	}
+
+	// By IP address, as peers connect to us from any port
+	if !torrent.isBanned("10.0.0.1:51413") {
+		t.Fatal("peer isn't banned after too many failed pieces")
+	}
+	if torrent.isBanned(good.address) {
+		t.Fatal("peer that sent one good block of a failed piece was banned")
+	}
+
+	// Its connection is closed
+	badConn.SetReadDeadline(time.Now().Add(time.Second))
+	_, err := badConn.Read(make([]byte, 1))
+	if err == nil || isTimeout(err) {
+		t.Fatalf("connection of the banned peer is still open: %v", err)
+	}
+
+	// And the piece is completed once the good data arrives
+	sendBlock(torrent, good, 1, 0, data, false)
+	if !sendBlock(torrent, good, 1, 1, data, false) || !torrent.have.Test(1) {
+		t.Fatal("piece wasn't completed with good data")
+	}
+	if good.hashFailures != 1 {
+		t.Fatalf("good peer has %v hash failures after a good piece", good.hashFailures)
+	}
+}
+
+func isTimeout(err error) bool {
+	netErr, ok := err.(net.Error)
+	return ok && netErr.Timeout()
+}
+
+// receivedMessages reads the messages sent down a pipe. A keep alive is sent after whatever the test looks
+// at, so everything before it can be taken in one go.
+func receivedMessages(t *testing.T, conn net.Conn) <-chan Message {
+	t.Helper()
+
+	messages := make(chan Message, 16)
+	go func() {
+		defer close(messages)
+		for {
+			msg, err := ReadMessage(conn)
+			if err != nil {
+				return
+			}
+			messages <- msg
+		}
+	}()
+
+	return messages
+}
+
+// sentSince returns the messages sent to the peer since the last call, by sending a keep alive and
+// taking everything up to it
+func sentSince(t *testing.T, peer *Peer, messages <-chan Message) []Message {
+	t.Helper()
+
+	err := peer.send(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var sent []Message
+	for msg := range messages {
+		if msg == nil {
+			return sent
+		}
+		sent = append(sent, msg)
+	}
+	t.Fatal("connection closed")
+
+	return nil
+}
+
+// newHaveSwarm is a torrent of two pieces with three live peers: one that has both pieces, one
+// with only the first and one with none. We're interested in the first two.
+func newHaveSwarm(t *testing.T) (*Torrent, []byte, []*Peer, []<-chan Message) {
+	t.Helper()
+
+	data := make([]byte, 4*blockSize)
+	torrent := newTestTorrent(t, data, NewMemoryStorage())
+
+	var peers []*Peer
+	var messages []<-chan Message
+	for i, pieces := range [][]int{{0, 1}, {0}, {}} {
+		peer, conn := newPipePeer(t, torrent, net.JoinHostPort("10.0.0.1", strconv.Itoa(6881+i)))
+		for _, index := range pieces {
+			peer.Bitfield.Set(index)
+		}
+		torrent.picker.addBitfield(&peer.Bitfield)
+		torrent.livePeers = append(torrent.livePeers, peer)
+		torrent.updateInterest(peer)
+
+		peers = append(peers, peer)
+		messages = append(messages, receivedMessages(t, conn))
+	}
+
+	return torrent, data, peers, messages
+}
+
+func TestHaveBroadcast(t *testing.T) {
+	torrent, data, peers, messages := newHaveSwarm(t)
+	if !peers[0].amInterested || !peers[1].amInterested || peers[2].amInterested {
+		t.Fatal("interest in the peers doesn't follow the pieces they have")
+	}
+
+	sendBlock(torrent, peers[1], 0, 0, data, false)
+	torrent.processBlock(peers[1], &PieceMessage{Index: 0, Begin: blockSize, Block: data[blockSize : 2*blockSize]})
+	if !torrent.have.Test(0) {
+		t.Fatal("piece wasn't completed")
+	}
+
+	// Every peer hears about the piece, and the one that has nothing else we want is told we aren't interested anymore
+	want := [][]Message{
+		{&HaveMessage{Index: 0}},
+		{&HaveMessage{Index: 0}, &NotInterestedMessage{}},
+		{&HaveMessage{Index: 0}},
+	}
+	for i, peer := range peers {
+		if sent := sentSince(t, peer, messages[i]); !reflect.DeepEqual(sent, want[i]) {
+			t.Errorf("peer %v was sent %v, want %v", i, sent, want[i])
+		}
+	}
+	if !peers[0].amInterested || peers[1].amInterested || peers[2].amInterested {
+		t.Fatal("interest in the peers wasn't recomputed")
+	}
+
+	// A have for a piece we still need makes us interested, one for a piece we have doesn't
+	peers[2].processMessage(&HaveMessage{Index: 0})
+	if sent := sentSince(t, peers[2], messages[2]); len(sent) != 0 || peers[2].amInterested {
+		t.Errorf("have of a piece we have sent %v", sent)
+	}
+	peers[2].processMessage(&HaveMessage{Index: 1})
+	if sent := sentSince(t, peers[2], messages[2]); !reflect.DeepEqual(sent, []Message{&InterestedMessage{}}) || !peers[2].amInterested {
+		t.Errorf("have of a piece we need sent %v, want an interested message", sent)
+	}
+}
+
+func TestSuppressHaves(t *testing.T) {
+	defer func(suppress bool) { Settings.SuppressHaves = suppress }(Settings.SuppressHaves)
+	Settings.SuppressHaves = true
+
+	torrent, data, peers, messages := newHaveSwarm(t)
+	sendBlock(torrent, peers[0], 1, 0, data, false)
+	torrent.processBlock(peers[0], &PieceMessage{Index: 1, Begin: blockSize, Block: data[3*blockSize:]})
+	if !torrent.have.Test(1) {
+		t.Fatal("piece wasn't completed")
+	}
+
+	// Only the peers without the piece are told about it
+	want := [][]Message{nil, {&HaveMessage{Index: 1}}, {&HaveMessage{Index: 1}}}
+	for i, peer := range peers {
+		if sent := sentSince(t, peer, messages[i]); !reflect.DeepEqual(sent, want[i]) {
+			t.Errorf("peer %v was sent %v, want %v", i, sent, want[i])
+		}
+	}
+}
+
+func TestEndgame(t *testing.T) {
+	torrent, peers := newTestSwarm(2,
+		[]int{1, 1},
+		[]int{1, 1},
+		[]int{1, 0},
+	)
+	slow, fast, partial := peers[0], peers[1], peers[2]
+
+	if torrent.inEndgame() {
+		t.Fatal("in endgame before anything was requested")
+	}
+
+	// The slow peer is asked for every block, which leaves nothing for the others outside endgame
+	if requests := torrent.fillPipeline(slow, time.Now(), false); len(requests) != 4 {
+		t.Fatalf("slow peer was asked for %v blocks, want all 4", len(requests))
+	}
+	if !torrent.inEndgame() {
+		t.Fatal("not in endgame with every block requested")
+	}
+	if requests := torrent.fillPipeline(fast, time.Now(), false); len(requests) != 0 {
+		t.Fatalf("fast peer was asked for %v outside endgame", requests)
+	}
+
+	// In endgame the other peers are asked for the same blocks, as far as they have the pieces
+	if requests := torrent.fillPipeline(fast, time.Now(), true); len(requests) != 4 {
+		t.Fatalf("fast peer was asked for %v in endgame, want all 4 blocks", requests)
+	}
+	requests := torrent.fillPipeline(partial, time.Now(), true)
+	if len(requests) != 2 || requests[0].index != 0 || requests[1].index != 0 {
+		t.Fatalf("peer with piece 0 only was asked for %v", requests)
+	}
+	if requests := torrent.fillPipeline(fast, time.Now(), true); len(requests) != 0 {
+		t.Fatalf("fast peer was asked for %v twice", requests)
+	}
+	if block := torrent.Pieces[0].Blocks[0]; block.requests != 3 {
+		t.Fatalf("block has %v requests outstanding, want 3", block.requests)
+	}
+
+	// Once the fast peer delivers, the others are cancelled
+	request := blockRequest{index: 0, begin: 0, length: blockSize}
+	torrent.forgetRequest(fast, request)
+	torrent.Pieces[0].Blocks[0].Data = make([]byte, blockSize)
+
+	cancels := torrent.cancelDuplicates(request)
+	if len(cancels) != 2 {
+		t.Fatalf("got %v cancels, want 2", len(cancels))
+	}
+	for _, cancel := range cancels {
+		if cancel.peer == fast {
+			t.Error("the peer that delivered the block was sent a cancel")
+		}
+		if _, ok := cancel.peer.requests[request]; ok {
+			t.Error("cancelled request is still outstanding")
+		}
+	}
+	if block := torrent.Pieces[0].Blocks[0]; block.requests != 0 {
+		t.Fatalf("delivered block has %v requests outstanding", block.requests)
+	}
+
+	// A delivered block isn't requested again
+	torrent.releaseRequests(partial)
+	for _, request := range torrent.fillPipeline(partial, time.Now(), true) {
+		if request.index == 0 && request.begin == 0 {
+			t.Fatal("delivered block was requested again")
+		}
+	}
+}
+
+func TestExpireRequests(t *testing.T) {
+	defer func(timeout time.Duration) { Settings.RequestTimeout = timeout }(Settings.RequestTimeout)
+	Settings.RequestTimeout = time.Minute
+
+	torrent, peers := newTestSwarm(2, []int{1, 1}, []int{1, 1})
+	slow, other := peers[0], peers[1]
+
+	now := time.Now()
+	if requests := torrent.fillPipeline(slow, now.Add(-2*time.Minute), false); len(requests) != 4 {
+		t.Fatalf("slow peer was asked for %v blocks, want all 4", len(requests))
+	}
+	// A request sent since is given its time
+	fresh := blockRequest{index: 1, begin: blockSize, length: blockSize}
+	slow.requests[fresh] = now
+
+	cancels := torrent.expireRequests(slow, now)
+	if len(cancels) != 3 {
+		t.Fatalf("got %v cancels, want one for each of the 3 requests that timed out", len(cancels))
+	}
+	for _, cancel := range cancels {
+		msg, ok := cancel.msg.(*CancelMessage)
+		if cancel.peer != slow || !ok || msg.Length != blockSize {
+			t.Fatalf("got %+v, want cancels to the slow peer", cancel)
+		}
+		request := blockRequest{index: msg.Index, begin: msg.Begin, length: msg.Length}
+		if _, ok := slow.requests[request]; ok || request == fresh {
+			t.Errorf("request %+v was cancelled but is still outstanding, or hadn't timed out", request)
+		}
+	}
+	if len(slow.requests) != 1 {
+		t.Fatalf("slow peer has %v requests outstanding, want the one that hasn't timed out", len(slow.requests))
+	}
+
+	// The blocks are requested from another peer
+	requests := torrent.fillPipeline(other, now, false)
+	if len(requests) != 3 {
+		t.Fatalf("other peer was asked for %v, want the 3 blocks that timed out", requests)
+	}
+	for _, request := range requests {
+		if request == fresh {
+			t.Fatal("block still requested from the slow peer was requested again outside endgame")
+		}
+	}
+}
+
+func TestUpdateSendsCancels(t *testing.T) {
+	defer func(timeout time.Duration) { Settings.RequestTimeout = timeout }(Settings.RequestTimeout)
+	Settings.RequestTimeout = time.Minute
+
+	data := make([]byte, 4*blockSize)
+	torrent := newTestTorrent(t, data, NewMemoryStorage())
+	peer, conn := newPipePeer(t, torrent, "10.0.0.1:6881")
+	messages := receivedMessages(t, conn)
+	torrent.livePeers = append(torrent.livePeers, peer)
+
+	// The peer has nothing anymore, so nothing new is requested from it
+	request := blockRequest{index: 0, begin: 0, length: blockSize}
+	peer.requests[request] = time.Now().Add(-2 * time.Minute)
+	torrent.Pieces[0].Blocks[0].requests = 1
+
+	torrent.Update()
+	want := []Message{&CancelMessage{Index: 0, Begin: 0, Length: blockSize}}
+	if sent := sentSince(t, peer, messages); !reflect.DeepEqual(sent, want) {
+		t.Fatalf("peer was sent %v, want %v", sent, want)
+	}
+	if len(peer.requests) != 0 || torrent.Pieces[0].Blocks[0].requests != 0 {
+		t.Fatal("timed out request is still outstanding")
+	}
+}
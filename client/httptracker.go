@@ -0,0 +1,246 @@
+package client
+
+// Will handle announcing to trackers over HTTP(S)
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/zeebo/bencode"
+)
+
+const (
+	httpTrackerTimeout  = 30 * time.Second
+	maxTrackerResponse  = 1 << 20 // bytes of a tracker response we are willing to read
+	compactPeerLength   = 6       // 4 bytes of IPv4 address and 2 bytes of port
+	compactPeer6Length  = 18      // 16 bytes of IPv6 address and 2 bytes of port (BEP 7)
+	gzipMagic           = "\x1f\x8b"
+	unreservedURLSymbol = "-._~"
+)
+
+// httpTrackerClient is used for every HTTP announce, so a tracker that doesn't answer can't hold up the announcer
+var httpTrackerClient = &http.Client{Timeout: httpTrackerTimeout}
+
+// A dictPeer is a peer in the original, non-compact, peer list of a tracker response
+type dictPeer struct {
+	PeerID string `bencode:"peer id"`
+	IP     string `bencode:"ip"` // IPv4 or IPv6 address, or a DNS name
+	Port   int    `bencode:"port"`
+}
+
+// announceHTTP sends the request to the tracker at announceURL with an HTTP GET. Query parameters
+// the announce URL already has, like a passkey, are kept. The request is abandoned once request.cancel is closed.
+func (request *TrackerRequest) announceHTTP(announceURL string) (*announceResult, error) {
+	objURL, err := url.Parse(announceURL)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse provided url: %s", err.Error())
+	}
+
+	query := request.announceQuery()
+	if objURL.RawQuery != "" {
+		query = objURL.RawQuery + "&" + query
+	}
+	objURL.RawQuery = query
+
+	ctx, abandon := context.WithCancel(context.Background())
+	defer abandon()
+	// The channel is taken now, as the goroutine may outlive the announce and the request be reused
+	if cancel := request.cancel; cancel != nil {
+		go func() {
+			select {
+			case <-cancel:
+				abandon()
+			case <-ctx.Done():
+			}
+		}()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, objURL.String(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create announce: %s", err.Error())
+	}
+	// Asking for gzip ourselves means the body isn't decompressed for us, which lets us
+	// also handle trackers that compress without saying so
+	req.Header.Set("Accept-Encoding", "gzip")
+
+	response, err := httpTrackerClient.Do(req)
+	if err != nil && ctx.Err() != nil {
+		return nil, errAnnounceCancelled
+	}
+	if err != nil {
+		return nil, fmt.Errorf("announce to tracker failed: %s", err.Error())
+	}
+	defer response.Body.Close()
+
+	body, err := readTrackerBody(response)
+	if err != nil && ctx.Err() != nil {
+		return nil, errAnnounceCancelled
+	}
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read response body: %s", err.Error())
+	}
+
+	var trackerResponse TrackerResponse
+	err = bencode.DecodeBytes(body, &trackerResponse)
+	if err != nil {
+		if response.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("tracker answered with %s", response.Status)
+		}
+		return nil, fmt.Errorf("unable to decode tracker response: %s", err.Error())
+	}
+
+	if trackerResponse.FailureReason != "" {
+		return nil, fmt.Errorf("tracker refused the announce: %s", trackerResponse.FailureReason)
+	}
+
+	if trackerResponse.WarningMessage != "" {
+		fmt.Printf("Tracker %s warns: %s \n", objURL.Host, trackerResponse.WarningMessage)
+	}
+
+	peers, peerIDs, err := parseHTTPPeers(trackerResponse.Peers)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(trackerResponse.Peers6)%compactPeer6Length != 0 {
+		return nil, errors.New("compact IPv6 peers aren't a multiple of 18 bytes")
+	}
+	peers = append(peers, parseCompactPeers([]byte(trackerResponse.Peers6), net.IPv6len)...)
+
+	fmt.Printf("There are %v seeders right now. \n", trackerResponse.Complete)
+	fmt.Printf("There are %v leechers right now. \n", trackerResponse.Incomplete)
+
+	return &announceResult{
+		interval:    time.Duration(trackerResponse.Interval) * time.Second,
+		minInterval: time.Duration(trackerResponse.MinInterval) * time.Second,
+		trackerID:   trackerResponse.TrackerID,
+		peers:       peers,
+		peerIDs:     peerIDs,
+	}, nil
+}
+
+// announceQuery encodes the request as the query string of an HTTP announce
+func (request *TrackerRequest) announceQuery() string {
+	params := url.Values{}
+
+	params.Add("port", strconv.Itoa(request.Port))
+	params.Add("uploaded", strconv.Itoa(request.Uploaded))
+	params.Add("downloaded", strconv.Itoa(request.Downloaded))
+	params.Add("left", strconv.Itoa(request.Left))
+	params.Add("compact", strconv.Itoa(request.Compact))
+	if request.Event != "" {
+		params.Add("event", request.Event)
+	}
+	if request.TrackerID != "" {
+		params.Add("trackerid", request.TrackerID)
+	}
+	if request.IPv6 != nil {
+		params.Add("ipv6", request.IPv6.String())
+	}
+
+	// The hashes are binary, which url.Values would escape as form data, turning spaces into '+'
+	return "info_hash=" + escapeBytes(request.InfoHash) + "&peer_id=" + escapeBytes(request.PeerID) + "&" + params.Encode()
+}
+
+// escapeBytes percent-encodes every byte that isn't an unreserved character of RFC 3986
+func escapeBytes(data []byte) string {
+	var escaped strings.Builder
+	for _, b := range data {
+		if 'a' <= b && b <= 'z' || 'A' <= b && b <= 'Z' || '0' <= b && b <= '9' || strings.IndexByte(unreservedURLSymbol, b) >= 0 {
+			escaped.WriteByte(b)
+			continue
+		}
+		fmt.Fprintf(&escaped, "%%%02X", b)
+	}
+
+	return escaped.String()
+}
+
+// readTrackerBody reads the body of a tracker response, decompressing it if it is gzipped
+func readTrackerBody(response *http.Response) ([]byte, error) {
+	body, err := ioutil.ReadAll(io.LimitReader(response.Body, maxTrackerResponse))
+	if err != nil {
+		return nil, err
+	}
+
+	if response.Header.Get("Content-Encoding") != "gzip" && !bytes.HasPrefix(body, []byte(gzipMagic)) {
+		return body, nil
+	}
+
+	reader, err := gzip.NewReader(bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	return ioutil.ReadAll(io.LimitReader(reader, maxTrackerResponse))
+}
+
+// parseHTTPPeers reads the peers of a tracker response, which are either a compact string or a list of dictionaries.
+// The peer ids of a list are returned by address, so the handshake can check peers are who the tracker said.
+func parseHTTPPeers(raw bencode.RawMessage) ([]string, map[string]string, error) {
+	if len(raw) == 0 {
+		return nil, nil, nil
+	}
+
+	if raw[0] == 'l' {
+		var list []dictPeer
+		err := bencode.DecodeBytes(raw, &list)
+		if err != nil {
+			return nil, nil, fmt.Errorf("unable to decode peer list: %s", err.Error())
+		}
+
+		var peers []string
+		peerIDs := map[string]string{}
+		for _, peer := range list {
+			if peer.IP == "" || peer.Port <= 0 || peer.Port > 65535 {
+				continue
+			}
+			address := net.JoinHostPort(peer.IP, strconv.Itoa(peer.Port))
+			peers = append(peers, address)
+
+			// Trackers asked for no_peer_id leave the id out
+			if len(peer.PeerID) == 20 {
+				peerIDs[address] = peer.PeerID
+			}
+		}
+		return peers, peerIDs, nil
+	}
+
+	var compact string
+	err := bencode.DecodeBytes(raw, &compact)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to decode compact peers: %s", err.Error())
+	}
+
+	if len(compact)%compactPeerLength != 0 {
+		return nil, nil, errors.New("compact peers aren't a multiple of 6 bytes")
+	}
+
+	return parseCompactPeers([]byte(compact), net.IPv4len), nil, nil
+}
+
+// parseCompactPeers reads peers in the compact format: an IP address of ipLength bytes, 4 for IPv4 or 16
+// for IPv6, followed by 2 bytes of port for every peer
+func parseCompactPeers(data []byte, ipLength int) []string {
+	var peers []string
+	for i := 0; i+ipLength+2 <= len(data); i += ipLength + 2 {
+		ip := net.IP(data[i : i+ipLength])
+		port := binary.BigEndian.Uint16(data[i+ipLength : i+ipLength+2])
+		peers = append(peers, net.JoinHostPort(ip.String(), strconv.Itoa(int(port))))
+	}
+
+	return peers
+}
@@ -0,0 +1,310 @@
+package client
+
+import (
+	"bytes"
+	"compress/gzip"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"goTorrent/tracker"
+
+	"github.com/zeebo/bencode"
+)
+
+// newTestTracker starts an HTTP tracker that answers every announce with the bencoded response,
+// handing each request to check first
+func newTestTracker(t *testing.T, response map[string]interface{}, check func(r *http.Request)) *httptest.Server {
+	t.Helper()
+
+	stream, err := bencode.EncodeBytes(response)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if check != nil {
+			check(r)
+		}
+		w.Write(stream)
+	}))
+	t.Cleanup(server.Close)
+
+	return server
+}
+
+func testRequest() *TrackerRequest {
+	return &TrackerRequest{
+		InfoHash: []byte("ab +/\x00\xff&=?#%cdefghijklm")[:20],
+		PeerID:   MyPeerID,
+		Port:     6881,
+		Left:     100,
+		Compact:  1,
+	}
+}
+
+func TestAnnounceHTTP(t *testing.T) {
+	request := testRequest()
+	server := newTestTracker(t, map[string]interface{}{
+		"interval":     1800,
+		"min interval": 900,
+		"peers":        "\x01\x02\x03\x04\x1a\xe1",
+		"peers6":       "\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x01\x00\x50",
+	}, func(r *http.Request) {
+		query := r.URL.Query()
+		if query.Get("passkey") != "secret" {
+			t.Errorf("passkey of the announce URL was dropped: %q", r.URL.RawQuery)
+		}
+		if query.Get("info_hash") != string(request.InfoHash) {
+			t.Errorf("info_hash arrived as %q", query.Get("info_hash"))
+		}
+		if query.Get("port") != "6881" || query.Get("left") != "100" || query.Get("compact") != "1" {
+			t.Errorf("unexpected query %q", r.URL.RawQuery)
+		}
+	})
+
+	result, err := request.announceHTTP(server.URL + "/announce?passkey=secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if result.interval != 1800*time.Second || result.minInterval != 900*time.Second {
+		t.Errorf("intervals are %v and %v", result.interval, result.minInterval)
+	}
+	if want := []string{"1.2.3.4:6881", "[::1]:80"}; !reflect.DeepEqual(result.peers, want) {
+		t.Errorf("peers are %v, want %v", result.peers, want)
+	}
+}
+
+func TestAnnounceHTTPToTracker(t *testing.T) {
+	server := httptest.NewServer(tracker.New(tracker.Config{Interval: 10 * time.Minute, MinInterval: time.Minute}))
+	defer server.Close()
+
+	first := testRequest()
+	first.PeerID = []byte("-XX0001-000000000001")
+	first.Event = "started"
+	_, err := first.announceHTTP(server.URL + "/announce")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, compact := range []int{1, 0} {
+		second := testRequest()
+		second.Port = 6882
+		second.Compact = compact
+		result, err := second.announceHTTP(server.URL + "/announce")
+		if err != nil {
+			t.Fatalf("compact %v: %s", compact, err)
+		}
+
+		if result.interval != 10*time.Minute || result.minInterval != time.Minute {
+			t.Errorf("compact %v: intervals are %v and %v", compact, result.interval, result.minInterval)
+		}
+		if want := []string{"127.0.0.1:6881"}; !reflect.DeepEqual(result.peers, want) {
+			t.Errorf("compact %v: peers are %v, want %v", compact, result.peers, want)
+		}
+	}
+
+	first.Event = "stopped"
+	_, err = first.announceHTTP(server.URL + "/announce")
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := testRequest().announceHTTP(server.URL + "/announce")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.peers) != 0 {
+		t.Errorf("peers are %v after the other peer stopped", result.peers)
+	}
+
+	// The tracker's refusal comes back as the error
+	private := httptest.NewServer(tracker.New(tracker.Config{Whitelist: [][20]byte{{1}}}))
+	defer private.Close()
+	_, err = testRequest().announceHTTP(private.URL + "/announce")
+	if err == nil || !strings.Contains(err.Error(), "not registered") {
+		t.Fatalf("got error %v, want the tracker's failure reason", err)
+	}
+}
+
+func TestAnnounceHTTPDictPeers(t *testing.T) {
+	server := newTestTracker(t, map[string]interface{}{
+		"interval": 1800,
+		"peers": []map[string]interface{}{
+			{"peer id": "-XX0001-000000000000", "ip": "5.6.7.8", "port": 51413},
+			{"peer id": "-XX0001-000000000001", "ip": "2001:db8::1", "port": 6881},
+			{"peer id": "-XX0001-000000000002", "ip": "9.9.9.9", "port": 0},
+			{"ip": "5.6.7.9", "port": 6881},
+		},
+	}, nil)
+
+	result, err := testRequest().announceHTTP(server.URL + "/announce")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := []string{"5.6.7.8:51413", "[2001:db8::1]:6881", "5.6.7.9:6881"}; !reflect.DeepEqual(result.peers, want) {
+		t.Errorf("peers are %v, want %v", result.peers, want)
+	}
+
+	// Peers listed without an id are left out, so their handshake isn't checked against one
+	wantIDs := map[string]string{
+		"5.6.7.8:51413":      "-XX0001-000000000000",
+		"[2001:db8::1]:6881": "-XX0001-000000000001",
+	}
+	if !reflect.DeepEqual(result.peerIDs, wantIDs) {
+		t.Errorf("peer ids are %v, want %v", result.peerIDs, wantIDs)
+	}
+}
+
+func TestAnnounceHTTPGzip(t *testing.T) {
+	stream, _ := bencode.EncodeBytes(map[string]interface{}{"interval": 60, "peers": "\x01\x02\x03\x04\x1a\xe1"})
+	var compressed bytes.Buffer
+	writer := gzip.NewWriter(&compressed)
+	writer.Write(stream)
+	writer.Close()
+
+	for _, header := range []bool{true, false} {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if header {
+				w.Header().Set("Content-Encoding", "gzip")
+			}
+			w.Write(compressed.Bytes())
+		}))
+
+		result, err := testRequest().announceHTTP(server.URL + "/announce")
+		server.Close()
+		if err != nil {
+			t.Fatalf("gzip with header %v: %s", header, err)
+		}
+		if len(result.peers) != 1 {
+			t.Errorf("gzip with header %v: peers are %v", header, result.peers)
+		}
+	}
+}
+
+func TestAnnounceHTTPTrackerID(t *testing.T) {
+	var got []string
+	server := newTestTracker(t, map[string]interface{}{
+		"interval":   1800,
+		"tracker id": "tid-42",
+		"peers":      "",
+	}, func(r *http.Request) {
+		got = append(got, r.URL.Query().Get("trackerid"))
+	})
+
+	request := testRequest()
+	tracker := server.URL + "/announce"
+	for i := 0; i < 2; i++ {
+		_, err := request.announceTo(tracker)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if want := []string{"", "tid-42"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("tracker ids sent are %q, want %q", got, want)
+	}
+}
+
+func TestAnnounceHTTPFailureReason(t *testing.T) {
+	server := newTestTracker(t, map[string]interface{}{"failure reason": "torrent not registered"}, nil)
+
+	_, err := testRequest().announceHTTP(server.URL + "/announce")
+	if err == nil || !strings.Contains(err.Error(), "torrent not registered") {
+		t.Fatalf("got error %v, want the failure reason", err)
+	}
+}
+
+func TestAnnounceHTTPErrorStatus(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "overloaded", http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	_, err := testRequest().announceHTTP(server.URL + "/announce")
+	if err == nil || !strings.Contains(err.Error(), "503") {
+		t.Fatalf("got error %v, want the status", err)
+	}
+}
+
+func TestAnnounceHTTPCancel(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer server.Close()
+	defer close(release)
+
+	request := testRequest()
+	cancel := make(chan struct{})
+	request.cancel = cancel
+	time.AfterFunc(100*time.Millisecond, func() { close(cancel) })
+
+	start := time.Now()
+	_, err := request.announceHTTP(server.URL + "/announce")
+	if err != errAnnounceCancelled {
+		t.Fatalf("got error %v, want %v", err, errAnnounceCancelled)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("cancelled announce took %v", elapsed)
+	}
+}
+
+func TestAnnounceHTTPIPv6(t *testing.T) {
+	server := httptest.NewServer(tracker.New(tracker.Config{}))
+	defer server.Close()
+	announceURL := server.URL + "/announce"
+
+	// A peer telling the tracker its IPv6 address besides the IPv4 one it connects from
+	dualStack := testRequest()
+	dualStack.PeerID = []byte("-XX0001-000000000001")
+	dualStack.IPv6 = net.ParseIP("2001:db8::1")
+	_, err := dualStack.announceHTTP(announceURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Is handed out at both, the IPv6 address in peers6
+	result, err := testUDPRequest().announceHTTP(announceURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"127.0.0.1:6881", "[2001:db8::1]:6881"}
+	if !reflect.DeepEqual(result.peers, want) {
+		t.Fatalf("peers are %v, want %v", result.peers, want)
+	}
+}
+
+func TestAnnounceHTTPBadPeers6(t *testing.T) {
+	server := newTestTracker(t, map[string]interface{}{
+		"interval": 1800,
+		"peers6":   "\x20\x01\x0d\xb8\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x01\x1a",
+	}, nil)
+
+	_, err := testRequest().announceHTTP(server.URL + "/announce")
+	if err == nil || !strings.Contains(err.Error(), "18 bytes") {
+		t.Fatalf("got error %v for peers6 of 17 bytes", err)
+	}
+}
+
+func TestParseCompactPeers(t *testing.T) {
+	v4 := parseCompactPeers([]byte("\x01\x02\x03\x04\x1a\xe1\x05\x06\x07\x08\x00\x50\x09"), net.IPv4len)
+	if want := []string{"1.2.3.4:6881", "5.6.7.8:80"}; !reflect.DeepEqual(v4, want) {
+		t.Errorf("IPv4 peers are %v, want %v", v4, want)
+	}
+
+	v6 := parseCompactPeers([]byte(
+		"\x20\x01\x0d\xb8\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x01\x1a\xe1"+
+			"\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\xff\xff\x01\x02\x03\x04\x00\x50"), net.IPv6len)
+	if want := []string{"[2001:db8::1]:6881", "1.2.3.4:80"}; !reflect.DeepEqual(v6, want) {
+		t.Errorf("IPv6 peers are %v, want %v", v6, want)
+	}
+}
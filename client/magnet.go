@@ -0,0 +1,164 @@
+package client
+
+// Will handle magnet links, i.e. torrents that start out with nothing but an info-hash
+
+import (
+	"encoding/base32"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// A Magnet holds the parameters of a magnet:?xt=urn:btih:... link
+type Magnet struct {
+	InfoHash    []byte   // xt: 20-byte SHA1 info-hash of the torrent
+	InfoHashV2  []byte   // xt: 32-byte SHA256 info-hash of v2 and hybrid torrents (urn:btmh)
+	DisplayName string   // dn: name to show until the info dictionary is known
+	Trackers    []string // tr: tracker URLs
+	WebSeeds    []string // ws: web seed URLs
+	Peers       []string // x.pe: peer addresses in host:port form
+}
+
+// ParseMagnet parses a magnet URI. The info-hash may be given in hex (40 characters) or base32 (32 characters).
+func ParseMagnet(uri string) (*Magnet, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse magnet link: %s", err.Error())
+	}
+
+	if u.Scheme != "magnet" {
+		return nil, fmt.Errorf("not a magnet link: %q", uri)
+	}
+
+	magnet := Magnet{}
+
+	for key, values := range u.Query() {
+		/* Parameters that can appear more than once may be numbered
+		   (tr.1, tr.2, ...), so only look at what comes before the dot. */
+		if i := strings.Index(key, "."); i > 0 && key != "x.pe" {
+			key = key[:i]
+		}
+
+		for _, value := range values {
+			switch key {
+			case "xt":
+				if strings.HasPrefix(value, "urn:btmh:") {
+					hash, err := decodeMultihash(strings.TrimPrefix(value, "urn:btmh:"))
+					if err != nil {
+						return nil, err
+					}
+					magnet.InfoHashV2 = hash
+					continue
+				}
+				if !strings.HasPrefix(value, "urn:btih:") {
+					continue
+				}
+				hash, err := decodeInfoHash(strings.TrimPrefix(value, "urn:btih:"))
+				if err != nil {
+					return nil, err
+				}
+				magnet.InfoHash = hash
+			case "dn":
+				magnet.DisplayName = value
+			case "tr":
+				magnet.Trackers = append(magnet.Trackers, value)
+			case "ws":
+				magnet.WebSeeds = append(magnet.WebSeeds, value)
+			case "x.pe":
+				magnet.Peers = append(magnet.Peers, value)
+			}
+		}
+	}
+
+	if magnet.InfoHash == nil && magnet.InfoHashV2 == nil {
+		return nil, errors.New("magnet link has no urn:btih or urn:btmh info-hash")
+	}
+
+	return &magnet, nil
+}
+
+func decodeInfoHash(encoded string) ([]byte, error) {
+	switch len(encoded) {
+	case 40:
+		hash, err := hex.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("invalid hex info-hash: %s", err.Error())
+		}
+		return hash, nil
+	case 32:
+		hash, err := base32.StdEncoding.DecodeString(strings.ToUpper(encoded))
+		if err != nil {
+			return nil, fmt.Errorf("invalid base32 info-hash: %s", err.Error())
+		}
+		return hash, nil
+	}
+
+	return nil, fmt.Errorf("info-hash %q has an invalid length", encoded)
+}
+
+// decodeMultihash decodes the hex multihash of a v2 info-hash: 0x12 (SHA256), 0x20 (32 bytes), then the hash
+func decodeMultihash(encoded string) ([]byte, error) {
+	multihash, err := hex.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("invalid hex multihash: %s", err.Error())
+	}
+
+	if len(multihash) != 34 || multihash[0] != 0x12 || multihash[1] != 0x20 {
+		return nil, fmt.Errorf("multihash %q is not a SHA256 hash", encoded)
+	}
+
+	return multihash[2:], nil
+}
+
+// AddMagnet creates a torrent from a magnet link. The info-hash is announced to the link's trackers and
+// looked up in the DHT, and the info dictionary is downloaded from the returned peers before the torrent is handed back.
+func AddMagnet(uri string) (*Torrent, error) {
+	magnet, err := ParseMagnet(uri)
+	if err != nil {
+		return nil, err
+	}
+
+	info := MetaInfo{
+		URLList: magnet.WebSeeds,
+		Info:    InfoDictionary{Name: magnet.DisplayName},
+	}
+
+	if len(magnet.Trackers) > 0 {
+		info.Announce = magnet.Trackers[0]
+	}
+
+	// Each tracker of a magnet link is its own tier
+	if len(magnet.Trackers) > 1 {
+		for _, tracker := range magnet.Trackers {
+			info.AnnounceList = append(info.AnnounceList, []string{tracker})
+		}
+	}
+
+	t := Torrent{Path: uri, Data: info, Hash: magnet.InfoHash, HashV2: magnet.InfoHashV2}
+	if t.Hash == nil {
+		// v2-only torrents use the truncated v2 info-hash for trackers and handshakes
+		t.Hash = t.HashV2[:20]
+	}
+
+	t.loadTrackers()
+	t.AddPeers(magnet.Peers)
+
+	if len(t.trackers) > 0 {
+		tRequest := t.Data.CreateTrackerRequest(t.Hash)
+		t.Announce(tRequest)
+	}
+	t.lookupDHT()
+
+	if len(t.Peers) == 0 {
+		return nil, errors.New("no peers found to download the torrent metadata from")
+	}
+
+	err = t.FetchMetadata()
+	if err != nil {
+		return nil, err
+	}
+
+	return &t, nil
+}
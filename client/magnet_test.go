@@ -0,0 +1,118 @@
+package client
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/hex"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestParseMagnet(t *testing.T) {
+	hash := sha1.Sum([]byte("info"))
+	hashV2 := sha256.Sum256([]byte("info"))
+	hexHash := hex.EncodeToString(hash[:])
+	base32Hash := base32.StdEncoding.EncodeToString(hash[:])
+	multihash := "1220" + hex.EncodeToString(hashV2[:])
+
+	cases := map[string]struct {
+		uri    string
+		magnet Magnet
+	}{
+		"hex": {
+			"magnet:?xt=urn:btih:" + hexHash,
+			Magnet{InfoHash: hash[:]},
+		},
+		"upper case hex": {
+			"magnet:?xt=urn:btih:" + strings.ToUpper(hexHash),
+			Magnet{InfoHash: hash[:]},
+		},
+		"base32": {
+			"magnet:?xt=urn:btih:" + base32Hash,
+			Magnet{InfoHash: hash[:]},
+		},
+		"lower case base32": {
+			"magnet:?xt=urn:btih:" + strings.ToLower(base32Hash),
+			Magnet{InfoHash: hash[:]},
+		},
+		"v2": {
+			"magnet:?xt=urn:btmh:" + multihash,
+			Magnet{InfoHashV2: hashV2[:]},
+		},
+		"hybrid": {
+			"magnet:?xt=urn:btih:" + hexHash + "&xt=urn:btmh:" + multihash,
+			Magnet{InfoHash: hash[:], InfoHashV2: hashV2[:]},
+		},
+		"everything": {
+			"magnet:?xt=urn:btih:" + hexHash +
+				"&dn=Some+File%20name.iso" +
+				"&tr=udp%3A%2F%2Ftracker.example%3A6969%2Fannounce" +
+				"&tr.1=http://other.example/announce?passkey=a" +
+				"&ws=http%3A%2F%2Fseed.example%2Ffile" +
+				"&x.pe=10.0.0.1:6881&x.pe=[2001:db8::1]:6881" +
+				"&xt=urn:sha1:ignored" +
+				"&xl=1234",
+			Magnet{
+				InfoHash:    hash[:],
+				DisplayName: "Some File name.iso",
+				Trackers:    []string{"http://other.example/announce?passkey=a", "udp://tracker.example:6969/announce"},
+				WebSeeds:    []string{"http://seed.example/file"},
+				Peers:       []string{"10.0.0.1:6881", "[2001:db8::1]:6881"},
+			},
+		},
+	}
+
+	for name, c := range cases {
+		magnet, err := ParseMagnet(c.uri)
+		if err != nil {
+			t.Errorf("%s: %s", name, err)
+			continue
+		}
+
+		// Numbered parameters come out in no particular order
+		sort.Strings(magnet.Trackers)
+		sort.Strings(magnet.Peers)
+		if !reflect.DeepEqual(*magnet, c.magnet) {
+			t.Errorf("%s: parsed %+v, want %+v", name, *magnet, c.magnet)
+		}
+	}
+}
+
+func TestParseMagnetErrors(t *testing.T) {
+	hash := sha1.Sum([]byte("info"))
+	hashV2 := sha256.Sum256([]byte("info"))
+	hexHash := hex.EncodeToString(hash[:])
+
+	cases := map[string]string{
+		"not a magnet":        "http://example.com/?xt=urn:btih:" + hexHash,
+		"no info-hash":        "magnet:?dn=name&tr=http://tracker.example/announce",
+		"other urn only":      "magnet:?xt=urn:sha1:" + hexHash,
+		"short hex":           "magnet:?xt=urn:btih:" + hexHash[:38],
+		"bad hex":             "magnet:?xt=urn:btih:" + "zz" + hexHash[2:],
+		"bad base32":          "magnet:?xt=urn:btih:" + "1" + base32.StdEncoding.EncodeToString(hash[:])[1:],
+		"multihash of sha1":   "magnet:?xt=urn:btmh:1114" + hexHash,
+		"short multihash":     "magnet:?xt=urn:btmh:1220" + hex.EncodeToString(hashV2[:31]),
+		"bad multihash hex":   "magnet:?xt=urn:btmh:12zz" + hex.EncodeToString(hashV2[:]),
+		"bad hex with a good": "magnet:?xt=urn:btmh:1220" + hex.EncodeToString(hashV2[:]) + "&xt=urn:btih:xyz",
+	}
+
+	for name, uri := range cases {
+		magnet, err := ParseMagnet(uri)
+		if err == nil {
+			t.Errorf("%s: parsed %+v", name, magnet)
+		}
+	}
+
+	// The hashes aren't mixed up between the two kinds of urn
+	magnet, err := ParseMagnet("magnet:?xt=urn:btmh:1220" + hex.EncodeToString(hashV2[:]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if magnet.InfoHash != nil || !bytes.Equal(magnet.InfoHashV2, hashV2[:]) {
+		t.Fatalf("v2 magnet has info-hashes %x and %x", magnet.InfoHash, magnet.InfoHashV2)
+	}
+}
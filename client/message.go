@@ -0,0 +1,373 @@
+package client
+
+// Will handle reading and writing the length prefixed messages of the peer wire protocol
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// Message ids of the peer wire protocol
+const (
+	chokeID         = 0
+	unchokeID       = 1
+	interestedID    = 2
+	notInterestedID = 3
+	haveID          = 4
+	bitfieldID      = 5
+	requestID       = 6
+	pieceID         = 7
+	cancelID        = 8
+	portID          = 9
+)
+
+// maxMessageLength is the largest message we accept from a peer, id included. Anything larger is treated as a broken stream.
+const maxMessageLength = 1 << 17
+
+/*
+	All messages after the handshake take the form <length prefix><message ID><payload>.
+	The length prefix is a four byte big-endian value covering the id and the payload.
+	A keep alive is a message with a length prefix of zero and no id or payload.
+*/
+
+// A Message is one message of the peer wire protocol. A nil Message is a keep alive.
+type Message interface {
+	ID() byte
+	payload() []byte
+	parse(payload []byte) error
+}
+
+// ChokeMessage tells the peer it won't get any of its requests answered
+type ChokeMessage struct{}
+
+// UnchokeMessage tells the peer its requests will be answered
+type UnchokeMessage struct{}
+
+// InterestedMessage tells the peer we want pieces it has
+type InterestedMessage struct{}
+
+// NotInterestedMessage tells the peer it has nothing we want
+type NotInterestedMessage struct{}
+
+// HaveMessage announces a piece that was downloaded and verified
+type HaveMessage struct {
+	Index int
+}
+
+// BitfieldMessage holds the pieces a peer has, the high bit of the first byte being piece 0
+type BitfieldMessage struct {
+	Bitfield []byte
+}
+
+// RequestMessage asks for a block of a piece
+type RequestMessage struct {
+	Index  int
+	Begin  int
+	Length int
+}
+
+// PieceMessage carries a block of a piece
+type PieceMessage struct {
+	Index int
+	Begin int
+	Block []byte
+}
+
+// CancelMessage withdraws an earlier request
+type CancelMessage struct {
+	Index  int
+	Begin  int
+	Length int
+}
+
+// PortMessage holds the port of the peer's DHT node
+type PortMessage struct {
+	Port uint16
+}
+
+// ExtendedMessage is a message of the extension protocol (BEP 10)
+type ExtendedMessage struct {
+	ExtendedID byte // 0 for the extended handshake, otherwise the id the receiver assigned to the extension
+	Payload    []byte
+}
+
+// UnknownMessage is any message with an id we don't model. The payload is kept as is.
+type UnknownMessage struct {
+	MessageID byte
+	Payload   []byte
+}
+
+func (*ChokeMessage) ID() byte         { return chokeID }
+func (*UnchokeMessage) ID() byte       { return unchokeID }
+func (*InterestedMessage) ID() byte    { return interestedID }
+func (*NotInterestedMessage) ID() byte { return notInterestedID }
+func (*HaveMessage) ID() byte          { return haveID }
+func (*BitfieldMessage) ID() byte      { return bitfieldID }
+func (*RequestMessage) ID() byte       { return requestID }
+func (*PieceMessage) ID() byte         { return pieceID }
+func (*CancelMessage) ID() byte        { return cancelID }
+func (*PortMessage) ID() byte          { return portID }
+func (*ExtendedMessage) ID() byte      { return extendedMessageID }
+func (msg *UnknownMessage) ID() byte   { return msg.MessageID }
+
+func (*ChokeMessage) payload() []byte         { return nil }
+func (*UnchokeMessage) payload() []byte       { return nil }
+func (*InterestedMessage) payload() []byte    { return nil }
+func (*NotInterestedMessage) payload() []byte { return nil }
+
+func (msg *HaveMessage) payload() []byte {
+	payload := make([]byte, 4)
+	binary.BigEndian.PutUint32(payload, uint32(msg.Index))
+
+	return payload
+}
+
+func (msg *BitfieldMessage) payload() []byte {
+	return msg.Bitfield
+}
+
+func (msg *RequestMessage) payload() []byte {
+	return blockPayload(msg.Index, msg.Begin, msg.Length)
+}
+
+func (msg *PieceMessage) payload() []byte {
+	payload := make([]byte, 8+len(msg.Block))
+	binary.BigEndian.PutUint32(payload[0:4], uint32(msg.Index))
+	binary.BigEndian.PutUint32(payload[4:8], uint32(msg.Begin))
+	copy(payload[8:], msg.Block)
+
+	return payload
+}
+
+func (msg *CancelMessage) payload() []byte {
+	return blockPayload(msg.Index, msg.Begin, msg.Length)
+}
+
+func (msg *PortMessage) payload() []byte {
+	payload := make([]byte, 2)
+	binary.BigEndian.PutUint16(payload, msg.Port)
+
+	return payload
+}
+
+func (msg *ExtendedMessage) payload() []byte {
+	return append([]byte{msg.ExtendedID}, msg.Payload...)
+}
+
+func (msg *UnknownMessage) payload() []byte {
+	return msg.Payload
+}
+
+func (*ChokeMessage) parse(payload []byte) error {
+	return expectLength("choke", payload, 0)
+}
+
+func (*UnchokeMessage) parse(payload []byte) error {
+	return expectLength("unchoke", payload, 0)
+}
+
+func (*InterestedMessage) parse(payload []byte) error {
+	return expectLength("interested", payload, 0)
+}
+
+func (*NotInterestedMessage) parse(payload []byte) error {
+	return expectLength("not interested", payload, 0)
+}
+
+func (msg *HaveMessage) parse(payload []byte) error {
+	// have: <len=0005><id=4><piece index>
+	err := expectLength("have", payload, 4)
+	if err != nil {
+		return err
+	}
+
+	msg.Index = int(binary.BigEndian.Uint32(payload))
+	return nil
+}
+
+func (msg *BitfieldMessage) parse(payload []byte) error {
+	// bitfield: <len=0001+X><id=5><bitfield>
+	msg.Bitfield = payload
+	return nil
+}
+
+func (msg *RequestMessage) parse(payload []byte) error {
+	// request: <len=0013><id=6><index><begin><length>
+	err := expectLength("request", payload, 12)
+	if err != nil {
+		return err
+	}
+
+	msg.Index, msg.Begin, msg.Length = parseBlockPayload(payload)
+	return nil
+}
+
+func (msg *PieceMessage) parse(payload []byte) error {
+	// piece: <len=0009+X><id=7><index><begin><block>
+	if len(payload) < 8 {
+		return fmt.Errorf("piece message payload of %v bytes is too short", len(payload))
+	}
+
+	msg.Index = int(binary.BigEndian.Uint32(payload[0:4]))
+	msg.Begin = int(binary.BigEndian.Uint32(payload[4:8]))
+	msg.Block = payload[8:]
+	return nil
+}
+
+func (msg *CancelMessage) parse(payload []byte) error {
+	// cancel: <len=0013><id=8><index><begin><length>
+	err := expectLength("cancel", payload, 12)
+	if err != nil {
+		return err
+	}
+
+	msg.Index, msg.Begin, msg.Length = parseBlockPayload(payload)
+	return nil
+}
+
+func (msg *PortMessage) parse(payload []byte) error {
+	// port: <len=0003><id=9><listen-port>
+	err := expectLength("port", payload, 2)
+	if err != nil {
+		return err
+	}
+
+	msg.Port = binary.BigEndian.Uint16(payload)
+	return nil
+}
+
+func (msg *ExtendedMessage) parse(payload []byte) error {
+	// extended: <len=0002+X><id=20><extended message ID><payload>
+	if len(payload) < 1 {
+		return fmt.Errorf("extended message has no extended message id")
+	}
+
+	msg.ExtendedID = payload[0]
+	msg.Payload = payload[1:]
+	return nil
+}
+
+func (msg *UnknownMessage) parse(payload []byte) error {
+	msg.Payload = payload
+	return nil
+}
+
+// newMessage returns an empty message of the type belonging to id
+func newMessage(id byte) Message {
+	switch id {
+	case chokeID:
+		return &ChokeMessage{}
+	case unchokeID:
+		return &UnchokeMessage{}
+	case interestedID:
+		return &InterestedMessage{}
+	case notInterestedID:
+		return &NotInterestedMessage{}
+	case haveID:
+		return &HaveMessage{}
+	case bitfieldID:
+		return &BitfieldMessage{}
+	case requestID:
+		return &RequestMessage{}
+	case pieceID:
+		return &PieceMessage{}
+	case cancelID:
+		return &CancelMessage{}
+	case portID:
+		return &PortMessage{}
+	case extendedMessageID:
+		return &ExtendedMessage{}
+	case hashRequestID:
+		return &HashRequestMessage{}
+	case hashesID:
+		return &HashesMessage{}
+	case hashRejectID:
+		return &HashRejectMessage{}
+	}
+
+	return &UnknownMessage{MessageID: id}
+}
+
+// ReadMessage reads one message from r. A keep alive is returned as a nil Message.
+func ReadMessage(r io.Reader) (Message, error) {
+	prefix := make([]byte, 4)
+	_, err := io.ReadFull(r, prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	length := binary.BigEndian.Uint32(prefix)
+	if length == 0 {
+		return nil, nil
+	}
+
+	if length > maxMessageLength {
+		return nil, fmt.Errorf("message of %v bytes is too large", length)
+	}
+
+	frame := make([]byte, length)
+	_, err = io.ReadFull(r, frame)
+	if err == io.EOF {
+		// The stream ended after the length prefix, in the middle of the message
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	msg := newMessage(frame[0])
+	err = msg.parse(frame[1:])
+	if err != nil {
+		return nil, err
+	}
+
+	return msg, nil
+}
+
+// EncodeMessage lays the message out as it is sent over the wire, length prefix included
+func EncodeMessage(msg Message) []byte {
+	if msg == nil {
+		return make([]byte, 4)
+	}
+
+	payload := msg.payload()
+	frame := make([]byte, 5+len(payload))
+	binary.BigEndian.PutUint32(frame[0:4], uint32(1+len(payload)))
+	frame[4] = msg.ID()
+	copy(frame[5:], payload)
+
+	return frame
+}
+
+// WriteMessage writes a single message to w. A nil Message is sent as a keep alive.
+func WriteMessage(w io.Writer, msg Message) error {
+	_, err := w.Write(EncodeMessage(msg))
+	return err
+}
+
+func expectLength(name string, payload []byte, length int) error {
+	if len(payload) != length {
+		return fmt.Errorf("%s message payload is %v bytes, expected %v", name, len(payload), length)
+	}
+
+	return nil
+}
+
+// blockPayload is the payload shared by request and cancel messages: <index><begin><length>
+func blockPayload(index, begin, length int) []byte {
+	payload := make([]byte, 12)
+	binary.BigEndian.PutUint32(payload[0:4], uint32(index))
+	binary.BigEndian.PutUint32(payload[4:8], uint32(begin))
+	binary.BigEndian.PutUint32(payload[8:12], uint32(length))
+
+	return payload
+}
+
+func parseBlockPayload(payload []byte) (index, begin, length int) {
+	index = int(binary.BigEndian.Uint32(payload[0:4]))
+	begin = int(binary.BigEndian.Uint32(payload[4:8]))
+	length = int(binary.BigEndian.Uint32(payload[8:12]))
+
+	return index, begin, length
+}
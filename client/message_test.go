@@ -0,0 +1,170 @@
+package client
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+func TestMessageRoundTrip(t *testing.T) {
+	messages := []Message{
+		&ChokeMessage{},
+		&UnchokeMessage{},
+		&InterestedMessage{},
+		&NotInterestedMessage{},
+		&HaveMessage{Index: 1234},
+		&BitfieldMessage{Bitfield: []byte{0xff, 0x80}},
+		&RequestMessage{Index: 1, Begin: 16384, Length: 16384},
+		&PieceMessage{Index: 2, Begin: 32768, Block: []byte("block data")},
+		&CancelMessage{Index: 3, Begin: 0, Length: 16384},
+		&PortMessage{Port: 6881},
+		&ExtendedMessage{ExtendedID: 0, Payload: []byte("d1:md11:ut_metadatai1eee")},
+		&ExtendedMessage{ExtendedID: 3, Payload: []byte{}},
+		&HashRequestMessage{hashRequest{piecesRoot: bytes.Repeat([]byte{7}, 32), baseLayer: 1, index: 4, length: 4, proofLayers: 3}},
+		&HashesMessage{hashRequest{piecesRoot: bytes.Repeat([]byte{7}, 32), baseLayer: 1, index: 0, length: 2, proofLayers: 1}, [][]byte{
+			bytes.Repeat([]byte{1}, 32), bytes.Repeat([]byte{2}, 32), bytes.Repeat([]byte{3}, 32),
+		}},
+		&HashRejectMessage{hashRequest{piecesRoot: bytes.Repeat([]byte{7}, 32), baseLayer: 1, index: 8, length: 8, proofLayers: 0}},
+		&UnknownMessage{MessageID: 30, Payload: []byte{1, 2, 3}},
+	}
+
+	for _, msg := range messages {
+		var buf bytes.Buffer
+		err := WriteMessage(&buf, msg)
+		if err != nil {
+			t.Fatalf("%T: write: %s", msg, err)
+		}
+
+		got, err := ReadMessage(&buf)
+		if err != nil {
+			t.Fatalf("%T: read: %s", msg, err)
+		}
+		if !reflect.DeepEqual(got, msg) {
+			t.Errorf("%T: read back %#v, wrote %#v", msg, got, msg)
+		}
+		if buf.Len() != 0 {
+			t.Errorf("%T: %v bytes left unread", msg, buf.Len())
+		}
+	}
+}
+
+func TestKeepAlive(t *testing.T) {
+	var buf bytes.Buffer
+	err := WriteMessage(&buf, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf.Bytes(), []byte{0, 0, 0, 0}) {
+		t.Fatalf("keep alive encoded as %x", buf.Bytes())
+	}
+
+	msg, err := ReadMessage(&buf)
+	if err != nil || msg != nil {
+		t.Fatalf("read keep alive as %v, %v", msg, err)
+	}
+}
+
+func TestReadMessageTruncated(t *testing.T) {
+	full := EncodeMessage(&RequestMessage{Index: 1, Begin: 2, Length: 3})
+
+	for n := 1; n < len(full); n++ {
+		_, err := ReadMessage(bytes.NewReader(full[:n]))
+		if err != io.ErrUnexpectedEOF {
+			t.Errorf("message cut to %v bytes: got %v, want %v", n, err, io.ErrUnexpectedEOF)
+		}
+	}
+
+	_, err := ReadMessage(bytes.NewReader(nil))
+	if err != io.EOF {
+		t.Errorf("empty stream: got %v, want %v", err, io.EOF)
+	}
+}
+
+func TestReadMessageOversized(t *testing.T) {
+	prefix := make([]byte, 4)
+	binary.BigEndian.PutUint32(prefix, maxMessageLength+1)
+
+	_, err := ReadMessage(bytes.NewReader(prefix))
+	if err == nil {
+		t.Fatal("message longer than maxMessageLength was accepted")
+	}
+
+	// The largest message we accept still goes through
+	frame := EncodeMessage(&PieceMessage{Block: make([]byte, maxMessageLength-9)})
+	_, err = ReadMessage(bytes.NewReader(frame))
+	if err != nil {
+		t.Fatalf("message of maxMessageLength bytes: %s", err)
+	}
+}
+
+func TestReadMessageBadPayload(t *testing.T) {
+	frames := map[string][]byte{
+		"choke with payload": {0, 0, 0, 2, chokeID, 0},
+		"short have":         {0, 0, 0, 3, haveID, 0, 1},
+		"short request":      {0, 0, 0, 5, requestID, 0, 0, 0, 1},
+		"short piece":        {0, 0, 0, 5, pieceID, 0, 0, 0, 1},
+		"long port":          {0, 0, 0, 4, portID, 0, 1, 2},
+		"empty extended":     {0, 0, 0, 1, extendedMessageID},
+		"short hash request": append([]byte{0, 0, 0, 48, hashRequestID}, make([]byte, 47)...),
+		"long hash reject":   append([]byte{0, 0, 0, 50, hashRejectID}, make([]byte, 49)...),
+		"partial hash":       append([]byte{0, 0, 0, 59, hashesID}, make([]byte, 58)...),
+	}
+
+	for name, frame := range frames {
+		_, err := ReadMessage(bytes.NewReader(frame))
+		if err == nil {
+			t.Errorf("%s: accepted", name)
+		}
+	}
+}
+
+// checkReencodes reads a message from data, and checks that whatever parses encodes back to the frame it was read from
+func checkReencodes(t *testing.T, data []byte) {
+	t.Helper()
+
+	msg, err := ReadMessage(bytes.NewReader(data))
+	if err != nil || msg == nil {
+		return
+	}
+
+	frame := EncodeMessage(msg)
+	if len(frame) > len(data) || !bytes.Equal(frame, data[:len(frame)]) {
+		t.Fatalf("%T re-encoded as %x, read from %x", msg, frame, data)
+	}
+}
+
+func TestReadMessageReencodes(t *testing.T) {
+	frames := [][]byte{
+		EncodeMessage(nil),
+		EncodeMessage(&HaveMessage{Index: 7}),
+		EncodeMessage(&PieceMessage{Index: 1, Begin: 2, Block: []byte("abc")}),
+		EncodeMessage(&ExtendedMessage{ExtendedID: 1, Payload: []byte("d1:ai1ee")}),
+		EncodeMessage(&BitfieldMessage{Bitfield: []byte{0xff, 0x80}}),
+		EncodeMessage(&CancelMessage{Index: 3, Begin: blockSize, Length: blockSize}),
+		// Another frame following the first one
+		append(EncodeMessage(&HaveMessage{Index: 1}), EncodeMessage(&HaveMessage{Index: 2})...),
+		{0, 0, 0, 1, 0xfe},
+		{0xff, 0xff, 0xff, 0xff},
+	}
+
+	for _, frame := range frames {
+		checkReencodes(t, frame)
+	}
+
+	// The frames with a few bytes changed, which a reader has to cope with just as well
+	random := rand.New(rand.NewSource(1))
+	for i := 0; i < 10000; i++ {
+		data := append([]byte(nil), frames[random.Intn(len(frames))]...)
+		for n := random.Intn(3) + 1; n > 0; n-- {
+			data[random.Intn(len(data))] = byte(random.Intn(256))
+		}
+		if random.Intn(4) == 0 {
+			data = data[:random.Intn(len(data)+1)]
+		}
+
+		checkReencodes(t, data)
+	}
+}
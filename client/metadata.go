@@ -0,0 +1,266 @@
+package client
+
+// Will handle the extension protocol (BEP 10) and downloading the info dictionary of magnet links from peers (BEP 9)
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/zeebo/bencode"
+)
+
+const (
+	extendedMessageID   = 20
+	extendedHandshakeID = 0
+	utMetadataID        = 1 // the id we ask peers to use for ut_metadata messages they send us
+
+	extensionProtocolBit = 0x10 // reserved[5] of the handshake
+	metadataPieceSize    = 16384
+	maxMetadataSize      = 16 * 1024 * 1024
+	metadataTimeout      = 60 * time.Second
+)
+
+// ut_metadata msg_type values
+const (
+	metadataRequest = 0
+	metadataData    = 1
+	metadataReject  = 2
+)
+
+// The extendedHandshake is the payload of the extended message with id 0, sent right after the BitTorrent handshake
+type extendedHandshake struct {
+	M            map[string]int `bencode:"m"`                       // extension names mapped to the message id the sender wants to receive them with
+	MetadataSize int            `bencode:"metadata_size,omitempty"` // size of the info dictionary in bytes
+	V            string         `bencode:"v,omitempty"`             // client name and version
+}
+
+// A metadataMessage is the bencoded dictionary at the start of every ut_metadata message
+type metadataMessage struct {
+	MsgType   int `bencode:"msg_type"`
+	Piece     int `bencode:"piece"`
+	TotalSize int `bencode:"total_size,omitempty"`
+}
+
+// FetchMetadata downloads the info dictionary of a torrent that was added through a magnet link.
+// Peers are asked in parallel, and the first dictionary matching the info-hash is used to build the pieces.
+func (torrent *Torrent) FetchMetadata() error {
+	peers := make(chan *Peer, len(torrent.Peers))
+	for i := range torrent.Peers {
+		peers <- &torrent.Peers[i]
+	}
+	close(peers)
+
+	found := make(chan []byte, 1)
+	done := make(chan struct{})
+	defer close(done)
+
+	workers := make(chan struct{}, maxPeers)
+	for i := 0; i < maxPeers; i++ {
+		go func() {
+			defer func() { workers <- struct{}{} }()
+			for peer := range peers {
+				select {
+				case <-done:
+					return
+				default:
+				}
+
+				rawInfo, err := peer.fetchMetadata(torrent)
+				if err != nil {
+					fmt.Printf("Unable to fetch metadata from %s: %s \n", peer.address, err.Error())
+					continue
+				}
+
+				select {
+				case found <- rawInfo:
+				default:
+				}
+				return
+			}
+		}()
+	}
+
+	for finished := 0; finished < maxPeers; {
+		select {
+		case rawInfo := <-found:
+			return torrent.setInfo(rawInfo)
+		case <-workers:
+			finished++
+		}
+	}
+
+	// Every worker gave up, but the last one may have succeeded just before doing so
+	select {
+	case rawInfo := <-found:
+		return torrent.setInfo(rawInfo)
+	default:
+	}
+
+	return errors.New("no peer was able to provide the torrent metadata")
+}
+
+// setInfo takes an info dictionary that was verified against the info-hash and prepares the torrent for downloading
+func (torrent *Torrent) setInfo(rawInfo []byte) error {
+	info := InfoDictionary{}
+
+	err := bencode.DecodeBytes(rawInfo, &info)
+	if err != nil {
+		return fmt.Errorf("unable to decode info dictionary: %s", err.Error())
+	}
+
+	torrent.Data.Info = info
+	torrent.Data.rawInfo = rawInfo
+
+	err = torrent.loadInfo()
+	if err != nil {
+		return err
+	}
+
+	return torrent.openStorage()
+}
+
+// fetchMetadata connects to the peer and requests every piece of the info dictionary over ut_metadata
+func (peer *Peer) fetchMetadata(torrent *Torrent) ([]byte, error) {
+	infoHash := torrent.Hash
+
+	conn, err := net.DialTimeout("tcp", peer.address, 10*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(metadataTimeout))
+
+	handshake := newHandshake(infoHash)
+	handshake.Reserved[5] |= extensionProtocolBit
+
+	err = WriteHandshake(conn, handshake)
+	if err != nil {
+		return nil, err
+	}
+
+	reply, err := ReadHandshake(conn)
+	if err != nil {
+		return nil, fmt.Errorf("no handshake received: %s", err.Error())
+	}
+
+	err = checkHandshake(reply, infoHash)
+	if err != nil {
+		return nil, err
+	}
+
+	peer.reserved = reply.Reserved
+	if !peer.supportsExtensions() {
+		return nil, errors.New("peer does not support the extension protocol")
+	}
+
+	payload, err := bencode.EncodeBytes(extendedHandshake{
+		M: map[string]int{"ut_metadata": utMetadataID},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = WriteMessage(conn, &ExtendedMessage{ExtendedID: extendedHandshakeID, Payload: payload})
+	if err != nil {
+		return nil, err
+	}
+
+	var pieces [][]byte
+	var metadataSize int
+	received := 0
+
+	for {
+		msg, err := ReadMessage(conn)
+		if err != nil {
+			return nil, err
+		}
+
+		// Skip keep alives and everything that isn't part of the extension protocol
+		extended, ok := msg.(*ExtendedMessage)
+		if !ok {
+			continue
+		}
+
+		switch extended.ExtendedID {
+		case extendedHandshakeID:
+			remote := extendedHandshake{}
+			err := bencode.DecodeBytes(extended.Payload, &remote)
+			if err != nil {
+				return nil, fmt.Errorf("invalid extended handshake: %s", err.Error())
+			}
+
+			remoteID, ok := remote.M["ut_metadata"]
+			if !ok || remoteID == 0 {
+				return nil, errors.New("peer does not support ut_metadata")
+			}
+
+			if remote.MetadataSize <= 0 || remote.MetadataSize > maxMetadataSize {
+				return nil, fmt.Errorf("peer reported an invalid metadata size of %v bytes", remote.MetadataSize)
+			}
+
+			metadataSize = remote.MetadataSize
+			pieces = make([][]byte, (metadataSize+metadataPieceSize-1)/metadataPieceSize)
+
+			for i := range pieces {
+				request, err := bencode.EncodeBytes(metadataMessage{MsgType: metadataRequest, Piece: i})
+				if err != nil {
+					return nil, err
+				}
+				err = WriteMessage(conn, &ExtendedMessage{ExtendedID: byte(remoteID), Payload: request})
+				if err != nil {
+					return nil, err
+				}
+			}
+		case utMetadataID:
+			if pieces == nil {
+				return nil, errors.New("peer sent metadata before its extended handshake")
+			}
+
+			decoder := bencode.NewDecoder(bytes.NewReader(extended.Payload))
+			response := metadataMessage{}
+			err := decoder.Decode(&response)
+			if err != nil {
+				return nil, fmt.Errorf("invalid ut_metadata message: %s", err.Error())
+			}
+
+			if response.MsgType == metadataReject {
+				return nil, fmt.Errorf("peer rejected the request for metadata piece %v", response.Piece)
+			}
+
+			if response.MsgType != metadataData {
+				continue
+			}
+
+			if response.Piece < 0 || response.Piece >= len(pieces) || pieces[response.Piece] != nil {
+				return nil, fmt.Errorf("peer sent unexpected metadata piece %v", response.Piece)
+			}
+
+			data := extended.Payload[decoder.BytesParsed():]
+			expected := metadataPieceSize
+			if response.Piece == len(pieces)-1 {
+				expected = metadataSize - response.Piece*metadataPieceSize
+			}
+
+			if len(data) != expected {
+				return nil, fmt.Errorf("metadata piece %v is %v bytes, expected %v", response.Piece, len(data), expected)
+			}
+
+			pieces[response.Piece] = data
+			received++
+
+			if received == len(pieces) {
+				rawInfo := bytes.Join(pieces, nil)
+
+				if !torrent.matchesInfo(rawInfo) {
+					return nil, errors.New("metadata does not match the info-hash")
+				}
+
+				return rawInfo, nil
+			}
+		}
+	}
+}
@@ -0,0 +1,219 @@
+package client
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/zeebo/bencode"
+)
+
+// A testMetadataPeer serves an info dictionary over ut_metadata, answering the requests it gets in
+// reverse order. It tells the size it is asked to, and corrupt changes the dictionary as it is sent.
+type testMetadataPeer struct {
+	rawInfo []byte
+	size    int
+	corrupt bool
+}
+
+// testRawInfo is an info dictionary large enough to take three metadata pieces
+func testRawInfo(t *testing.T) []byte {
+	t.Helper()
+
+	pieces := bytes.Repeat([]byte("0123456789abcdefghij"), 2000)
+	rawInfo, err := bencode.EncodeBytes(InfoDictionary{
+		Name:        "test.bin",
+		PieceLength: 2 * blockSize,
+		Length:      len(pieces) / 20 * 2 * blockSize,
+		Pieces:      string(pieces),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rawInfo) <= 2*metadataPieceSize {
+		t.Fatalf("info dictionary of %v bytes doesn't take three pieces", len(rawInfo))
+	}
+
+	return rawInfo
+}
+
+// serve listens for one connection of the torrent with the info-hash, returning the address it listens on
+func (server *testMetadataPeer) serve(t *testing.T, infoHash []byte) string {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		// The client hanging up early is what some tests are after
+		server.answer(conn, infoHash)
+	}()
+
+	return listener.Addr().String()
+}
+
+func (server *testMetadataPeer) answer(conn net.Conn, infoHash []byte) error {
+	_, err := ReadHandshake(conn)
+	if err != nil {
+		return err
+	}
+	reply := newHandshake(infoHash)
+	copy(reply.PeerID[:], "-XX0001-000000000001")
+	reply.Reserved[5] |= extensionProtocolBit
+	err = WriteHandshake(conn, reply)
+	if err != nil {
+		return err
+	}
+
+	// Our id for ut_metadata is another than the one of the client, so mixing them up shows
+	const ourID = 3
+	payload, _ := bencode.EncodeBytes(extendedHandshake{M: map[string]int{"ut_metadata": ourID}, MetadataSize: server.size})
+	err = WriteMessage(conn, &ExtendedMessage{ExtendedID: extendedHandshakeID, Payload: payload})
+	if err != nil {
+		return err
+	}
+
+	var theirID int
+	var requested []int
+	count := (len(server.rawInfo) + metadataPieceSize - 1) / metadataPieceSize
+	for len(requested) < count {
+		msg, err := ReadMessage(conn)
+		if err != nil {
+			return err
+		}
+		extended, ok := msg.(*ExtendedMessage)
+		if !ok {
+			continue
+		}
+
+		switch extended.ExtendedID {
+		case extendedHandshakeID:
+			remote := extendedHandshake{}
+			err := bencode.DecodeBytes(extended.Payload, &remote)
+			if err != nil {
+				return err
+			}
+			theirID = remote.M["ut_metadata"]
+		case ourID:
+			request := metadataMessage{}
+			err := bencode.DecodeBytes(extended.Payload, &request)
+			if err != nil || request.MsgType != metadataRequest {
+				return err
+			}
+			requested = append(requested, request.Piece)
+		}
+	}
+
+	for i := len(requested) - 1; i >= 0; i-- {
+		piece := requested[i]
+		end := (piece + 1) * metadataPieceSize
+		if end > len(server.rawInfo) {
+			end = len(server.rawInfo)
+		}
+		data := append([]byte(nil), server.rawInfo[piece*metadataPieceSize:end]...)
+		if server.corrupt && piece == 1 {
+			data[0] ^= 0xff
+		}
+
+		header, _ := bencode.EncodeBytes(metadataMessage{MsgType: metadataData, Piece: piece, TotalSize: len(server.rawInfo)})
+		err = WriteMessage(conn, &ExtendedMessage{ExtendedID: byte(theirID), Payload: append(header, data...)})
+		if err != nil {
+			return err
+		}
+	}
+
+	// Wait for the client to hang up
+	_, err = ReadMessage(conn)
+	for err == nil {
+		_, err = ReadMessage(conn)
+	}
+
+	return nil
+}
+
+// fetchFrom has a torrent of the info-hash fetch the info dictionary from the metadata peer
+func fetchFrom(t *testing.T, server *testMetadataPeer, infoHash []byte) ([]byte, error) {
+	t.Helper()
+
+	torrent := &Torrent{Hash: infoHash}
+	peer := &Peer{address: server.serve(t, infoHash), torrent: torrent}
+
+	return peer.fetchMetadata(torrent)
+}
+
+func TestFetchMetadata(t *testing.T) {
+	rawInfo := testRawInfo(t)
+	hash := sha1.Sum(rawInfo)
+
+	server := &testMetadataPeer{rawInfo: rawInfo, size: len(rawInfo)}
+	fetched, err := fetchFrom(t, server, hash[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(fetched, rawInfo) {
+		t.Fatal("pieces of the info dictionary were put together in the wrong order")
+	}
+}
+
+func TestFetchMetadataHashMismatch(t *testing.T) {
+	rawInfo := testRawInfo(t)
+	hash := sha1.Sum(rawInfo)
+
+	server := &testMetadataPeer{rawInfo: rawInfo, size: len(rawInfo), corrupt: true}
+	_, err := fetchFrom(t, server, hash[:])
+	if err == nil || !strings.Contains(err.Error(), "does not match the info-hash") {
+		t.Fatalf("got error %v for a corrupted info dictionary", err)
+	}
+}
+
+func TestFetchMetadataSize(t *testing.T) {
+	rawInfo := testRawInfo(t)
+	hash := sha1.Sum(rawInfo)
+
+	// Peers can't make us allocate more than the cap, or nothing at all
+	for _, size := range []int{maxMetadataSize + 1, 0, -1} {
+		server := &testMetadataPeer{rawInfo: rawInfo, size: size}
+		_, err := fetchFrom(t, server, hash[:])
+		if err == nil || !strings.Contains(err.Error(), "invalid metadata size") {
+			t.Errorf("got error %v for a metadata size of %v bytes", err, size)
+		}
+	}
+
+	// A size that doesn't match the pieces that are sent
+	server := &testMetadataPeer{rawInfo: rawInfo, size: len(rawInfo) + 1}
+	_, err := fetchFrom(t, server, hash[:])
+	if err == nil || !strings.Contains(err.Error(), "expected") {
+		t.Errorf("got error %v for pieces that don't add up to the metadata size", err)
+	}
+}
+
+func TestFetchMetadataSetsInfo(t *testing.T) {
+	rawInfo := testRawInfo(t)
+	hash := sha1.Sum(rawInfo)
+
+	defer func(backend Storage) { Settings.Storage = backend }(Settings.Storage)
+	Settings.Storage = NewMemoryStorage()
+
+	server := &testMetadataPeer{rawInfo: rawInfo, size: len(rawInfo)}
+	torrent := &Torrent{Hash: hash[:]}
+	torrent.Peers = []Peer{{address: server.serve(t, hash[:]), torrent: torrent}}
+
+	err := torrent.FetchMetadata()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if torrent.Data.Info.Name != "test.bin" || len(torrent.Pieces) != 2000 || !bytes.Equal(torrent.Hash, hash[:]) {
+		t.Fatalf("torrent has name %q, %v pieces and info-hash %x after fetching its metadata", torrent.Data.Info.Name, len(torrent.Pieces), torrent.Hash)
+	}
+}
@@ -1,6 +1,14 @@
 package client
 
-import "net"
+import (
+	"net"
+	"sync"
+	"time"
+
+	"goTorrent/dht"
+
+	"github.com/zeebo/bencode"
+)
 
 /* TODO: GO BACK AND UNEXPORT EVERY STRUCT FIELD THAT ISN'T BEING USED OUTSIDE THIS CLIENT PACKAGE
 
@@ -20,18 +28,54 @@ import "net"
 
 // Client will represent the state of our client, in terms of torrents that are currently being tracked.
 type Client struct {
-	torrents []Torrent
+	mu       sync.Mutex
+	torrents []*Torrent
+}
+
+// Config holds the settings every torrent of the client runs with
+type Config struct {
+	DownloadDir string  // Directory torrents are saved in. Multi-file torrents get a directory named after the torrent inside it
+	Storage     Storage // Where the data of torrents is kept. If nil, it is stored in files under DownloadDir
+
+	PipelineSize   int           // Block requests kept outstanding with every peer that unchoked us
+	RequestTimeout time.Duration // How long a block request may go unanswered before the block is requested again
+
+	RandomFirstPieces int // Pieces picked at random before switching to rarest first, so we have something to share early on
+	UploadSlots       int // Peers unchoked for giving us the most, next to the one optimistic unchoke
+
+	SuppressHaves bool // Don't send have messages to peers that already have the piece
+
+	DHT *dht.Server // DHT node torrents also find peers through, except private ones. If nil, only trackers are used
 }
 
 // Torrent contains all necessary information to start downloading a torrent
 type Torrent struct {
 	Path            string
 	Data            MetaInfo
-	Hash            []byte
-	TrackerProtocol string //whether its tracker uses UDP or TCP
+	Hash            []byte // v1 info-hash, or the truncated v2 info-hash of a v2-only torrent. Used for trackers and handshakes
+	HashV2          []byte // 32-byte SHA256 info-hash of v2 and hybrid torrents (BEP 52)
 	Peers           []Peer
 	Pieces          []Piece
 	ConnectedPeers  int
+	mu              sync.Mutex
+	livePeers       []*Peer       // peers we completed a handshake with
+	wake            chan struct{} // signals the download loop to update right away
+	started         bool          // Start was called
+	stop            chan struct{} // closed by Stop, which may come before Start
+	trackers        [][]string    // tiers of announce URLs, in the order they are tried
+	completed       chan struct{} // closed once every piece is in, when started if the torrent was complete by then
+	announced       chan struct{} // closed once the trackers were told the torrent stopped
+	downloaded      int64         // bytes of blocks peers sent us since the torrent was started
+	uploaded        int64         // bytes of blocks we sent peers since the torrent was started
+	optimistic      *Peer         // the peer that is unchoked optimistically
+	optimisticSince time.Time
+	banned          map[string]bool     // IP addresses of peers that kept sending data failing the hash check
+	picker          *piecePicker        // decides which piece to download next
+	have            Bitset              // pieces we have verified
+	filePriorities  []int               // priority of every file, PriorityNormal unless set otherwise
+	storage         TorrentStorage      // where the pieces are read from and written to
+	v2Files         []v2File            // files of the v2 file tree, with the pieces they occupy
+	pendingLayers   map[string][][]byte // piece layers that are partially received from peers
 }
 
 // MetaInfo represents the information .torrent file that stores the information needed to download a torrent.
@@ -42,18 +86,45 @@ type MetaInfo struct {
 	Comment      string         `bencode:"comment,omitempty"`
 	CreatedBy    string         `bencode:"created by,omitempty"`
 	Encoding     string         `bencode:"encoding,omitempty"`
+	URLList      URLList        `bencode:"url-list,omitempty"` // web seeds (BEP 19)
 	Info         InfoDictionary `bencode:"info"`
+	PieceLayers  PieceLayers    `bencode:"piece layers,omitempty"` // v2: pieces root of a file mapped to its concatenated piece hashes
+	rawInfo      []byte         // the info dictionary exactly as it was bencoded in the .torrent file
 }
 
+// PieceLayers maps the 32-byte pieces root of every file larger than one piece to the SHA256 merkle hashes of its pieces
+type PieceLayers map[string]string
+
+// URLList is the list of web seeds of a torrent. Some .torrent files store a single URL as a plain string instead of a list.
+type URLList []string
+
 // The InfoDictionary is a dictionary that describes the file(s) of the torrent.
 type InfoDictionary struct {
-	Name        string `bencode:"name"`
-	PieceLength int    `bencode:"piece length"`
-	Pieces      string `bencode:"pieces"`
-	Private     int    `bencode:"private,omitempty"`
-	Files       []File `bencode:"files,omitempty"`
-	Length      int    `bencode:"length,omitempty"`
-	Md5sum      string `bencode:"md5sum,omitempty"`
+	Name        string   `bencode:"name"`
+	PieceLength int      `bencode:"piece length"`
+	Pieces      string   `bencode:"pieces"`
+	Private     int      `bencode:"private,omitempty"`
+	Files       []File   `bencode:"files,omitempty"`
+	Length      int      `bencode:"length,omitempty"`
+	Md5sum      string   `bencode:"md5sum,omitempty"`
+	MetaVersion int      `bencode:"meta version,omitempty"` // 2 for v2 and hybrid torrents
+	FileTree    FileTree `bencode:"file tree,omitempty"`    // v2 description of the files
+}
+
+// A FileTree is the v2 description of the files, mapping the names of files and directories to their nodes:
+// {"dir": {"file.txt": {"": {"length": 1024, "pieces root": <32 bytes>}}}}
+type FileTree map[string]*FileTreeNode
+
+// A FileTreeNode is either a file, whose only key is the empty string, or a directory holding another FileTree
+type FileTreeNode struct {
+	File     *FileTreeEntry
+	Children FileTree
+}
+
+// A FileTreeEntry describes a single file in the v2 file tree
+type FileTreeEntry struct {
+	Length     int    `bencode:"length"`
+	PiecesRoot string `bencode:"pieces root,omitempty"` // root of the SHA256 merkle tree of the file's 16 KiB blocks, absent for empty files
 }
 
 // A File represents the info dictionary of a torrent in single-file mode, as well as the multipe files in multi-file mode
@@ -61,43 +132,64 @@ type File struct {
 	Path   []string `bencode:"path"` // Bencoded list of strings that represent the path and filename
 	Length int      `bencode:"length"`
 	Md5sum string   `bencode:"md5sum,omitempty"`
+	Attr   string   `bencode:"attr,omitempty"` // BEP 47 attributes. 'p' marks a padding file that aligns the next file to a piece boundary
 }
 
 // A TrackerRequest is a client to tracker GET request
 type TrackerRequest struct {
-	InfoHash      []byte // URLencoded 20-byte SHA1 hash of the value of the info key from the MetaInfo file, bencoded.
-	PeerID        []byte // URLencoded 20-byte string used as a unique ID for the client, and generated by the client at startup.
-	Port          int    // Port number the client is listening on
-	Uploaded      int    // Total amount of bytes uploaded in base ten ASCII
-	Downloaded    int    // Total amount of bytes downloaded  in base ten ASCII
-	Left          int    // The number of bytes that still need to be downloaded to reach 100%
-	Compact       int    // A setting that tells whether the client accepts a compact response or not using 0 and 1
-	Event         string // Must be one of started, completed or stopped. If not specified, then the request is repeated at regular intervals
-	TrackerID     string // If a previus announce contained a tracker id, it should be here
-	ConnectionID  []byte // Current connection ID to the tracker
-	TransactionID []byte // Current transaction ID
+	InfoHash   []byte            // URLencoded 20-byte SHA1 hash of the value of the info key from the MetaInfo file, bencoded.
+	PeerID     []byte            // URLencoded 20-byte string used as a unique ID for the client, and generated by the client at startup.
+	Port       int               // Port number the client is listening on
+	Uploaded   int               // Total amount of bytes uploaded in base ten ASCII
+	Downloaded int               // Total amount of bytes downloaded  in base ten ASCII
+	Left       int               // The number of bytes that still need to be downloaded to reach 100%
+	Compact    int               // A setting that tells whether the client accepts a compact response or not using 0 and 1
+	Event      string            // Must be one of started, completed or stopped. If not specified, then the request is repeated at regular intervals
+	TrackerID  string            // If a previus announce contained a tracker id, it should be here
+	IPv6       net.IP            // Our public IPv6 address, which HTTP trackers hand to IPv6 peers (BEP 7)
+	trackerIDs map[string]string // tracker ids handed out, by the announce URL of the tracker
+	cancel     <-chan struct{}   // closing it makes an announce in progress give up
 }
 
 // The TrackerResponse sent from the tracker
 type TrackerResponse struct {
-	FailureReason string `bencode:"failure reason,omitempty"`
-	Interval      int    `bencode:"interval"`
-	TrackerID     string `bencode:"tracker id"` // A string that the client shold send back on its next announcements. If absent and a previous announce sent an ID, use the old value
-	Complete      int    `bencode:"complete"`   // Number of peers with the entire file
-	Incomplete    int    `bencode:"incomplete"` // number of leechers; non-seeder peers
-	Peers         string `bencode:"peers"`
-	//Peers         []Peer `bencode:"peers"`
+	FailureReason  string             `bencode:"failure reason,omitempty"`
+	WarningMessage string             `bencode:"warning message,omitempty"` // Like failure reason, but the response is still processed
+	Interval       int                `bencode:"interval"`
+	MinInterval    int                `bencode:"min interval,omitempty"` // Clients must not reannounce more often than this
+	TrackerID      string             `bencode:"tracker id"`             // A string that the client shold send back on its next announcements. If absent and a previous announce sent an ID, use the old value
+	Complete       int                `bencode:"complete"`               // Number of peers with the entire file
+	Incomplete     int                `bencode:"incomplete"`             // number of leechers; non-seeder peers
+	Peers          bencode.RawMessage `bencode:"peers"`                  // A compact string of 6 bytes per peer, or a list of peer dictionaries
+	Peers6         string             `bencode:"peers6,omitempty"`       // A compact string of 18 bytes per IPv6 peer (BEP 7)
 }
 
 // A Peer is a participant in the swarm
 type Peer struct {
 	address    string
 	peerID     string
+	infoHash   []byte // info-hash of the swarm the peer was found in, which differs between the halves of a hybrid torrent
 	torrent    *Torrent
-	Bitfield   []int
+	reserved   [8]byte // reserved bytes of the peer's handshake, announcing the extensions it supports
+	Bitfield   Bitset  // pieces the peer has
 	Interested int
 	Choking    int
 	conn       *net.Conn
+
+	amInterested bool                       // we told the peer we want pieces it has
+	requests     map[blockRequest]time.Time // block requests outstanding with the peer, and when they were sent
+	lastSent     time.Time
+	hashFailures int            // pieces the peer contributed to that failed their hash check
+	uploads      []blockRequest // blocks the peer requested from us, in the order they are to be sent
+	amChoking    bool           // we don't answer the peer's requests
+	uploadReady  chan struct{}  // signals that requests were queued
+	closed       chan struct{}  // closed once the connection with the peer is gone
+
+	downloaded      int64     // bytes of blocks the peer sent us
+	uploaded        int64     // bytes of blocks we sent the peer
+	chokeDownloaded int64     // downloaded at the last choke round
+	chokeUploaded   int64     // uploaded at the last choke round
+	lastBlock       time.Time // when the peer last sent us a block, or since when we wait on one: connecting, becoming interested or sending a first request
 }
 
 // The Handshake is a required message and must be the first message transmitted by the client to a peer.
@@ -111,15 +203,19 @@ type Handshake struct {
 
 // Piece represents the yet to be concacenated pieces that make up the file(s) being downloaded
 type Piece struct {
-	Index          int
-	Hash           []byte
-	Blocks         []Block
-	Complete       bool
-	AvailablePeers []*Peer
+	Index    int
+	Hash     []byte
+	HashV2   []byte // v2 merkle hash of the piece, from the piece layers or the pieces root of a single piece file
+	Length   int    // Bytes of data in the piece. The last piece, and pieces at the end of a v2 file, are shorter
+	rootHash bool   // HashV2 is the pieces root of a file that fits in this one piece
+	Blocks   []Block
 }
 
 // A Block is a subset of a piece, and is what is actualy downloaded p2p before being assembled programmatically
 type Block struct {
-	Offset int
-	Data   []byte
+	Offset   int
+	Length   int // 16 KiB, except for the last block of a piece that isn't a multiple of 16 KiB
+	Data     []byte
+	requests int   // requests for the block outstanding with peers. More than one only in endgame
+	peer     *Peer // the peer the data came from
 }
@@ -5,34 +5,36 @@ package client
 import (
 	"bufio"
 	"bytes"
-	"crypto/sha1"
-	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"net"
 	"time"
 )
 
-var (
-	amChoking      []byte
-	amInterested   []byte // unchoke message
-	peerChoking    []byte // uninterested message
-	peerInterested []byte
+const (
+	protocolIdentifier = "BitTorrent protocol"
+	handshakeTimeout   = 20 * time.Second
 )
 
+// Capabilities are announced by setting bits in the reserved bytes of the handshake
 const (
-	keepAlive = byte(0)
+	dhtBit  = 0x01 // reserved[7]: the peer runs a DHT node and sends a port message (BEP 5)
+	fastBit = 0x04 // reserved[7]: the peer supports the fast extension (BEP 6)
 )
 
-func (peer *Peer) initiateConnection(infoHash []byte) (*net.TCPConn, error) {
-	raddr, err := net.ResolveTCPAddr("tcp", peer.address)
-	fmt.Println(raddr.String())
+var errSelfConnection = errors.New("connected to ourselves")
 
+// initiateConnection connects to the peer and exchanges handshakes for the swarm of infoHash.
+// Once the peer's handshake checks out and our bitfield went out, the peer joins the live peers of its torrent.
+func (peer *Peer) initiateConnection(infoHash []byte) (net.Conn, error) {
+	raddr, err := net.ResolveTCPAddr("tcp", peer.address)
 	if err != nil {
 		fmt.Printf("Unable to resolve peer IP address: %s \n", err.Error())
 		return nil, err
 	}
-	conn, err := net.DialTCP("tcp", nil, raddr)
+
+	conn, err := net.DialTimeout("tcp", raddr.String(), handshakeTimeout)
 	if err != nil {
 		fmt.Printf("Unable to connect with provided peer address (%s): %s \n", raddr.String(), err.Error())
 		return nil, err
@@ -40,62 +42,225 @@ func (peer *Peer) initiateConnection(infoHash []byte) (*net.TCPConn, error) {
 
 	fmt.Println("Peer connection open")
 
-	// conn.SetDeadline(time.Now().Add(time.Second * time.Duration(20)))
-
-	message := make([]byte, 67)
-
-	copy(message[0:], string(19))
-	copy(message[1:20], "BitTorrent protocol")
-	binary.BigEndian.PutUint64(message[20:28], uint64(0))
-	copy(message[28:48], infoHash)
-	copy(message[48:], MyPeerID)
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
 
-	nWritten, err := conn.Write(message)
+	err = WriteHandshake(conn, peer.torrent.handshake(infoHash))
 	if err != nil {
 		fmt.Printf("Unable to write to TCP connection: %s \n", err.Error())
+		conn.Close()
 		return nil, err
 	}
 
-	fmt.Printf("%v bytes written to address: %v \n", nWritten, conn.RemoteAddr())
-	buf := bufio.NewReader(conn)
-	buff := make([]byte, 100)
-	for {
-		size, err := buf.ReadByte()
-		if err != nil {
-			fmt.Printf("Unable to read from tcp connection: %s \n", err.Error())
-			break
-		}
-		/*if len(buf.Bytes()) > 0 {
-			fmt.Println(buf.Bytes())
-			break
-		} */
+	reply, err := ReadHandshake(conn)
+	if err == nil {
+		err = checkHandshake(reply, infoHash)
+	}
+	// A peer we got from a tracker with its id must answer with that id
+	if err == nil && peer.peerID != "" && peer.peerID != string(reply.PeerID[:]) {
+		err = errors.New("peer answered with a different peer id than the tracker gave")
+	}
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("handshake with %s failed: %s", peer.address, err.Error())
+	}
 
-		_, err = io.ReadFull(buf, buff[:int(size)])
-		if err != nil {
-			return nil, err
-		}
+	conn.SetDeadline(time.Time{})
 
-		if size > 0 {
-			break
-		}
+	peer.recordHandshake(reply, conn)
+	if !peer.goLive(peer.sendBitfield()) {
+		conn.Close()
+		return nil, fmt.Errorf("already connected to peer %x", reply.PeerID)
 	}
+
 	return conn, nil
 }
 
-// sendMessage takes a func that returns a built message and a connection and sends that message over the connection
-func sendMessage(msg []byte, conn *net.TCPConn) {
-	_, err := conn.Write(msg)
+// newHandshake creates the handshake we send for the torrent with the given info-hash
+func newHandshake(infoHash []byte) *Handshake {
+	handshake := Handshake{
+		Pstrlen: byte(len(protocolIdentifier)),
+		Pstr:    protocolIdentifier,
+	}
+	copy(handshake.InfoHash[:], infoHash)
+	copy(handshake.PeerID[:], MyPeerID)
+
+	return &handshake
+}
+
+// handshake creates the handshake we send in the swarm of infoHash, with the capabilities the torrent supports
+func (torrent *Torrent) handshake(infoHash []byte) *Handshake {
+	handshake := newHandshake(infoHash)
+	if torrent.isV2() {
+		handshake.Reserved[7] |= v2ProtocolBit
+	}
+	if torrent.usesDHT() {
+		handshake.Reserved[7] |= dhtBit
+	}
+
+	return handshake
+}
+
+// serialize lays the handshake out as it is sent over the wire: <pstrlen><pstr><reserved><info_hash><peer_id>
+func (handshake *Handshake) serialize() []byte {
+	message := make([]byte, 49+len(handshake.Pstr))
+	message[0] = handshake.Pstrlen
+	offset := 1
+	offset += copy(message[offset:], handshake.Pstr)
+	offset += copy(message[offset:], handshake.Reserved[:])
+	offset += copy(message[offset:], handshake.InfoHash[:])
+	copy(message[offset:], handshake.PeerID[:])
+
+	return message
+}
+
+// WriteHandshake sends the handshake over w
+func WriteHandshake(w io.Writer, handshake *Handshake) error {
+	_, err := w.Write(handshake.serialize())
+	return err
+}
+
+// ReadHandshake reads the handshake of a peer and checks that it speaks the BitTorrent protocol
+func ReadHandshake(r io.Reader) (*Handshake, error) {
+	pstrlen := make([]byte, 1)
+	_, err := io.ReadFull(r, pstrlen)
 	if err != nil {
-		fmt.Printf("Could not send given message to %v: %s \n", conn.RemoteAddr(), err.Error())
+		return nil, err
+	}
+
+	if int(pstrlen[0]) != len(protocolIdentifier) {
+		return nil, fmt.Errorf("unknown protocol string of %v bytes", pstrlen[0])
 	}
+
+	rest := make([]byte, 48+len(protocolIdentifier))
+	_, err = io.ReadFull(r, rest)
+	if err != nil {
+		return nil, err
+	}
+
+	handshake := Handshake{
+		Pstrlen: pstrlen[0],
+		Pstr:    string(rest[:len(protocolIdentifier)]),
+	}
+	if handshake.Pstr != protocolIdentifier {
+		return nil, fmt.Errorf("unknown protocol %q", handshake.Pstr)
+	}
+
+	offset := len(protocolIdentifier)
+	offset += copy(handshake.Reserved[:], rest[offset:])
+	offset += copy(handshake.InfoHash[:], rest[offset:])
+	copy(handshake.PeerID[:], rest[offset:])
+
+	return &handshake, nil
+}
+
+// checkHandshake makes sure the handshake of a peer is for the swarm of infoHash, and isn't our own
+func checkHandshake(handshake *Handshake, infoHash []byte) error {
+	if !bytes.Equal(handshake.InfoHash[:], infoHash) {
+		return fmt.Errorf("peer sent info-hash %x, expected %x", handshake.InfoHash, infoHash)
+	}
+
+	if bytes.Equal(handshake.PeerID[:], MyPeerID) {
+		return errSelfConnection
+	}
+
+	return nil
+}
+
+// recordHandshake stores what the peer's handshake told us about it
+func (peer *Peer) recordHandshake(handshake *Handshake, conn net.Conn) {
+	peer.peerID = string(handshake.PeerID[:])
+	peer.reserved = handshake.Reserved
+	peer.conn = &conn
+	// Both sides start out choked and not interested
+	peer.Choking = 1
+	peer.Interested = 0
+	peer.amChoking = true
+	peer.uploadReady = make(chan struct{}, 1)
+	peer.closed = make(chan struct{})
+	peer.lastBlock = time.Now()
+	peer.lastSent = time.Now()
+	peer.Bitfield = NewBitset(len(peer.torrent.Pieces))
+}
+
+// sendBitfield tells a peer we just completed the handshake with which pieces we have. Nothing is sent if we have none.
+// The pieces the peer was told about are returned.
+func (peer *Peer) sendBitfield() Bitset {
+	peer.torrent.mu.Lock()
+	have, _ := DecodeBitset(peer.torrent.have.Bytes(), peer.torrent.have.Len())
+	peer.torrent.mu.Unlock()
+
+	if have.Count() > 0 {
+		peer.send(&BitfieldMessage{Bitfield: have.Bytes()})
+	}
+
+	return have
+}
+
+// goLive makes the peer one of the live peers of its torrent, which the download loop, the choker and
+// have broadcasts write to. Until then only the handshake and the bitfield may go out, so it is called
+// once they were sent. Pieces completed after the bitfield was taken are announced with haves.
+func (peer *Peer) goLive(told Bitset) bool {
+	torrent := peer.torrent
+	if !torrent.addLivePeer(peer) {
+		return false
+	}
+
+	var missed []int
+	torrent.mu.Lock()
+	torrent.have.Iterate(func(i int) bool {
+		if !told.Test(i) {
+			missed = append(missed, i)
+		}
+		return true
+	})
+	torrent.mu.Unlock()
+
+	for _, index := range missed {
+		peer.send(&HaveMessage{Index: index})
+	}
+
+	return true
+}
+
+// supportsDHT reports whether the peer runs a DHT node
+func (peer *Peer) supportsDHT() bool {
+	return peer.reserved[7]&dhtBit != 0
+}
+
+// supportsFast reports whether the peer supports the fast extension
+func (peer *Peer) supportsFast() bool {
+	return peer.reserved[7]&fastBit != 0
+}
+
+// supportsExtensions reports whether the peer supports the extension protocol
+func (peer *Peer) supportsExtensions() bool {
+	return peer.reserved[5]&extensionProtocolBit != 0
+}
+
+// supportsV2 reports whether the peer supports v2 torrents and their hash messages
+func (peer *Peer) supportsV2() bool {
+	return peer.reserved[7]&v2ProtocolBit != 0
 }
 
 // Listen loops for the duration of the client being on, waiting for peer connections.
+// Without an IP in laddr, connections are accepted over both IPv4 and IPv6.
 func Listen(laddr *net.TCPAddr) {
-	listener, err := net.ListenTCP("tcp", laddr)
+	// Listening on IPv4 and IPv6 separately works even where IPv6 sockets don't accept IPv4 connections
+	if laddr.IP == nil || laddr.IP.IsUnspecified() {
+		go listen("tcp6", &net.TCPAddr{IP: net.IPv6unspecified, Port: laddr.Port})
+		listen("tcp4", &net.TCPAddr{IP: net.IPv4zero, Port: laddr.Port})
+		return
+	}
+
+	listen("tcp", laddr)
+}
 
+// listen accepts connections from peers on one socket
+func listen(network string, laddr *net.TCPAddr) {
+	listener, err := net.ListenTCP(network, laddr)
 	if err != nil {
 		fmt.Printf("Unable to listen on give local address: %s \n", err.Error())
+		return
 	}
 
 	for {
@@ -109,108 +274,188 @@ func Listen(laddr *net.TCPAddr) {
 	}
 }
 
+// handlePeerConnection reads messages from the peer until the connection breaks, handling them in the order they arrive
 func (peer *Peer) handlePeerConnection(conn net.Conn) {
 	rdr := bufio.NewReader(conn)
 
-	for {
-		msgSize := make([]byte, 4)
-		_, err := rdr.Read(msgSize)
+	go peer.upload()
+	defer close(peer.closed)
 
+	for {
+		msg, err := ReadMessage(rdr)
 		if err != nil {
-			fmt.Printf("Unable to read msgSize: %s \n", err.Error())
+			fmt.Printf("Unable to read message from %s: %s \n", conn.RemoteAddr().String(), err.Error())
+			conn.Close()
+			peer.torrent.removeLivePeer(peer)
+			return
 		}
 
-		msgSizeInt := int(binary.BigEndian.Uint32(msgSize))
-
-		msg := make([]byte, msgSizeInt)
+		peer.processMessage(msg)
+	}
+}
 
-		n, err := rdr.Read(msg[:msgSizeInt])
+func (peer *Peer) processMessage(msg Message) {
+	/* The core part of our evaluation logic is checking the type of the
+	   message and passing it on to the appropriate handler.
+	*/
+	torrent := peer.torrent
 
-		if err != nil {
-			fmt.Printf("Unable to read msg: %s \n", err.Error())
-			continue
+	switch msg := msg.(type) {
+	case nil:
+		// It's a keep alive. By being received it's already served it's purpose
+		return
+	case *ChokeMessage:
+		torrent.mu.Lock()
+		peer.Choking = 1
+		// A choking peer discards the requests we sent it
+		torrent.releaseRequests(peer)
+		torrent.mu.Unlock()
+	case *UnchokeMessage:
+		torrent.mu.Lock()
+		peer.Choking = 0
+		torrent.mu.Unlock()
+		torrent.wakeUp()
+	case *InterestedMessage:
+		torrent.mu.Lock()
+		peer.Interested = 1
+		// Slots the choker left free are filled right away instead of at the next round
+		var reply Message
+		if torrent.hasFreeSlot() {
+			reply = peer.unchoke()
 		}
+		torrent.mu.Unlock()
 
-		if n > 0 {
-			fmt.Printf("%v bytes read from %s \n", n, conn.RemoteAddr().String())
-
-			go peer.processMessage(msg)
+		if reply != nil {
+			peer.send(reply)
+		}
+	case *NotInterestedMessage:
+		torrent.mu.Lock()
+		peer.Interested = 0
+		torrent.mu.Unlock()
+	case *HaveMessage:
+		torrent.mu.Lock()
+		peer.processHave(msg)
+		reply := torrent.updateInterest(peer)
+		torrent.mu.Unlock()
+
+		if reply != nil {
+			peer.send(reply)
+		}
+		torrent.wakeUp()
+	case *BitfieldMessage:
+		torrent.mu.Lock()
+		err := peer.processBitfield(msg)
+		var reply Message
+		if err == nil {
+			reply = torrent.updateInterest(peer)
+		}
+		torrent.mu.Unlock()
 
+		// A peer sending a bitfield that doesn't fit the torrent is broken, so we drop it
+		if err != nil {
+			fmt.Printf("Invalid bitfield from %s: %s \n", peer.address, err.Error())
+			(*peer.conn).Close()
+			return
 		}
 
+		if reply != nil {
+			peer.send(reply)
+		}
+		torrent.wakeUp()
+	case *RequestMessage:
+		torrent.mu.Lock()
+		peer.processRequest(msg)
+		torrent.mu.Unlock()
+	case *PieceMessage:
+		torrent.processBlock(peer, msg)
+	case *CancelMessage:
+		torrent.mu.Lock()
+		peer.processCancel(msg)
+		torrent.mu.Unlock()
+	case *PortMessage:
+		peer.processPort(msg)
+	case *HashRequestMessage:
+		peer.processHashRequest(msg)
+	case *HashesMessage:
+		peer.processHashes(msg)
+	case *HashRejectMessage:
+		peer.processHashReject(msg)
 	}
 }
 
-func (peer *Peer) processMessage(msg []byte) {
-	if len(msg) == 4 {
-		// It's a keep alive. By being received it's already served it's purpose
+// processHandshake answers the handshake of a peer that connected to us, if it is for a torrent we have.
+// Once our handshake and bitfield went out, the peer joins the live peers of that torrent.
+func processHandshake(c net.Conn) {
+	c.SetDeadline(time.Now().Add(handshakeTimeout))
+
+	handshake, err := ReadHandshake(c)
+	if err != nil {
+		fmt.Printf("Invalid handshake from %s: %s \n", c.RemoteAddr().String(), err.Error())
+		c.Close()
 		return
 	}
-	/* The range depicted should be an int32 representing the id of the message.
-	   The core part of our evaluation logic is checking the id and signaling to
-	   the appropriate channel with the relevant information.
-	*/
-	id := msg[4]
 
-	if id == 0 {
-		peer.Choking = 1
-		return
-	} else if id == 1 {
-		peer.Choking = 0
-		return
-	} else if id == 2 {
-		peer.Interested = 1
-		return
-	} else if id == 3 {
-		peer.Interested = 0
-		return
-	} else if id == 4 {
-		peer.updateBitfield(msg)
-		return
-	} else if id == 5 {
-		peer.processBitfield(msg)
-		return
-	} else if id == 6 {
-		peer.processRequest(msg)
+	infoHash := handshake.InfoHash[:]
+
+	torrent := clientState.torrentFor(infoHash)
+	if torrent == nil {
+		fmt.Printf("Peer %s asked for unknown torrent %x \n", c.RemoteAddr().String(), infoHash)
+		c.Close()
 		return
-	} else if id == 7 {
-		peer.torrent.processBlock(msg)
+	}
+
+	if torrent.isBanned(c.RemoteAddr().String()) {
+		c.Close()
 		return
-	} else if id == 8 {
+	}
+
+	err = checkHandshake(handshake, infoHash)
+	if err != nil {
+		fmt.Printf("Handshake with %s failed: %s \n", c.RemoteAddr().String(), err.Error())
+		c.Close()
 		return
 	}
-}
 
-func processHandshake(c net.Conn) {
+	peer := &Peer{
+		address:  c.RemoteAddr().String(),
+		infoHash: append([]byte(nil), infoHash...),
+		torrent:  torrent,
+	}
+	torrent.mu.Lock()
+	duplicate := torrent.hasLivePeer(string(handshake.PeerID[:]))
+	torrent.mu.Unlock()
 
-	rdr := bufio.NewReader(c)
-	handshakeMsg := make([]byte, 68)
+	if duplicate {
+		fmt.Printf("Already connected to peer %x \n", handshake.PeerID)
+		c.Close()
+		return
+	}
 
-	for {
-		n, err := rdr.Read(handshakeMsg)
-		if err != nil {
-			fmt.Printf("Unable to read msg: %s \n", err.Error())
-			continue
-		}
+	peer.recordHandshake(handshake, c)
 
-		if n > 0 {
-			break
-		}
+	err = WriteHandshake(c, torrent.handshake(infoHash))
+	if err != nil {
+		fmt.Printf("Unable to answer handshake from %s: %s \n", c.RemoteAddr().String(), err.Error())
+		c.Close()
+		return
 	}
 
-	infoHash := handshakeMsg[28:48]
+	c.SetDeadline(time.Time{})
 
-	for _, torrent := range clientState.torrents {
-		if string(torrent.Hash) == string(infoHash) {
-			peer := Peer{
-				peerID: string(handshakeMsg[48:]),
-				conn:   &c,
-			}
-			torrent.Peers = append(torrent.Peers, peer)
-		}
+	if !peer.goLive(peer.sendBitfield()) {
+		fmt.Printf("Already connected to peer %x \n", handshake.PeerID)
+		c.Close()
+		return
+	}
+
+	peer.sendDHTPort()
+	if torrent.isV2() && peer.supportsV2() {
+		peer.requestMissingPieceLayers()
 	}
+	go peer.handlePeerConnection(c)
 }
-func (torrent *Torrent) processBlock(blkMsg []byte) {
+
+func (torrent *Torrent) processBlock(peer *Peer, blkMsg *PieceMessage) {
 	/*	piece: <len=0009+X><id=7><index><begin><block>
 
 		The piece message is variable length, where X is the length of the block. The payload contains the following information:
@@ -219,99 +464,71 @@ func (torrent *Torrent) processBlock(blkMsg []byte) {
 			begin: integer specifying the zero-based byte offset within the piece
 			block: block of data, which is a subset of the piece specified by index.
 	*/
-	length := int32(binary.BigEndian.Uint32(blkMsg[0:4]))
-	index := int32(binary.BigEndian.Uint32(blkMsg[5:9]))
-	begin := int32(binary.BigEndian.Uint32(blkMsg[9:13]))
-	blk := blkMsg[13:length]
-
-	/*	Iterate through the torrents pieces and find the one at the
-		given index. Once found, iterate through the blocks of that
-		piece until you find one with an offset that matches the given
-		'begin' value. Assign the blk data to that block. Every time the
-		function is called, compare the complete hash of the piece given
-		by the tracker and the current has of every block. If they equate,
-		say the piece is complete.
-	*/
-	for _, piece := range torrent.Pieces {
-		if piece.Index == int(index) {
-			var blocks []byte
-			for _, block := range piece.Blocks {
-				copy(blocks[(len(blocks)+1):], block.Data)
-				if block.Offset == int(begin) {
-					block.Data = blk
-				}
-			}
-			hash := sha1.New()
-			hash.Write(blocks)
-			if bytes.Compare(hash.Sum(nil), piece.Hash) == 0 {
-				var data []byte
-				for _, blk := range piece.Blocks {
-					copy(data[len(data):], blk.Data)
-				}
-				torrent.writeToFile(data, torrent.Data.Info.PieceLength*piece.Index)
-				piece.Complete = true
-			}
-			return
-		}
+	request := blockRequest{index: blkMsg.Index, begin: blkMsg.Begin, length: len(blkMsg.Block)}
+
+	torrent.mu.Lock()
+	torrent.forgetRequest(peer, request)
+	// In endgame other peers may have been asked for the same block
+	outgoing := torrent.cancelDuplicates(request)
+	if torrent.receiveBlock(peer, blkMsg) {
+		outgoing = append(outgoing, torrent.announcePiece(blkMsg.Index)...)
 	}
-	fmt.Println("Block received not found compatible with any piece.")
-	return
-}
-
-// Assume a request has been sent only if the peer knows you have the piece (which should be the case in every situation.)
-func (peer *Peer) processRequest(reqMsg []byte) {
-	/*	request: <len=0013><id=6><index><begin><length>
-
-			The request message is fixed length, and is used to request a block. The payload contains the following information:
+	torrent.mu.Unlock()
 
-				index: integer specifying the zero-based piece index
-				begin: integer specifying the zero-based byte offset within the piece
-				length: integer specifying the requested length.
-
-		index := int32(binary.BigEndian.Uint32(reqMsg[5:9]))
-		begin := int32(binary.BigEndian.Uint32(reqMsg[9:13]))
-		length := int32(binary.BigEndian.Uint32(reqMsg[13:17]))
-
-		var blk []byte
-		for _, piece := range torrent.Pieces {
-			if piece.Index == int(index) {
-				for _, block := range piece.Blocks {
-					if block.Offset == int(begin) {
-						blk = block.Data[:int(length)]
-						break
-					}
-				}
+	for _, out := range outgoing {
+		out.peer.send(out.msg)
+	}
+	torrent.wakeUp()
+}
 
-			}
-		}
-		var reply []byte
+// receiveBlock stores the data of a block, and completes its piece once it was the last block missing.
+// It reports whether that completed the piece.
+func (torrent *Torrent) receiveBlock(peer *Peer, blkMsg *PieceMessage) bool {
+	/*	Find the block of the piece at the given index that starts at
+		the given 'begin' value and assign the data to it. Once every
+		block of the piece is in, the piece is assembled and checked
+		against its hash.
+	*/
+	block := torrent.block(blkMsg.Index, blkMsg.Begin)
+	if block == nil || block.Length != len(blkMsg.Block) {
+		fmt.Println("Block received not found compatible with any piece.")
+		return false
+	}
 
-		binary.BigEndian.PutUint32(reply[0:], uint32(9+len(blk)))
-		reply[4] = 7
-		copy(reply[5:9], reqMsg[5:9])
-		copy(reply[9:13], reqMsg[9:13])
-		copy(reply[13:17], reqMsg[13:17])
-		copy(reply[17:], blk)
+	piece := &torrent.Pieces[blkMsg.Index]
+	if torrent.have.Test(piece.Index) || block.Data != nil {
+		// We already have this block
+		return false
+	}
 
-		return reply
-	*/
+	block.Data = blkMsg.Block
+	block.peer = peer
+	peer.downloaded += int64(len(blkMsg.Block))
+	torrent.downloaded += int64(len(blkMsg.Block))
+	peer.lastBlock = time.Now()
 
+	return piece.hasAllBlocks() && torrent.completePiece(piece)
 }
 
-func (peer *Peer) processHave(haveMsg []byte) {
+func (peer *Peer) processHave(haveMsg *HaveMessage) {
 	/*	have: <len=0005><id=4><piece index>
 
 		The have message is fixed length. The payload is the zero-based index of a piece that has just been
 		successfully downloaded and verified via the hash.
 	*/
 
-	index := int32(binary.BigEndian.Uint32(haveMsg[5:9]))
 	// Update the specified index in the peers bitfield to say they have the piece.
-	peer.Bitfield[index] = 1
+	if haveMsg.Index < 0 || haveMsg.Index >= len(peer.torrent.Pieces) {
+		return
+	}
+	if !peer.Bitfield.Test(haveMsg.Index) {
+		peer.Bitfield.Set(haveMsg.Index)
+		peer.torrent.picker.addHave(haveMsg.Index)
+	}
 
 }
 
-func (peer *Peer) processBitfield(bfieldMsg []byte) {
+func (peer *Peer) processBitfield(bfieldMsg *BitfieldMessage) error {
 	/*	bitfield: <len=0001+X><id=5><bitfield>
 
 		The bitfield message may only be sent immediately after the handshaking sequence is completed, and before any
@@ -327,61 +544,32 @@ func (peer *Peer) processBitfield(bfieldMsg []byte) {
 		lazy bitfield.
 	*/
 
-	peer.Bitfield = getBitsFromByteSlice(bfieldMsg[5:])
+	bitfield, err := DecodeBitset(bfieldMsg.Bitfield, len(peer.torrent.Pieces))
+	if err != nil {
+		return err
+	}
 
-}
+	peer.torrent.picker.removeBitfield(&peer.Bitfield)
+	peer.Bitfield = bitfield
+	peer.torrent.picker.addBitfield(&peer.Bitfield)
 
-func (peer *Peer) updateBitfield(bfieldMsg []byte) {
+	return nil
 
 }
 
-func (torrent *Torrent) processCancel(cancelMessage []byte) {
+func (peer *Peer) processCancel(cancelMessage *CancelMessage) {
 	/*	cancel: <len=0013><id=8><index><begin><length>
 
 		The cancel message is fixed length, and is used to cancel block requests. The payload is identical to that of the
 		"request" message. It is typically used during "End Game" (see the Algorithms section below).
 	*/
-	return
-}
+	cancelled := blockRequest{index: cancelMessage.Index, begin: cancelMessage.Begin, length: cancelMessage.Length}
 
-// This whole function might be a waste of time... review.
-func (peer *Peer) waitForUnchoke(conn *net.TCPConn, choking chan []byte) {
-	ticker := time.NewTicker(115 * time.Second)
-	defer ticker.Stop()
-Loop:
-	for {
-		// peer is currently choking us. Loop until it's ready, sending occassional keep alives.
-		select {
-		case <-ticker.C:
-			sendMessage([]byte{keepAlive}, conn)
-		case chkMsg := <-choking:
-			if chkMsg[0] == 1 {
-				// unchoked. Start processing again.
-				break Loop
-			}
-		default:
-			continue
-		}
-	}
-
-	return
-}
-
-func createRequest(piece *Piece) []byte {
-	// request: <len=0013><id=6><index><begin><length>
-	request := make([]byte, 17)
-	binary.BigEndian.PutUint32(request[:4], uint32(13))
-	copy(request[4:], string(6))
-	binary.BigEndian.PutUint32(request[5:9], uint32(piece.Index))
-
-	for _, blk := range piece.Blocks {
-		if len(blk.Data) == 0 {
-			binary.BigEndian.PutUint32(request[9:13], uint32(blk.Offset))
-			break
+	// Drop the request from the upload queue if it hasn't been answered yet
+	for i, request := range peer.uploads {
+		if request == cancelled {
+			peer.uploads = append(peer.uploads[:i], peer.uploads[i+1:]...)
+			return
 		}
 	}
-
-	binary.BigEndian.PutUint32(request[13:17], uint32(16384))
-
-	return request
 }
@@ -0,0 +1,230 @@
+package client
+
+import (
+	"bytes"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestPeer listens for a peer connection and answers the handshake with the given one, returning
+// the address it listens on
+func newTestPeer(t *testing.T, reply *Handshake) string {
+	t.Helper()
+
+	return listenTestPeer(t, "127.0.0.1:0", reply)
+}
+
+// listenTestPeer is a newTestPeer listening on the address, e.g. one over IPv6
+func listenTestPeer(t *testing.T, address string, reply *Handshake) string {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		_, err = ReadHandshake(conn)
+		if err != nil {
+			return
+		}
+		WriteHandshake(conn, reply)
+	}()
+
+	return listener.Addr().String()
+}
+
+func TestHandshakeChecksTrackerPeerID(t *testing.T) {
+	torrent := newTestTorrent(t, make([]byte, 3*blockSize), NewMemoryStorage())
+
+	reply := newHandshake(torrent.Hash)
+	copy(reply.PeerID[:], "-XX0001-000000000001")
+	address := newTestPeer(t, reply)
+
+	torrent.addPeers([]string{address}, map[string]string{address: "-XX0001-000000000002"}, torrent.Hash)
+	if len(torrent.Peers) != 1 || torrent.Peers[0].peerID != "-XX0001-000000000002" {
+		t.Fatalf("peers are %+v, want the one with the tracker's peer id", torrent.Peers)
+	}
+
+	peer := torrent.Peers[0]
+	_, err := peer.initiateConnection(torrent.Hash)
+	if err == nil || !strings.Contains(err.Error(), "different peer id") {
+		t.Fatalf("got error %v, want the handshake with another peer id rejected", err)
+	}
+}
+
+func TestHandshakeRoundTrip(t *testing.T) {
+	handshake := newHandshake([]byte("-infohash-infohash--"))
+	handshake.Reserved[5] = extensionProtocolBit
+	handshake.Reserved[7] = dhtBit | fastBit
+
+	data := handshake.serialize()
+	if len(data) != 68 || data[0] != 19 || string(data[1:20]) != protocolIdentifier {
+		t.Fatalf("serialized handshake is %q", data)
+	}
+
+	read, err := ReadHandshake(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(read, handshake) {
+		t.Fatalf("read %+v, want %+v", read, handshake)
+	}
+}
+
+func TestReadHandshakeErrors(t *testing.T) {
+	valid := newHandshake([]byte("-infohash-infohash--")).serialize()
+
+	otherProtocol := append([]byte(nil), valid...)
+	copy(otherProtocol[1:], "BitTorrent protocoL")
+
+	cases := map[string][]byte{
+		"empty":            nil,
+		"other length":     append([]byte{18}, valid[1:]...),
+		"other protocol":   otherProtocol,
+		"truncated":        valid[:67],
+		"only the pstrlen": valid[:1],
+	}
+	for name, data := range cases {
+		_, err := ReadHandshake(bytes.NewReader(data))
+		if err == nil {
+			t.Errorf("%s: handshake was read", name)
+		}
+	}
+}
+
+func TestCheckHandshake(t *testing.T) {
+	infoHash := []byte("-infohash-infohash--")
+
+	other := newHandshake(infoHash)
+	copy(other.PeerID[:], "-XX0001-000000000001")
+	if err := checkHandshake(other, infoHash); err != nil {
+		t.Fatalf("handshake of another peer for the torrent: %s", err)
+	}
+
+	if err := checkHandshake(other, []byte("-otherhash-otherhash")); err == nil || !strings.Contains(err.Error(), "info-hash") {
+		t.Errorf("got error %v for a handshake for another torrent", err)
+	}
+
+	// Our own handshake means we connected to ourselves
+	if err := checkHandshake(newHandshake(infoHash), infoHash); err != errSelfConnection {
+		t.Errorf("got error %v for our own handshake, want %v", err, errSelfConnection)
+	}
+}
+
+func TestInitiateConnectionChecksHandshake(t *testing.T) {
+	torrent := newTestTorrent(t, make([]byte, 3*blockSize), NewMemoryStorage())
+
+	wrongHash := newHandshake([]byte("-otherhash-otherhash"))
+	copy(wrongHash.PeerID[:], "-XX0001-000000000001")
+	ourselves := newHandshake(torrent.Hash)
+
+	for name, reply := range map[string]*Handshake{"wrong info-hash": wrongHash, "ourselves": ourselves} {
+		peer := &Peer{address: newTestPeer(t, reply), torrent: torrent}
+		conn, err := peer.initiateConnection(torrent.Hash)
+		if err == nil {
+			conn.Close()
+			t.Errorf("%s: handshake was accepted", name)
+		}
+		torrent.mu.Lock()
+		live := torrent.hasLivePeer(string(reply.PeerID[:]))
+		torrent.mu.Unlock()
+		if live {
+			t.Errorf("%s: peer went live", name)
+		}
+	}
+}
+
+// connectTo hands processHandshake one end of a pipe, sends the handshake down the other end and returns
+// the handshake we answer with, if any
+func connectTo(t *testing.T, handshake *Handshake) *Handshake {
+	t.Helper()
+
+	ours, theirs := net.Pipe()
+	t.Cleanup(func() { theirs.Close() })
+	go processHandshake(ours)
+
+	err := WriteHandshake(theirs, handshake)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	theirs.SetDeadline(time.Now().Add(time.Second))
+	reply, err := ReadHandshake(theirs)
+	if err != nil {
+		return nil
+	}
+
+	return reply
+}
+
+func TestProcessHandshake(t *testing.T) {
+	torrent := newTestTorrent(t, make([]byte, 3*blockSize), NewMemoryStorage())
+	clientState.addTorrent(torrent)
+	t.Cleanup(func() {
+		clientState.mu.Lock()
+		clientState.torrents = nil
+		clientState.mu.Unlock()
+	})
+
+	// Peers asking for a torrent we don't have, or claiming to be us, are hung up on without an answer
+	unknown := newHandshake([]byte("-otherhash-otherhash"))
+	copy(unknown.PeerID[:], "-XX0001-000000000001")
+	if reply := connectTo(t, unknown); reply != nil {
+		t.Errorf("got handshake %+v for a torrent we don't have", reply)
+	}
+	if reply := connectTo(t, newHandshake(torrent.Hash)); reply != nil {
+		t.Errorf("got handshake %+v for our own peer id", reply)
+	}
+
+	known := newHandshake(torrent.Hash)
+	copy(known.PeerID[:], "-XX0001-000000000001")
+	reply := connectTo(t, known)
+	if reply == nil {
+		t.Fatal("handshake for the torrent went unanswered")
+	}
+	if !bytes.Equal(reply.InfoHash[:], torrent.Hash) || !bytes.Equal(reply.PeerID[:], MyPeerID) {
+		t.Fatalf("answered with info-hash %x and peer id %q", reply.InfoHash, reply.PeerID)
+	}
+}
+
+func TestConnectIPv6Peer(t *testing.T) {
+	torrent := newTestTorrent(t, make([]byte, 3*blockSize), NewMemoryStorage())
+	reply := newHandshake(torrent.Hash)
+	copy(reply.PeerID[:], "-XX0001-000000000001")
+	address := listenTestPeer(t, "[::1]:0", reply)
+
+	torrent.AddPeers([]string{address})
+	if len(torrent.Peers) != 1 || torrent.Peers[0].address != address {
+		t.Fatalf("peers are %+v, want the one at %s", torrent.Peers, address)
+	}
+
+	peer := torrent.Peers[0]
+	conn, err := peer.initiateConnection(torrent.Hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	torrent.mu.Lock()
+	live := torrent.hasLivePeer(string(reply.PeerID[:]))
+	torrent.mu.Unlock()
+	if !live {
+		t.Fatal("peer at an IPv6 address didn't go live")
+	}
+
+	// Peers are banned by the address without the port, IPv6 ones included
+	if ip := peerIP("[2001:db8::1]:51413"); ip != "2001:db8::1" {
+		t.Fatalf("IP address of an IPv6 peer is %s", ip)
+	}
+}
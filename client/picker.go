@@ -0,0 +1,168 @@
+package client
+
+// Will handle choosing which piece to download next: rarest first, with file priorities taken into account
+
+import (
+	"errors"
+	"math/rand"
+	"time"
+)
+
+// File priorities. Pieces of higher priority files are downloaded first, and files with PriorityNone not at all.
+const (
+	PriorityNone   = 0
+	PriorityNormal = 1
+	PriorityHigh   = 2
+)
+
+// A piecePicker keeps track of how many peers have every piece, and what priority every piece has
+type piecePicker struct {
+	availability []int // connected peers that have the piece
+	priorities   []int // highest priority of the files the piece holds data of
+	random       *rand.Rand
+}
+
+func newPiecePicker(pieces int) *piecePicker {
+	picker := piecePicker{
+		availability: make([]int, pieces),
+		priorities:   make([]int, pieces),
+		random:       rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+
+	for i := range picker.priorities {
+		picker.priorities[i] = PriorityNormal
+	}
+
+	return &picker
+}
+
+// addBitfield counts the pieces of a peer's bitfield as available
+func (picker *piecePicker) addBitfield(bitfield *Bitset) {
+	bitfield.Iterate(func(i int) bool {
+		if i < len(picker.availability) {
+			picker.availability[i]++
+		}
+		return true
+	})
+}
+
+// removeBitfield stops counting the pieces of a peer's bitfield, after it went away or sent a new one
+func (picker *piecePicker) removeBitfield(bitfield *Bitset) {
+	bitfield.Iterate(func(i int) bool {
+		if i < len(picker.availability) {
+			picker.availability[i]--
+		}
+		return true
+	})
+}
+
+// addHave counts a piece a peer announced with a have message
+func (picker *piecePicker) addHave(index int) {
+	if index >= 0 && index < len(picker.availability) {
+		picker.availability[index]++
+	}
+}
+
+// wanted reports whether the piece belongs to a file we want to download
+func (picker *piecePicker) wanted(index int) bool {
+	return picker.priorities[index] > PriorityNone
+}
+
+// pick chooses among the pieces candidate accepts: the highest priority first, then the rarest,
+// with ties broken at random. In random mode availability is ignored, which gets us a first
+// complete piece to share sooner than waiting on the rarest ones.
+// It returns -1 if there is no candidate.
+func (picker *piecePicker) pick(candidate func(index int) bool, random bool) int {
+	best := -1
+	ties := 0
+
+	for i := range picker.availability {
+		if !picker.wanted(i) || !candidate(i) {
+			continue
+		}
+
+		if best == -1 {
+			best, ties = i, 1
+			continue
+		}
+
+		switch picker.compare(i, best, random) {
+		case -1:
+			best, ties = i, 1
+		case 0:
+			// Every piece that ties gets an equal chance of being picked
+			ties++
+			if picker.random.Intn(ties) == 0 {
+				best = i
+			}
+		}
+	}
+
+	return best
+}
+
+// compare returns -1 if piece a should be picked before piece b, 1 if after, and 0 if either will do
+func (picker *piecePicker) compare(a, b int, random bool) int {
+	if picker.priorities[a] != picker.priorities[b] {
+		if picker.priorities[a] > picker.priorities[b] {
+			return -1
+		}
+		return 1
+	}
+
+	if random || picker.availability[a] == picker.availability[b] {
+		return 0
+	}
+
+	if picker.availability[a] < picker.availability[b] {
+		return -1
+	}
+	return 1
+}
+
+// SetFilePriority sets the priority of a file of the torrent. index is the position of the file in
+// Data.Info.Files, or 0 for a single-file torrent. Pieces shared by several files get the highest priority among them.
+func (torrent *Torrent) SetFilePriority(index int, priority int) error {
+	torrent.mu.Lock()
+	defer torrent.mu.Unlock()
+
+	files := torrent.Data.Info.Files
+	if len(files) == 0 {
+		files = []File{{Length: torrent.Data.Info.Length}}
+	}
+
+	if index < 0 || index >= len(files) {
+		return errors.New("file index out of range")
+	}
+
+	if priority < PriorityNone || priority > PriorityHigh {
+		return errors.New("invalid file priority")
+	}
+
+	if torrent.filePriorities == nil {
+		torrent.filePriorities = make([]int, len(files))
+		for i := range torrent.filePriorities {
+			torrent.filePriorities[i] = PriorityNormal
+		}
+	}
+	torrent.filePriorities[index] = priority
+
+	for i := range torrent.picker.priorities {
+		torrent.picker.priorities[i] = PriorityNone
+	}
+
+	pieceLength := torrent.Data.Info.PieceLength
+	offset := 0
+	for i, file := range files {
+		if file.Length > 0 && !isPaddingFile(file) {
+			for p := offset / pieceLength; p <= (offset+file.Length-1)/pieceLength && p < len(torrent.picker.priorities); p++ {
+				if torrent.filePriorities[i] > torrent.picker.priorities[p] {
+					torrent.picker.priorities[p] = torrent.filePriorities[i]
+				}
+			}
+		}
+		offset += file.Length
+	}
+
+	return nil
+}
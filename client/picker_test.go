@@ -0,0 +1,165 @@
+package client
+
+import (
+	"testing"
+	"time"
+)
+
+// newTestSwarm sets up a torrent with pieces of the given amount of blocks, and a live peer for every
+// bitfield, which lists with 1 and 0 which pieces the peer has
+func newTestSwarm(blocks int, bitfields ...[]int) (*Torrent, []*Peer) {
+	pieces := len(bitfields[0])
+	torrent := &Torrent{
+		Pieces: make([]Piece, pieces),
+		picker: newPiecePicker(pieces),
+		have:   NewBitset(pieces),
+	}
+
+	for i := range torrent.Pieces {
+		piece := &torrent.Pieces[i]
+		piece.Index = i
+		piece.Hash = make([]byte, 20)
+		piece.Length = blocks * blockSize
+		for j := 0; j < blocks; j++ {
+			piece.Blocks = append(piece.Blocks, Block{Offset: j * blockSize, Length: blockSize})
+		}
+	}
+
+	var peers []*Peer
+	for _, bitfield := range bitfields {
+		peer := &Peer{torrent: torrent, Bitfield: NewBitset(pieces), requests: map[blockRequest]time.Time{}}
+		for i, has := range bitfield {
+			if has == 1 {
+				peer.Bitfield.Set(i)
+			}
+		}
+		torrent.picker.addBitfield(&peer.Bitfield)
+		torrent.livePeers = append(torrent.livePeers, peer)
+		peers = append(peers, peer)
+	}
+
+	return torrent, peers
+}
+
+func anyPiece(int) bool { return true }
+
+func TestPickRarestFirst(t *testing.T) {
+	// Pieces 1 and 4 are the rarest, with one peer having them
+	torrent, _ := newTestSwarm(1,
+		[]int{1, 1, 1, 1, 1, 1},
+		[]int{1, 0, 1, 1, 0, 1},
+		[]int{1, 0, 1, 0, 0, 1},
+	)
+	picker := torrent.picker
+
+	picked := map[int]int{}
+	for i := 0; i < 1000; i++ {
+		picked[picker.pick(anyPiece, false)]++
+	}
+	if len(picked) != 2 || picked[1] < 300 || picked[4] < 300 {
+		t.Fatalf("picked %v, want pieces 1 and 4 about equally often", picked)
+	}
+
+	// A have message makes piece 4 more common than piece 1
+	picker.addHave(4)
+	if index := picker.pick(anyPiece, false); index != 1 {
+		t.Fatalf("picked piece %v, want 1", index)
+	}
+
+	// Priority comes before rarity
+	picker.priorities[5] = PriorityHigh
+	if index := picker.pick(anyPiece, false); index != 5 {
+		t.Fatalf("picked piece %v, want the high priority piece 5", index)
+	}
+	picker.priorities[5] = PriorityNone
+	picker.priorities[1] = PriorityNone
+	if index := picker.pick(anyPiece, false); index != 3 && index != 4 {
+		t.Fatalf("picked piece %v, want 3 or 4 with pieces 1 and 5 unwanted", index)
+	}
+
+	if index := picker.pick(func(int) bool { return false }, false); index != -1 {
+		t.Fatalf("picked piece %v without candidates", index)
+	}
+}
+
+func TestPickRandomFirst(t *testing.T) {
+	torrent, _ := newTestSwarm(1,
+		[]int{1, 1, 1, 1, 1, 1},
+		[]int{1, 0, 1, 1, 0, 1},
+		[]int{1, 0, 1, 0, 0, 1},
+	)
+
+	picked := map[int]int{}
+	for i := 0; i < 6000; i++ {
+		picked[torrent.picker.pick(anyPiece, true)]++
+	}
+	for i := 0; i < 6; i++ {
+		if picked[i] < 500 {
+			t.Fatalf("picked %v, want every piece about equally often", picked)
+		}
+	}
+}
+
+func TestNextRequestRandomFirstPieces(t *testing.T) {
+	bitfields := [][]int{
+		{1, 1, 1, 1, 1, 1, 1, 1},
+		{1, 1, 1, 1, 1, 1, 1, 0},
+	}
+
+	// Until we have Settings.RandomFirstPieces, any piece will do
+	picked := map[int]bool{}
+	for i := 0; i < 200; i++ {
+		torrent, peers := newTestSwarm(1, bitfields...)
+		request, ok := torrent.nextRequest(peers[0])
+		if !ok {
+			t.Fatal("no request for a peer with every piece")
+		}
+		picked[request.index] = true
+	}
+	if len(picked) < 2 {
+		t.Fatalf("picked only pieces %v for the first piece", picked)
+	}
+
+	// After that the rarest goes first
+	for i := 0; i < 50; i++ {
+		torrent, peers := newTestSwarm(1, bitfields...)
+		for index := 0; index < Settings.RandomFirstPieces; index++ {
+			torrent.have.Set(index)
+		}
+		request, ok := torrent.nextRequest(peers[0])
+		if !ok || request.index != 7 {
+			t.Fatalf("requested %v, want the rarest piece 7", request)
+		}
+	}
+}
+
+func TestNextRequestFinishesStartedPieces(t *testing.T) {
+	torrent, peers := newTestSwarm(3,
+		[]int{1, 1, 1, 1},
+		[]int{1, 0, 1, 0},
+	)
+
+	// Piece 1 was started, so it is finished before another piece is picked
+	torrent.Pieces[1].Blocks[0].Data = make([]byte, blockSize)
+	requests := torrent.fillPipeline(peers[0], time.Now(), false)
+
+	want := []blockRequest{
+		{index: 1, begin: blockSize, length: blockSize},
+		{index: 1, begin: 2 * blockSize, length: blockSize},
+	}
+	if len(requests) < len(want) {
+		t.Fatalf("requests are %v", requests)
+	}
+	for i := range want {
+		if requests[i] != want[i] {
+			t.Fatalf("requests start with %v, want %v", requests[:len(want)], want)
+		}
+	}
+
+	// A peer without the started piece gets a new one
+	torrent.releaseRequests(peers[0])
+	request, ok := torrent.nextRequest(peers[1])
+	if !ok || request.index == 1 {
+		t.Fatalf("requested %v from a peer without the started piece", request)
+	}
+}
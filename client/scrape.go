@@ -0,0 +1,232 @@
+package client
+
+// Will handle scraping trackers for the state of swarms, without joining them
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/zeebo/bencode"
+)
+
+const (
+	maxUDPScrapeHashes  = 74          // info-hashes that fit in one UDP scrape (BEP 15)
+	maxHTTPScrapeHashes = 50          // info-hashes per HTTP scrape, which keeps the URL a sane length
+	udpScrapeTimeout    = time.Minute // a scrape isn't worth the hour of retransmits an announce may wait
+)
+
+// A ScrapeResult is the state of the swarm of one info-hash, as a tracker sees it
+type ScrapeResult struct {
+	InfoHash  []byte
+	Seeders   int
+	Completed int // peers that ever finished downloading
+	Leechers  int
+}
+
+// The scrapeResponse an HTTP tracker sends
+type scrapeResponse struct {
+	FailureReason string                `bencode:"failure reason,omitempty"`
+	Files         map[string]scrapeFile `bencode:"files"` // by binary info-hash
+}
+
+type scrapeFile struct {
+	Complete   int `bencode:"complete"`
+	Downloaded int `bencode:"downloaded"`
+	Incomplete int `bencode:"incomplete"`
+}
+
+// Scrape asks the tracker at the announce URL about the swarms of the info-hashes, as many in every
+// request as the protocol allows. Info-hashes an HTTP tracker doesn't know are left out of the results.
+func Scrape(tracker string, infoHashes [][]byte) ([]ScrapeResult, error) {
+	u, err := url.Parse(tracker)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse url: %s", err.Error())
+	}
+
+	batchSize := maxHTTPScrapeHashes
+	if u.Scheme == "udp" {
+		batchSize = maxUDPScrapeHashes
+	}
+
+	var results []ScrapeResult
+	for start := 0; start < len(infoHashes); start += batchSize {
+		end := start + batchSize
+		if end > len(infoHashes) {
+			end = len(infoHashes)
+		}
+
+		var batch []ScrapeResult
+		switch u.Scheme {
+		case "udp":
+			batch, err = scrapeUDP(u.Host, infoHashes[start:end])
+		case "http", "https":
+			batch, err = scrapeHTTP(u, infoHashes[start:end])
+		default:
+			return nil, fmt.Errorf("unsupported tracker protocol %q", u.Scheme)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		results = append(results, batch...)
+	}
+
+	return results, nil
+}
+
+func scrapeUDP(address string, infoHashes [][]byte) ([]ScrapeResult, error) {
+	raddr, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve provided udp address: %s", err.Error())
+	}
+
+	/*
+		Offset          Size            Name            Value
+		0               64-bit integer  connection_id
+		8               32-bit integer  action          2 // scrape
+		12              32-bit integer  transaction_id
+		16 + 20 * n     20-byte string  info_hash
+		16 + 20 * N
+	*/
+	payload := make([]byte, 20*len(infoHashes))
+	for i, infoHash := range infoHashes {
+		copy(payload[20*i:], infoHash)
+	}
+
+	response, err := udpTrackers.transact(raddr, udpScrape, payload, expireAfter(udpScrapeTimeout))
+	if err == errAnnounceCancelled {
+		return nil, errUDPTimeout
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	/*
+		Offset      Size            Name            Value
+		0           32-bit integer  action          2 // scrape
+		4           32-bit integer  transaction_id
+		8 + 12 * n  32-bit integer  seeders
+		12 + 12 * n 32-bit integer  completed
+		16 + 12 * n 32-bit integer  leechers
+		8 + 12 * N
+	*/
+	if len(response) < 8+12*len(infoHashes) {
+		return nil, errors.New("tracker sent a truncated scrape response")
+	}
+
+	results := make([]ScrapeResult, len(infoHashes))
+	for i, infoHash := range infoHashes {
+		offset := 8 + 12*i
+		results[i] = ScrapeResult{
+			InfoHash:  infoHash,
+			Seeders:   int(int32(binary.BigEndian.Uint32(response[offset:]))),
+			Completed: int(int32(binary.BigEndian.Uint32(response[offset+4:]))),
+			Leechers:  int(int32(binary.BigEndian.Uint32(response[offset+8:]))),
+		}
+	}
+
+	return results, nil
+}
+
+func scrapeHTTP(announceURL *url.URL, infoHashes [][]byte) ([]ScrapeResult, error) {
+	scrapeURL, err := scrapeURLFor(announceURL)
+	if err != nil {
+		return nil, err
+	}
+
+	var query []string
+	if scrapeURL.RawQuery != "" {
+		query = append(query, scrapeURL.RawQuery)
+	}
+	for _, infoHash := range infoHashes {
+		query = append(query, "info_hash="+escapeBytes(infoHash))
+	}
+	scrapeURL.RawQuery = strings.Join(query, "&")
+
+	req, err := http.NewRequest(http.MethodGet, scrapeURL.String(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create scrape: %s", err.Error())
+	}
+	req.Header.Set("Accept-Encoding", "gzip")
+
+	response, err := httpTrackerClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("scrape of tracker failed: %s", err.Error())
+	}
+	defer response.Body.Close()
+
+	body, err := readTrackerBody(response)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read response body: %s", err.Error())
+	}
+
+	var scrape scrapeResponse
+	err = bencode.DecodeBytes(body, &scrape)
+	if err != nil {
+		if response.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("tracker answered with %s", response.Status)
+		}
+		return nil, fmt.Errorf("unable to decode scrape response: %s", err.Error())
+	}
+
+	if scrape.FailureReason != "" {
+		return nil, fmt.Errorf("tracker refused the scrape: %s", scrape.FailureReason)
+	}
+
+	var results []ScrapeResult
+	for _, infoHash := range infoHashes {
+		file, ok := scrape.Files[string(infoHash)]
+		if !ok {
+			continue
+		}
+
+		results = append(results, ScrapeResult{
+			InfoHash:  infoHash,
+			Seeders:   file.Complete,
+			Completed: file.Downloaded,
+			Leechers:  file.Incomplete,
+		})
+	}
+
+	return results, nil
+}
+
+// scrapeURLFor derives the scrape URL of an HTTP tracker from its announce URL. By convention, the last
+// part of the path starts with "announce", which is replaced by "scrape": /x/announce.php becomes /x/scrape.php.
+// Trackers whose announce URL doesn't follow the convention don't support scraping.
+func scrapeURLFor(announceURL *url.URL) (*url.URL, error) {
+	dir, last := path.Split(announceURL.Path)
+	if !strings.HasPrefix(last, "announce") {
+		return nil, errors.New("tracker doesn't support scraping")
+	}
+
+	scrapeURL := *announceURL
+	scrapeURL.Path = dir + "scrape" + strings.TrimPrefix(last, "announce")
+	scrapeURL.RawPath = ""
+
+	return &scrapeURL, nil
+}
+
+// Trackers returns the announce URLs of every tracker of the torrent
+func (info *MetaInfo) Trackers() []string {
+	if len(info.AnnounceList) == 0 {
+		if info.Announce == "" {
+			return nil
+		}
+		return []string{info.Announce}
+	}
+
+	var trackers []string
+	for _, tier := range info.AnnounceList {
+		trackers = append(trackers, tier...)
+	}
+
+	return trackers
+}
@@ -0,0 +1,181 @@
+package client
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+
+	"goTorrent/tracker"
+)
+
+func TestScrapeURLFor(t *testing.T) {
+	cases := []struct {
+		announce string
+		scrape   string // empty when the tracker can't be scraped
+	}{
+		{"http://tracker.example/announce", "http://tracker.example/scrape"},
+		{"http://tracker.example/x/announce", "http://tracker.example/x/scrape"},
+		{"http://tracker.example/x/announce.php", "http://tracker.example/x/scrape.php"},
+		{"https://tracker.example:8443/announce?passkey=abc", "https://tracker.example:8443/scrape?passkey=abc"},
+		{"http://tracker.example/a%20b/announce", "http://tracker.example/a%20b/scrape"},
+		{"http://tracker.example/a", ""},
+		{"http://tracker.example/announce/", ""},
+		{"http://tracker.example/x/announce.php/y", ""},
+		{"http://tracker.example/", ""},
+		{"http://tracker.example", ""},
+	}
+
+	for _, c := range cases {
+		u, err := url.Parse(c.announce)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		scrapeURL, err := scrapeURLFor(u)
+		if c.scrape == "" {
+			if err == nil {
+				t.Errorf("%s: scraped at %s, want it not scrapeable", c.announce, scrapeURL)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", c.announce, err)
+			continue
+		}
+		if scrapeURL.String() != c.scrape {
+			t.Errorf("%s: scraped at %s, want %s", c.announce, scrapeURL, c.scrape)
+		}
+		if u.String() != c.announce {
+			t.Errorf("%s: announce URL changed to %s", c.announce, u)
+		}
+	}
+}
+
+func TestScrapeHTTP(t *testing.T) {
+	var mu sync.Mutex
+	var paths []string
+	var batches []int
+	server := tracker.New(tracker.Config{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		paths = append(paths, r.URL.Path)
+		batches = append(batches, len(r.URL.Query()["info_hash"]))
+		mu.Unlock()
+		server.ServeHTTP(w, r)
+	}))
+	defer ts.Close()
+	announceURL := ts.URL + "/x/announce"
+
+	// One seeder and one leecher
+	seeder := testRequest()
+	seeder.PeerID = []byte("-XX0001-000000000001")
+	seeder.Left = 0
+	seeder.Event = started
+	leecher := testRequest()
+	leecher.Port = 6882
+	leecher.Event = started
+	for _, request := range []*TrackerRequest{seeder, leecher} {
+		_, err := request.announceHTTP(announceURL)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Enough info-hashes for two scrapes, of which only the first has peers
+	hashes := [][]byte{testRequest().InfoHash}
+	for i := 0; i < maxHTTPScrapeHashes; i++ {
+		hashes = append(hashes, bytes.Repeat([]byte{byte(i + 1)}, 20))
+	}
+
+	mu.Lock()
+	paths, batches = nil, nil
+	mu.Unlock()
+
+	results, err := Scrape(announceURL, hashes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != len(hashes) {
+		t.Fatalf("got %v results, want %v", len(results), len(hashes))
+	}
+	result := results[0]
+	if !bytes.Equal(result.InfoHash, hashes[0]) || result.Seeders != 1 || result.Leechers != 1 {
+		t.Errorf("got %+v, want one seeder and one leecher", result)
+	}
+	if last := results[len(results)-1]; !bytes.Equal(last.InfoHash, hashes[len(hashes)-1]) || last.Seeders != 0 || last.Leechers != 0 {
+		t.Errorf("got %+v for a swarm nobody joined", last)
+	}
+
+	// A private tracker leaves out the swarms it doesn't track
+	private := httptest.NewServer(tracker.New(tracker.Config{Whitelist: [][20]byte{{1}}}))
+	defer private.Close()
+	results, err = Scrape(private.URL+"/announce", hashes[:2])
+	if err != nil || len(results) != 0 {
+		t.Errorf("got %v and error %v from a tracker that knows none of the swarms", results, err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(batches) != 2 || batches[0] != maxHTTPScrapeHashes || batches[1] != 1 {
+		t.Errorf("info-hashes were scraped in batches of %v", batches)
+	}
+	for _, path := range paths {
+		if path != "/x/scrape" {
+			t.Errorf("scraped at %s", path)
+		}
+	}
+}
+
+func TestScrapeUDP(t *testing.T) {
+	server := newTestUDPTracker(t, tracker.Config{})
+	server.joinSwarm(t)
+
+	unknown := bytes.Repeat([]byte{1}, 20)
+	results, err := Scrape("udp://"+server.address(), [][]byte{testRequest().InfoHash, unknown})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// UDP answers for every info-hash, in the order they were asked about
+	if len(results) != 2 {
+		t.Fatalf("got %v results, want 2", len(results))
+	}
+	if !bytes.Equal(results[0].InfoHash, testRequest().InfoHash) || results[0].Leechers != 1 || results[0].Seeders != 0 {
+		t.Errorf("got %+v for the swarm that was joined, want one leecher", results[0])
+	}
+	if !bytes.Equal(results[1].InfoHash, unknown) || results[1].Leechers != 0 || results[1].Seeders != 0 {
+		t.Errorf("got %+v for a swarm nobody joined", results[1])
+	}
+}
+
+func TestScrapeUnsupported(t *testing.T) {
+	hashes := [][]byte{testRequest().InfoHash}
+
+	_, err := Scrape("http://tracker.example/tracker", hashes)
+	if err == nil || !strings.Contains(err.Error(), "doesn't support scraping") {
+		t.Errorf("got error %v for a tracker that can't be scraped", err)
+	}
+
+	_, err = Scrape("wss://tracker.example/announce", hashes)
+	if err == nil || !strings.Contains(err.Error(), "unsupported tracker protocol") {
+		t.Errorf("got error %v for an unknown protocol", err)
+	}
+}
+
+func TestSwarmHash(t *testing.T) {
+	v1 := newTestTorrent(t, make([]byte, 3*blockSize), NewMemoryStorage())
+	if !bytes.Equal(v1.Data.SwarmHash(), v1.Data.HashInfo()) || !bytes.Equal(v1.Hash, v1.Data.HashInfo()) {
+		t.Errorf("swarm hash of a v1 torrent is %x, want its info-hash %x", v1.Data.SwarmHash(), v1.Data.HashInfo())
+	}
+
+	meta := testV2MetaInfo(2*merkleBlockSize, testV2Files()...)
+	hash := meta.SwarmHash()
+	v2 := loadTestV2(t, meta)
+	if !bytes.Equal(hash, v2.HashV2[:20]) || !bytes.Equal(v2.Hash, v2.HashV2[:20]) {
+		t.Errorf("swarm hash of a v2-only torrent is %x, want the truncated v2 info-hash %x", hash, v2.HashV2[:20])
+	}
+}
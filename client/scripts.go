@@ -17,14 +17,3 @@ func convertIntToUint16(i int) uint16 {
 	rep16Int := int16(i)
 	return uint16(rep16Int)
 }
-
-// turns a slice of bytes into an int slice representation of inividual bits. Useful for bitfield evaluation.
-func getBitsFromByteSlice(bs []byte) []int {
-	r := make([]int, len(bs)*8)
-	for i, b := range bs {
-		for j := 0; j < 8; j++ {
-			r[i*8+j] = int(b >> uint(7-j) & 0x01)
-		}
-	}
-	return r
-}
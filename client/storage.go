@@ -0,0 +1,522 @@
+package client
+
+// Will handle storing piece data: the Storage interface and its file, blob and in-memory implementations
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Storage is where the data of torrents is kept. It is asked once per torrent for the TorrentStorage holding its pieces.
+type Storage interface {
+	OpenTorrent(info *InfoDictionary, infoHash []byte) (TorrentStorage, error)
+}
+
+// A TorrentStorage holds the pieces of a single torrent
+type TorrentStorage interface {
+	Piece(piece *Piece) PieceStorage
+	Close() error
+}
+
+// A PieceStorage reads and writes the data of one piece. Offsets are relative to the start of the piece.
+// A piece is marked complete once its data has been verified against its hash.
+type PieceStorage interface {
+	io.ReaderAt
+	io.WriterAt
+	MarkComplete() error
+	Completed() bool
+}
+
+// NewFileStorage stores torrents the usual way: in the file(s) of their info dictionary, under dir
+func NewFileStorage(dir string) Storage {
+	return fileStorage{dir: dir}
+}
+
+// NewBlobStorage stores every torrent in a single file under dir, named after its info-hash and preallocated to its full size
+func NewBlobStorage(dir string) Storage {
+	return blobStorage{dir: dir}
+}
+
+// NewMemoryStorage keeps torrents in memory. Nothing touches the disk, which makes it useful for tests.
+func NewMemoryStorage() Storage {
+	return &memoryStorage{torrents: map[string]*torrentMemory{}}
+}
+
+type fileStorage struct {
+	dir string
+}
+
+func (storage fileStorage) OpenTorrent(info *InfoDictionary, infoHash []byte) (TorrentStorage, error) {
+	return newTorrentFiles(storage.dir, info)
+}
+
+// pieceCompletion remembers which pieces of a torrent have been verified
+type pieceCompletion struct {
+	mu       sync.Mutex
+	complete map[int]bool
+}
+
+func (completion *pieceCompletion) mark(index int) {
+	completion.mu.Lock()
+	defer completion.mu.Unlock()
+
+	if completion.complete == nil {
+		completion.complete = map[int]bool{}
+	}
+	completion.complete[index] = true
+}
+
+func (completion *pieceCompletion) completed(index int) bool {
+	completion.mu.Lock()
+	defer completion.mu.Unlock()
+
+	return completion.complete[index]
+}
+
+// A storagePiece is a piece of a torrent whose data is laid out as one torrent-global stream of bytes
+type storagePiece struct {
+	stream     readerWriterAt
+	offset     int64 // torrent-global offset of the piece's first byte
+	length     int64
+	index      int
+	completion *pieceCompletion
+}
+
+type readerWriterAt interface {
+	io.ReaderAt
+	io.WriterAt
+}
+
+// globalPiece places the piece on the torrent-global stream, at its index times the piece length
+func globalPiece(stream readerWriterAt, info *InfoDictionary, piece *Piece, completion *pieceCompletion) PieceStorage {
+	return &storagePiece{
+		stream:     stream,
+		offset:     int64(piece.Index) * int64(info.PieceLength),
+		length:     int64(piece.Length),
+		index:      piece.Index,
+		completion: completion,
+	}
+}
+
+func (piece *storagePiece) ReadAt(data []byte, offset int64) (int, error) {
+	if offset < 0 || offset+int64(len(data)) > piece.length {
+		return 0, fmt.Errorf("range %v-%v is outside of piece %v", offset, offset+int64(len(data)), piece.index)
+	}
+
+	return piece.stream.ReadAt(data, piece.offset+offset)
+}
+
+func (piece *storagePiece) WriteAt(data []byte, offset int64) (int, error) {
+	if offset < 0 || offset+int64(len(data)) > piece.length {
+		return 0, fmt.Errorf("range %v-%v is outside of piece %v", offset, offset+int64(len(data)), piece.index)
+	}
+
+	return piece.stream.WriteAt(data, piece.offset+offset)
+}
+
+func (piece *storagePiece) MarkComplete() error {
+	piece.completion.mark(piece.index)
+	return nil
+}
+
+func (piece *storagePiece) Completed() bool {
+	return piece.completion.completed(piece.index)
+}
+
+type blobStorage struct {
+	dir string
+}
+
+// torrentBlob is a torrent stored in one preallocated file
+type torrentBlob struct {
+	file       *os.File
+	info       *InfoDictionary
+	completion pieceCompletion
+}
+
+func (storage blobStorage) OpenTorrent(info *InfoDictionary, infoHash []byte) (TorrentStorage, error) {
+	err := os.MkdirAll(storage.dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.OpenFile(filepath.Join(storage.dir, hex.EncodeToString(infoHash)), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	err = file.Truncate(int64(info.TotalLength()))
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return &torrentBlob{file: file, info: info}, nil
+}
+
+func (blob *torrentBlob) Piece(piece *Piece) PieceStorage {
+	return globalPiece(blob.file, blob.info, piece, &blob.completion)
+}
+
+func (blob *torrentBlob) Close() error {
+	return blob.file.Close()
+}
+
+// memoryStorage keeps the torrents it opened, so a torrent that is opened again finds its pieces
+type memoryStorage struct {
+	mu       sync.Mutex
+	torrents map[string]*torrentMemory
+}
+
+// torrentMemory is a torrent kept in memory. Pieces are only allocated once they are written to.
+type torrentMemory struct {
+	mu         sync.Mutex
+	pieces     map[int][]byte
+	completion pieceCompletion
+}
+
+// A memoryPiece is a single piece of a torrent kept in memory
+type memoryPiece struct {
+	torrent *torrentMemory
+	index   int
+	length  int
+}
+
+func (storage *memoryStorage) OpenTorrent(info *InfoDictionary, infoHash []byte) (TorrentStorage, error) {
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+
+	torrent, ok := storage.torrents[string(infoHash)]
+	if !ok {
+		torrent = &torrentMemory{pieces: map[int][]byte{}}
+		storage.torrents[string(infoHash)] = torrent
+	}
+
+	return torrent, nil
+}
+
+func (torrent *torrentMemory) Piece(piece *Piece) PieceStorage {
+	return &memoryPiece{torrent: torrent, index: piece.Index, length: piece.Length}
+}
+
+func (torrent *torrentMemory) Close() error {
+	return nil
+}
+
+func (piece *memoryPiece) ReadAt(data []byte, offset int64) (int, error) {
+	if offset < 0 || offset+int64(len(data)) > int64(piece.length) {
+		return 0, fmt.Errorf("range %v-%v is outside of piece %v", offset, offset+int64(len(data)), piece.index)
+	}
+
+	piece.torrent.mu.Lock()
+	defer piece.torrent.mu.Unlock()
+
+	stored, ok := piece.torrent.pieces[piece.index]
+	if !ok {
+		return 0, fmt.Errorf("piece %v has not been written", piece.index)
+	}
+
+	return copy(data, stored[offset:]), nil
+}
+
+func (piece *memoryPiece) WriteAt(data []byte, offset int64) (int, error) {
+	if offset < 0 || offset+int64(len(data)) > int64(piece.length) {
+		return 0, fmt.Errorf("range %v-%v is outside of piece %v", offset, offset+int64(len(data)), piece.index)
+	}
+
+	piece.torrent.mu.Lock()
+	defer piece.torrent.mu.Unlock()
+
+	stored, ok := piece.torrent.pieces[piece.index]
+	if !ok {
+		stored = make([]byte, piece.length)
+		piece.torrent.pieces[piece.index] = stored
+	}
+
+	return copy(stored[offset:], data), nil
+}
+
+func (piece *memoryPiece) MarkComplete() error {
+	piece.torrent.completion.mark(piece.index)
+	return nil
+}
+
+func (piece *memoryPiece) Completed() bool {
+	return piece.torrent.completion.completed(piece.index)
+}
+
+// Names Windows reserves for devices, with or without an extension
+var reservedNames = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true, "COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true, "LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+// A storageFile is a file of the torrent, placed where it starts in the torrent-global stream of bytes
+type storageFile struct {
+	path    string // where the file is stored on disk
+	offset  int64  // torrent-global offset of the file's first byte
+	length  int64
+	padding bool // padding files only align the next file to a piece boundary and are never stored
+}
+
+// torrentFiles stores a torrent in the file(s) described by its info dictionary, under a directory named after the torrent
+type torrentFiles struct {
+	info       *InfoDictionary
+	files      []storageFile
+	length     int64
+	completion pieceCompletion
+
+	mu      sync.Mutex
+	handles map[string]*os.File
+}
+
+// newTorrentFiles lays the files of the torrent out under saveDir and creates the directory tree they live in
+func newTorrentFiles(saveDir string, info *InfoDictionary) (*torrentFiles, error) {
+	root, err := filepath.Abs(saveDir)
+	if err != nil {
+		return nil, err
+	}
+
+	storage := torrentFiles{info: info, handles: map[string]*os.File{}}
+	name := sanitizePathComponent(info.Name)
+
+	// Single-file mode stores the file directly in the save directory, under the torrent's name
+	if len(info.Files) == 0 {
+		storage.files = []storageFile{{path: filepath.Join(root, name), length: int64(info.Length)}}
+		storage.length = int64(info.Length)
+	}
+
+	for _, file := range info.Files {
+		if file.Length < 0 {
+			return nil, fmt.Errorf("file %v has a negative length", file.Path)
+		}
+
+		storageFile := storageFile{
+			offset:  storage.length,
+			length:  int64(file.Length),
+			padding: isPaddingFile(file),
+		}
+		storage.length += storageFile.length
+
+		if !storageFile.padding {
+			storageFile.path, err = filePath(root, name, file.Path)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		storage.files = append(storage.files, storageFile)
+	}
+
+	for _, file := range storage.files {
+		if file.padding {
+			continue
+		}
+
+		err := os.MkdirAll(filepath.Dir(file.path), 0755)
+		if err != nil {
+			return nil, err
+		}
+
+		// Empty files never receive a write, so they are created right away
+		if file.length == 0 {
+			handle, err := os.OpenFile(file.path, os.O_RDWR|os.O_CREATE, 0644)
+			if err != nil {
+				return nil, err
+			}
+			handle.Close()
+		}
+	}
+
+	return &storage, nil
+}
+
+// isPaddingFile recognizes BEP 47 padding files, as well as the older convention of naming them _____padding_file_
+func isPaddingFile(file File) bool {
+	if strings.Contains(file.Attr, "p") {
+		return true
+	}
+
+	return len(file.Path) > 0 && strings.HasPrefix(file.Path[len(file.Path)-1], "_____padding_file_")
+}
+
+// filePath builds the path of a file from the components in the info dictionary, and makes sure it stays inside root
+func filePath(root string, name string, components []string) (string, error) {
+	if len(components) == 0 {
+		return "", errors.New("file in info dictionary has an empty path")
+	}
+
+	parts := []string{root, name}
+	for _, component := range components {
+		parts = append(parts, sanitizePathComponent(component))
+	}
+
+	path := filepath.Join(parts...)
+
+	relative, err := filepath.Rel(root, path)
+	if err != nil || relative == ".." || strings.HasPrefix(relative, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("file %v would be stored outside of %s", components, root)
+	}
+
+	return path, nil
+}
+
+// sanitizePathComponent turns a file or directory name from an untrusted info dictionary into a name that is safe to
+// create: it can't climb out of its directory, be absolute, contain separators, or be a name reserved by the OS.
+func sanitizePathComponent(component string) string {
+	component = strings.Map(func(r rune) rune {
+		switch {
+		case r < 0x20, r == 0x7f:
+			return -1
+		case r == '/', r == '\\', r == ':', r == '*', r == '?', r == '"', r == '<', r == '>', r == '|':
+			return '_'
+		}
+		return r
+	}, component)
+
+	// Windows drops trailing dots and spaces, which would turn "..." into ".." again
+	component = strings.TrimRight(component, ". ")
+
+	if component == "" {
+		return "_"
+	}
+
+	base := strings.ToUpper(component)
+	if i := strings.Index(base, "."); i >= 0 {
+		base = base[:i]
+	}
+	if reservedNames[base] {
+		component = "_" + component
+	}
+
+	return component
+}
+
+func (storage *torrentFiles) Piece(piece *Piece) PieceStorage {
+	return globalPiece(storage, storage.info, piece, &storage.completion)
+}
+
+// WriteAt writes data at a torrent-global offset, splitting it over every file it straddles
+func (storage *torrentFiles) WriteAt(data []byte, offset int64) (int, error) {
+	return storage.span(data, offset, func(file *storageFile, chunk []byte, fileOffset int64) error {
+		if file.padding {
+			return nil
+		}
+
+		handle, err := storage.open(file, true)
+		if err != nil {
+			return err
+		}
+
+		_, err = handle.WriteAt(chunk, fileOffset)
+		return err
+	})
+}
+
+// ReadAt reads data from a torrent-global offset, gathering it from every file it straddles
+func (storage *torrentFiles) ReadAt(data []byte, offset int64) (int, error) {
+	return storage.span(data, offset, func(file *storageFile, chunk []byte, fileOffset int64) error {
+		if file.padding {
+			for i := range chunk {
+				chunk[i] = 0
+			}
+			return nil
+		}
+
+		// A file that was never written to has none of its pieces, so reading it doesn't create it
+		handle, err := storage.open(file, false)
+		if err != nil {
+			return err
+		}
+
+		_, err = handle.ReadAt(chunk, fileOffset)
+		return err
+	})
+}
+
+// span calls do for every part of data that falls in a single file
+func (storage *torrentFiles) span(data []byte, offset int64, do func(*storageFile, []byte, int64) error) (int, error) {
+	if offset < 0 || offset+int64(len(data)) > storage.length {
+		return 0, fmt.Errorf("range %v-%v is outside of the torrent's %v bytes", offset, offset+int64(len(data)), storage.length)
+	}
+
+	// The first file that ends after offset holds its first byte
+	i := sort.Search(len(storage.files), func(i int) bool {
+		return storage.files[i].offset+storage.files[i].length > offset
+	})
+
+	done := 0
+	for ; done < len(data) && i < len(storage.files); i++ {
+		file := &storage.files[i]
+		if file.length == 0 {
+			continue
+		}
+
+		fileOffset := offset + int64(done) - file.offset
+		size := file.length - fileOffset
+		if size > int64(len(data)-done) {
+			size = int64(len(data) - done)
+		}
+
+		err := do(file, data[done:done+int(size)], fileOffset)
+		if err != nil {
+			return done, err
+		}
+		done += int(size)
+	}
+
+	if done < len(data) {
+		return done, io.ErrUnexpectedEOF
+	}
+
+	return done, nil
+}
+
+// open returns the handle of a file. A file that doesn't exist yet is created if create is set, and
+// otherwise reported with an error that os.IsNotExist recognizes.
+func (storage *torrentFiles) open(file *storageFile, create bool) (*os.File, error) {
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+
+	if handle, ok := storage.handles[file.path]; ok {
+		return handle, nil
+	}
+
+	flags := os.O_RDWR
+	if create {
+		flags |= os.O_CREATE
+	}
+
+	handle, err := os.OpenFile(file.path, flags, 0644)
+	if err != nil {
+		return nil, err
+	}
+	storage.handles[file.path] = handle
+
+	return handle, nil
+}
+
+// Close closes every file that was opened
+func (storage *torrentFiles) Close() error {
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+
+	var closeErr error
+	for path, handle := range storage.handles {
+		err := handle.Close()
+		if err != nil && closeErr == nil {
+			closeErr = err
+		}
+		delete(storage.handles, path)
+	}
+
+	return closeErr
+}
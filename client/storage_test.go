@@ -0,0 +1,343 @@
+package client
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// newTestTorrent sets up a single file v1 torrent for the data, with two blocks per piece, stored in storage
+func newTestTorrent(t *testing.T, data []byte, storage Storage) *Torrent {
+	t.Helper()
+
+	return openTestTorrent(t, InfoDictionary{Name: "test.bin", Length: len(data)}, data, storage)
+}
+
+// openTestTorrent sets up a v1 torrent of the info dictionary, with two blocks per piece, stored in storage.
+// The data is every file of the torrent one after the other, padding included.
+func openTestTorrent(t *testing.T, info InfoDictionary, data []byte, storage Storage) *Torrent {
+	t.Helper()
+
+	info.PieceLength = 2 * blockSize
+	var pieces []byte
+	for offset := 0; offset < len(data); offset += info.PieceLength {
+		end := offset + info.PieceLength
+		if end > len(data) {
+			end = len(data)
+		}
+		hash := sha1.Sum(data[offset:end])
+		pieces = append(pieces, hash[:]...)
+	}
+	info.Pieces = string(pieces)
+
+	torrent := &Torrent{Data: MetaInfo{Info: info}}
+
+	err := torrent.loadInfo()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer func(backend Storage) { Settings.Storage = backend }(Settings.Storage)
+	Settings.Storage = storage
+
+	err = torrent.openStorage()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return torrent
+}
+
+// receivePiece hands the piece its data block by block, the way peers send it, and completes it
+func receivePiece(torrent *Torrent, index int, data []byte) bool {
+	piece := &torrent.Pieces[index]
+	start := index * torrent.Data.Info.PieceLength
+	for i := range piece.Blocks {
+		block := &piece.Blocks[i]
+		block.Data = append([]byte(nil), data[start+block.Offset:start+block.Offset+block.Length]...)
+	}
+
+	return torrent.completePiece(piece)
+}
+
+func TestMemoryStorageRoundTrip(t *testing.T) {
+	// Two and a half pieces, so the last piece and its last block are short
+	data := make([]byte, 5*blockSize+100)
+	rand.New(rand.NewSource(1)).Read(data)
+	storage := NewMemoryStorage()
+
+	torrent := newTestTorrent(t, data, storage)
+	if len(torrent.Pieces) != 3 {
+		t.Fatalf("torrent has %v pieces, want 3", len(torrent.Pieces))
+	}
+	if torrent.completePieces() != 0 {
+		t.Fatalf("empty storage rechecked as %v pieces", torrent.completePieces())
+	}
+
+	// A piece with bad data isn't stored
+	bad := append([]byte(nil), data...)
+	bad[0] ^= 0xff
+	if receivePiece(torrent, 0, bad) {
+		t.Fatal("piece with bad data was completed")
+	}
+	if torrent.storage.Piece(&torrent.Pieces[0]).Completed() {
+		t.Fatal("piece with bad data was marked complete")
+	}
+
+	for i := range torrent.Pieces {
+		if !receivePiece(torrent, i, data) {
+			t.Fatalf("piece %v wasn't completed", i)
+		}
+	}
+	if torrent.completePieces() != 3 {
+		t.Fatalf("have %v pieces after receiving all 3", torrent.completePieces())
+	}
+
+	// What went into storage reads back the same
+	for i := range torrent.Pieces {
+		piece := &torrent.Pieces[i]
+		stored := make([]byte, piece.Length)
+		_, err := torrent.storage.Piece(piece).ReadAt(stored, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		start := i * torrent.Data.Info.PieceLength
+		if !bytes.Equal(stored, data[start:start+piece.Length]) {
+			t.Fatalf("piece %v reads back different data", i)
+		}
+	}
+
+	// The same torrent opened again finds every piece when it rechecks the storage
+	reopened := newTestTorrent(t, data, storage)
+	if reopened.completePieces() != 3 {
+		t.Fatalf("recheck found %v pieces, want 3", reopened.completePieces())
+	}
+
+	// Another torrent doesn't see them
+	other := newTestTorrent(t, data[:4*blockSize], storage)
+	if other.completePieces() != 0 {
+		t.Fatalf("recheck of another torrent found %v pieces", other.completePieces())
+	}
+}
+
+func TestMemoryStorageBounds(t *testing.T) {
+	torrent := newTestTorrent(t, make([]byte, 3*blockSize), NewMemoryStorage())
+	piece := torrent.storage.Piece(&torrent.Pieces[1])
+
+	_, err := piece.ReadAt(make([]byte, 10), 0)
+	if err == nil {
+		t.Fatal("piece that was never written was read")
+	}
+
+	_, err = piece.WriteAt(make([]byte, 10), int64(blockSize))
+	if err == nil {
+		t.Fatal("write past the end of the short last piece was accepted")
+	}
+	_, err = piece.WriteAt(make([]byte, 10), -1)
+	if err == nil {
+		t.Fatal("write at a negative offset was accepted")
+	}
+
+	n, err := piece.WriteAt([]byte("abc"), int64(blockSize-3))
+	if err != nil || n != 3 {
+		t.Fatalf("write at the end of the piece: %v, %v", n, err)
+	}
+	stored := make([]byte, 3)
+	_, err = piece.ReadAt(stored, int64(blockSize-3))
+	if err != nil || string(stored) != "abc" {
+		t.Fatalf("read back %q, %v", stored, err)
+	}
+}
+
+func TestSanitizePathComponent(t *testing.T) {
+	cases := map[string]string{
+		"movie.mkv":     "movie.mkv",
+		"..":            "_",
+		".":             "_",
+		"...":           "_",
+		"":              "_",
+		"/etc/passwd":   "_etc_passwd",
+		"C:\\Windows":   "C__Windows",
+		"../../escape":  ".._.._escape",
+		"what?.txt":     "what_.txt",
+		"tab\there":     "tabhere",
+		"trailing. . ":  "trailing",
+		"CON":           "_CON",
+		"nul.txt":       "_nul.txt",
+		"Com1.tar.gz":   "_Com1.tar.gz",
+		"CONSOLE":       "CONSOLE",
+		"lpt10":         "lpt10",
+		"normal name 1": "normal name 1",
+	}
+
+	for component, want := range cases {
+		if got := sanitizePathComponent(component); got != want {
+			t.Errorf("%q sanitized to %q, want %q", component, got, want)
+		}
+	}
+}
+
+func TestFilePath(t *testing.T) {
+	root := filepath.Join(t.TempDir(), "downloads")
+
+	cases := []struct {
+		components []string
+		want       string
+	}{
+		{[]string{"dir", "file.txt"}, "dir/file.txt"},
+		{[]string{"..", "..", "etc", "passwd"}, "_/_/etc/passwd"},
+		{[]string{"/etc/passwd"}, "_etc_passwd"},
+		{[]string{"/", "abs"}, "_/abs"},
+		{[]string{"a/../../b"}, "a_.._.._b"},
+		{[]string{"aux", "prn.txt"}, "_aux/_prn.txt"},
+	}
+
+	for _, c := range cases {
+		got, err := filePath(root, "torrent", c.components)
+		if err != nil {
+			t.Errorf("%q: %s", c.components, err)
+			continue
+		}
+		if want := filepath.Join(root, "torrent", filepath.FromSlash(c.want)); got != want {
+			t.Errorf("%q is stored at %s, want %s", c.components, got, want)
+		}
+	}
+
+	// The torrent's name is a component like any other
+	got, err := filePath(root, sanitizePathComponent(".."), []string{"file"})
+	if err != nil || got != filepath.Join(root, "_", "file") {
+		t.Errorf("file of a torrent named .. is stored at %s, %v", got, err)
+	}
+
+	_, err = filePath(root, "torrent", nil)
+	if err == nil {
+		t.Error("file with an empty path was accepted")
+	}
+}
+
+// testFiles is a multi-file torrent laid out so pieces and blocks straddle files: a.txt fills half of the first
+// piece and is padded to the end of it, and the second and third pieces hold b/c.bin, the empty e.txt and d.bin
+func testFiles() ([]File, []byte) {
+	files := []File{
+		{Path: []string{"a.txt"}, Length: blockSize + 100},
+		{Path: []string{".pad", "16284"}, Length: blockSize - 100, Attr: "p"},
+		{Path: []string{"b", "c.bin"}, Length: 3 * blockSize},
+		{Path: []string{"e.txt"}, Length: 0},
+		{Path: []string{"d.bin"}, Length: 500},
+	}
+
+	var data []byte
+	random := rand.New(rand.NewSource(2))
+	for _, file := range files {
+		contents := make([]byte, file.Length)
+		if !isPaddingFile(file) {
+			random.Read(contents)
+		}
+		data = append(data, contents...)
+	}
+
+	return files, data
+}
+
+func TestFileStorageSpansFiles(t *testing.T) {
+	dir := t.TempDir()
+	files, data := testFiles()
+	info := InfoDictionary{Name: "multi", Files: files}
+
+	torrent := openTestTorrent(t, info, data, NewFileStorage(dir))
+	if len(torrent.Pieces) != 3 {
+		t.Fatalf("torrent has %v pieces, want 3", len(torrent.Pieces))
+	}
+	if torrent.completePieces() != 0 {
+		t.Fatalf("empty directory rechecked as %v pieces", torrent.completePieces())
+	}
+
+	// The empty file is there from the start
+	if stat, err := os.Stat(filepath.Join(dir, "multi", "e.txt")); err != nil || stat.Size() != 0 {
+		t.Fatalf("empty file wasn't created: %v", err)
+	}
+
+	// A write from the middle of a.txt into b/c.bin goes through the padding without storing it
+	storage := torrent.storage.(*torrentFiles)
+	start, end := blockSize, 2*blockSize+100
+	n, err := storage.WriteAt(data[start:end], int64(start))
+	if err != nil || n != end-start {
+		t.Fatalf("write over three files: %v, %v", n, err)
+	}
+	stored := make([]byte, end-start)
+	n, err = storage.ReadAt(stored, int64(start))
+	if err != nil || n != end-start || !bytes.Equal(stored, data[start:end]) {
+		t.Fatalf("read over three files: %v, %v", n, err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "multi", ".pad")); !os.IsNotExist(err) {
+		t.Fatalf("padding was stored: %v", err)
+	}
+
+	for i := range torrent.Pieces {
+		if !receivePiece(torrent, i, data) {
+			t.Fatalf("piece %v wasn't completed", i)
+		}
+	}
+	torrent.storage.Close()
+
+	// Every file holds its own part of the data
+	offset := 0
+	for _, file := range files {
+		if !isPaddingFile(file) {
+			contents, err := os.ReadFile(filepath.Join(append([]string{dir, "multi"}, file.Path...)...))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(contents, data[offset:offset+file.Length]) {
+				t.Errorf("%v holds the wrong data", file.Path)
+			}
+		}
+		offset += file.Length
+	}
+
+	// And a recheck finds every piece again
+	reopened := openTestTorrent(t, info, data, NewFileStorage(dir))
+	if reopened.completePieces() != 3 {
+		t.Fatalf("recheck found %v pieces, want 3", reopened.completePieces())
+	}
+	reopened.storage.Close()
+}
+
+func TestFileStorageRecheckCreatesNothing(t *testing.T) {
+	dir := t.TempDir()
+	files, data := testFiles()
+	info := InfoDictionary{Name: "multi", Files: files}
+	missing := []string{filepath.Join(dir, "multi", "a.txt"), filepath.Join(dir, "multi", "b", "c.bin"), filepath.Join(dir, "multi", "d.bin")}
+
+	torrent := openTestTorrent(t, info, data, NewFileStorage(dir))
+	for _, path := range missing {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Fatalf("recheck of an empty directory created %s", path)
+		}
+	}
+
+	_, err := torrent.storage.Piece(&torrent.Pieces[1]).ReadAt(make([]byte, 10), 0)
+	if !os.IsNotExist(err) {
+		t.Fatalf("read of a file that doesn't exist got error %v", err)
+	}
+
+	// Only the first piece is there after it's downloaded, and the files of the others still aren't
+	if !receivePiece(torrent, 0, data) {
+		t.Fatal("piece 0 wasn't completed")
+	}
+	torrent.storage.Close()
+
+	reopened := openTestTorrent(t, info, data, NewFileStorage(dir))
+	if reopened.completePieces() != 1 || !reopened.have.Test(0) {
+		t.Fatalf("recheck found %v pieces, want only the first", reopened.completePieces())
+	}
+	reopened.storage.Close()
+	for _, path := range missing[1:] {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Fatalf("recheck created %s", path)
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package client
+
+// Will handle the tiers of trackers a torrent is announced to (BEP 12)
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/url"
+)
+
+// loadTrackers sets up the tiers of trackers from announce-list, or from announce if the torrent has no
+// announce-list. The trackers within every tier are shuffled, so clients spread their load over them.
+func (torrent *Torrent) loadTrackers() {
+	torrent.trackers = nil
+
+	tiers := torrent.Data.AnnounceList
+	if len(tiers) == 0 && torrent.Data.Announce != "" {
+		tiers = [][]string{{torrent.Data.Announce}}
+	}
+
+	for _, tier := range tiers {
+		if len(tier) == 0 {
+			continue
+		}
+
+		// The tiers are copied, so promoting trackers doesn't reorder the metainfo
+		shuffled := append([]string(nil), tier...)
+		rand.Shuffle(len(shuffled), func(i, j int) {
+			shuffled[i], shuffled[j] = shuffled[j], shuffled[i]
+		})
+		torrent.trackers = append(torrent.trackers, shuffled)
+	}
+}
+
+// announce tries the trackers one by one, tier by tier, until one answers. The tracker that answered is
+// moved to the front of its tier, so it is tried first next time.
+func (torrent *Torrent) announce(request *TrackerRequest) (*announceResult, error) {
+	lastErr := errors.New("torrent has no trackers")
+
+	for tier := 0; tier < torrent.trackerTiers(); tier++ {
+		for _, tracker := range torrent.trackerTier(tier) {
+			result, err := request.announceTo(tracker)
+			if err == errAnnounceCancelled {
+				return nil, err
+			}
+			if err != nil {
+				fmt.Printf("Announce to %s failed: %s \n", tracker, err.Error())
+				lastErr = err
+				continue
+			}
+
+			torrent.promoteTracker(tier, tracker)
+			return result, nil
+		}
+	}
+
+	return nil, lastErr
+}
+
+// announceTo announces the request to one tracker, over UDP or HTTP depending on its URL. The tracker id
+// the tracker hands out is sent back to it, and only to it, with the next announce.
+func (request *TrackerRequest) announceTo(tracker string) (*announceResult, error) {
+	u, err := url.Parse(tracker)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse url: %s", err.Error())
+	}
+
+	request.TrackerID = request.trackerIDs[tracker]
+
+	var result *announceResult
+	switch u.Scheme {
+	case "udp":
+		result, err = request.announceUDP(u.Host)
+	case "http", "https":
+		result, err = request.announceHTTP(tracker)
+	default:
+		return nil, fmt.Errorf("unsupported tracker protocol %q", u.Scheme)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if result.trackerID != "" {
+		if request.trackerIDs == nil {
+			request.trackerIDs = map[string]string{}
+		}
+		request.trackerIDs[tracker] = result.trackerID
+	}
+
+	return result, nil
+}
+
+// trackerTiers returns the amount of tiers of trackers
+func (torrent *Torrent) trackerTiers() int {
+	torrent.mu.Lock()
+	defer torrent.mu.Unlock()
+
+	return len(torrent.trackers)
+}
+
+// trackerTier returns the trackers of a tier, in the order they are to be tried
+func (torrent *Torrent) trackerTier(tier int) []string {
+	torrent.mu.Lock()
+	defer torrent.mu.Unlock()
+
+	return append([]string(nil), torrent.trackers[tier]...)
+}
+
+// promoteTracker moves a tracker to the front of its tier
+func (torrent *Torrent) promoteTracker(tier int, tracker string) {
+	torrent.mu.Lock()
+	defer torrent.mu.Unlock()
+
+	trackers := torrent.trackers[tier]
+	for i := range trackers {
+		if trackers[i] == tracker {
+			copy(trackers[1:i+1], trackers[:i])
+			trackers[0] = tracker
+			return
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package client
+
+import (
+	"net/http"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+)
+
+func TestLoadTrackers(t *testing.T) {
+	torrent := &Torrent{Data: MetaInfo{
+		Announce:     "http://a.example/announce",
+		AnnounceList: [][]string{{"http://a.example/announce", "http://b.example/announce", "http://c.example/announce"}, {}, {"udp://d.example:6969"}},
+	}}
+	torrent.loadTrackers()
+
+	// Empty tiers are dropped, and the trackers of a tier are shuffled
+	if len(torrent.trackers) != 2 || !reflect.DeepEqual(torrent.trackers[1], []string{"udp://d.example:6969"}) {
+		t.Fatalf("tiers are %v", torrent.trackers)
+	}
+	first := append([]string(nil), torrent.trackers[0]...)
+	sort.Strings(first)
+	if !reflect.DeepEqual(first, torrent.Data.AnnounceList[0]) {
+		t.Fatalf("first tier is %v, want the trackers of %v", torrent.trackers[0], torrent.Data.AnnounceList[0])
+	}
+
+	// Promoting a tracker doesn't reorder the metainfo
+	torrent.promoteTracker(0, "http://c.example/announce")
+	if torrent.Data.AnnounceList[0][2] != "http://c.example/announce" {
+		t.Fatalf("announce-list was reordered to %v", torrent.Data.AnnounceList[0])
+	}
+
+	// Without an announce-list, announce is the only tier
+	torrent = &Torrent{Data: MetaInfo{Announce: "http://a.example/announce"}}
+	torrent.loadTrackers()
+	if !reflect.DeepEqual(torrent.trackers, [][]string{{"http://a.example/announce"}}) {
+		t.Fatalf("tiers are %v", torrent.trackers)
+	}
+}
+
+func TestPromoteTracker(t *testing.T) {
+	torrent := &Torrent{trackers: [][]string{{"a"}, {"b", "c", "d", "e"}}}
+
+	torrent.promoteTracker(1, "d")
+	torrent.promoteTracker(1, "b")
+	torrent.promoteTracker(1, "unknown")
+	want := [][]string{{"a"}, {"b", "d", "c", "e"}}
+	if !reflect.DeepEqual(torrent.trackers, want) {
+		t.Fatalf("tiers are %v, want %v", torrent.trackers, want)
+	}
+}
+
+func TestAnnounceFailover(t *testing.T) {
+	var mu sync.Mutex
+	hits := map[string]int{}
+	tracker := func(name string, response map[string]interface{}) string {
+		server := newTestTracker(t, response, func(*http.Request) {
+			mu.Lock()
+			hits[name]++
+			mu.Unlock()
+		})
+		return server.URL + "/" + name + "/announce"
+	}
+	failure := map[string]interface{}{"failure reason": "down for maintenance"}
+	working := map[string]interface{}{"interval": 1800, "peers": ""}
+
+	down1 := tracker("down1", failure)
+	down2 := tracker("down2", failure)
+	down3 := tracker("down3", failure)
+	up := tracker("up", working)
+	spare := tracker("spare", working)
+
+	torrent := &Torrent{trackers: [][]string{{down1, down2}, {down3, up, spare}}}
+
+	// Every tracker of the first tier is tried before the next tier, whose first working tracker answers
+	_, err := torrent.announce(testRequest())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]int{"down1": 1, "down2": 1, "down3": 1, "up": 1}
+	if !reflect.DeepEqual(hits, want) {
+		t.Fatalf("trackers got %v announces, want %v", hits, want)
+	}
+
+	// The tracker that answered is tried first from now on, in its own tier
+	if wantTiers := [][]string{{down1, down2}, {up, down3, spare}}; !reflect.DeepEqual(torrent.trackers, wantTiers) {
+		t.Fatalf("tiers are %v, want %v", torrent.trackers, wantTiers)
+	}
+	_, err = torrent.announce(testRequest())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = map[string]int{"down1": 2, "down2": 2, "down3": 1, "up": 2}
+	if !reflect.DeepEqual(hits, want) {
+		t.Fatalf("trackers got %v announces, want %v", hits, want)
+	}
+
+	// Once the first tier works again, it is used before any later one
+	torrent.trackers[0] = append(torrent.trackers[0], spare)
+	_, err = torrent.announce(testRequest())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = map[string]int{"down1": 3, "down2": 3, "down3": 1, "up": 2, "spare": 1}
+	if !reflect.DeepEqual(hits, want) {
+		t.Fatalf("trackers got %v announces, want %v", hits, want)
+	}
+	if torrent.trackers[0][0] != spare {
+		t.Fatalf("first tier is %v, want the tracker that answered first", torrent.trackers[0])
+	}
+
+	// Without a working tracker the announce fails with the last error
+	torrent.trackers = [][]string{{down1}, {down2}}
+	_, err = torrent.announce(testRequest())
+	if err == nil {
+		t.Fatal("announce to trackers that are down succeeded")
+	}
+}
@@ -5,16 +5,12 @@ package client
 import (
 	"bytes"
 	"crypto/sha1"
-	"encoding/binary"
+	"crypto/sha256"
+	"errors"
 	"fmt"
-	"io"
 	"io/ioutil"
 	"log"
-	"math/rand"
-	"net"
-	"net/url"
 	"os"
-	"time"
 
 	"github.com/zeebo/bencode"
 )
@@ -23,113 +19,298 @@ const (
 	maxPeers = 5
 )
 
-// AddTorrent returns a MetaInfo struct
-func AddTorrent(path string) *Torrent {
+// AddTorrent reads the .torrent file at path and returns a Torrent ready to be announced
+func AddTorrent(path string) (*Torrent, error) {
 
 	file, err := os.Open(path)
 	if err != nil {
-		log.Printf("Error opening file: %s", err.Error())
+		return nil, fmt.Errorf("unable to open torrent file: %s", err.Error())
 	}
+	defer file.Close()
 
 	stream, err := ioutil.ReadAll(file)
 
 	if err != nil {
-		log.Printf("Error reading file: %s", err.Error())
+		return nil, fmt.Errorf("unable to read torrent file: %s", err.Error())
 	}
 
-	info := MetaInfo{}
+	info, err := ParseMetaInfo(stream)
+	if err != nil {
+		return nil, err
+	}
 
-	bencode.DecodeBytes(stream, &info)
+	t := Torrent{Path: path, Data: *info}
+	t.loadTrackers()
 
-	protocol := "tcp"
+	err = t.loadInfo()
+	if err != nil {
+		return nil, err
+	}
 
-	u, err := url.Parse(info.Announce)
+	err = t.openStorage()
 	if err != nil {
-		fmt.Printf("Unable to parse url: %s", err.Error())
+		return nil, err
 	}
 
-	info.Announce = u.Host
+	return &t, nil
+}
+
+// loadInfo computes the info-hashes from the info dictionary and creates the pieces. v1 torrents are
+// identified by the SHA1 hash, v2 torrents by the SHA256 hash, and hybrid torrents by both.
+func (torrent *Torrent) loadInfo() error {
+	info := &torrent.Data.Info
+	rawInfo := torrent.Data.RawInfo()
+	// Taken before the file tree fills in the info, so it is the hash of the info as it was given.
+	// Hybrid torrents join the v1 swarm under this hash, and the v2 one under HashV2.
+	torrent.Hash = torrent.Data.SwarmHash()
+
+	if info.MetaVersion == 2 {
+		hash := sha256.Sum256(rawInfo)
+		torrent.HashV2 = hash[:]
 
-	for _, address := range info.AnnounceList {
-		u, err := url.Parse(address[0])
+		err := torrent.loadFileTree()
 		if err != nil {
-			fmt.Printf("Unable to parse url: %s", err.Error())
+			return err
 		}
-		address[0] = u.Host
+	} else if info.MetaVersion != 0 {
+		return fmt.Errorf("unsupported meta version %v", info.MetaVersion)
 	}
 
-	if isUDP(u) {
-		protocol = "udp"
+	if info.Pieces != "" {
+		if len(info.Pieces)%20 != 0 {
+			return fmt.Errorf("pieces has a length of %v, which is not a multiple of 20", len(info.Pieces))
+		}
+
+		torrent.splitPieces()
+	} else if torrent.isV2() {
+		torrent.splitPiecesV2()
+	} else {
+		return errors.New("torrent has no pieces")
 	}
-	t := Torrent{Path: path, Data: info, TrackerProtocol: protocol}
-	t.Hash = info.HashInfo()
 
-	t.splitPieces()
+	torrent.picker = newPiecePicker(len(torrent.Pieces))
+	torrent.have = NewBitset(len(torrent.Pieces))
 
-	if _, err := os.Stat("downloadedTorrent"); err == nil {
-		t.Path = "downloadedTorrent"
-	} else {
-		_, err := os.Create("downloadedTorrent")
-		if err != nil {
-			fmt.Println(err.Error())
-		}
+	return nil
+}
+
+// openStorage prepares the file(s) the torrent is downloaded into
+func (torrent *Torrent) openStorage() error {
+	backend := Settings.Storage
+	if backend == nil {
+		backend = NewFileStorage(Settings.DownloadDir)
+	}
+
+	storage, err := backend.OpenTorrent(&torrent.Data.Info, torrent.Hash)
+	if err != nil {
+		return fmt.Errorf("unable to prepare storage for %s: %s", torrent.Data.Info.Name, err.Error())
 	}
 
-	return &t
+	torrent.storage = storage
+	torrent.Recheck()
+
+	return nil
 }
 
-// HashInfo hashes the info section of the MetaInfo file in preparation for a tracker request
-func (info *MetaInfo) HashInfo() []byte {
-	hash := sha1.New()
+// ParseMetaInfo decodes the contents of a .torrent file. Alongside the decoded fields, the
+// info dictionary is kept byte for byte so the info-hash covers keys InfoDictionary doesn't model.
+func ParseMetaInfo(stream []byte) (*MetaInfo, error) {
+	info := MetaInfo{}
+
+	err := bencode.DecodeBytes(stream, &info)
+	if err != nil {
+		return nil, fmt.Errorf("unable to decode torrent file: %s", err.Error())
+	}
+
+	raw := struct {
+		Info bencode.RawMessage `bencode:"info"`
+	}{}
+
+	err = bencode.DecodeBytes(stream, &raw)
+	if err != nil {
+		return nil, fmt.Errorf("unable to decode info dictionary: %s", err.Error())
+	}
+
+	if len(raw.Info) == 0 || raw.Info[0] != 'd' {
+		return nil, errors.New("torrent file has no info dictionary")
+	}
+
+	info.rawInfo = raw.Info
+
+	return &info, nil
+}
+
+// UnmarshalBencode accepts url-list both as a list of URLs and as a single URL string.
+func (list *URLList) UnmarshalBencode(stream []byte) error {
+	var single string
+	if err := bencode.DecodeBytes(stream, &single); err == nil {
+		*list = URLList{single}
+		return nil
+	}
+
+	var urls []string
+	if err := bencode.DecodeBytes(stream, &urls); err != nil {
+		return err
+	}
+	*list = urls
+
+	return nil
+}
+
+// RawInfo returns the bencoded info dictionary the info-hash is computed over.
+func (info *MetaInfo) RawInfo() []byte {
+	if info.rawInfo != nil {
+		return info.rawInfo
+	}
+
 	stream, err := bencode.EncodeBytes(info.Info)
 	if err != nil {
 		log.Printf("Unable to encode object: %s", err.Error())
 		return nil
 	}
-	streamer := bytes.NewReader(stream)
-	_, err = io.Copy(hash, streamer)
-	if err != nil {
-		log.Printf("Unable to hash given stream: %s", err.Error())
+
+	return stream
+}
+
+// HashInfo hashes the info section of the MetaInfo file in preparation for a tracker request
+func (info *MetaInfo) HashInfo() []byte {
+	stream := info.RawInfo()
+	if stream == nil {
 		return nil
 	}
 
-	infoHash := hash.Sum(nil)
+	hash := sha1.Sum(stream)
 
-	return infoHash
+	return hash[:]
 }
 
-// CreateTrackerRequest creates an initial tracker request
-func (info *MetaInfo) CreateTrackerRequest(hash []byte) *TrackerRequest {
-	// create a random unique transactionID
-	transactionID := func() uint32 {
-		r := rand.New(rand.NewSource(time.Now().UnixNano()))
-		return r.Uint32()
+// SwarmHash returns the info-hash trackers and peers know the torrent by: the v1 info-hash, or the
+// truncated v2 info-hash of a v2-only torrent
+func (info *MetaInfo) SwarmHash() []byte {
+	if info.Info.Pieces == "" && info.Info.MetaVersion == 2 {
+		hash := sha256.Sum256(info.RawInfo())
+		return hash[:20]
 	}
 
-	ID := make([]byte, 4)
+	return info.HashInfo()
+}
 
-	binary.BigEndian.PutUint32(ID[:], transactionID())
+// CreateTrackerRequest creates an initial tracker request
+func (info *MetaInfo) CreateTrackerRequest(hash []byte) *TrackerRequest {
 	request := TrackerRequest{
-		InfoHash:      hash,
-		PeerID:        MyPeerID,
-		Port:          port,
-		Compact:       1,
-		TransactionID: ID,
+		InfoHash: hash,
+		PeerID:   MyPeerID,
+		Port:     port,
+		Compact:  1,
+		IPv6:     publicIPv6(),
 	}
 
 	return &request
-
 }
 
 // AddPeers takes a slice of peer addresses, creates individual peer objects from them and
 // appends them to the Peers field in the torrent struct.
 func (torrent *Torrent) AddPeers(addresses []string) {
+	torrent.addPeers(addresses, nil, torrent.Hash)
+}
+
+// addPeers adds peers found in the swarm of the given info-hash, with the peer ids the tracker gave for
+// them, if any. Addresses we already know are skipped, and while the torrent runs the new peers are
+// connected to right away.
+func (torrent *Torrent) addPeers(addresses []string, peerIDs map[string]string, infoHash []byte) {
+	torrent.mu.Lock()
+
+	var added []Peer
 	for _, addr := range addresses {
+		if torrent.knowsPeer(addr) {
+			continue
+		}
+
 		newPeer := Peer{
-			address: addr,
+			address:  addr,
+			peerID:   peerIDs[addr],
+			infoHash: infoHash,
+			torrent:  torrent,
 		}
 		torrent.Peers = append(torrent.Peers, newPeer)
+		added = append(added, newPeer)
+	}
+
+	running := torrent.isRunning()
+	torrent.mu.Unlock()
+
+	if running {
+		for i := range added {
+			go torrent.connect(&added[i])
+		}
+	}
+}
+
+// knowsPeer reports whether the address is already among the torrent's peers. The torrent must be locked.
+func (torrent *Torrent) knowsPeer(address string) bool {
+	for _, peer := range torrent.Peers {
+		if peer.address == address {
+			return true
+		}
+	}
+
+	return false
+}
+
+// isRunning reports whether the torrent was started and not stopped yet. The torrent must be locked.
+func (torrent *Torrent) isRunning() bool {
+	return torrent.started && !torrent.stopped()
+}
+
+// addLivePeer adds a peer we completed a handshake with to the torrent.
+// It returns false if we are already connected to a peer with the same id.
+func (torrent *Torrent) addLivePeer(peer *Peer) bool {
+	torrent.mu.Lock()
+	defer torrent.mu.Unlock()
+
+	if torrent.hasLivePeer(peer.peerID) {
+		return false
+	}
+
+	torrent.livePeers = append(torrent.livePeers, peer)
+	torrent.ConnectedPeers = len(torrent.livePeers)
+	return true
+}
+
+// hasLivePeer reports whether we are connected to the peer with the given id. The torrent must be locked.
+func (torrent *Torrent) hasLivePeer(peerID string) bool {
+	for _, live := range torrent.livePeers {
+		if live.peerID == peerID {
+			return true
+		}
 	}
+
+	return false
+}
+
+// removeLivePeer drops a peer whose connection was closed
+func (torrent *Torrent) removeLivePeer(peer *Peer) {
+	torrent.mu.Lock()
+	defer torrent.mu.Unlock()
+
+	torrent.releaseRequests(peer)
+	torrent.picker.removeBitfield(&peer.Bitfield)
+
+	for i, live := range torrent.livePeers {
+		if live == peer {
+			torrent.livePeers = append(torrent.livePeers[:i], torrent.livePeers[i+1:]...)
+			break
+		}
+	}
+	torrent.ConnectedPeers = len(torrent.livePeers)
+}
+
+// connectedPeers returns the peers we currently have a connection with
+func (torrent *Torrent) connectedPeers() []*Peer {
+	torrent.mu.Lock()
+	defer torrent.mu.Unlock()
+
+	return append([]*Peer(nil), torrent.livePeers...)
 }
 
 // helper function to split string of torrent piece hashes into slice of said hashes.
@@ -139,113 +320,197 @@ func (torrent *Torrent) splitPieces() {
 	var splitPieces []string
 	/* append to slice in intervals of (20*i) to (20*(i+1))
 	   to separate every 20 byte hash */
-	for i := 0; len(notSplit[:(20*(i+1))]) < len(notSplit); i++ {
+	for i := 0; 20*(i+1) <= len(notSplit); i++ {
 		splitPieces = append(splitPieces, string(notSplit[(20*i):(20*(i+1))]))
 		indexes = append(indexes, i)
 	}
 
 	/* create a corresponding piece struct for every hash
 	   and append to torrent.Pieces */
+	totalLength := torrent.Data.Info.TotalLength()
 	for i, hash := range splitPieces {
 		piece := Piece{
-			Hash:  []byte(hash),
-			Index: indexes[i],
+			Hash:   []byte(hash),
+			Index:  indexes[i],
+			Length: torrent.Data.Info.PieceLength,
+		}
+		// The last piece only holds what's left of the data
+		if rest := totalLength - piece.Index*piece.Length; rest < piece.Length {
+			piece.Length = rest
 		}
-		piece.prepBlocks(torrent.Data.Info.PieceLength)
+		piece.prepBlocks(piece.Length)
 		torrent.Pieces = append(torrent.Pieces, piece)
 	}
 }
 
-func (piece *Piece) prepBlocks(pieceLength int) {
-	amountOfBlocks := pieceLength / 16384
+// TotalLength returns the size of the torrent's data in bytes, padding files included
+func (info *InfoDictionary) TotalLength() int {
+	if len(info.Files) == 0 {
+		return info.Length
+	}
+
+	total := 0
+	for _, file := range info.Files {
+		total += file.Length
+	}
+
+	return total
+}
+
+// verify checks the data of a piece against its SHA1 hash, or its merkle hash for v2-only torrents
+func (piece *Piece) verify(data []byte, pieceLength int) bool {
+	if piece.Hash != nil {
+		hash := sha1.Sum(data)
+		return bytes.Equal(hash[:], piece.Hash)
+	}
 
-	for i := 0; amountOfBlocks > i; i++ {
+	return piece.verifyV2(data, pieceLength)
+}
+
+// prepBlocks splits a piece of the given length into the blocks it is requested in
+func (piece *Piece) prepBlocks(length int) {
+	for offset := 0; offset < length; offset += blockSize {
 		blk := Block{
-			Offset: i * 16384,
+			Offset: offset,
+			Length: blockSize,
+		}
+		// The last block only holds what's left of the piece
+		if rest := length - offset; rest < blockSize {
+			blk.Length = rest
 		}
 
 		piece.Blocks = append(piece.Blocks, blk)
 	}
 }
 
-// Start starts the torrent download
-func (torrent *Torrent) Start(laddr *net.TCPAddr) {
-	clientState.torrents = append(clientState.torrents, *torrent)
-
-	for _, peer := range torrent.Peers {
-		fmt.Println("connecting to peer...")
-		conn, err := peer.initiateConnection(torrent.Hash)
-		if err != nil {
-			fmt.Printf("Unable to establish connection with peer: %s \n", err.Error())
-		}
-		go peer.handlePeerConnection(conn)
+// Start downloads the torrent, and once every piece is in, seeds it until Stop is called. While it runs,
+// the torrent is announced to its trackers and the DHT. A torrent that was stopped, even before it was
+// started, isn't started again.
+func (torrent *Torrent) Start() {
+	torrent.mu.Lock()
+	if torrent.started || torrent.stopped() {
+		torrent.mu.Unlock()
+		return
+	}
+	torrent.started = true
+	torrent.wake = make(chan struct{}, 1)
+	if torrent.completed == nil {
+		torrent.completed = make(chan struct{})
+	}
+	if !torrent.missingPieces() {
+		close(torrent.completed)
 	}
+	torrent.announced = make(chan struct{})
+	peers := append([]Peer(nil), torrent.Peers...)
+	torrent.mu.Unlock()
 
-	for torrent.torrentNotComplete() {
-		torrent.Update()
+	clientState.addTorrent(torrent)
+
+	for i := range peers {
+		go torrent.connect(&peers[i])
 	}
 
+	go torrent.choker()
+	go torrent.announcer()
+	go torrent.dhtAnnouncer()
+	torrent.download()
+
 	torrent.StopDownloading()
-	fmt.Println("Torrent is done!")
+	<-torrent.announced
 }
 
-// Update checks torrent state then sends appropriate request to peers for missing pieces
-func (torrent *Torrent) Update() {
+// Stop ends the torrent, closing its connections and storage. It may be called as soon as the torrent is
+// added: a torrent stopped before Start doesn't start at all.
+func (torrent *Torrent) Stop() {
+	torrent.mu.Lock()
+	defer torrent.mu.Unlock()
 
-}
-
-//StopDownloading closes all current connections with peers after a torrent is finished.
-func (torrent *Torrent) StopDownloading() {
-	for _, peer := range torrent.Peers {
-		connection := *peer.conn
-		err := connection.Close()
-		if err != nil {
-			fmt.Printf("Unable to close peer connection: %s \n", err.Error())
-		}
+	if !torrent.stopped() {
+		close(torrent.stop)
 	}
 }
 
-func (torrent *Torrent) arrangePiecesBasedOnRarity(pieces []Piece) []Piece {
-	var orderedPieces []Piece
-	for _, piece := range pieces {
-		for _, peer := range torrent.Peers {
-			if peer.Bitfield != nil && peer.Bitfield[piece.Index] == 1 {
-				piece.AvailablePeers = append(piece.AvailablePeers, &peer)
-			}
-		}
-		orderedPieces = append(orderedPieces, piece)
+// stopped reports whether Stop was called, creating the channel Stop closes if nobody needed it yet. The torrent must be locked.
+func (torrent *Torrent) stopped() bool {
+	if torrent.stop == nil {
+		torrent.stop = make(chan struct{})
 	}
 
-	return orderedPieces
+	select {
+	case <-torrent.stop:
+		return true
+	default:
+		return false
+	}
 }
 
-func (torrent *Torrent) torrentNotComplete() bool {
-	for _, piece := range torrent.Pieces {
-		if !piece.Complete {
-			return true
-		}
+// Done returns a channel that is closed once every piece of the torrent is in. For a torrent that was
+// already complete, that is when it is started.
+func (torrent *Torrent) Done() <-chan struct{} {
+	torrent.mu.Lock()
+	defer torrent.mu.Unlock()
+
+	if torrent.completed == nil {
+		torrent.completed = make(chan struct{})
 	}
 
-	return false
+	return torrent.completed
 }
 
-func (torrent *Torrent) writeToFile(data []byte, offset int) {
-	file, err := os.Open(torrent.Path)
+// connect opens a connection to the peer and handles its messages until the connection is closed
+func (torrent *Torrent) connect(peer *Peer) {
+	if torrent.isBanned(peer.address) {
+		return
+	}
+
+	fmt.Println("connecting to peer...")
+	conn, err := peer.initiateConnection(peer.infoHash)
 	if err != nil {
-		fmt.Println(err.Error())
+		fmt.Printf("Unable to establish connection with peer: %s \n", err.Error())
+		return
 	}
 
-	_, err = file.Seek(int64(offset), 0)
+	peer.sendDHTPort()
+	if torrent.isV2() && peer.supportsV2() {
+		peer.requestMissingPieceLayers()
+	}
+	torrent.wakeUp()
+
+	peer.handlePeerConnection(conn)
+}
 
+//StopDownloading closes all current connections with peers after a torrent is finished.
+func (torrent *Torrent) StopDownloading() {
+	for _, peer := range torrent.connectedPeers() {
+		connection := *peer.conn
+		err := connection.Close()
+		if err != nil {
+			fmt.Printf("Unable to close peer connection: %s \n", err.Error())
+		}
+	}
+
+	err := torrent.storage.Close()
 	if err != nil {
-		fmt.Println(err.Error())
+		fmt.Printf("Unable to close torrent files: %s \n", err.Error())
 	}
+}
+
+// torrentNotComplete reports whether pieces of the files we want are still missing
+func (torrent *Torrent) torrentNotComplete() bool {
+	torrent.mu.Lock()
+	defer torrent.mu.Unlock()
+
+	return torrent.missingPieces()
+}
 
-	_, err = file.Write(data)
+// writePiece stores the data of a verified piece and marks it complete
+func (torrent *Torrent) writePiece(piece *Piece, data []byte) error {
+	storage := torrent.storage.Piece(piece)
 
+	_, err := storage.WriteAt(data, 0)
 	if err != nil {
-		fmt.Println(err.Error())
+		return err
 	}
 
-	return
+	return storage.MarkComplete()
 }
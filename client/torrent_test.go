@@ -0,0 +1,160 @@
+package client
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The info dictionary of the fixture has its keys out of order, and a key InfoDictionary doesn't model,
+// as some .torrent files in the wild do. Re-encoding the decoded dictionary would sort the keys and drop
+// the unknown one, changing the info-hash.
+const fixtureInfo = "d4:name8:test.txt12:piece lengthi16384e6:lengthi5e6:source7:privtrk" +
+	"6:pieces20:aaaaaaaaaaaaaaaaaaaae"
+
+const fixtureTorrent = "d8:announce31:http://tracker.example/announce4:info" + fixtureInfo + "e"
+
+func TestParseMetaInfoKeepsRawInfo(t *testing.T) {
+	info, err := ParseMetaInfo([]byte(fixtureTorrent))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(info.RawInfo(), []byte(fixtureInfo)) {
+		t.Fatalf("raw info is %q, want the info dictionary of the file %q", info.RawInfo(), fixtureInfo)
+	}
+	if info.Info.Name != "test.txt" || info.Info.Length != 5 || info.Info.PieceLength != 16384 {
+		t.Fatalf("info dictionary decoded as %+v", info.Info)
+	}
+
+	want := sha1.Sum([]byte(fixtureInfo))
+	if !bytes.Equal(info.HashInfo(), want[:]) {
+		t.Fatalf("info-hash is %x, want the SHA1 of the raw info dictionary %x", info.HashInfo(), want)
+	}
+
+	torrent := Torrent{Data: *info}
+	err = torrent.loadInfo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(torrent.Hash, want[:]) {
+		t.Fatalf("torrent hash is %x, want %x", torrent.Hash, want)
+	}
+
+	// Without the raw dictionary the hash would differ, which is what the fixture is for
+	reencoded := MetaInfo{Info: info.Info}
+	if bytes.Equal(reencoded.HashInfo(), want[:]) {
+		t.Fatal("fixture hashes the same when re-encoded, so it doesn't test anything")
+	}
+}
+
+func TestParseMetaInfoWithoutInfo(t *testing.T) {
+	_, err := ParseMetaInfo([]byte("d8:announce31:http://tracker.example/announcee"))
+	if err == nil || !strings.Contains(err.Error(), "no info dictionary") {
+		t.Fatalf("got error %v, want a missing info dictionary", err)
+	}
+
+	_, err = ParseMetaInfo([]byte("d4:infoi5ee"))
+	if err == nil {
+		t.Fatal("info that isn't a dictionary was accepted")
+	}
+}
+
+// The info-hashes the torrents under files/ are known by in their swarms
+var fixtureHashes = map[string]string{
+	"Iron Man (2008) 1080p.BluRay.x264.Full 744MB.torrent": "5b202481a8f769e8024f90d111e890f0887a4d51",
+	"Marvel's Avengers (v1.3.3-141640, MULTi15).torrent":   "394b96f091a7568f8de7a3aee5a8162760bb4237",
+}
+
+func TestHashInfoOfFixtures(t *testing.T) {
+	paths, err := filepath.Glob(filepath.Join("..", "files", "*.torrent"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(paths) != len(fixtureHashes) {
+		t.Fatalf("found %v torrents under files/, want %v", len(paths), len(fixtureHashes))
+	}
+
+	for _, path := range paths {
+		name := filepath.Base(path)
+		want, ok := fixtureHashes[name]
+		if !ok {
+			t.Errorf("%s: no known info-hash", name)
+			continue
+		}
+
+		stream, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		info, err := ParseMetaInfo(stream)
+		if err != nil {
+			t.Errorf("%s: %s", name, err)
+			continue
+		}
+
+		if got := hex.EncodeToString(info.HashInfo()); got != want {
+			t.Errorf("%s: info-hash is %s, want %s", name, got, want)
+		}
+	}
+}
+
+func TestStopBeforeStart(t *testing.T) {
+	torrent := newTestTorrent(t, make([]byte, 4*blockSize), NewMemoryStorage())
+	torrent.Stop()
+
+	returned := make(chan struct{})
+	go func() {
+		torrent.Start()
+		close(returned)
+	}()
+
+	select {
+	case <-returned:
+	case <-time.After(5 * time.Second):
+		t.Fatal("torrent stopped before it was started ran anyway")
+	}
+}
+
+func TestDoneWhenCompleteAtStart(t *testing.T) {
+	data := make([]byte, 4*blockSize)
+	storage := NewMemoryStorage()
+	seeded := newTestTorrent(t, data, storage)
+	for i := range seeded.Pieces {
+		if !receivePiece(seeded, i, data) {
+			t.Fatalf("piece %v wasn't completed", i)
+		}
+	}
+
+	torrent := newTestTorrent(t, data, storage)
+	returned := make(chan struct{})
+	go func() {
+		torrent.Start()
+		close(returned)
+	}()
+
+	select {
+	case <-torrent.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("Done wasn't closed for a torrent that was complete when started")
+	}
+
+	// It is seeded until it is stopped
+	select {
+	case <-returned:
+		t.Fatal("complete torrent returned before it was stopped")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	torrent.Stop()
+	select {
+	case <-returned:
+	case <-time.After(5 * time.Second):
+		t.Fatal("torrent didn't stop")
+	}
+}
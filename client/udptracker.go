@@ -0,0 +1,318 @@
+package client
+
+// Will handle talking to UDP trackers (BEP 15) over one socket shared by every tracker
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	udpProtocolID      = 0x41727101980 // magic constant that starts every connect request
+	maxUDPRetransmits  = 8             // the n-th try waits udpRetransmitTimeout·2^n for an answer
+	udpConnectionIDAge = time.Minute   // how long a connection ID may be used
+	maxUDPPacket       = 2048          // large enough for any answer we're interested in
+)
+
+// udpRetransmitTimeout is how long the first try of a request waits for an answer. Tests shorten it.
+var udpRetransmitTimeout = 15 * time.Second
+
+// UDP tracker actions
+const (
+	udpConnect  uint32 = 0
+	udpAnnounce uint32 = 1
+	udpScrape   uint32 = 2
+	udpError    uint32 = 3
+)
+
+// udpEvents maps the events of announces to the numbers UDP trackers know them by
+var udpEvents = map[string]uint32{"": 0, completed: 1, started: 2, stopped: 3}
+
+var (
+	errAnnounceCancelled = errors.New("announce cancelled")
+	errUDPTimeout        = errors.New("tracker didn't answer in time")
+)
+
+// udpTrackers is the client every UDP tracker is reached through
+var udpTrackers = udpTrackerClient{
+	pending:     map[uint32]*udpTransaction{},
+	connections: map[string]udpConnection{},
+}
+
+// A udpTrackerClient sends the requests to all UDP trackers from a single socket, and hands the answers
+// that come in to the transactions that wait for them
+type udpTrackerClient struct {
+	mu          sync.Mutex
+	conn        net.PacketConn
+	pending     map[uint32]*udpTransaction // transactions waiting for an answer, by transaction ID
+	connections map[string]udpConnection   // connection IDs handed out, by tracker address
+}
+
+// A udpTransaction is a request waiting for the answer of a tracker
+type udpTransaction struct {
+	tracker  string
+	response chan []byte
+}
+
+// A udpConnection is a connection ID, and when the tracker handed it out
+type udpConnection struct {
+	id       uint64
+	obtained time.Time
+}
+
+// announceUDP announces the request to the UDP tracker at the given host:port. It first obtains a
+// connection ID, unless the tracker handed one out less than a minute ago, and then sends the announce
+// with it through transact, which retransmits both until the tracker answers or the request is cancelled.
+func (request *TrackerRequest) announceUDP(address string) (*announceResult, error) {
+	raddr, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve provided udp address: %s", err.Error())
+	}
+
+	/*  Create a payload that holds the 82 bytes that follow the connection ID, action
+	and transaction ID of our announce:
+	Offset  Size   			Name    Value
+	0       64-bit integer  connection_id
+	8       32-bit integer  action          1 // announce
+	12      32-bit integer  transaction_id
+	16      20-byte string  info_hash
+	36      20-byte string  peer_id
+	56      64-bit integer  downloaded
+	64      64-bit integer  left
+	72      64-bit integer  uploaded
+	80      32-bit integer  event           0 // 0: none; 1: completed; 2: started; 3: stopped
+	84      32-bit integer  IP address      0 // default
+	88      32-bit integer  key
+	92      32-bit integer  num_want        -1 // default
+	96      16-bit integer  port
+	98
+	*/
+	payload := make([]byte, 82)
+	copy(payload[0:20], request.InfoHash)
+	copy(payload[20:40], request.PeerID)
+	binary.BigEndian.PutUint64(payload[40:], convertIntToUint64(request.Downloaded))
+	binary.BigEndian.PutUint64(payload[48:], convertIntToUint64(request.Left))
+	binary.BigEndian.PutUint64(payload[56:], convertIntToUint64(request.Uploaded))
+	binary.BigEndian.PutUint32(payload[64:], udpEvents[request.Event])
+	binary.BigEndian.PutUint32(payload[68:], 0)
+	binary.BigEndian.PutUint32(payload[72:], 0)
+	binary.BigEndian.PutUint32(payload[76:], convertIntToUint32(-1))
+	binary.BigEndian.PutUint16(payload[80:], convertIntToUint16(request.Port))
+
+	response, err := udpTrackers.transact(raddr, udpAnnounce, payload, request.cancel)
+	if err != nil {
+		return nil, err
+	}
+
+	/*
+		Offset      Size            Name            Value
+		0           32-bit integer  action          1 // announce
+		4           32-bit integer  transaction_id
+		8           32-bit integer  interval
+		12          32-bit integer  leechers
+		16          32-bit integer  seeders
+		20 + 6 * n  32-bit integer  IP address
+		24 + 6 * n  16-bit integer  TCP port
+		20 + 6 * N
+
+		Trackers we reach over IPv6 send 16-byte IPv6 addresses instead, making 18 bytes per peer.
+	*/
+	if len(response) < 20 {
+		return nil, errors.New("tracker sent a truncated announce response")
+	}
+
+	ipLength := net.IPv4len
+	if raddr.IP.To4() == nil {
+		ipLength = net.IPv6len
+	}
+
+	fmt.Printf("There are %v seeders right now. \n", int32(binary.BigEndian.Uint32(response[16:20])))
+	fmt.Printf("There are %v leechers right now. \n", int32(binary.BigEndian.Uint32(response[12:16])))
+
+	return &announceResult{
+		interval: time.Duration(binary.BigEndian.Uint32(response[8:12])) * time.Second,
+		peers:    parseCompactPeers(response[20:], ipLength),
+	}, nil
+}
+
+// transact sends a request with the given action and payload to the tracker, and returns its answer. The
+// request is sent again whenever the tracker leaves it unanswered, waiting twice as long every time.
+func (client *udpTrackerClient) transact(tracker *net.UDPAddr, action uint32, payload []byte, cancel <-chan struct{}) ([]byte, error) {
+	for n := 0; n <= maxUDPRetransmits; n++ {
+		timeout := udpRetransmitTimeout << uint(n)
+
+		connectionID, err := client.connectionID(tracker, timeout, cancel)
+		if err == errUDPTimeout {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		packet := make([]byte, 16+len(payload))
+		binary.BigEndian.PutUint64(packet[0:], connectionID)
+		binary.BigEndian.PutUint32(packet[8:], action)
+		copy(packet[16:], payload)
+
+		response, err := client.roundTrip(tracker, packet, action, timeout, cancel)
+		if err == errUDPTimeout {
+			continue
+		}
+
+		return response, err
+	}
+
+	return nil, errors.New("tracker doesn't answer")
+}
+
+// connectionID returns the connection ID the tracker handed out, asking for a new one if it is older than a minute
+func (client *udpTrackerClient) connectionID(tracker *net.UDPAddr, timeout time.Duration, cancel <-chan struct{}) (uint64, error) {
+	client.mu.Lock()
+	connection, ok := client.connections[tracker.String()]
+	client.mu.Unlock()
+
+	if ok && time.Since(connection.obtained) < udpConnectionIDAge {
+		return connection.id, nil
+	}
+
+	/*  Create a []byte that can hold the 16 bytes that make
+	up the initial connect request:
+	Offset  Size            Name            Value
+	0       64-bit integer  protocol_id     0x41727101980 // magic constant
+	8       32-bit integer  action          0 // connect
+	12      32-bit integer  transaction_id
+	16
+	*/
+	packet := make([]byte, 16)
+	binary.BigEndian.PutUint64(packet[0:], udpProtocolID)
+	binary.BigEndian.PutUint32(packet[8:], udpConnect)
+
+	response, err := client.roundTrip(tracker, packet, udpConnect, timeout, cancel)
+	if err != nil {
+		return 0, err
+	}
+
+	if len(response) < 16 {
+		return 0, errors.New("tracker sent a truncated connect response")
+	}
+
+	connection = udpConnection{id: binary.BigEndian.Uint64(response[8:16]), obtained: time.Now()}
+
+	client.mu.Lock()
+	client.connections[tracker.String()] = connection
+	client.mu.Unlock()
+
+	return connection.id, nil
+}
+
+// roundTrip sends a packet under a new transaction ID, which is written into the packet at offset 12,
+// and waits for the answer to it. An error action (3) from the tracker is returned as an error.
+func (client *udpTrackerClient) roundTrip(tracker *net.UDPAddr, packet []byte, action uint32, timeout time.Duration, cancel <-chan struct{}) ([]byte, error) {
+	conn, err := client.socket()
+	if err != nil {
+		return nil, err
+	}
+
+	transaction := &udpTransaction{tracker: tracker.String(), response: make(chan []byte, 1)}
+
+	client.mu.Lock()
+	transactionID := rand.Uint32()
+	for client.pending[transactionID] != nil {
+		transactionID = rand.Uint32()
+	}
+	client.pending[transactionID] = transaction
+	client.mu.Unlock()
+
+	defer func() {
+		client.mu.Lock()
+		delete(client.pending, transactionID)
+		client.mu.Unlock()
+	}()
+
+	binary.BigEndian.PutUint32(packet[12:], transactionID)
+
+	_, err = conn.WriteTo(packet, tracker)
+	if err != nil {
+		return nil, fmt.Errorf("unable to send request to tracker: %s", err.Error())
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	var response []byte
+	select {
+	case response = <-transaction.response:
+	case <-timer.C:
+		return nil, errUDPTimeout
+	case <-cancel:
+		return nil, errAnnounceCancelled
+	}
+
+	switch binary.BigEndian.Uint32(response[0:4]) {
+	case action:
+		return response, nil
+	case udpError:
+		return nil, fmt.Errorf("tracker refused the request: %s", string(response[8:]))
+	default:
+		return nil, errors.New("tracker answered with an unexpected action")
+	}
+}
+
+// socket returns the UDP socket requests are sent from, opening it the first time it is needed
+func (client *udpTrackerClient) socket() (net.PacketConn, error) {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+
+	if client.conn != nil {
+		return client.conn, nil
+	}
+
+	conn, err := net.ListenPacket("udp", ":0")
+	if err != nil {
+		return nil, fmt.Errorf("unable to open UDP socket for trackers: %s", err.Error())
+	}
+
+	client.conn = conn
+	go client.receive(conn)
+
+	return conn, nil
+}
+
+// receive hands every answer that arrives on the socket to the transaction it belongs to. Answers with
+// an unknown transaction ID, or from another address than the request went to, are dropped.
+func (client *udpTrackerClient) receive(conn net.PacketConn) {
+	buf := make([]byte, maxUDPPacket)
+
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			fmt.Printf("Unable to read from UDP tracker socket: %s \n", err.Error())
+
+			// The next request opens a new socket
+			client.mu.Lock()
+			client.conn = nil
+			client.mu.Unlock()
+			conn.Close()
+			return
+		}
+
+		if n < 8 {
+			continue
+		}
+
+		client.mu.Lock()
+		transaction := client.pending[binary.BigEndian.Uint32(buf[4:8])]
+		if transaction != nil && transaction.tracker == addr.String() {
+			select {
+			case transaction.response <- append([]byte(nil), buf[:n]...):
+			default:
+			}
+		}
+		client.mu.Unlock()
+	}
+}
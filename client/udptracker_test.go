@@ -0,0 +1,279 @@
+package client
+
+import (
+	"encoding/binary"
+	"net"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"goTorrent/tracker"
+)
+
+// A testUDPTracker is a tracker serving UDP through a socket that counts the requests it reads, and can be
+// told to lose announces, or to have the test's before function see every answer just before it is sent
+type testUDPTracker struct {
+	net.PacketConn
+
+	mu        sync.Mutex
+	connects  int
+	announces int
+	drop      int                                // announces left to lose
+	before    func(response []byte, to net.Addr) // called with every answer before it goes out
+}
+
+func newTestUDPTracker(t *testing.T, config tracker.Config) *testUDPTracker {
+	t.Helper()
+
+	return listenTestUDPTracker(t, "127.0.0.1:0", config)
+}
+
+// listenTestUDPTracker is a testUDPTracker listening on the address, e.g. one over IPv6
+func listenTestUDPTracker(t *testing.T, address string, config tracker.Config) *testUDPTracker {
+	t.Helper()
+
+	conn, err := net.ListenPacket("udp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	server := &testUDPTracker{PacketConn: conn}
+	go tracker.New(config).ServeUDP(server)
+
+	return server
+}
+
+func (server *testUDPTracker) ReadFrom(buf []byte) (int, net.Addr, error) {
+	for {
+		n, addr, err := server.PacketConn.ReadFrom(buf)
+		if err != nil || n < 16 {
+			return n, addr, err
+		}
+
+		server.mu.Lock()
+		lost := false
+		switch binary.BigEndian.Uint32(buf[8:12]) {
+		case udpConnect:
+			server.connects++
+		case udpAnnounce:
+			server.announces++
+			if server.drop > 0 {
+				server.drop--
+				lost = true
+			}
+		}
+		server.mu.Unlock()
+
+		if !lost {
+			return n, addr, err
+		}
+	}
+}
+
+func (server *testUDPTracker) WriteTo(response []byte, addr net.Addr) (int, error) {
+	server.mu.Lock()
+	before := server.before
+	server.mu.Unlock()
+
+	if before != nil {
+		before(response, addr)
+	}
+
+	return server.PacketConn.WriteTo(response, addr)
+}
+
+func (server *testUDPTracker) address() string {
+	return server.LocalAddr().String()
+}
+
+func (server *testUDPTracker) counts() (connects, announces int) {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+
+	return server.connects, server.announces
+}
+
+// joinSwarm announces another peer at port 6881, so the tracker has someone to hand out
+func (server *testUDPTracker) joinSwarm(t *testing.T) {
+	t.Helper()
+
+	request := testRequest()
+	request.PeerID = []byte("-XX0001-000000000001")
+	request.Event = started
+	_, err := request.announceUDP(server.address())
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// testUDPRequest is the announce of a peer at port 6882, which is handed the one that joined the swarm
+func testUDPRequest() *TrackerRequest {
+	request := testRequest()
+	request.Port = 6882
+
+	return request
+}
+
+var testUDPPeers = []string{"127.0.0.1:6881"}
+
+func TestAnnounceUDP(t *testing.T) {
+	server := newTestUDPTracker(t, tracker.Config{Interval: 15 * time.Minute})
+	server.joinSwarm(t)
+
+	result, err := testUDPRequest().announceUDP(server.address())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if result.interval != 15*time.Minute {
+		t.Errorf("interval is %v", result.interval)
+	}
+	if !reflect.DeepEqual(result.peers, testUDPPeers) {
+		t.Errorf("peers are %v, want %v", result.peers, testUDPPeers)
+	}
+}
+
+func TestAnnounceUDPConnectionIDExpiry(t *testing.T) {
+	server := newTestUDPTracker(t, tracker.Config{})
+	request := testUDPRequest()
+
+	for i := 0; i < 2; i++ {
+		_, err := request.announceUDP(server.address())
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if connects, announces := server.counts(); connects != 1 || announces != 2 {
+		t.Fatalf("got %v connects for %v announces, want the connection ID reused", connects, announces)
+	}
+
+	// Age the connection ID past the point trackers stop accepting it
+	udpTrackers.mu.Lock()
+	for address, connection := range udpTrackers.connections {
+		if address == server.address() {
+			connection.obtained = time.Now().Add(-udpConnectionIDAge)
+			udpTrackers.connections[address] = connection
+		}
+	}
+	udpTrackers.mu.Unlock()
+
+	_, err := request.announceUDP(server.address())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if connects, announces := server.counts(); connects != 2 || announces != 3 {
+		t.Fatalf("got %v connects for %v announces, want a new connection ID once the old one expired", connects, announces)
+	}
+}
+
+func TestAnnounceUDPRetransmit(t *testing.T) {
+	defer func(timeout time.Duration) { udpRetransmitTimeout = timeout }(udpRetransmitTimeout)
+	udpRetransmitTimeout = 50 * time.Millisecond
+
+	server := newTestUDPTracker(t, tracker.Config{})
+	server.joinSwarm(t)
+	_, joined := server.counts()
+
+	// Lose the first two tries
+	server.mu.Lock()
+	server.drop = 2
+	server.mu.Unlock()
+
+	result, err := testUDPRequest().announceUDP(server.address())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(result.peers, testUDPPeers) {
+		t.Errorf("peers are %v, want %v", result.peers, testUDPPeers)
+	}
+	if _, announces := server.counts(); announces-joined != 3 {
+		t.Errorf("announce was sent %v times, want 3", announces-joined)
+	}
+}
+
+func TestAnnounceUDPTransactionIDMismatch(t *testing.T) {
+	impostor, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer impostor.Close()
+
+	server := newTestUDPTracker(t, tracker.Config{})
+	server.joinSwarm(t)
+
+	server.mu.Lock()
+	server.before = func(response []byte, to net.Addr) {
+		if binary.BigEndian.Uint32(response[0:4]) != udpAnnounce {
+			return
+		}
+
+		// An answer with bogus peers comes in first from another address, and one to another transaction
+		bogus := append(append([]byte(nil), response[:20]...), 6, 6, 6, 6, 0, 1)
+		impostor.WriteTo(bogus, to)
+
+		wrong := append([]byte(nil), bogus...)
+		wrong[4] ^= 0xff
+		server.PacketConn.WriteTo(wrong, to)
+	}
+	server.mu.Unlock()
+
+	result, err := testUDPRequest().announceUDP(server.address())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(result.peers, testUDPPeers) {
+		t.Errorf("peers are %v, want %v", result.peers, testUDPPeers)
+	}
+}
+
+func TestAnnounceUDPError(t *testing.T) {
+	server := newTestUDPTracker(t, tracker.Config{Whitelist: [][20]byte{{1}}})
+
+	_, err := testUDPRequest().announceUDP(server.address())
+	if err == nil || !strings.Contains(err.Error(), "torrent not registered") {
+		t.Fatalf("got error %v, want the tracker's message", err)
+	}
+}
+
+func TestAnnounceUDPCancel(t *testing.T) {
+	server := newTestUDPTracker(t, tracker.Config{})
+	server.mu.Lock()
+	server.drop = maxUDPRetransmits + 1
+	server.mu.Unlock()
+
+	request := testUDPRequest()
+	cancel := make(chan struct{})
+	request.cancel = cancel
+	time.AfterFunc(100*time.Millisecond, func() { close(cancel) })
+
+	_, err := request.announceUDP(server.address())
+	if err != errAnnounceCancelled {
+		t.Fatalf("got error %v, want %v", err, errAnnounceCancelled)
+	}
+}
+
+func TestAnnounceUDPOverIPv6(t *testing.T) {
+	server := listenTestUDPTracker(t, "[::1]:0", tracker.Config{})
+	server.joinSwarm(t)
+
+	// A tracker reached over IPv6 sends 18 bytes per peer
+	result, err := testUDPRequest().announceUDP(server.address())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"[::1]:6881"}; !reflect.DeepEqual(result.peers, want) {
+		t.Errorf("peers are %v, want %v", result.peers, want)
+	}
+
+	// And is scraped over IPv6 as well
+	results, err := Scrape("udp://"+server.address(), [][]byte{testRequest().InfoHash})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || results[0].Leechers != 2 {
+		t.Errorf("scrape over IPv6 got %+v, want the two peers that joined", results)
+	}
+}
@@ -0,0 +1,159 @@
+package client
+
+// Will handle seeding: answering the block requests of peers from the verified pieces in storage
+
+import (
+	"fmt"
+)
+
+// maxUploadQueue is the amount of requests a peer may have queued with us. Requests beyond it are dropped.
+const maxUploadQueue = 256
+
+// processRequest queues a block request of the peer, provided it asks for a block of a piece we have
+func (peer *Peer) processRequest(reqMsg *RequestMessage) {
+	/*	request: <len=0013><id=6><index><begin><length>
+
+		The request message is fixed length, and is used to request a block. The payload contains the following information:
+
+			index: integer specifying the zero-based piece index
+			begin: integer specifying the zero-based byte offset within the piece
+			length: integer specifying the requested length.
+	*/
+	request := blockRequest{index: reqMsg.Index, begin: reqMsg.Begin, length: reqMsg.Length}
+
+	// A choked peer knows its requests won't be answered
+	if peer.amChoking {
+		return
+	}
+
+	if !peer.torrent.canUpload(request) {
+		fmt.Printf("Ignoring invalid request from %s for %v bytes at %v of piece %v \n", peer.address, request.length, request.begin, request.index)
+		return
+	}
+
+	if len(peer.uploads) >= maxUploadQueue {
+		return
+	}
+
+	// Requests are queued, so a cancel that arrives before one is answered can still drop it
+	peer.uploads = append(peer.uploads, request)
+
+	select {
+	case peer.uploadReady <- struct{}{}:
+	default:
+	}
+}
+
+// canUpload reports whether the request is for at most 16 KiB of a piece we have verified
+func (torrent *Torrent) canUpload(request blockRequest) bool {
+	if request.index < 0 || request.index >= len(torrent.Pieces) {
+		return false
+	}
+
+	piece := &torrent.Pieces[request.index]
+
+	return torrent.have.Test(piece.Index) &&
+		request.length > 0 && request.length <= blockSize &&
+		request.begin >= 0 && request.begin+request.length <= piece.Length
+}
+
+// upload answers the queued requests of the peer until the connection is closed
+func (peer *Peer) upload() {
+	for {
+		select {
+		case <-peer.closed:
+			return
+		case <-peer.uploadReady:
+		}
+
+		for {
+			request, storage, ok := peer.nextUpload()
+			if !ok {
+				break
+			}
+
+			block := make([]byte, request.length)
+			_, err := storage.ReadAt(block, int64(request.begin))
+			if err != nil {
+				fmt.Printf("Unable to read block of piece %v: %s \n", request.index, err.Error())
+				continue
+			}
+
+			err = peer.send(&PieceMessage{Index: request.index, Begin: request.begin, Block: block})
+			if err != nil {
+				return
+			}
+
+			// Only blocks that were written count as uploaded
+			torrent := peer.torrent
+			torrent.mu.Lock()
+			peer.uploaded += int64(request.length)
+			torrent.uploaded += int64(request.length)
+			torrent.mu.Unlock()
+		}
+	}
+}
+
+// nextUpload takes the first request off the peer's upload queue, along with the storage of its piece
+func (peer *Peer) nextUpload() (blockRequest, PieceStorage, bool) {
+	torrent := peer.torrent
+
+	torrent.mu.Lock()
+	defer torrent.mu.Unlock()
+
+	if peer.amChoking || len(peer.uploads) == 0 {
+		return blockRequest{}, nil, false
+	}
+
+	request := peer.uploads[0]
+	peer.uploads = peer.uploads[1:]
+
+	return request, torrent.storage.Piece(&torrent.Pieces[request.index]), true
+}
+
+// unchoke lets the peer know its requests will be answered. It returns the message to send, or nil if the
+// peer already was unchoked.
+func (peer *Peer) unchoke() Message {
+	if !peer.amChoking {
+		return nil
+	}
+
+	peer.amChoking = false
+	return &UnchokeMessage{}
+}
+
+// choke stops answering the peer's requests. Requests it queued are dropped, as the peer will send them
+// again once it is unchoked. It returns the message to send, or nil if the peer already was choked.
+func (peer *Peer) choke() Message {
+	if peer.amChoking {
+		return nil
+	}
+
+	peer.amChoking = true
+	peer.uploads = nil
+	return &ChokeMessage{}
+}
+
+// Recheck verifies the data already in storage, so the pieces we have are shared instead of downloaded again
+func (torrent *Torrent) Recheck() {
+	for i := range torrent.Pieces {
+		piece := &torrent.Pieces[i]
+		storage := torrent.storage.Piece(piece)
+
+		data := make([]byte, piece.Length)
+		_, err := storage.ReadAt(data, 0)
+		if err != nil || !piece.verify(data, torrent.Data.Info.PieceLength) {
+			continue
+		}
+
+		err = storage.MarkComplete()
+		if err != nil {
+			fmt.Printf("Unable to mark piece %v complete: %s \n", piece.Index, err.Error())
+			continue
+		}
+
+		torrent.mu.Lock()
+		torrent.have.Set(piece.Index)
+		torrent.mu.Unlock()
+	}
+}
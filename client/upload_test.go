@@ -0,0 +1,100 @@
+package client
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// newTestUploader sets up a peer of a torrent that has every piece, uploading to the far end of the returned pipe
+func newTestUploader(t *testing.T) (*Peer, net.Conn) {
+	t.Helper()
+
+	data := make([]byte, 4*blockSize)
+	torrent := newTestTorrent(t, data, NewMemoryStorage())
+	for i := range torrent.Pieces {
+		if !receivePiece(torrent, i, data) {
+			t.Fatalf("piece %v wasn't completed", i)
+		}
+	}
+
+	local, remote := net.Pipe()
+	t.Cleanup(func() {
+		local.Close()
+		remote.Close()
+	})
+
+	peer := &Peer{
+		address:     "pipe",
+		torrent:     torrent,
+		conn:        &local,
+		uploadReady: make(chan struct{}, 1),
+		closed:      make(chan struct{}),
+	}
+	t.Cleanup(func() { close(peer.closed) })
+
+	return peer, remote
+}
+
+func uploadedBytes(peer *Peer) (int64, int64) {
+	peer.torrent.mu.Lock()
+	defer peer.torrent.mu.Unlock()
+
+	return peer.uploaded, peer.torrent.uploaded
+}
+
+func TestUploadCountsSentBlocks(t *testing.T) {
+	peer, remote := newTestUploader(t)
+	go peer.upload()
+
+	peer.torrent.mu.Lock()
+	peer.processRequest(&RequestMessage{Index: 1, Begin: 0, Length: blockSize})
+	peer.torrent.mu.Unlock()
+
+	remote.SetReadDeadline(time.Now().Add(5 * time.Second))
+	msg, err := ReadMessage(remote)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if block, ok := msg.(*PieceMessage); !ok || block.Index != 1 || len(block.Block) != blockSize {
+		t.Fatalf("peer was sent %#v", msg)
+	}
+
+	// The count follows the write, so give the uploader a moment to take the lock
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		uploaded, total := uploadedBytes(peer)
+		if uploaded == blockSize && total == blockSize {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("uploaded %v bytes to the peer and %v in total, want %v", uploaded, total, blockSize)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestUploadSkipsFailedWrites(t *testing.T) {
+	peer, remote := newTestUploader(t)
+	remote.Close()
+
+	peer.torrent.mu.Lock()
+	peer.processRequest(&RequestMessage{Index: 1, Begin: 0, Length: blockSize})
+	peer.torrent.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		peer.upload()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("uploader kept going after the write failed")
+	}
+
+	if uploaded, total := uploadedBytes(peer); uploaded != 0 || total != 0 {
+		t.Fatalf("uploaded %v bytes to the peer and %v in total, though the block never went out", uploaded, total)
+	}
+}
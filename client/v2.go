@@ -0,0 +1,704 @@
+package client
+
+// Will handle BitTorrent v2 (BEP 52): the file tree, piece layers, SHA256 merkle trees and the hash messages
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/bits"
+	"sort"
+	"strconv"
+
+	"github.com/zeebo/bencode"
+)
+
+const (
+	merkleBlockSize = 16384 // v2 leaf hashes each cover a 16 KiB block
+	maxHashesLength = 512   // most hashes we ask for in a single hash request
+
+	v2ProtocolBit = 0x10 // reserved[7] of the handshake, set by clients that support v2
+
+	hashRequestID = 21
+	hashesID      = 22
+	hashRejectID  = 23
+)
+
+var zeroHash = make([]byte, sha256.Size)
+
+// A v2File is a file of the file tree together with the pieces it occupies
+type v2File struct {
+	path       []string
+	length     int
+	piecesRoot string
+	firstPiece int
+	pieceCount int
+}
+
+// UnmarshalBencode decodes the file tree and every directory below it
+func (tree *FileTree) UnmarshalBencode(stream []byte) error {
+	entries := map[string]bencode.RawMessage{}
+	err := bencode.DecodeBytes(stream, &entries)
+	if err != nil {
+		return err
+	}
+
+	*tree = FileTree{}
+
+	for name, raw := range entries {
+		if name == "" {
+			return errors.New("file tree entry has an empty name")
+		}
+
+		node := FileTreeNode{}
+		keys := map[string]bencode.RawMessage{}
+		err := bencode.DecodeBytes(raw, &keys)
+		if err != nil {
+			return err
+		}
+
+		if rawEntry, ok := keys[""]; ok {
+			if len(keys) != 1 {
+				return fmt.Errorf("file tree node %q is both a file and a directory", name)
+			}
+
+			entry := FileTreeEntry{}
+			err := bencode.DecodeBytes(rawEntry, &entry)
+			if err != nil {
+				return err
+			}
+			node.File = &entry
+		} else {
+			err := node.Children.UnmarshalBencode(raw)
+			if err != nil {
+				return err
+			}
+		}
+
+		(*tree)[name] = &node
+	}
+
+	return nil
+}
+
+// MarshalBencode encodes the file tree the way it is stored in the info dictionary
+func (tree FileTree) MarshalBencode() ([]byte, error) {
+	entries := map[string]interface{}{}
+	for name, node := range tree {
+		if node.File != nil {
+			entries[name] = map[string]interface{}{"": node.File}
+		} else {
+			entries[name] = node.Children
+		}
+	}
+
+	return bencode.EncodeBytes(entries)
+}
+
+// files flattens the tree into its files. Names are visited in sorted order, which is the order of the files in the torrent.
+func (tree FileTree) files(path []string, files []v2File) []v2File {
+	names := make([]string, 0, len(tree))
+	for name := range tree {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		node := tree[name]
+		nodePath := append(append([]string(nil), path...), name)
+
+		if node.File != nil {
+			files = append(files, v2File{
+				path:       nodePath,
+				length:     node.File.Length,
+				piecesRoot: node.File.PiecesRoot,
+			})
+			continue
+		}
+
+		files = node.Children.files(nodePath, files)
+	}
+
+	return files
+}
+
+// isV2 reports whether the torrent has a v2 info dictionary, either on its own or as part of a hybrid torrent
+func (torrent *Torrent) isV2() bool {
+	return torrent.HashV2 != nil
+}
+
+// isHybrid reports whether the torrent can be downloaded from both the v1 and the v2 swarm
+func (torrent *Torrent) isHybrid() bool {
+	return torrent.isV2() && torrent.Data.Info.Pieces != ""
+}
+
+// ownsInfoHash reports whether a 20-byte info-hash received from a peer belongs to this torrent
+func (torrent *Torrent) ownsInfoHash(infoHash []byte) bool {
+	if bytes.Equal(torrent.Hash, infoHash) {
+		return true
+	}
+
+	return torrent.isV2() && bytes.Equal(torrent.HashV2[:20], infoHash)
+}
+
+// matchesInfo reports whether a downloaded info dictionary is the one the torrent's info-hash was computed from
+func (torrent *Torrent) matchesInfo(rawInfo []byte) bool {
+	if torrent.isV2() {
+		hash := sha256.Sum256(rawInfo)
+		return bytes.Equal(hash[:], torrent.HashV2)
+	}
+
+	hash := sha1.Sum(rawInfo)
+	return bytes.Equal(hash[:], torrent.Hash)
+}
+
+// loadFileTree reads the v2 file tree, checks the piece layers against the pieces roots and works out
+// which pieces every file occupies. Files start at a piece boundary, so the piece indexes line up with
+// the padding files of the v1 part of a hybrid torrent.
+func (torrent *Torrent) loadFileTree() error {
+	info := &torrent.Data.Info
+
+	if len(info.FileTree) == 0 {
+		return errors.New("v2 torrent has no file tree")
+	}
+
+	if info.PieceLength < merkleBlockSize || info.PieceLength&(info.PieceLength-1) != 0 {
+		return fmt.Errorf("v2 piece length %v is not a power of two of at least 16 KiB", info.PieceLength)
+	}
+
+	torrent.v2Files = info.FileTree.files(nil, nil)
+	if len(torrent.v2Files) == 0 {
+		return errors.New("v2 file tree contains no files")
+	}
+
+	index := 0
+	for i := range torrent.v2Files {
+		file := &torrent.v2Files[i]
+
+		if file.length < 0 {
+			return fmt.Errorf("file %v has a negative length", file.path)
+		}
+		if file.length > 0 && len(file.piecesRoot) != sha256.Size {
+			return fmt.Errorf("file %v has no valid pieces root", file.path)
+		}
+
+		file.firstPiece = index
+		file.pieceCount = (file.length + info.PieceLength - 1) / info.PieceLength
+		index += file.pieceCount
+
+		if file.pieceCount <= 1 {
+			continue
+		}
+
+		// Piece layers may be missing for magnet links, they are requested from peers instead
+		layer, ok := torrent.Data.PieceLayers[file.piecesRoot]
+		if !ok {
+			continue
+		}
+
+		err := torrent.checkPieceLayer(file, layer)
+		if err != nil {
+			return err
+		}
+	}
+
+	if torrent.isHybrid() && index != len(info.Pieces)/20 {
+		return fmt.Errorf("hybrid torrent has %v v1 pieces but %v v2 pieces", len(info.Pieces)/20, index)
+	}
+
+	return nil
+}
+
+// checkPieceLayer verifies that a file's piece layer hashes up to its pieces root
+func (torrent *Torrent) checkPieceLayer(file *v2File, layer string) error {
+	if len(layer) != sha256.Size*file.pieceCount {
+		return fmt.Errorf("piece layer of %v has %v bytes, expected %v", file.path, len(layer), sha256.Size*file.pieceCount)
+	}
+
+	hashes := splitHashes([]byte(layer))
+	root := merkleRoot(hashes, nextPowerOfTwo(file.pieceCount), padHash(torrent.pieceLayerIndex()))
+
+	if !bytes.Equal(root, []byte(file.piecesRoot)) {
+		return fmt.Errorf("piece layer of %v does not match its pieces root", file.path)
+	}
+
+	return nil
+}
+
+// pieceLayerIndex is the layer of the merkle trees that holds the piece hashes, counted from the 16 KiB leaves
+func (torrent *Torrent) pieceLayerIndex() int {
+	return bits.TrailingZeros(uint(torrent.Data.Info.PieceLength / merkleBlockSize))
+}
+
+// splitPiecesV2 creates the pieces of a v2-only torrent. Every file starts at a piece boundary, so the
+// last piece of a file is usually short. The layout is mirrored into Info.Files, with padding files
+// filling up the last piece of each file, so files can be mapped the same way as a v1 torrent's.
+func (torrent *Torrent) splitPiecesV2() {
+	info := &torrent.Data.Info
+	var files []File
+
+	for i, file := range torrent.v2Files {
+		layer := torrent.Data.PieceLayers[file.piecesRoot]
+
+		for p := 0; p < file.pieceCount; p++ {
+			piece := Piece{
+				Index:  file.firstPiece + p,
+				Length: info.PieceLength,
+			}
+
+			if p == file.pieceCount-1 && file.length%info.PieceLength != 0 {
+				piece.Length = file.length % info.PieceLength
+			}
+
+			if file.pieceCount == 1 {
+				piece.HashV2 = []byte(file.piecesRoot)
+				piece.rootHash = true
+			} else if layer != "" {
+				piece.HashV2 = []byte(layer[sha256.Size*p : sha256.Size*(p+1)])
+			}
+
+			piece.prepBlocks(piece.Length)
+			torrent.Pieces = append(torrent.Pieces, piece)
+		}
+
+		files = append(files, File{Path: file.path, Length: file.length})
+
+		if padding := file.pieceCount*info.PieceLength - file.length; padding > 0 && i < len(torrent.v2Files)-1 {
+			files = append(files, File{
+				Path:   []string{".pad", strconv.Itoa(padding)},
+				Length: padding,
+				Attr:   "p",
+			})
+		}
+	}
+
+	if len(torrent.v2Files) == 1 && len(torrent.v2Files[0].path) == 1 && torrent.v2Files[0].path[0] == info.Name {
+		info.Length = torrent.v2Files[0].length
+		return
+	}
+
+	info.Files = files
+}
+
+// setPieceLayer stores a verified piece layer and hands its hashes to the file's pieces. The torrent must be locked.
+func (torrent *Torrent) setPieceLayer(file *v2File, layer []byte) {
+	if torrent.Data.PieceLayers == nil {
+		torrent.Data.PieceLayers = PieceLayers{}
+	}
+	torrent.Data.PieceLayers[file.piecesRoot] = string(layer)
+
+	for p := 0; p < file.pieceCount; p++ {
+		index := file.firstPiece + p
+		if index < len(torrent.Pieces) && !torrent.isHybrid() {
+			torrent.Pieces[index].HashV2 = layer[sha256.Size*p : sha256.Size*(p+1)]
+		}
+	}
+}
+
+func (torrent *Torrent) v2FileByRoot(root []byte) *v2File {
+	for i := range torrent.v2Files {
+		if torrent.v2Files[i].piecesRoot == string(root) {
+			return &torrent.v2Files[i]
+		}
+	}
+
+	return nil
+}
+
+// verifyV2 checks the data of a piece against its merkle hash
+func (piece *Piece) verifyV2(data []byte, pieceLength int) bool {
+	if piece.HashV2 == nil {
+		return false
+	}
+
+	leaves := blockHashes(data)
+
+	// A file that fits in a single piece has its tree cut down to the blocks it needs
+	width := pieceLength / merkleBlockSize
+	if piece.rootHash {
+		width = nextPowerOfTwo(len(leaves))
+	}
+
+	return bytes.Equal(merkleRoot(leaves, width, zeroHash), piece.HashV2)
+}
+
+// blockHashes returns the SHA256 hash of every 16 KiB block of data. The last block may be shorter.
+func blockHashes(data []byte) [][]byte {
+	var hashes [][]byte
+	for offset := 0; offset < len(data); offset += merkleBlockSize {
+		end := offset + merkleBlockSize
+		if end > len(data) {
+			end = len(data)
+		}
+		hash := sha256.Sum256(data[offset:end])
+		hashes = append(hashes, hash[:])
+	}
+
+	return hashes
+}
+
+func hashPair(left, right []byte) []byte {
+	hash := sha256.New()
+	hash.Write(left)
+	hash.Write(right)
+
+	return hash.Sum(nil)
+}
+
+// padHash returns the root of a subtree of the given height whose leaves are all zero
+func padHash(height int) []byte {
+	hash := zeroHash
+	for i := 0; i < height; i++ {
+		hash = hashPair(hash, hash)
+	}
+
+	return hash
+}
+
+// merkleRoot computes the root of the tree with layer at the bottom, padded to width (a power of two) with pad
+func merkleRoot(layer [][]byte, width int, pad []byte) []byte {
+	levels := merkleLevels(layer, width, pad)
+	top := levels[len(levels)-1]
+
+	if len(top) == 0 {
+		return pad
+	}
+
+	return top[0]
+}
+
+// merkleLevels returns every level of the tree, from layer at the bottom up to the root. Only the hashes
+// covering layer are stored, anything to the right of them hashes up from pad.
+func merkleLevels(layer [][]byte, width int, pad []byte) [][][]byte {
+	levels := [][][]byte{layer}
+
+	for ; width > 1; width /= 2 {
+		next := make([][]byte, (len(layer)+1)/2)
+		for i := range next {
+			right := pad
+			if 2*i+1 < len(layer) {
+				right = layer[2*i+1]
+			}
+			next[i] = hashPair(layer[2*i], right)
+		}
+
+		layer = next
+		pad = hashPair(pad, pad)
+		levels = append(levels, layer)
+	}
+
+	return levels
+}
+
+func nextPowerOfTwo(n int) int {
+	power := 1
+	for power < n {
+		power *= 2
+	}
+
+	return power
+}
+
+func splitHashes(stream []byte) [][]byte {
+	hashes := make([][]byte, 0, len(stream)/sha256.Size)
+	for offset := 0; offset+sha256.Size <= len(stream); offset += sha256.Size {
+		hashes = append(hashes, stream[offset:offset+sha256.Size])
+	}
+
+	return hashes
+}
+
+// A hashRequest is the payload shared by the hash request, hashes and hash reject messages
+type hashRequest struct {
+	piecesRoot  []byte
+	baseLayer   int
+	index       int
+	length      int
+	proofLayers int
+}
+
+// HashRequestMessage asks a v2 peer for hashes of a layer of a file's merkle tree
+type HashRequestMessage struct {
+	hashRequest
+}
+
+// HashesMessage answers a hash request with the requested hashes, followed by the uncle hashes that prove them
+type HashesMessage struct {
+	hashRequest
+	Hashes [][]byte
+}
+
+// HashRejectMessage tells the peer we won't answer its hash request
+type HashRejectMessage struct {
+	hashRequest
+}
+
+func (*HashRequestMessage) ID() byte { return hashRequestID }
+func (*HashesMessage) ID() byte      { return hashesID }
+func (*HashRejectMessage) ID() byte  { return hashRejectID }
+
+func (req *hashRequest) payload() []byte {
+	/*	hash request: <len=0049><id=21><pieces root><base layer><index><length><proof layers>
+		hashes:       <len=0049+X><id=22><pieces root><base layer><index><length><proof layers><hashes>
+		hash reject:  <len=0049><id=23><pieces root><base layer><index><length><proof layers>
+
+		pieces root: the 32-byte root of the file the hashes belong to
+		base layer: the layer of the tree the hashes are taken from, 0 being the 16 KiB leaves
+		index: offset of the first hash in the base layer, a multiple of length
+		length: amount of hashes from the base layer, a power of two
+		proof layers: amount of uncle hashes following the base hashes, needed to verify them against the pieces root
+	*/
+	payload := make([]byte, 48)
+	copy(payload[0:32], req.piecesRoot)
+	binary.BigEndian.PutUint32(payload[32:36], uint32(req.baseLayer))
+	binary.BigEndian.PutUint32(payload[36:40], uint32(req.index))
+	binary.BigEndian.PutUint32(payload[40:44], uint32(req.length))
+	binary.BigEndian.PutUint32(payload[44:48], uint32(req.proofLayers))
+
+	return payload
+}
+
+func (req *hashRequest) parse(payload []byte) error {
+	if len(payload) < 48 {
+		return fmt.Errorf("hash message payload of %v bytes is too short", len(payload))
+	}
+
+	req.piecesRoot = payload[0:32]
+	req.baseLayer = int(binary.BigEndian.Uint32(payload[32:36]))
+	req.index = int(binary.BigEndian.Uint32(payload[36:40]))
+	req.length = int(binary.BigEndian.Uint32(payload[40:44]))
+	req.proofLayers = int(binary.BigEndian.Uint32(payload[44:48]))
+	return nil
+}
+
+func (msg *HashRequestMessage) parse(payload []byte) error {
+	err := expectLength("hash request", payload, 48)
+	if err != nil {
+		return err
+	}
+
+	return msg.hashRequest.parse(payload)
+}
+
+func (msg *HashRejectMessage) parse(payload []byte) error {
+	err := expectLength("hash reject", payload, 48)
+	if err != nil {
+		return err
+	}
+
+	return msg.hashRequest.parse(payload)
+}
+
+func (msg *HashesMessage) payload() []byte {
+	return append(msg.hashRequest.payload(), bytes.Join(msg.Hashes, nil)...)
+}
+
+func (msg *HashesMessage) parse(payload []byte) error {
+	err := msg.hashRequest.parse(payload)
+	if err != nil {
+		return err
+	}
+
+	if (len(payload)-48)%sha256.Size != 0 {
+		return fmt.Errorf("hashes message carries %v bytes of hashes, which is not a multiple of %v", len(payload)-48, sha256.Size)
+	}
+
+	msg.Hashes = splitHashes(payload[48:])
+	return nil
+}
+
+// isValid checks that the request asks for a whole, aligned subtree of the file's piece layer
+func (req *hashRequest) isValid(file *v2File, pieceLayer int) bool {
+	width := nextPowerOfTwo(file.pieceCount)
+
+	return file.pieceCount > 1 &&
+		req.baseLayer == pieceLayer &&
+		req.length > 0 && req.length <= maxHashesLength &&
+		req.length&(req.length-1) == 0 &&
+		req.index%req.length == 0 &&
+		req.index+req.length <= width
+}
+
+// missingPieceLayerRequests returns hash requests for the piece layers of every file we don't have them for yet.
+// The torrent must be locked.
+func (torrent *Torrent) missingPieceLayerRequests() []*hashRequest {
+	var requests []*hashRequest
+
+	for _, file := range torrent.v2Files {
+		if file.pieceCount <= 1 {
+			continue
+		}
+		if _, ok := torrent.Data.PieceLayers[file.piecesRoot]; ok {
+			continue
+		}
+
+		width := nextPowerOfTwo(file.pieceCount)
+		length := width
+		if length > maxHashesLength {
+			length = maxHashesLength
+		}
+
+		for index := 0; index < file.pieceCount; index += length {
+			requests = append(requests, &hashRequest{
+				piecesRoot:  []byte(file.piecesRoot),
+				baseLayer:   torrent.pieceLayerIndex(),
+				index:       index,
+				length:      length,
+				proofLayers: bits.TrailingZeros(uint(width)) - bits.TrailingZeros(uint(length)),
+			})
+		}
+	}
+
+	return requests
+}
+
+// requestMissingPieceLayers asks a v2 peer for the piece layers we are missing
+func (peer *Peer) requestMissingPieceLayers() {
+	if peer.torrent == nil {
+		return
+	}
+
+	peer.torrent.mu.Lock()
+	requests := peer.torrent.missingPieceLayerRequests()
+	peer.torrent.mu.Unlock()
+
+	for _, req := range requests {
+		err := peer.send(&HashRequestMessage{*req})
+		if err != nil {
+			return
+		}
+	}
+}
+
+// processHashRequest answers a hash request with hashes from the piece layers, or rejects it
+func (peer *Peer) processHashRequest(msg *HashRequestMessage) {
+	torrent := peer.torrent
+	if torrent == nil || peer.conn == nil {
+		return
+	}
+
+	req := msg.hashRequest
+	var reply Message = &HashRejectMessage{req}
+
+	torrent.mu.Lock()
+	file := torrent.v2FileByRoot(req.piecesRoot)
+	if file != nil && req.isValid(file, torrent.pieceLayerIndex()) {
+		if layer, ok := torrent.Data.PieceLayers[file.piecesRoot]; ok {
+			hashes := proofHashes(&req, splitHashes([]byte(layer)), nextPowerOfTwo(file.pieceCount), padHash(torrent.pieceLayerIndex()))
+			req.proofLayers = len(hashes) - req.length
+			reply = &HashesMessage{req, hashes}
+		}
+	}
+	torrent.mu.Unlock()
+
+	peer.send(reply)
+}
+
+// proofHashes returns the requested hashes of the layer followed by the uncle hashes that prove them
+func proofHashes(req *hashRequest, layer [][]byte, width int, pad []byte) [][]byte {
+	levels := merkleLevels(layer, width, pad)
+	pads := [][]byte{pad}
+	for i := 1; i < len(levels); i++ {
+		pads = append(pads, hashPair(pads[i-1], pads[i-1]))
+	}
+
+	hashAt := func(level, index int) []byte {
+		if index < len(levels[level]) {
+			return levels[level][index]
+		}
+		return pads[level]
+	}
+
+	var hashes [][]byte
+	for i := req.index; i < req.index+req.length; i++ {
+		hashes = append(hashes, hashAt(0, i))
+	}
+
+	level := bits.TrailingZeros(uint(req.length))
+	node := req.index / req.length
+	for p := 0; p < req.proofLayers && level < len(levels)-1; p++ {
+		hashes = append(hashes, hashAt(level, node^1))
+		level++
+		node /= 2
+	}
+
+	return hashes
+}
+
+// processHashes verifies hashes sent by a peer against the pieces root and collects them into the file's piece layer
+func (peer *Peer) processHashes(msg *HashesMessage) {
+	req := &msg.hashRequest
+	torrent := peer.torrent
+	if torrent == nil {
+		return
+	}
+
+	torrent.mu.Lock()
+	defer torrent.mu.Unlock()
+
+	file := torrent.v2FileByRoot(req.piecesRoot)
+	if file == nil || !req.isValid(file, torrent.pieceLayerIndex()) {
+		fmt.Printf("Peer %s sent hashes we didn't ask for \n", peer.address)
+		return
+	}
+
+	hashes := msg.Hashes
+	if len(hashes) != req.length+req.proofLayers {
+		fmt.Printf("Peer %s sent %v hashes, expected %v \n", peer.address, len(hashes), req.length+req.proofLayers)
+		return
+	}
+
+	width := nextPowerOfTwo(file.pieceCount)
+	if bits.TrailingZeros(uint(req.length))+req.proofLayers != bits.TrailingZeros(uint(width)) {
+		fmt.Printf("Hashes from %s don't prove up to the pieces root \n", peer.address)
+		return
+	}
+
+	// Hash the base hashes up to their subtree, then climb to the root with the uncles
+	root := merkleRoot(hashes[:req.length], req.length, nil)
+	node := req.index / req.length
+	for _, uncle := range hashes[req.length:] {
+		if node%2 == 0 {
+			root = hashPair(root, uncle)
+		} else {
+			root = hashPair(uncle, root)
+		}
+		node /= 2
+	}
+
+	if !bytes.Equal(root, []byte(file.piecesRoot)) {
+		fmt.Printf("Hashes from %s don't match the pieces root of %v \n", peer.address, file.path)
+		return
+	}
+
+	if torrent.pendingLayers == nil {
+		torrent.pendingLayers = map[string][][]byte{}
+	}
+	pending, ok := torrent.pendingLayers[file.piecesRoot]
+	if !ok {
+		pending = make([][]byte, file.pieceCount)
+		torrent.pendingLayers[file.piecesRoot] = pending
+	}
+
+	for i, hash := range hashes[:req.length] {
+		if req.index+i < file.pieceCount {
+			pending[req.index+i] = hash
+		}
+	}
+
+	for _, hash := range pending {
+		if hash == nil {
+			return
+		}
+	}
+
+	delete(torrent.pendingLayers, file.piecesRoot)
+	torrent.setPieceLayer(file, bytes.Join(pending, nil))
+}
+
+func (peer *Peer) processHashReject(msg *HashRejectMessage) {
+	fmt.Printf("Peer %s rejected our request for %v hashes at index %v \n", peer.address, msg.length, msg.index)
+}
@@ -0,0 +1,409 @@
+package client
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"math/rand"
+	"net"
+	"strings"
+	"testing"
+)
+
+// naiveRoot is the textbook merkle root the v2 code is checked against: the leaves are padded to width
+// with pad, and then hashed pairwise until one hash is left
+func naiveRoot(leaves [][]byte, width int, pad []byte) []byte {
+	layer := append([][]byte(nil), leaves...)
+	for len(layer) < width {
+		layer = append(layer, pad)
+	}
+
+	for len(layer) > 1 {
+		var next [][]byte
+		for i := 0; i < len(layer); i += 2 {
+			hash := sha256.Sum256(append(append([]byte(nil), layer[i]...), layer[i+1]...))
+			next = append(next, hash[:])
+		}
+		layer = next
+	}
+
+	return layer[0]
+}
+
+// leavesOf hashes every 16 KiB block of data
+func leavesOf(data []byte) [][]byte {
+	var leaves [][]byte
+	for offset := 0; offset < len(data); offset += merkleBlockSize {
+		end := offset + merkleBlockSize
+		if end > len(data) {
+			end = len(data)
+		}
+		hash := sha256.Sum256(data[offset:end])
+		leaves = append(leaves, hash[:])
+	}
+
+	return leaves
+}
+
+func testHashes(n int) [][]byte {
+	var hashes [][]byte
+	for i := 0; i < n; i++ {
+		hash := sha256.Sum256([]byte{byte(i)})
+		hashes = append(hashes, hash[:])
+	}
+
+	return hashes
+}
+
+func TestMerkleRoot(t *testing.T) {
+	hashes := testHashes(5)
+
+	cases := []struct {
+		name   string
+		leaves [][]byte
+		width  int
+		pad    []byte
+	}{
+		{"single leaf", hashes[:1], 1, zeroHash},
+		{"full pair", hashes[:2], 2, zeroHash},
+		{"one padded leaf", hashes[:3], 4, zeroHash},
+		{"three padded leaves", hashes[:5], 8, zeroHash},
+		{"leaf padded to a wider tree", hashes[:1], 4, zeroHash},
+		{"padded with a subtree root", hashes[:3], 4, padHash(2)},
+		{"wide tree padded with a subtree root", hashes[:5], 16, padHash(3)},
+	}
+
+	for _, c := range cases {
+		want := naiveRoot(c.leaves, c.width, c.pad)
+		if got := merkleRoot(c.leaves, c.width, c.pad); !bytes.Equal(got, want) {
+			t.Errorf("%s: root is %x, want %x", c.name, got, want)
+		}
+	}
+
+	// The pad of a layer is the root of a subtree of zero leaves
+	for height := 0; height < 5; height++ {
+		if want := naiveRoot(nil, 1<<uint(height), zeroHash); !bytes.Equal(padHash(height), want) {
+			t.Errorf("pad of height %v is %x, want %x", height, padHash(height), want)
+		}
+	}
+}
+
+// A testV2File is a file of a v2 torrent built for a test
+type testV2File struct {
+	path []string
+	data []byte
+}
+
+// testV2MetaInfo builds a v2-only torrent of the files, with pieces roots and piece layers computed by naiveRoot
+func testV2MetaInfo(pieceLength int, files ...testV2File) MetaInfo {
+	blocksPerPiece := pieceLength / merkleBlockSize
+	info := InfoDictionary{Name: "test", PieceLength: pieceLength, MetaVersion: 2, FileTree: FileTree{}}
+	layers := PieceLayers{}
+
+	for _, file := range files {
+		leaves := leavesOf(file.data)
+		pieceCount := (len(file.data) + pieceLength - 1) / pieceLength
+
+		var root []byte
+		if pieceCount == 1 {
+			root = naiveRoot(leaves, nextPowerOfTwo(len(leaves)), zeroHash)
+		} else {
+			root = naiveRoot(leaves, nextPowerOfTwo(pieceCount)*blocksPerPiece, zeroHash)
+
+			var layer []byte
+			for p := 0; p < pieceCount; p++ {
+				end := (p + 1) * blocksPerPiece
+				if end > len(leaves) {
+					end = len(leaves)
+				}
+				layer = append(layer, naiveRoot(leaves[p*blocksPerPiece:end], blocksPerPiece, zeroHash)...)
+			}
+			layers[string(root)] = string(layer)
+		}
+
+		tree := info.FileTree
+		for _, name := range file.path[:len(file.path)-1] {
+			if tree[name] == nil {
+				tree[name] = &FileTreeNode{Children: FileTree{}}
+			}
+			tree = tree[name].Children
+		}
+		tree[file.path[len(file.path)-1]] = &FileTreeNode{File: &FileTreeEntry{Length: len(file.data), PiecesRoot: string(root)}}
+	}
+
+	return MetaInfo{Info: info, PieceLayers: layers}
+}
+
+func loadTestV2(t *testing.T, meta MetaInfo) *Torrent {
+	t.Helper()
+
+	torrent := &Torrent{Data: meta}
+	err := torrent.loadInfo()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return torrent
+}
+
+func randomData(seed int64, length int) []byte {
+	data := make([]byte, length)
+	rand.New(rand.NewSource(seed)).Read(data)
+
+	return data
+}
+
+func testV2Files() []testV2File {
+	return []testV2File{
+		{[]string{"a", "big.bin"}, randomData(1, 4*2*merkleBlockSize+10000)}, // five pieces, the last one short
+		{[]string{"small.txt"}, randomData(2, 2*merkleBlockSize-5)},          // fits in one piece
+	}
+}
+
+func TestVerifyV2(t *testing.T) {
+	pieceLength := 2 * merkleBlockSize
+	files := testV2Files()
+	torrent := loadTestV2(t, testV2MetaInfo(pieceLength, files...))
+
+	if len(torrent.Pieces) != 6 {
+		t.Fatalf("torrent has %v pieces, want 6", len(torrent.Pieces))
+	}
+
+	// The files are in sorted order: a/big.bin, then small.txt starting at a piece boundary
+	data := append([]byte(nil), files[0].data...)
+	data = append(data, make([]byte, 5*pieceLength-len(data))...)
+	data = append(data, files[1].data...)
+
+	for i := range torrent.Pieces {
+		piece := &torrent.Pieces[i]
+		start := i * pieceLength
+		pieceData := data[start : start+piece.Length]
+
+		if !piece.verify(pieceData, pieceLength) {
+			t.Errorf("piece %v doesn't verify", i)
+		}
+
+		bad := append([]byte(nil), pieceData...)
+		bad[len(bad)-1] ^= 0xff
+		if piece.verify(bad, pieceLength) {
+			t.Errorf("piece %v verifies with bad data", i)
+		}
+	}
+}
+
+func TestCheckPieceLayer(t *testing.T) {
+	files := testV2Files()
+	root := testV2MetaInfo(2*merkleBlockSize, files...).Info.FileTree["a"].Children["big.bin"].File.PiecesRoot
+
+	cases := map[string]func(layer string) string{
+		"swapped hashes": func(layer string) string {
+			return layer[32:64] + layer[0:32] + layer[64:]
+		},
+		"changed hash": func(layer string) string {
+			return layer[:len(layer)-1] + "x"
+		},
+		"missing hash": func(layer string) string {
+			return layer[32:]
+		},
+	}
+
+	for name, change := range cases {
+		meta := testV2MetaInfo(2*merkleBlockSize, files...)
+		meta.PieceLayers[root] = change(meta.PieceLayers[root])
+
+		torrent := &Torrent{Data: meta}
+		err := torrent.loadInfo()
+		if err == nil || !strings.Contains(err.Error(), "piece layer of [a big.bin]") {
+			t.Errorf("%s: got error %v, want the piece layer rejected", name, err)
+		}
+	}
+}
+
+// newTestHashPeer sets up a peer of the torrent, whose messages are read from the returned end of a pipe
+func newTestHashPeer(t *testing.T, torrent *Torrent) (*Peer, net.Conn) {
+	t.Helper()
+
+	local, remote := net.Pipe()
+	t.Cleanup(func() {
+		local.Close()
+		remote.Close()
+	})
+
+	return &Peer{address: "pipe", torrent: torrent, conn: &local}, remote
+}
+
+// askForHashes hands the request to the peer and returns its answer
+func askForHashes(t *testing.T, peer *Peer, remote net.Conn, req hashRequest) Message {
+	t.Helper()
+
+	go peer.processHashRequest(&HashRequestMessage{req})
+	reply, err := ReadMessage(remote)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return reply
+}
+
+func TestHashRequests(t *testing.T) {
+	pieceLength := 2 * merkleBlockSize
+	meta := testV2MetaInfo(pieceLength, testV2Files()...)
+	seeder := loadTestV2(t, meta)
+	peer, remote := newTestHashPeer(t, seeder)
+
+	big := &seeder.v2Files[0]
+	small := &seeder.v2Files[1]
+	layer := seeder.pieceLayerIndex()
+
+	rejected := map[string]hashRequest{
+		"unknown root":           {piecesRoot: make([]byte, 32), baseLayer: layer, index: 0, length: 8},
+		"file of a single piece": {piecesRoot: []byte(small.piecesRoot), baseLayer: layer, index: 0, length: 1},
+		"other layer":            {piecesRoot: []byte(big.piecesRoot), baseLayer: 0, index: 0, length: 8},
+		"misaligned":             {piecesRoot: []byte(big.piecesRoot), baseLayer: layer, index: 2, length: 4},
+		"length not a power":     {piecesRoot: []byte(big.piecesRoot), baseLayer: layer, index: 0, length: 3},
+		"past the tree":          {piecesRoot: []byte(big.piecesRoot), baseLayer: layer, index: 8, length: 8},
+	}
+	for name, req := range rejected {
+		answer := askForHashes(t, peer, remote, req)
+		reply, ok := answer.(*HashRejectMessage)
+		if !ok {
+			t.Errorf("%s: request was answered with %T, want a reject", name, answer)
+			continue
+		}
+		if reply.index != req.index || reply.length != req.length {
+			t.Errorf("%s: reject is for %v hashes at %v", name, reply.length, reply.index)
+		}
+	}
+
+	// The whole layer in one go needs no proof, as it hashes up to the root by itself
+	answer := askForHashes(t, peer, remote, hashRequest{piecesRoot: []byte(big.piecesRoot), baseLayer: layer, index: 0, length: 8})
+	reply, ok := answer.(*HashesMessage)
+	if !ok {
+		t.Fatalf("request for the whole layer was answered with %T", answer)
+	}
+	if len(reply.Hashes) != 8 || reply.proofLayers != 0 {
+		t.Fatalf("got %v hashes with %v proof layers, want 8 and 0", len(reply.Hashes), reply.proofLayers)
+	}
+	if got := bytes.Join(reply.Hashes[:5], nil); string(got) != meta.PieceLayers[big.piecesRoot] {
+		t.Fatal("hashes aren't the piece layer")
+	}
+	for _, pad := range reply.Hashes[5:] {
+		if !bytes.Equal(pad, padHash(layer)) {
+			t.Fatalf("hash past the end of the file is %x, want the pad %x", pad, padHash(layer))
+		}
+	}
+}
+
+func TestHashesProveThePieceLayer(t *testing.T) {
+	meta := testV2MetaInfo(2*merkleBlockSize, testV2Files()...)
+	seeder := loadTestV2(t, meta)
+	peer, remote := newTestHashPeer(t, seeder)
+
+	// A leecher that came from a magnet link has the info dictionary, but not the piece layers
+	leecherMeta := meta
+	leecherMeta.PieceLayers = nil
+	leecher := loadTestV2(t, leecherMeta)
+	from := &Peer{address: "seeder", torrent: leecher}
+
+	big := &leecher.v2Files[0]
+	if leecher.Pieces[0].HashV2 != nil {
+		t.Fatal("piece has a hash before the piece layer arrived")
+	}
+	if requests := leecher.missingPieceLayerRequests(); len(requests) != 1 || requests[0].length != 8 {
+		t.Fatalf("leecher asks for %+v, want the 8 hashes of the one file with a piece layer", requests)
+	}
+
+	// Ask for two hashes at a time, so each answer has to prove its hashes with two uncles
+	var answers []*HashesMessage
+	for index := 0; index < 8; index += 2 {
+		req := hashRequest{piecesRoot: []byte(big.piecesRoot), baseLayer: leecher.pieceLayerIndex(), index: index, length: 2, proofLayers: 2}
+		answer := askForHashes(t, peer, remote, req)
+		reply, ok := answer.(*HashesMessage)
+		if !ok {
+			t.Fatalf("request at %v was answered with %T", index, answer)
+		}
+		if len(reply.Hashes) != 4 || reply.proofLayers != 2 {
+			t.Fatalf("got %v hashes with %v proof layers, want 2 hashes and 2 uncles", len(reply.Hashes), reply.proofLayers)
+		}
+		answers = append(answers, reply)
+	}
+
+	tampered := map[string]*HashesMessage{}
+	for name, change := range map[string]func(msg *HashesMessage){
+		"changed hash":  func(msg *HashesMessage) { msg.Hashes[0] = msg.Hashes[1] },
+		"changed uncle": func(msg *HashesMessage) { msg.Hashes[3] = zeroHash },
+		"missing uncle": func(msg *HashesMessage) { msg.Hashes = msg.Hashes[:3] },
+		"short proof":   func(msg *HashesMessage) { msg.Hashes = msg.Hashes[:3]; msg.proofLayers = 1 },
+		"moved":         func(msg *HashesMessage) { msg.index = 2 },
+	} {
+		msg := &HashesMessage{answers[0].hashRequest, append([][]byte(nil), answers[0].Hashes...)}
+		change(msg)
+		tampered[name] = msg
+	}
+	for name, msg := range tampered {
+		from.processHashes(msg)
+		if len(leecher.pendingLayers[big.piecesRoot]) != 0 && leecher.pendingLayers[big.piecesRoot][0] != nil {
+			t.Fatalf("%s: hashes were accepted", name)
+		}
+	}
+
+	// A reject leaves the layer missing
+	from.processHashReject(&HashRejectMessage{answers[0].hashRequest})
+	if _, ok := leecher.Data.PieceLayers[big.piecesRoot]; ok {
+		t.Fatal("piece layer set after a reject")
+	}
+
+	for i, answer := range answers[:3] {
+		if _, ok := leecher.Data.PieceLayers[big.piecesRoot]; ok {
+			t.Fatalf("piece layer set after %v of the 3 answers covering the file", i)
+		}
+		from.processHashes(answer)
+	}
+
+	if leecher.Data.PieceLayers[big.piecesRoot] != meta.PieceLayers[big.piecesRoot] {
+		t.Fatal("piece layer wasn't assembled from the hashes")
+	}
+	for i := 0; i < 5; i++ {
+		if !bytes.Equal(leecher.Pieces[i].HashV2, seeder.Pieces[i].HashV2) {
+			t.Fatalf("piece %v has hash %x, want %x", i, leecher.Pieces[i].HashV2, seeder.Pieces[i].HashV2)
+		}
+	}
+	if requests := leecher.missingPieceLayerRequests(); len(requests) != 0 {
+		t.Fatalf("leecher still asks for %+v", requests)
+	}
+}
+
+func TestProofHashes(t *testing.T) {
+	layer := testHashes(5)
+	pad := padHash(1)
+	root := naiveRoot(layer, 8, pad)
+
+	for length := 1; length <= 8; length *= 2 {
+		for index := 0; index < 8; index += length {
+			proofLayers := 0
+			for width := length; width < 8; width *= 2 {
+				proofLayers++
+			}
+
+			req := &hashRequest{index: index, length: length, proofLayers: proofLayers}
+			hashes := proofHashes(req, layer, 8, pad)
+			if len(hashes) != length+proofLayers {
+				t.Fatalf("%v hashes at %v: got %v hashes, want %v", length, index, len(hashes), length+proofLayers)
+			}
+
+			// Climbing from the subtree of the hashes with the uncles ends at the root
+			hash := naiveRoot(hashes[:length], length, pad)
+			node := index / length
+			for _, uncle := range hashes[length:] {
+				if node%2 == 0 {
+					hash = hashPair(hash, uncle)
+				} else {
+					hash = hashPair(uncle, hash)
+				}
+				node /= 2
+			}
+			if !bytes.Equal(hash, root) {
+				t.Errorf("%v hashes at %v don't prove up to the root", length, index)
+			}
+		}
+	}
+}
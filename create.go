@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"goTorrent/client"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// A listFlag collects every value of a flag that is passed more than once
+type listFlag []string
+
+func (list *listFlag) String() string {
+	return strings.Join(*list, " ")
+}
+
+func (list *listFlag) Set(value string) error {
+	*list = append(*list, value)
+	return nil
+}
+
+// create builds a .torrent file for a file or directory: goTorrent create [flags] <path>
+func create(args []string) {
+	flags := flag.NewFlagSet("create", flag.ExitOnError)
+
+	var trackers, webSeeds listFlag
+	flags.Var(&trackers, "a", "tracker tier, with the trackers of a tier separated by commas. Can be repeated, one per tier")
+	flags.Var(&webSeeds, "w", "web seed URL. Can be repeated")
+	output := flags.String("o", "", "file to write the torrent to (default <name>.torrent)")
+	pieceLength := flags.Int("piece-length", 0, "piece length in bytes, a power of two of at least 16384 (default chosen from the total size)")
+	private := flags.Bool("private", false, "only get peers from the trackers")
+	comment := flags.String("comment", "", "comment stored in the torrent")
+
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: goTorrent create [flags] <file or directory>")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	builder := client.Builder{
+		Path:        flags.Arg(0),
+		PieceLength: *pieceLength,
+		WebSeeds:    webSeeds,
+		Private:     *private,
+		Comment:     *comment,
+	}
+
+	for _, tier := range trackers {
+		builder.AnnounceList = append(builder.AnnounceList, strings.Split(tier, ","))
+	}
+
+	info, err := builder.Build()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if *output == "" {
+		*output = filepath.Base(info.Info.Name) + ".torrent"
+	}
+
+	err = info.Save(*output)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	fmt.Printf("Created %s with %v pieces of %v bytes \n", *output, len(info.Info.Pieces)/20, info.Info.PieceLength)
+	fmt.Printf("Info-hash: %s \n", hex.EncodeToString(info.HashInfo()))
+}
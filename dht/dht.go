@@ -0,0 +1,481 @@
+// Package dht is a node of the mainline DHT (BEP 5), the Kademlia network peers find each other through
+// without a tracker. It answers the queries of other nodes, and looks up and announces peers of info-hashes.
+package dht
+
+// Will handle the node itself: its socket, answering queries, and the transactions of queries we send
+
+import (
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	defaultAddr     = ":6881"
+	queryTimeout    = 5 * time.Second
+	maxPacket       = 2048
+	secretLifetime  = 5 * time.Minute  // tokens are accepted for up to twice this long
+	peerLifetime    = 30 * time.Minute // peers that don't announce again for this long are forgotten
+	maxValues       = 50               // peers handed out in one get_peers response, so it fits in a packet
+	maintenanceTick = time.Minute
+	refreshInterval = 15 * time.Minute // how often we look ourselves up to learn about new nodes around us
+)
+
+var (
+	errClosed  = errors.New("DHT node closed")
+	errTimeout = errors.New("node didn't answer in time")
+)
+
+// DefaultBootstrapNodes are well-known nodes a node joins the network through when it knows no other nodes
+var DefaultBootstrapNodes = []string{
+	"router.bittorrent.com:6881",
+	"dht.transmissionbt.com:6881",
+	"router.utorrent.com:6881",
+}
+
+// Config holds the settings a node runs with. Zero values are replaced by defaults.
+type Config struct {
+	Addr           string   // UDP address to listen on, ":6881" by default
+	BootstrapNodes []string // host:port of nodes to join the network through, DefaultBootstrapNodes by default
+	StateFile      string   // where the node ID and routing table are kept between runs. If empty, nothing is kept
+	ExternalIP     net.IP   // the IPv4 address other nodes see us at. If nil, it is learned from their responses
+	StrictNodeIDs  bool     // leave nodes whose IDs aren't valid for their IP address (BEP 42) out of the routing table
+}
+
+// A Server is our node in the DHT
+type Server struct {
+	config Config
+	conn   net.PacketConn
+	id     [20]byte
+
+	mu           sync.Mutex
+	table        *routingTable
+	pending      map[string]*transaction           // queries waiting for an answer, by transaction ID
+	peers        map[[20]byte]map[string]time.Time // peers announced to us, by info-hash, with when they announced
+	nextID       uint16
+	secret       []byte // tokens handed out are derived from the secret, or the one before it
+	secretBefore []byte
+	externalIP   net.IP                     // our IPv4 address as other nodes see it, the node ID is derived from
+	ipVotes      map[string]map[string]bool // IP addresses nodes say we have, with the nodes that said so
+	closed       chan struct{}
+}
+
+// A transaction is a query waiting for an answer
+type transaction struct {
+	addr     string
+	response chan *krpcMessage
+}
+
+// New starts a node listening on the configured address. The node ID and the nodes it knows are read
+// from the state file if there is one. Otherwise the node starts with an ID derived from the external IP
+// address, or a random one if that isn't known yet, and knows no other nodes until Bootstrap is called
+// or other nodes contact it.
+func New(config Config) (*Server, error) {
+	if config.Addr == "" {
+		config.Addr = defaultAddr
+	}
+	if config.BootstrapNodes == nil {
+		config.BootstrapNodes = DefaultBootstrapNodes
+	}
+
+	var state *savedState
+	if config.StateFile != "" {
+		var err error
+		state, err = loadState(config.StateFile)
+		if err != nil && !os.IsNotExist(err) {
+			fmt.Printf("Unable to load DHT state, starting over: %s \n", err.Error())
+		}
+	}
+
+	conn, err := net.ListenPacket("udp4", config.Addr)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open DHT socket: %s", err.Error())
+	}
+
+	s := &Server{
+		config:     config,
+		conn:       conn,
+		pending:    map[string]*transaction{},
+		peers:      map[[20]byte]map[string]time.Time{},
+		secret:     randomBytes(20),
+		externalIP: config.ExternalIP.To4(),
+		ipVotes:    map[string]map[string]bool{},
+		closed:     make(chan struct{}),
+	}
+	s.secretBefore = s.secret
+	s.restore(state)
+
+	go s.receive()
+	go s.maintain()
+
+	return s, nil
+}
+
+// ID returns our node ID. It changes when we learn that our external IP address is one the ID isn't valid for.
+func (s *Server) ID() [20]byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.id
+}
+
+// ExternalIP returns the IPv4 address other nodes see us at, or nil if it isn't known yet
+func (s *Server) ExternalIP() net.IP {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.externalIP
+}
+
+// Addr returns the address the node listens on
+func (s *Server) Addr() *net.UDPAddr {
+	return s.conn.LocalAddr().(*net.UDPAddr)
+}
+
+// Port returns the UDP port the node listens on, which is what peers are told in a port message
+func (s *Server) Port() int {
+	return s.Addr().Port
+}
+
+// Nodes returns the amount of nodes in the routing table
+func (s *Server) Nodes() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.table.size()
+}
+
+// Close stops the node, saving its state first
+func (s *Server) Close() error {
+	s.mu.Lock()
+	select {
+	case <-s.closed:
+		s.mu.Unlock()
+		return nil
+	default:
+	}
+	close(s.closed)
+	s.mu.Unlock()
+
+	err := s.save()
+	s.conn.Close()
+
+	return err
+}
+
+// AddNode pings the node at the host:port address, adding it to the routing table if it answers. Peers
+// tell us about their nodes in port messages.
+func (s *Server) AddNode(address string) {
+	addr, err := net.ResolveUDPAddr("udp4", address)
+	if err != nil {
+		return
+	}
+
+	go s.query(addr, "ping", &krpcArgs{})
+}
+
+// receive handles every packet that arrives on the socket until the node is closed
+func (s *Server) receive() {
+	buf := make([]byte, maxPacket)
+
+	for {
+		n, addr, err := s.conn.ReadFrom(buf)
+		if err != nil {
+			select {
+			case <-s.closed:
+			default:
+				fmt.Printf("Unable to read from DHT socket: %s \n", err.Error())
+			}
+			return
+		}
+
+		msg, err := decodeMessage(buf[:n])
+		if err != nil {
+			continue
+		}
+
+		udpAddr := addr.(*net.UDPAddr)
+		switch msg.Y {
+		case typeQuery:
+			s.handleQuery(msg, udpAddr)
+		case typeResponse, typeError:
+			s.handleResponse(msg, udpAddr)
+		}
+	}
+}
+
+// handleResponse hands a response or error to the query it answers. Answers from another address than
+// the query went to are dropped.
+func (s *Server) handleResponse(msg *krpcMessage, addr *net.UDPAddr) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t := s.pending[msg.T]
+	if t == nil || t.addr != addr.String() {
+		return
+	}
+	delete(s.pending, msg.T)
+
+	if msg.Y == typeResponse && msg.R != nil {
+		if id, ok := nodeID(msg.R.ID); ok {
+			s.table.seen(id, addr, time.Now())
+		}
+		if len(msg.IP) == compactPeerLength {
+			s.voteExternalIP(net.IP([]byte(msg.IP[:4])), addr)
+		}
+	}
+
+	t.response <- msg
+}
+
+// handleQuery answers a query of another node
+func (s *Server) handleQuery(msg *krpcMessage, addr *net.UDPAddr) {
+	if msg.A == nil {
+		s.send(errorMessage(msg.T, errorProtocol, "missing arguments"), addr)
+		return
+	}
+
+	id, ok := nodeID(msg.A.ID)
+	if !ok {
+		s.send(errorMessage(msg.T, errorProtocol, "invalid node ID"), addr)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.table.seen(id, addr, time.Now())
+	r := &krpcReturn{ID: string(s.id[:])}
+
+	switch msg.Q {
+	case "ping":
+
+	case "find_node":
+		target, ok := nodeID(msg.A.Target)
+		if !ok {
+			s.send(errorMessage(msg.T, errorProtocol, "invalid target"), addr)
+			return
+		}
+		r.Nodes = encodeNodes(s.table.closest(target, bucketSize))
+
+	case "get_peers":
+		infoHash, ok := nodeID(msg.A.InfoHash)
+		if !ok {
+			s.send(errorMessage(msg.T, errorProtocol, "invalid info_hash"), addr)
+			return
+		}
+		r.Token = s.token(addr.IP, s.secret)
+		r.Values = s.values(infoHash, time.Now())
+		if len(r.Values) == 0 {
+			r.Nodes = encodeNodes(s.table.closest(infoHash, bucketSize))
+		}
+
+	case "announce_peer":
+		infoHash, ok := nodeID(msg.A.InfoHash)
+		if !ok {
+			s.send(errorMessage(msg.T, errorProtocol, "invalid info_hash"), addr)
+			return
+		}
+		if !s.validToken(msg.A.Token, addr.IP) {
+			s.send(errorMessage(msg.T, errorProtocol, "bad token"), addr)
+			return
+		}
+
+		port := msg.A.Port
+		if msg.A.ImpliedPort != 0 {
+			port = addr.Port
+		}
+		if port <= 0 || port > 65535 {
+			s.send(errorMessage(msg.T, errorProtocol, "invalid port"), addr)
+			return
+		}
+
+		if s.peers[infoHash] == nil {
+			s.peers[infoHash] = map[string]time.Time{}
+		}
+		s.peers[infoHash][encodePeer(addr.IP, port)] = time.Now()
+
+	default:
+		s.send(errorMessage(msg.T, errorMethod, "method unknown"), addr)
+		return
+	}
+
+	s.send(&krpcMessage{T: msg.T, Y: typeResponse, R: r, IP: encodePeer(addr.IP, addr.Port)}, addr)
+}
+
+// values returns the peers announced for the info-hash, in the compact format get_peers answers with.
+// s.mu must be held.
+func (s *Server) values(infoHash [20]byte, now time.Time) []string {
+	var values []string
+	for value, announced := range s.peers[infoHash] {
+		if now.Sub(announced) > peerLifetime {
+			delete(s.peers[infoHash], value)
+			continue
+		}
+		if len(values) < maxValues {
+			values = append(values, value)
+		}
+	}
+
+	if len(s.peers[infoHash]) == 0 {
+		delete(s.peers, infoHash)
+	}
+
+	return values
+}
+
+// query sends a query to the node at addr and waits for its response. A node that leaves the query
+// unanswered is marked as failing in the routing table.
+func (s *Server) query(addr *net.UDPAddr, method string, args *krpcArgs) (*krpcReturn, error) {
+	t := &transaction{addr: addr.String(), response: make(chan *krpcMessage, 1)}
+
+	s.mu.Lock()
+	args.ID = string(s.id[:])
+	transactionID := make([]byte, 2)
+	binary.BigEndian.PutUint16(transactionID, s.nextID)
+	for s.pending[string(transactionID)] != nil {
+		s.nextID++
+		binary.BigEndian.PutUint16(transactionID, s.nextID)
+	}
+	s.nextID++
+	s.pending[string(transactionID)] = t
+	s.mu.Unlock()
+
+	defer func() {
+		s.mu.Lock()
+		delete(s.pending, string(transactionID))
+		s.mu.Unlock()
+	}()
+
+	err := s.send(&krpcMessage{T: string(transactionID), Y: typeQuery, Q: method, A: args}, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	timer := time.NewTimer(queryTimeout)
+	defer timer.Stop()
+
+	select {
+	case msg := <-t.response:
+		if msg.Y == typeError {
+			return nil, fmt.Errorf("node refused %s: %v", method, msg.E)
+		}
+		if msg.R == nil {
+			return nil, fmt.Errorf("node sent an empty response to %s", method)
+		}
+		return msg.R, nil
+	case <-timer.C:
+		s.mu.Lock()
+		if id, ok := s.nodeAt(addr); ok {
+			s.table.failed(id)
+		}
+		s.mu.Unlock()
+		return nil, errTimeout
+	case <-s.closed:
+		return nil, errClosed
+	}
+}
+
+// nodeAt returns the ID of the node in the routing table at addr. s.mu must be held.
+func (s *Server) nodeAt(addr *net.UDPAddr) ([20]byte, bool) {
+	for _, bucket := range s.table.buckets {
+		for _, c := range bucket {
+			if c.addr.String() == addr.String() {
+				return c.id, true
+			}
+		}
+	}
+
+	return [20]byte{}, false
+}
+
+func (s *Server) send(msg *krpcMessage, addr *net.UDPAddr) error {
+	packet, err := encodeMessage(msg)
+	if err != nil {
+		return fmt.Errorf("unable to encode DHT message: %s", err.Error())
+	}
+
+	_, err = s.conn.WriteTo(packet, addr)
+	if err != nil {
+		return fmt.Errorf("unable to send DHT message: %s", err.Error())
+	}
+
+	return nil
+}
+
+// token returns the token handed to the IP address in get_peers responses. s.mu must be held.
+func (s *Server) token(ip net.IP, secret []byte) string {
+	hash := sha1.Sum(append(append([]byte(nil), secret...), ip.To16()...))
+	return string(hash[:8])
+}
+
+// validToken reports whether the token is one we recently handed to the IP address. s.mu must be held.
+func (s *Server) validToken(token string, ip net.IP) bool {
+	return token != "" && (token == s.token(ip, s.secret) || token == s.token(ip, s.secretBefore))
+}
+
+// maintain rotates the token secret, pings nodes we haven't heard from for a while, and refreshes the
+// routing table, until the node is closed
+func (s *Server) maintain() {
+	ticker := time.NewTicker(maintenanceTick)
+	defer ticker.Stop()
+
+	lastRotation := time.Now()
+	lastRefresh := time.Now()
+
+	for {
+		select {
+		case <-s.closed:
+			return
+		case now := <-ticker.C:
+			s.mu.Lock()
+			if now.Sub(lastRotation) >= secretLifetime {
+				s.secretBefore, s.secret = s.secret, randomBytes(20)
+				lastRotation = now
+			}
+			questionable := s.table.questionable(now)
+			for infoHash := range s.peers {
+				s.values(infoHash, now)
+			}
+			s.mu.Unlock()
+
+			for _, c := range questionable {
+				go s.query(c.addr, "ping", &krpcArgs{})
+			}
+
+			if now.Sub(lastRefresh) >= refreshInterval {
+				lastRefresh = now
+				go s.Bootstrap()
+
+				err := s.save()
+				if err != nil {
+					fmt.Printf("%s \n", err.Error())
+				}
+			}
+		}
+	}
+}
+
+// nodeID reads a 20-byte node ID or info-hash
+func nodeID(value string) ([20]byte, bool) {
+	var id [20]byte
+	if len(value) != len(id) {
+		return id, false
+	}
+	copy(id[:], value)
+
+	return id, true
+}
+
+func randomBytes(n int) []byte {
+	data := make([]byte, n)
+	rand.Read(data)
+
+	return data
+}
@@ -0,0 +1,163 @@
+package dht
+
+import (
+	"crypto/sha1"
+	"net"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// newTestNetwork starts a root node and n nodes on the loopback interface, each bootstrapped off the
+// root, and then off the network they joined
+func newTestNetwork(t *testing.T, n int) []*Server {
+	t.Helper()
+
+	root := newTestNode(t, "127.0.0.1:0", []string{})
+	nodes := []*Server{root}
+	for i := 0; i < n; i++ {
+		node := newTestNode(t, "127.0.0.1:0", []string{root.Addr().String()})
+		err := node.Bootstrap()
+		if err != nil {
+			t.Fatalf("bootstrapping node %v: %s", i, err)
+		}
+		nodes = append(nodes, node)
+	}
+
+	for _, node := range nodes {
+		node.Bootstrap()
+	}
+
+	return nodes
+}
+
+func newTestNode(t *testing.T, addr string, bootstrapNodes []string) *Server {
+	t.Helper()
+
+	node, err := New(Config{Addr: addr, BootstrapNodes: bootstrapNodes})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { node.Close() })
+
+	return node
+}
+
+func TestBootstrap(t *testing.T) {
+	nodes := newTestNetwork(t, 12)
+
+	for i, node := range nodes {
+		if node.Nodes() == 0 {
+			t.Errorf("node %v knows no other nodes after bootstrapping", i)
+		}
+	}
+}
+
+func TestAnnounceGetPeers(t *testing.T) {
+	nodes := newTestNetwork(t, 12)
+	infoHash := sha1.Sum([]byte("torrent"))
+
+	_, err := nodes[3].Announce(infoHash, 5555)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = nodes[8].Announce(infoHash, 6666)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	peers, err := nodes[11].GetPeers(infoHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(peers)
+	if want := []string{"127.0.0.1:5555", "127.0.0.1:6666"}; strings.Join(peers, " ") != strings.Join(want, " ") {
+		t.Fatalf("got peers %v, want %v", peers, want)
+	}
+
+	other := sha1.Sum([]byte("other torrent"))
+	peers, err = nodes[5].GetPeers(other)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(peers) != 0 {
+		t.Fatalf("got peers %v for a torrent nobody announced", peers)
+	}
+}
+
+func TestAnnounceToken(t *testing.T) {
+	server := newTestNode(t, "127.0.0.1:0", []string{})
+	client := newTestNode(t, "127.0.0.1:0", []string{})
+	infoHash := sha1.Sum([]byte("torrent"))
+
+	_, err := client.query(server.Addr(), "announce_peer", &krpcArgs{InfoHash: string(infoHash[:]), Port: 5555, Token: "forged"})
+	if err == nil || !strings.Contains(err.Error(), "bad token") {
+		t.Fatalf("announce with a forged token: got %v, want a bad token error", err)
+	}
+
+	r, err := client.query(server.Addr(), "get_peers", &krpcArgs{InfoHash: string(infoHash[:])})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Token == "" {
+		t.Fatal("get_peers response holds no token")
+	}
+
+	// The token is only good for the address it was handed to
+	elsewhere, err := New(Config{Addr: "127.0.0.2:0", BootstrapNodes: []string{}})
+	if err != nil {
+		t.Skipf("can't listen on a second loopback address: %s", err)
+	}
+	defer elsewhere.Close()
+	_, err = elsewhere.query(server.Addr(), "announce_peer", &krpcArgs{InfoHash: string(infoHash[:]), Port: 5555, Token: r.Token})
+	if err == nil || !strings.Contains(err.Error(), "bad token") {
+		t.Fatalf("announce with a token handed to another address: got %v, want a bad token error", err)
+	}
+
+	_, err = client.query(server.Addr(), "announce_peer", &krpcArgs{InfoHash: string(infoHash[:]), Port: 5555, Token: r.Token})
+	if err != nil {
+		t.Fatalf("announce with the token handed out: %s", err)
+	}
+
+	r, err = client.query(server.Addr(), "get_peers", &krpcArgs{InfoHash: string(infoHash[:])})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Values) != 1 || r.Values[0] != encodePeer(net.IPv4(127, 0, 0, 1), 5555) {
+		t.Fatalf("get_peers after the announce answered with values %q", r.Values)
+	}
+}
+
+func TestLookupNextSkipsUnresponsive(t *testing.T) {
+	l := &lookup{known: map[[20]byte]bool{}}
+	for i := 1; i <= 2*bucketSize; i++ {
+		l.insert(&candidate{contact: &contact{id: [20]byte{19: byte(i)}}})
+	}
+
+	// The closest bucketSize were queried, but only one of them answered
+	for _, c := range l.candidates[:bucketSize] {
+		c.queried = true
+	}
+	l.candidates[0].responded = true
+
+	batch := l.next()
+	if len(batch) != alpha {
+		t.Fatalf("got a batch of %v, want %v", len(batch), alpha)
+	}
+	for i, c := range batch {
+		if c != l.candidates[bucketSize+i] {
+			t.Errorf("batch holds node %x, want the next closest", c.contact.id[19])
+		}
+	}
+
+	// Once the bucketSize closest that can still answer are all queried, the lookup is done
+	for _, c := range l.candidates {
+		c.queried = true
+	}
+	for _, c := range l.candidates[bucketSize : 2*bucketSize-1] {
+		c.responded = true
+	}
+	if batch := l.next(); len(batch) != 0 {
+		t.Fatalf("got a batch of %v after every node was queried", len(batch))
+	}
+}
@@ -0,0 +1,132 @@
+package dht
+
+// Will handle the KRPC messages nodes exchange: bencoded dictionaries sent as single UDP packets
+
+import (
+	"encoding/binary"
+	"net"
+	"strconv"
+
+	"github.com/zeebo/bencode"
+)
+
+// KRPC message types
+const (
+	typeQuery    = "q"
+	typeResponse = "r"
+	typeError    = "e"
+)
+
+// KRPC error codes
+const (
+	errorGeneric  = 201
+	errorServer   = 202
+	errorProtocol = 203
+	errorMethod   = 204
+)
+
+const (
+	compactNodeLength = 26 // 20 bytes of node ID, 4 bytes of IPv4 address and 2 bytes of port
+	compactPeerLength = 6  // 4 bytes of IPv4 address and 2 bytes of port
+)
+
+// A krpcMessage is a query, a response, or an error
+type krpcMessage struct {
+	T string        `bencode:"t"` // transaction ID, echoed in the response
+	Y string        `bencode:"y"` // type: q, r or e
+	Q string        `bencode:"q,omitempty"`
+	A *krpcArgs     `bencode:"a,omitempty"`
+	R *krpcReturn   `bencode:"r,omitempty"`
+	E []interface{} `bencode:"e,omitempty"` // error code and message
+
+	IP string `bencode:"ip,omitempty"` // compact address the response was sent to, telling the querying node its external IP address (BEP 42)
+}
+
+// The krpcArgs of a query. Which are set depends on the query.
+type krpcArgs struct {
+	ID          string `bencode:"id"`
+	Target      string `bencode:"target,omitempty"`    // find_node
+	InfoHash    string `bencode:"info_hash,omitempty"` // get_peers, announce_peer
+	Port        int    `bencode:"port,omitempty"`      // announce_peer
+	Token       string `bencode:"token,omitempty"`     // announce_peer
+	ImpliedPort int    `bencode:"implied_port,omitempty"`
+}
+
+// The krpcReturn values of a response
+type krpcReturn struct {
+	ID     string   `bencode:"id"`
+	Nodes  string   `bencode:"nodes,omitempty"`  // compact node info of the closest nodes we know
+	Values []string `bencode:"values,omitempty"` // compact peer info of peers of the info-hash
+	Token  string   `bencode:"token,omitempty"`  // to be sent back with announce_peer
+}
+
+func decodeMessage(packet []byte) (*krpcMessage, error) {
+	var msg krpcMessage
+	err := bencode.DecodeBytes(packet, &msg)
+	if err != nil {
+		return nil, err
+	}
+
+	return &msg, nil
+}
+
+func encodeMessage(msg *krpcMessage) ([]byte, error) {
+	return bencode.EncodeBytes(msg)
+}
+
+// errorMessage creates the error response to the query with transaction ID t
+func errorMessage(t string, code int, message string) *krpcMessage {
+	return &krpcMessage{T: t, Y: typeError, E: []interface{}{code, message}}
+}
+
+// encodeNodes lays the contacts out in the compact node info format. Contacts without an IPv4 address are left out.
+func encodeNodes(contacts []*contact) string {
+	data := make([]byte, 0, compactNodeLength*len(contacts))
+	for _, c := range contacts {
+		ip := c.addr.IP.To4()
+		if ip == nil {
+			continue
+		}
+
+		data = append(data, c.id[:]...)
+		data = append(data, ip...)
+		data = append(data, byte(c.addr.Port>>8), byte(c.addr.Port))
+	}
+
+	return string(data)
+}
+
+// decodeNodes reads nodes in the compact node info format
+func decodeNodes(data string) []*contact {
+	var contacts []*contact
+	for i := 0; i+compactNodeLength <= len(data); i += compactNodeLength {
+		c := contact{addr: &net.UDPAddr{
+			IP:   net.IP([]byte(data[i+20 : i+24])),
+			Port: int(binary.BigEndian.Uint16([]byte(data[i+24 : i+26]))),
+		}}
+		copy(c.id[:], data[i:i+20])
+
+		if c.addr.Port != 0 {
+			contacts = append(contacts, &c)
+		}
+	}
+
+	return contacts
+}
+
+// encodePeer lays a peer out in the compact peer info format
+func encodePeer(ip net.IP, port int) string {
+	return string(append(append([]byte(nil), ip.To4()...), byte(port>>8), byte(port)))
+}
+
+// decodePeer reads a peer in the compact peer info format as a host:port address
+func decodePeer(value string) (string, bool) {
+	if len(value) != compactPeerLength {
+		return "", false
+	}
+
+	ip := net.IP([]byte(value[:4]))
+	port := binary.BigEndian.Uint16([]byte(value[4:]))
+
+	return net.JoinHostPort(ip.String(), strconv.Itoa(int(port))), true
+}
@@ -0,0 +1,259 @@
+package dht
+
+// Will handle iterative lookups: asking ever closer nodes for the nodes, or peers, closest to a target
+
+import (
+	"errors"
+	"net"
+	"sync"
+)
+
+const alpha = 3 // queries a lookup has in flight at once
+
+var errNoNodes = errors.New("no DHT node answered")
+
+// A candidate is a node a lookup found, and what became of querying it
+type candidate struct {
+	contact   *contact
+	queried   bool
+	responded bool
+	token     string // handed out in its get_peers response
+}
+
+// A lookup walks the network towards a target. It keeps the nodes it heard of sorted by distance to
+// the target, and queries the closest ones it hasn't queried yet, until the bucketSize closest
+// nodes it knows have all been queried.
+type lookup struct {
+	s      *Server
+	target [20]byte
+	method string // find_node or get_peers
+
+	mu         sync.Mutex
+	candidates []*candidate
+	known      map[[20]byte]bool
+	peers      map[string]bool
+}
+
+// Bootstrap joins the network by looking up our own ID, which fills the routing table with the nodes
+// around us. The bootstrap nodes are only asked when the routing table is empty.
+func (s *Server) Bootstrap() error {
+	_, _, err := s.lookup(s.ID(), "find_node")
+	return err
+}
+
+// GetPeers looks up peers of the info-hash
+func (s *Server) GetPeers(infoHash [20]byte) ([]string, error) {
+	peers, _, err := s.lookup(infoHash, "get_peers")
+	return peers, err
+}
+
+// Announce looks up peers of the info-hash, and then announces to the closest nodes that we are a
+// peer too, downloading on the given TCP port. Nodes with IDs valid for their IP address are preferred
+// to store the announce, since nobody can choose to be close to the info-hash with them. The peers found
+// are returned.
+func (s *Server) Announce(infoHash [20]byte, port int) ([]string, error) {
+	peers, closest, err := s.lookup(infoHash, "get_peers")
+	if err != nil {
+		return nil, err
+	}
+
+	var wg sync.WaitGroup
+	for _, c := range closest {
+		if c.token == "" {
+			continue
+		}
+
+		wg.Add(1)
+		go func(c *candidate) {
+			defer wg.Done()
+			s.query(c.contact.addr, "announce_peer", &krpcArgs{
+				InfoHash: string(infoHash[:]),
+				Port:     port,
+				Token:    c.token,
+			})
+		}(c)
+	}
+	wg.Wait()
+
+	return peers, nil
+}
+
+// lookup runs a lookup for the target with find_node or get_peers queries. It returns the peers found,
+// and the bucketSize closest nodes that answered, those with IDs valid for their IP address first.
+func (s *Server) lookup(target [20]byte, method string) ([]string, []*candidate, error) {
+	l := &lookup{
+		s:      s,
+		target: target,
+		method: method,
+		known:  map[[20]byte]bool{},
+		peers:  map[string]bool{},
+	}
+
+	s.mu.Lock()
+	l.known[s.id] = true
+	for _, c := range s.table.closest(target, bucketSize) {
+		l.add(&contact{id: c.id, addr: c.addr})
+	}
+	s.mu.Unlock()
+
+	if len(l.candidates) == 0 {
+		l.bootstrap()
+	}
+
+	for {
+		batch := l.next()
+		if len(batch) == 0 {
+			break
+		}
+
+		var wg sync.WaitGroup
+		for _, c := range batch {
+			wg.Add(1)
+			go func(c *candidate) {
+				defer wg.Done()
+				l.ask(c)
+			}(c)
+		}
+		wg.Wait()
+	}
+
+	// The candidates are sorted by distance, so the first bucketSize that answered are the closest
+	var responders []*candidate
+	for _, c := range l.candidates {
+		if len(responders) >= bucketSize {
+			break
+		}
+		if c.responded {
+			responders = append(responders, c)
+		}
+	}
+	if len(responders) == 0 {
+		return nil, nil, errNoNodes
+	}
+
+	var closest, insecure []*candidate
+	for _, c := range responders {
+		if validNodeID(c.contact.id, c.contact.addr.IP) {
+			closest = append(closest, c)
+		} else {
+			insecure = append(insecure, c)
+		}
+	}
+	closest = append(closest, insecure...)
+
+	var peers []string
+	for peer := range l.peers {
+		peers = append(peers, peer)
+	}
+
+	return peers, closest, nil
+}
+
+// bootstrap queries the bootstrap nodes, whose IDs we don't know, so the lookup has nodes to start from
+func (l *lookup) bootstrap() {
+	var wg sync.WaitGroup
+	for _, address := range l.s.config.BootstrapNodes {
+		addr, err := net.ResolveUDPAddr("udp4", address)
+		if err != nil {
+			continue
+		}
+
+		wg.Add(1)
+		go func(addr *net.UDPAddr) {
+			defer wg.Done()
+			l.ask(&candidate{contact: &contact{addr: addr}})
+		}(addr)
+	}
+	wg.Wait()
+}
+
+// next returns up to alpha of the closest bucketSize candidates that haven't been queried yet, marking them as queried.
+// Nodes that were queried and didn't answer don't count towards the bucketSize, so they can't end the lookup early.
+// Every earlier batch has finished when next is called, so a queried candidate that hasn't responded never will.
+func (l *lookup) next() []*candidate {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var batch []*candidate
+	counted := 0
+	for _, c := range l.candidates {
+		if counted >= bucketSize || len(batch) >= alpha {
+			break
+		}
+		if c.queried && !c.responded {
+			continue
+		}
+		counted++
+		if !c.queried {
+			c.queried = true
+			batch = append(batch, c)
+		}
+	}
+
+	return batch
+}
+
+// ask queries a candidate, and adds the nodes and peers it answers with to the lookup
+func (l *lookup) ask(c *candidate) {
+	args := &krpcArgs{}
+	if l.method == "find_node" {
+		args.Target = string(l.target[:])
+	} else {
+		args.InfoHash = string(l.target[:])
+	}
+
+	r, err := l.s.query(c.contact.addr, l.method, args)
+	if err != nil {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	// A bootstrap node isn't a candidate until it told us its ID
+	if !c.queried {
+		id, ok := nodeID(r.ID)
+		if !ok || l.known[id] {
+			return
+		}
+		c.contact.id = id
+		c.queried = true
+		l.insert(c)
+	}
+
+	c.responded = true
+	c.token = r.Token
+
+	for _, node := range decodeNodes(r.Nodes) {
+		l.add(node)
+	}
+
+	for _, value := range r.Values {
+		if peer, ok := decodePeer(value); ok {
+			l.peers[peer] = true
+		}
+	}
+}
+
+// add makes a node a candidate, unless the lookup already knows it. l.mu must be held, or the lookup not yet started.
+func (l *lookup) add(node *contact) {
+	if l.known[node.id] || l.s.config.StrictNodeIDs && !validNodeID(node.id, node.addr.IP) {
+		return
+	}
+
+	l.insert(&candidate{contact: node})
+}
+
+// insert puts a candidate in its place among the candidates sorted by distance
+func (l *lookup) insert(c *candidate) {
+	l.known[c.contact.id] = true
+
+	i := len(l.candidates)
+	for i > 0 && closer(c.contact.id, l.candidates[i-1].contact.id, l.target) {
+		i--
+	}
+
+	l.candidates = append(l.candidates, nil)
+	copy(l.candidates[i+1:], l.candidates[i:])
+	l.candidates[i] = c
+}
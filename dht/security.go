@@ -0,0 +1,127 @@
+package dht
+
+// Will handle node ID security (BEP 42): node IDs derived from the IP address of the node, so nobody can
+// pick the IDs it takes in the network, and learning our external IP address from the nodes we talk to
+
+import (
+	"hash/crc32"
+	"net"
+)
+
+const externalIPVotes = 3 // nodes that must agree on our external IP address before we believe them
+
+var (
+	castagnoli = crc32.MakeTable(crc32.Castagnoli)
+	ipv4Mask   = []byte{0x03, 0x0f, 0x3f, 0xff}
+
+	// Nodes on these networks can't have IDs derived from an external IP address, so their IDs aren't checked
+	localNetworks = []*net.IPNet{
+		parseCIDR("10.0.0.0/8"),
+		parseCIDR("172.16.0.0/12"),
+		parseCIDR("192.168.0.0/16"),
+		parseCIDR("169.254.0.0/16"),
+		parseCIDR("127.0.0.0/8"),
+	}
+)
+
+// secureIDPrefix returns the CRC32-C of the IPv4 address with r mixed in, whose first 21 bits start
+// the node IDs of the address
+func secureIDPrefix(ip net.IP, r byte) uint32 {
+	masked := make([]byte, net.IPv4len)
+	for i := range masked {
+		masked[i] = ip[i] & ipv4Mask[i]
+	}
+	masked[0] |= r << 5
+
+	return crc32.Checksum(masked, castagnoli)
+}
+
+// secureNodeID generates a random node ID that is valid for the IPv4 address
+func secureNodeID(ip net.IP) [20]byte {
+	var id [20]byte
+	copy(id[:], randomBytes(20))
+
+	ip = ip.To4()
+	if ip == nil {
+		return id
+	}
+
+	crc := secureIDPrefix(ip, id[19]&0x07)
+	id[0] = byte(crc >> 24)
+	id[1] = byte(crc >> 16)
+	id[2] = byte(crc>>8)&0xf8 | id[2]&0x07
+
+	return id
+}
+
+// validNodeID reports whether the node ID is valid for the IP address. Only IPv4 addresses outside
+// local networks are checked.
+func validNodeID(id [20]byte, ip net.IP) bool {
+	ip = ip.To4()
+	if ip == nil || isLocal(ip) {
+		return true
+	}
+
+	crc := secureIDPrefix(ip, id[19]&0x07)
+
+	return id[0] == byte(crc>>24) && id[1] == byte(crc>>16) && id[2]&0xf8 == byte(crc>>8)&0xf8
+}
+
+func isLocal(ip net.IP) bool {
+	for _, network := range localNetworks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// voteExternalIP counts the IP address a node at addr says we have. Once enough nodes agree on an
+// address other than the one we know, it becomes our external IP address, and if our node ID isn't
+// valid for it we take a new one. s.mu must be held.
+func (s *Server) voteExternalIP(ip net.IP, addr *net.UDPAddr) {
+	if ip == nil || ip.Equal(s.externalIP) {
+		return
+	}
+
+	voters := s.ipVotes[ip.String()]
+	if voters == nil {
+		voters = map[string]bool{}
+		s.ipVotes[ip.String()] = voters
+	}
+	voters[addr.IP.String()] = true
+
+	if len(voters) < externalIPVotes {
+		return
+	}
+
+	s.externalIP = ip
+	s.ipVotes = map[string]map[string]bool{}
+
+	if !validNodeID(s.id, ip) {
+		s.setID(secureNodeID(ip))
+	}
+}
+
+// setID changes our node ID. The nodes we know are sorted into the buckets of the new ID. s.mu must be held.
+func (s *Server) setID(id [20]byte) {
+	old := s.table
+	s.id = id
+	s.table = newRoutingTable(id, s.config.StrictNodeIDs)
+
+	for _, bucket := range old.buckets {
+		for _, c := range bucket {
+			s.table.add(c)
+		}
+	}
+}
+
+func parseCIDR(cidr string) *net.IPNet {
+	_, network, err := net.ParseCIDR(cidr)
+	if err != nil {
+		panic(err)
+	}
+
+	return network
+}
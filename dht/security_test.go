@@ -0,0 +1,263 @@
+package dht
+
+import (
+	"encoding/hex"
+	"net"
+	"testing"
+)
+
+// The test vectors of BEP 42: node IDs that are valid for the IP address, with the random byte they end in
+var secureIDVectors = []struct {
+	ip string
+	id string
+}{
+	{"124.31.75.21", "5fbfbff10c5d6a4ec8a88e4c6ab4c28b95eee401"},
+	{"21.75.31.124", "5a3ce9c14e7a08645677bbd1cfe7d8f956d53256"},
+	{"65.23.51.170", "a5d43220bc8f112a3d426c84764f8c2a1150e616"},
+	{"84.124.73.14", "1b0321dd1bb1fe518101ceef99462b947a01ff41"},
+	{"43.213.53.83", "e56f6cbf5b7c4be0237986d5243b87aa6d51305a"},
+}
+
+func vectorID(t *testing.T, s string) [20]byte {
+	t.Helper()
+
+	var id [20]byte
+	data, err := hex.DecodeString(s)
+	if err != nil || len(data) != 20 {
+		t.Fatalf("bad node ID %s", s)
+	}
+	copy(id[:], data)
+
+	return id
+}
+
+func TestSecureNodeID(t *testing.T) {
+	for _, vector := range secureIDVectors {
+		ip := net.ParseIP(vector.ip)
+		id := vectorID(t, vector.id)
+
+		if !validNodeID(id, ip) {
+			t.Errorf("%s: node ID %x isn't valid", vector.ip, id)
+		}
+
+		// Any change to the first 21 bits makes it invalid, the rest of the ID can be anything
+		for _, bit := range []int{0, 7, 15, 20} {
+			changed := id
+			changed[bit/8] ^= 0x80 >> uint(bit%8)
+			if validNodeID(changed, ip) {
+				t.Errorf("%s: node ID with bit %v flipped is valid", vector.ip, bit)
+			}
+		}
+		changed := id
+		changed[2] ^= 0x07
+		changed[10] ^= 0xff
+		if !validNodeID(changed, ip) {
+			t.Errorf("%s: node ID with its random bits changed isn't valid", vector.ip)
+		}
+
+		// The prefix the vector starts with is the one we generate for its random byte
+		crc := secureIDPrefix(ip.To4(), id[19]&0x07)
+		if byte(crc>>24) != id[0] || byte(crc>>16) != id[1] || byte(crc>>8)&0xf8 != id[2]&0xf8 {
+			t.Errorf("%s: prefix is %08x, want the one of %x", vector.ip, crc, id)
+		}
+
+		// And IDs we generate are valid
+		for i := 0; i < 10; i++ {
+			if generated := secureNodeID(ip); !validNodeID(generated, ip) {
+				t.Errorf("%s: generated node ID %x isn't valid", vector.ip, generated)
+			}
+		}
+	}
+
+	// Local and IPv6 addresses aren't checked, as their IDs can't be derived from an external address
+	id := vectorID(t, secureIDVectors[0].id)
+	for _, ip := range []string{"127.0.0.1", "10.1.2.3", "192.168.1.1", "172.20.0.1", "169.254.0.5", "2001:db8::1"} {
+		if !validNodeID(id, net.ParseIP(ip)) {
+			t.Errorf("node ID isn't valid for %s", ip)
+		}
+	}
+	if validNodeID(id, net.ParseIP("203.0.113.1")) {
+		t.Error("node ID of another address is valid for a public address")
+	}
+}
+
+// newTestServer is a node that isn't connected to anything, for testing what it does with what it's told
+func newTestServer(id [20]byte, config Config) *Server {
+	return &Server{
+		config:  config,
+		id:      id,
+		table:   newRoutingTable(id, config.StrictNodeIDs),
+		ipVotes: map[string]map[string]bool{},
+	}
+}
+
+func TestVoteExternalIP(t *testing.T) {
+	ip := net.ParseIP(secureIDVectors[0].ip).To4()
+	var id [20]byte
+	id[0] = ^vectorID(t, secureIDVectors[0].id)[0]
+	s := newTestServer(id, Config{})
+
+	known := []*contact{
+		{id: secureNodeID(net.ParseIP("203.0.113.1")), addr: &net.UDPAddr{IP: net.ParseIP("203.0.113.1"), Port: 1}},
+		{id: secureNodeID(net.ParseIP("198.51.100.2")), addr: &net.UDPAddr{IP: net.ParseIP("198.51.100.2"), Port: 2}},
+	}
+	for _, c := range known {
+		s.table.add(c)
+	}
+
+	voter := func(n byte) *net.UDPAddr {
+		return &net.UDPAddr{IP: net.IPv4(198, 51, 100, n), Port: 6881}
+	}
+
+	// The same node saying it again doesn't count twice
+	s.voteExternalIP(ip, voter(1))
+	s.voteExternalIP(ip, voter(1))
+	s.voteExternalIP(ip, voter(2))
+	if s.externalIP != nil || s.id != id {
+		t.Fatal("external IP changed before enough nodes agreed on it")
+	}
+
+	s.voteExternalIP(ip, voter(3))
+	if !s.externalIP.Equal(ip) {
+		t.Fatalf("external IP is %v after %v nodes agreed on %v", s.externalIP, externalIPVotes, ip)
+	}
+	if s.id == id || !validNodeID(s.id, ip) {
+		t.Fatalf("node ID %x isn't valid for the new external IP", s.id)
+	}
+
+	// The nodes we knew are sorted into the buckets of the new ID
+	if s.table.self != s.id {
+		t.Fatal("routing table is still keyed on the old ID")
+	}
+	for _, c := range known {
+		index := s.table.bucketIndex(c.id)
+		found := false
+		for _, other := range s.table.buckets[index] {
+			found = found || other == c
+		}
+		if !found {
+			t.Errorf("node %x was lost when the ID changed", c.id)
+		}
+	}
+
+	// Another address needs votes of its own, and a valid ID survives votes for the address we already have
+	secure := s.id
+	s.voteExternalIP(ip, voter(4))
+	s.voteExternalIP(net.ParseIP("203.0.113.9").To4(), voter(5))
+	if s.id != secure || !s.externalIP.Equal(ip) {
+		t.Fatal("one vote changed the node ID or external IP")
+	}
+}
+
+func TestVoteExternalIPKeepsValidID(t *testing.T) {
+	ip := net.ParseIP(secureIDVectors[1].ip).To4()
+	id := vectorID(t, secureIDVectors[1].id)
+	s := newTestServer(id, Config{})
+
+	for n := byte(1); n <= externalIPVotes; n++ {
+		s.voteExternalIP(ip, &net.UDPAddr{IP: net.IPv4(198, 51, 100, n), Port: 6881})
+	}
+	if !s.externalIP.Equal(ip) || s.id != id {
+		t.Fatalf("external IP is %v and ID %x, want %v and the ID that was already valid for it", s.externalIP, s.id, ip)
+	}
+}
+
+// bucketContacts returns count contacts that all land in the first bucket of a table whose ID starts with 0xff.
+// Secure ones have IDs valid for their public address, the others don't.
+func bucketContacts(count int, secure bool) []*contact {
+	ip := net.ParseIP(secureIDVectors[0].ip)
+	var contacts []*contact
+	for i := 0; i < count; i++ {
+		// Which bit the ID starts with depends on its random byte
+		id := secureNodeID(ip)
+		for id[0]&0x80 != 0 {
+			id = secureNodeID(ip)
+		}
+		if !secure {
+			id[0] ^= 0x40
+		}
+		contacts = append(contacts, &contact{id: id, addr: &net.UDPAddr{IP: ip, Port: 1000 + i}})
+	}
+
+	return contacts
+}
+
+func bucketHolds(table *routingTable, c *contact) bool {
+	for _, other := range table.buckets[0] {
+		if other == c {
+			return true
+		}
+	}
+
+	return false
+}
+
+func TestRoutingTableStrict(t *testing.T) {
+	self := [20]byte{0xff}
+	table := newRoutingTable(self, true)
+
+	insecure := bucketContacts(1, false)[0]
+	table.add(insecure)
+	if bucketHolds(table, insecure) {
+		t.Fatal("strict table took a node whose ID isn't valid for its address")
+	}
+
+	secure := bucketContacts(1, true)[0]
+	table.add(secure)
+	if !bucketHolds(table, secure) {
+		t.Fatal("strict table left out a node with a valid ID")
+	}
+
+	// Nodes on local networks can't have secure IDs, so they're let in
+	local := &contact{id: insecure.id, addr: &net.UDPAddr{IP: net.IPv4(192, 168, 1, 2), Port: 1}}
+	table.add(local)
+	if !bucketHolds(table, local) {
+		t.Fatal("strict table left out a node on a local network")
+	}
+}
+
+func TestRoutingTablePrefersSecure(t *testing.T) {
+	self := [20]byte{0xff}
+	table := newRoutingTable(self, false)
+
+	insecure := bucketContacts(bucketSize, false)
+	for _, c := range insecure {
+		table.add(c)
+	}
+	if len(table.buckets[0]) != bucketSize {
+		t.Fatalf("bucket holds %v nodes, want it full", len(table.buckets[0]))
+	}
+
+	// A full bucket has no room for another node without a valid ID
+	extra := bucketContacts(1, false)[0]
+	table.add(extra)
+	if bucketHolds(table, extra) {
+		t.Fatal("node without a valid ID took a spot in a full bucket")
+	}
+
+	// But a node with one takes the spot of one without
+	secure := bucketContacts(bucketSize, true)
+	for i, c := range secure {
+		table.add(c)
+		if !bucketHolds(table, c) {
+			t.Fatalf("node %v with a valid ID was left out of a bucket with insecure nodes", i)
+		}
+	}
+	for i, c := range insecure {
+		if bucketHolds(table, c) {
+			t.Errorf("insecure node %v is still there after every spot was taken", i)
+		}
+	}
+
+	// Once every node is secure, newcomers only get the spots of nodes that stopped answering
+	newcomer := bucketContacts(1, true)[0]
+	table.add(newcomer)
+	if bucketHolds(table, newcomer) {
+		t.Fatal("node took the spot of one that still answers")
+	}
+	secure[3].failures = maxFailures
+	table.add(newcomer)
+	if !bucketHolds(table, newcomer) || bucketHolds(table, secure[3]) {
+		t.Fatal("node didn't take the spot of one that stopped answering")
+	}
+}
@@ -0,0 +1,101 @@
+package dht
+
+// Will handle keeping the node ID and routing table on disk, so a restarted node rejoins the network right away
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+
+	"github.com/zeebo/bencode"
+)
+
+// The savedState of a node, as it is kept in the state file
+type savedState struct {
+	ID         string `bencode:"id"`
+	ExternalIP string `bencode:"ip,omitempty"` // 4 bytes of the IPv4 address other nodes see us at
+	Nodes      string `bencode:"nodes"`        // compact node info of the routing table
+}
+
+// loadState reads the state file. Nodes in it are added to the routing table once the node ID is decided.
+func loadState(path string) (*savedState, error) {
+	stream, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var state savedState
+	err = bencode.DecodeBytes(stream, &state)
+	if err != nil {
+		return nil, fmt.Errorf("unable to decode DHT state: %s", err.Error())
+	}
+
+	if len(state.ID) != 20 {
+		return nil, errors.New("DHT state holds no valid node ID")
+	}
+
+	return &state, nil
+}
+
+// save writes the node ID, our external IP address and the nodes that still answer to the state file.
+// The file is replaced at once, so a crash while saving can't leave half a state behind.
+func (s *Server) save() error {
+	if s.config.StateFile == "" {
+		return nil
+	}
+
+	s.mu.Lock()
+	state := savedState{ID: string(s.id[:]), Nodes: encodeNodes(s.table.contacts())}
+	if ip := s.externalIP.To4(); ip != nil {
+		state.ExternalIP = string(ip)
+	}
+	s.mu.Unlock()
+
+	stream, err := bencode.EncodeBytes(state)
+	if err != nil {
+		return fmt.Errorf("unable to encode DHT state: %s", err.Error())
+	}
+
+	temp := s.config.StateFile + ".tmp"
+	err = ioutil.WriteFile(temp, stream, 0644)
+	if err != nil {
+		return fmt.Errorf("unable to save DHT state: %s", err.Error())
+	}
+
+	return os.Rename(temp, s.config.StateFile)
+}
+
+// restore decides our node ID from the configured external IP address and the saved state, and adds the
+// saved nodes to the routing table. The saved ID is kept unless it isn't valid for our external IP address.
+func (s *Server) restore(state *savedState) {
+	var id [20]byte
+	copy(id[:], randomBytes(20))
+
+	if s.externalIP == nil && state != nil && len(state.ExternalIP) == net.IPv4len {
+		s.externalIP = net.IP([]byte(state.ExternalIP))
+	}
+
+	switch {
+	case state != nil && (s.externalIP == nil || validNodeID(savedID(state), s.externalIP)):
+		id = savedID(state)
+	case s.externalIP != nil:
+		id = secureNodeID(s.externalIP)
+	}
+
+	s.id = id
+	s.table = newRoutingTable(id, s.config.StrictNodeIDs)
+
+	if state != nil {
+		// We don't know when these nodes were last seen, so they are pinged before they are trusted again
+		for _, c := range decodeNodes(state.Nodes) {
+			s.table.add(c)
+		}
+	}
+}
+
+func savedID(state *savedState) [20]byte {
+	id, _ := nodeID(state.ID)
+	return id
+}
@@ -0,0 +1,154 @@
+package dht
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// contactAddresses returns the addresses of the nodes in the table, sorted so tables compare in any order
+func contactAddresses(table *routingTable) []string {
+	var addresses []string
+	for _, c := range table.contacts() {
+		addresses = append(addresses, c.addr.String())
+	}
+	sort.Strings(addresses)
+
+	return addresses
+}
+
+// newSavedServer is a node with the ID and external IP address of a BEP 42 test vector, that knows a few
+// nodes and keeps its state at path. It returns the addresses of the nodes that are saved.
+func newSavedServer(t *testing.T, path string) (*Server, []string) {
+	t.Helper()
+
+	vector := secureIDVectors[2]
+	s := newTestServer(vectorID(t, vector.id), Config{StateFile: path})
+	s.externalIP = net.ParseIP(vector.ip).To4()
+
+	var saved []string
+	for n := byte(1); n <= 5; n++ {
+		addr := &net.UDPAddr{IP: net.IPv4(203, 0, 113, n), Port: 6880 + int(n)}
+		s.table.add(&contact{id: secureNodeID(addr.IP), addr: addr})
+		saved = append(saved, addr.String())
+	}
+	sort.Strings(saved)
+
+	// Nodes that stopped answering, or only have an IPv6 address, aren't
+	s.table.add(&contact{id: secureNodeID(net.IPv4(203, 0, 113, 9)), addr: &net.UDPAddr{IP: net.IPv4(203, 0, 113, 9), Port: 1}, failures: maxFailures})
+	s.table.add(&contact{id: [20]byte{1, 2, 3}, addr: &net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 1}})
+
+	return s, saved
+}
+
+func TestStateRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dht.state")
+	s, saved := newSavedServer(t, path)
+
+	err := s.save()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path + ".tmp"); !os.IsNotExist(err) {
+		t.Fatal("temporary state file was left behind")
+	}
+
+	state, err := loadState(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	restored := newTestServer([20]byte{}, Config{StateFile: path})
+	restored.restore(state)
+
+	if restored.id != s.id {
+		t.Fatalf("restored node ID is %x, want %x", restored.id, s.id)
+	}
+	if !restored.externalIP.Equal(s.externalIP) {
+		t.Fatalf("restored external IP is %v, want %v", restored.externalIP, s.externalIP)
+	}
+	if restored.table.self != s.id {
+		t.Fatal("restored routing table isn't keyed on the restored ID")
+	}
+	if got := contactAddresses(restored.table); !reflect.DeepEqual(got, saved) {
+		t.Fatalf("restored nodes are %v, want %v", got, saved)
+	}
+}
+
+func TestRestoreForAnotherIP(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dht.state")
+	s, saved := newSavedServer(t, path)
+	err := s.save()
+	if err != nil {
+		t.Fatal(err)
+	}
+	state, err := loadState(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The configured external IP address wins over the saved one, and the saved ID isn't valid for it
+	ip := net.ParseIP(secureIDVectors[3].ip).To4()
+	restored := newTestServer([20]byte{}, Config{StateFile: path})
+	restored.externalIP = ip
+	restored.restore(state)
+
+	if restored.id == s.id || !validNodeID(restored.id, ip) {
+		t.Fatalf("restored node ID %x isn't a new one valid for %v", restored.id, ip)
+	}
+	if !restored.externalIP.Equal(ip) {
+		t.Fatalf("external IP is %v, want the configured %v", restored.externalIP, ip)
+	}
+	if got := contactAddresses(restored.table); !reflect.DeepEqual(got, saved) {
+		t.Fatalf("restored nodes are %v, want %v", got, saved)
+	}
+}
+
+func TestRestoreWithoutState(t *testing.T) {
+	ip := net.ParseIP(secureIDVectors[4].ip).To4()
+	s := newTestServer([20]byte{}, Config{})
+	s.externalIP = ip
+	s.restore(nil)
+	if !validNodeID(s.id, ip) || len(s.table.contacts()) != 0 {
+		t.Fatalf("fresh node ID %x isn't valid for %v", s.id, ip)
+	}
+
+	// Without an external IP address the ID is random
+	first := newTestServer([20]byte{}, Config{})
+	first.restore(nil)
+	second := newTestServer([20]byte{}, Config{})
+	second.restore(nil)
+	if first.id == second.id || first.id == [20]byte{} {
+		t.Fatalf("fresh node IDs are %x and %x", first.id, second.id)
+	}
+}
+
+func TestLoadStateErrors(t *testing.T) {
+	dir := t.TempDir()
+
+	_, err := loadState(filepath.Join(dir, "missing"))
+	if !os.IsNotExist(err) {
+		t.Fatalf("got error %v for a missing state file", err)
+	}
+
+	for name, contents := range map[string]string{
+		"garbage":  "not bencode",
+		"short id": "d2:id3:abc5:nodes0:e",
+		"no id":    "d5:nodes0:e",
+	} {
+		path := filepath.Join(dir, name)
+		err := ioutil.WriteFile(path, []byte(contents), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = loadState(path)
+		if err == nil {
+			t.Errorf("%s: state was loaded", name)
+		}
+	}
+}
@@ -0,0 +1,184 @@
+package dht
+
+// Will handle the routing table: the nodes we know, in buckets by how close their IDs are to ours
+
+import (
+	"math/bits"
+	"net"
+	"sort"
+	"time"
+)
+
+const (
+	bucketSize    = 8                // K: nodes per bucket, and nodes a lookup ends at
+	maxFailures   = 2                // queries a node may leave unanswered in a row before it is replaced
+	questionAfter = 15 * time.Minute // nodes we haven't heard from for this long are pinged before they are trusted again
+)
+
+// A contact is a node of the network we know of
+type contact struct {
+	id       [20]byte
+	addr     *net.UDPAddr
+	lastSeen time.Time // when the node last answered us, or queried us
+	failures int       // queries it left unanswered since it last answered
+}
+
+// A routingTable keeps up to bucketSize nodes in each of its 160 buckets. Bucket i holds the nodes whose
+// IDs share exactly i leading bits with ours, so we know many nodes close to us and few far away.
+type routingTable struct {
+	self    [20]byte
+	strict  bool // leave out nodes whose IDs aren't valid for their IP address
+	buckets [160][]*contact
+}
+
+func newRoutingTable(self [20]byte, strict bool) *routingTable {
+	return &routingTable{self: self, strict: strict}
+}
+
+// bucketIndex returns the bucket a node ID belongs in, or -1 for our own ID
+func (table *routingTable) bucketIndex(id [20]byte) int {
+	for i := range id {
+		if x := id[i] ^ table.self[i]; x != 0 {
+			return i*8 + bits.LeadingZeros8(x)
+		}
+	}
+
+	return -1
+}
+
+// seen records that the node answered or queried us, adding it to the table if it is new to us
+func (table *routingTable) seen(id [20]byte, addr *net.UDPAddr, now time.Time) {
+	index := table.bucketIndex(id)
+	if index < 0 {
+		return
+	}
+
+	for _, c := range table.buckets[index] {
+		if c.id == id {
+			c.addr = addr
+			c.lastSeen = now
+			c.failures = 0
+			return
+		}
+	}
+
+	table.add(&contact{id: id, addr: addr, lastSeen: now})
+}
+
+// add puts a node in its bucket if there is a free spot, or takes the spot of a node that stopped
+// answering. A node with an ID valid for its IP address may also take the spot of one without. If there
+// is no spot for it, the node is left out: nodes that have been around for long are likely to stay.
+func (table *routingTable) add(fresh *contact) {
+	index := table.bucketIndex(fresh.id)
+	secure := validNodeID(fresh.id, fresh.addr.IP)
+	if index < 0 || table.strict && !secure {
+		return
+	}
+
+	bucket := table.buckets[index]
+	if len(bucket) < bucketSize {
+		table.buckets[index] = append(bucket, fresh)
+		return
+	}
+
+	for i, c := range bucket {
+		if c.failures >= maxFailures {
+			bucket[i] = fresh
+			return
+		}
+	}
+
+	if !secure {
+		return
+	}
+
+	for i, c := range bucket {
+		if !validNodeID(c.id, c.addr.IP) {
+			bucket[i] = fresh
+			return
+		}
+	}
+}
+
+// failed records that the node left a query unanswered
+func (table *routingTable) failed(id [20]byte) {
+	index := table.bucketIndex(id)
+	if index < 0 {
+		return
+	}
+
+	for _, c := range table.buckets[index] {
+		if c.id == id {
+			c.failures++
+			return
+		}
+	}
+}
+
+// closest returns up to count nodes that are closest to the target and still answer
+func (table *routingTable) closest(target [20]byte, count int) []*contact {
+	contacts := table.contacts()
+	sortByDistance(contacts, target)
+	if len(contacts) > count {
+		contacts = contacts[:count]
+	}
+
+	return contacts
+}
+
+// questionable returns the nodes we haven't heard from for a while
+func (table *routingTable) questionable(now time.Time) []*contact {
+	var contacts []*contact
+	for _, bucket := range table.buckets {
+		for _, c := range bucket {
+			if now.Sub(c.lastSeen) > questionAfter {
+				contacts = append(contacts, c)
+			}
+		}
+	}
+
+	return contacts
+}
+
+// contacts returns every node in the table that still answers
+func (table *routingTable) contacts() []*contact {
+	var contacts []*contact
+	for _, bucket := range table.buckets {
+		for _, c := range bucket {
+			if c.failures < maxFailures {
+				contacts = append(contacts, c)
+			}
+		}
+	}
+
+	return contacts
+}
+
+// size returns the amount of nodes in the table
+func (table *routingTable) size() int {
+	size := 0
+	for _, bucket := range table.buckets {
+		size += len(bucket)
+	}
+
+	return size
+}
+
+// sortByDistance orders the contacts by the XOR distance of their IDs to the target, closest first
+func sortByDistance(contacts []*contact, target [20]byte) {
+	sort.Slice(contacts, func(i, j int) bool {
+		return closer(contacts[i].id, contacts[j].id, target)
+	})
+}
+
+// closer reports whether a is closer to the target than b
+func closer(a, b, target [20]byte) bool {
+	for i := range target {
+		da, db := a[i]^target[i], b[i]^target[i]
+		if da != db {
+			return da < db
+		}
+	}
+
+	return false
+}
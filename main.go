@@ -3,19 +3,91 @@ package main
 import (
 	"fmt"
 	"goTorrent/client"
+	"goTorrent/dht"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 )
 
+const dhtStateFile = "dht.dat"
+
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "create" {
+		create(os.Args[2:])
+		return
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "scrape" {
+		scrape(os.Args[2:])
+		return
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "tracker" {
+		serveTracker(os.Args[2:])
+		return
+	}
+
 	name := `files\Marvel's Avengers (v1.3.3-141640, MULTi15).torrent`
-	torrent := client.AddTorrent(name)
+	if len(os.Args) > 1 {
+		name = os.Args[1]
+	}
+
+	err := download(name)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
 
-	tRequest := torrent.Data.CreateTrackerRequest(torrent.Hash)
+// download adds the torrent file or magnet link and runs it until we are interrupted, seeding it once
+// every piece is in. Stopping the torrent sends the stopped announce, and the DHT state is saved on the way out.
+func download(name string) error {
+	// Magnet links without trackers only find their peers through the DHT. The nodes we know are
+	// kept between runs, so joining the network again is quick.
+	node, err := dht.New(dht.Config{StateFile: dhtStateFile})
+	if err != nil {
+		fmt.Printf("Unable to start DHT node: %s \n", err.Error())
+	} else {
+		defer node.Close()
+		err = node.Bootstrap()
+		if err != nil {
+			fmt.Printf("Unable to join the DHT: %s \n", err.Error())
+		}
+		client.Settings.DHT = node
+	}
 
-	torrent.Announce(tRequest)
-	fmt.Printf("We grabbed %v peers in total \n", len(torrent.Peers))
-	for _, peer := range torrent.Peers {
-		fmt.Println(peer)
+	var torrent *client.Torrent
+	if strings.HasPrefix(name, "magnet:") {
+		// A magnet link is announced while its metadata is fetched
+		torrent, err = client.AddMagnet(name)
+	} else {
+		torrent, err = client.AddTorrent(name)
 	}
-	//torrent.Start()
+	if err != nil {
+		return err
+	}
+
+	interrupted := make(chan os.Signal, 1)
+	signal.Notify(interrupted, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(interrupted)
+
+	stopped := make(chan struct{})
+	go func() {
+		torrent.Start()
+		close(stopped)
+	}()
+
+	select {
+	case <-torrent.Done():
+		fmt.Println("Download finished, seeding until interrupted...")
+		<-interrupted
+	case <-interrupted:
+	}
+
+	fmt.Println("Stopping...")
+	torrent.Stop()
+	<-stopped
 
+	return nil
 }
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"goTorrent/client"
+	"io/ioutil"
+	"log"
+	"os"
+	"text/tabwriter"
+)
+
+// A swarm is a torrent we scrape, with the best answer any of its trackers gave so far
+type swarm struct {
+	name    string
+	hash    []byte
+	result  *client.ScrapeResult
+	tracker string
+}
+
+// scrape prints how healthy the swarms of .torrent files are: goTorrent scrape <file.torrent>...
+// Every tracker is scraped once, for all the torrents it tracks together.
+func scrape(args []string) {
+	flags := flag.NewFlagSet("scrape", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: goTorrent scrape <file.torrent>...")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if flags.NArg() == 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	var swarms []*swarm
+	var trackers []string
+	tracked := map[string][]*swarm{}
+
+	for _, file := range flags.Args() {
+		stream, err := ioutil.ReadFile(file)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		info, err := client.ParseMetaInfo(stream)
+		if err != nil {
+			log.Fatalf("%s: %s", file, err.Error())
+		}
+
+		s := &swarm{name: info.Info.Name, hash: info.SwarmHash()}
+		swarms = append(swarms, s)
+
+		for _, tracker := range info.Trackers() {
+			if tracked[tracker] == nil {
+				trackers = append(trackers, tracker)
+			}
+			tracked[tracker] = append(tracked[tracker], s)
+		}
+	}
+
+	for _, tracker := range trackers {
+		var hashes [][]byte
+		for _, s := range tracked[tracker] {
+			hashes = append(hashes, s.hash)
+		}
+
+		results, err := client.Scrape(tracker, hashes)
+		if err != nil {
+			fmt.Printf("Unable to scrape %s: %s \n", tracker, err.Error())
+			continue
+		}
+
+		for i := range results {
+			result := &results[i]
+			for _, s := range tracked[tracker] {
+				if string(s.hash) == string(result.InfoHash) && (s.result == nil || result.Seeders > s.result.Seeders) {
+					s.result = result
+					s.tracker = tracker
+				}
+			}
+		}
+	}
+
+	table := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(table, "TORRENT\tSEEDERS\tLEECHERS\tCOMPLETED\tTRACKER")
+	for _, s := range swarms {
+		if s.result == nil {
+			fmt.Fprintf(table, "%s\t-\t-\t-\tno tracker answered\n", s.name)
+			continue
+		}
+		fmt.Fprintf(table, "%s\t%v\t%v\t%v\t%s\n", s.name, s.result.Seeders, s.result.Leechers, s.result.Completed, s.tracker)
+	}
+	table.Flush()
+}
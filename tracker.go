@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"goTorrent/client"
+	"goTorrent/tracker"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// serveTracker runs a tracker: goTorrent tracker [flags]
+func serveTracker(args []string) {
+	flags := flag.NewFlagSet("tracker", flag.ExitOnError)
+
+	var whitelist listFlag
+	httpAddr := flags.String("http", ":6969", "address to serve HTTP announces and scrapes on, or empty for none")
+	udpAddr := flags.String("udp", ":6969", "address to serve UDP announces and scrapes on, or empty for none")
+	interval := flags.Duration("interval", 0, "how long peers wait between announces (default 30m)")
+	flags.Var(&whitelist, "w", "info-hash in hex, or .torrent file, that may be tracked. Can be repeated. Without it, every torrent may be tracked")
+
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: goTorrent tracker [flags]")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if *httpAddr == "" && *udpAddr == "" {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	config := tracker.Config{Interval: *interval}
+	for _, entry := range whitelist {
+		infoHash, err := whitelistEntry(entry)
+		if err != nil {
+			log.Fatalf("%s: %s", entry, err.Error())
+		}
+		config.Whitelist = append(config.Whitelist, infoHash)
+	}
+
+	t := tracker.New(config)
+
+	if *udpAddr != "" {
+		conn, err := net.ListenPacket("udp", *udpAddr)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		fmt.Printf("Serving UDP tracker on %s \n", conn.LocalAddr())
+		go func() {
+			log.Fatal(t.ServeUDP(conn))
+		}()
+	}
+
+	if *httpAddr == "" {
+		select {}
+	}
+
+	fmt.Printf("Serving HTTP tracker on %s \n", *httpAddr)
+	log.Fatal(http.ListenAndServe(*httpAddr, t))
+}
+
+// whitelistEntry reads an info-hash given in hex, or the info-hash of a .torrent file
+func whitelistEntry(entry string) ([20]byte, error) {
+	var infoHash [20]byte
+
+	if strings.HasSuffix(entry, ".torrent") {
+		stream, err := ioutil.ReadFile(entry)
+		if err != nil {
+			return infoHash, err
+		}
+
+		info, err := client.ParseMetaInfo(stream)
+		if err != nil {
+			return infoHash, err
+		}
+
+		copy(infoHash[:], info.SwarmHash())
+		return infoHash, nil
+	}
+
+	decoded, err := hex.DecodeString(entry)
+	if err != nil || len(decoded) != 20 {
+		return infoHash, fmt.Errorf("not a 40 character hex info-hash")
+	}
+
+	copy(infoHash[:], decoded)
+	return infoHash, nil
+}
@@ -0,0 +1,239 @@
+package tracker
+
+// Will handle announces and scrapes over HTTP
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/zeebo/bencode"
+)
+
+// The announceResponse sent to an HTTP announce. Peers is either the compact string or a list of peerDicts.
+type announceResponse struct {
+	Interval    int         `bencode:"interval"`
+	MinInterval int         `bencode:"min interval"`
+	Complete    int         `bencode:"complete"`
+	Incomplete  int         `bencode:"incomplete"`
+	Peers       interface{} `bencode:"peers"`
+	Peers6      string      `bencode:"peers6,omitempty"`
+}
+
+// A peerDict is a peer in the non-compact peer list
+type peerDict struct {
+	PeerID string `bencode:"peer id,omitempty"`
+	IP     string `bencode:"ip"`
+	Port   int    `bencode:"port"`
+}
+
+type scrapeResponse struct {
+	Files map[string]scrapeFile `bencode:"files"`
+}
+
+type scrapeFile struct {
+	Complete   int `bencode:"complete"`
+	Downloaded int `bencode:"downloaded"`
+	Incomplete int `bencode:"incomplete"`
+}
+
+type failureResponse struct {
+	FailureReason string `bencode:"failure reason"`
+}
+
+// ServeHTTP answers announces and scrapes. Any path ending in "announce" or "scrape" is served, so the
+// tracker can be mounted anywhere, and clients derive the scrape URL from the announce URL.
+func (tracker *Tracker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch last := path.Base(r.URL.Path); {
+	case strings.HasPrefix(last, "announce"):
+		tracker.serveAnnounce(w, r)
+	case strings.HasPrefix(last, "scrape"):
+		tracker.serveScrape(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (tracker *Tracker) serveAnnounce(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	a, reason := parseHTTPAnnounce(query, r.RemoteAddr)
+	if reason != "" {
+		writeBencode(w, failureResponse{reason})
+		return
+	}
+
+	state, err := tracker.announce(a)
+	if err != nil {
+		writeBencode(w, failureResponse{err.Error()})
+		return
+	}
+
+	response := announceResponse{
+		Interval:    int(tracker.config.Interval.Seconds()),
+		MinInterval: int(tracker.config.MinInterval.Seconds()),
+		Complete:    state.seeders,
+		Incomplete:  state.leechers,
+	}
+
+	if query.Get("compact") == "0" {
+		withIDs := query.Get("no_peer_id") != "1"
+		peers := []peerDict{}
+		for _, p := range state.peers {
+			for _, ip := range p.addresses() {
+				dict := peerDict{IP: ip.String(), Port: p.port}
+				if withIDs {
+					dict.PeerID = string(p.id[:])
+				}
+				peers = append(peers, dict)
+			}
+		}
+		response.Peers = peers
+	} else {
+		var peers, peers6 []byte
+		for _, p := range state.peers {
+			for _, ip := range p.addresses() {
+				if ip4 := ip.To4(); ip4 != nil {
+					peers = appendCompact(peers, ip4, p.port)
+				} else {
+					peers6 = appendCompact(peers6, ip, p.port)
+				}
+			}
+		}
+		response.Peers = string(peers)
+		response.Peers6 = string(peers6)
+	}
+
+	writeBencode(w, response)
+}
+
+// parseHTTPAnnounce reads the parameters of an HTTP announce. The peer's address is the one the request
+// came from, unless it announced another one. A non-empty failure reason is returned if the announce is invalid.
+func parseHTTPAnnounce(query url.Values, remoteAddr string) (*announce, string) {
+	a := announce{event: query.Get("event"), numWant: -1}
+
+	infoHash := query.Get("info_hash")
+	if len(infoHash) != 20 {
+		return nil, errBadInfoHash.Error()
+	}
+	copy(a.infoHash[:], infoHash)
+
+	peerID := query.Get("peer_id")
+	if len(peerID) != 20 {
+		return nil, errBadPeerID.Error()
+	}
+	copy(a.peerID[:], peerID)
+
+	port, err := strconv.Atoi(query.Get("port"))
+	if err != nil || port <= 0 || port > 65535 {
+		return nil, "invalid port"
+	}
+	a.port = port
+
+	a.left, err = strconv.ParseInt(query.Get("left"), 10, 64)
+	if err != nil {
+		return nil, "invalid left"
+	}
+
+	if numWant, err := strconv.Atoi(query.Get("numwant")); err == nil && numWant >= 0 {
+		a.numWant = numWant
+	}
+
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	a.ip = net.ParseIP(host)
+	if ip := net.ParseIP(query.Get("ip")); ip != nil {
+		a.ip = ip
+	}
+	if a.ip == nil {
+		return nil, "unable to tell the peer's address"
+	}
+
+	if ipv6 := net.ParseIP(query.Get("ipv6")); ipv6 != nil && ipv6.To4() == nil {
+		if a.ip.To4() == nil {
+			a.ip = ipv6
+		} else {
+			a.ipv6 = ipv6
+		}
+	}
+
+	return &a, ""
+}
+
+func (tracker *Tracker) serveScrape(w http.ResponseWriter, r *http.Request) {
+	var infoHashes [][20]byte
+	for _, value := range r.URL.Query()["info_hash"] {
+		if len(value) != 20 {
+			writeBencode(w, failureResponse{errBadInfoHash.Error()})
+			return
+		}
+
+		var infoHash [20]byte
+		copy(infoHash[:], value)
+		infoHashes = append(infoHashes, infoHash)
+	}
+
+	// A scrape without info-hashes asks for every swarm, which only an open tracker hands out
+	if len(infoHashes) == 0 {
+		if tracker.whitelist != nil {
+			writeBencode(w, failureResponse{"full scrapes are not allowed"})
+			return
+		}
+		infoHashes = tracker.infoHashes()
+	}
+
+	response := scrapeResponse{Files: map[string]scrapeFile{}}
+	for infoHash, state := range tracker.scrape(infoHashes) {
+		response.Files[string(infoHash[:])] = scrapeFile{
+			Complete:   state.seeders,
+			Downloaded: state.downloaded,
+			Incomplete: state.leechers,
+		}
+	}
+
+	writeBencode(w, response)
+}
+
+// infoHashes returns the info-hashes of every swarm
+func (tracker *Tracker) infoHashes() [][20]byte {
+	tracker.mu.Lock()
+	defer tracker.mu.Unlock()
+
+	var infoHashes [][20]byte
+	for infoHash := range tracker.swarms {
+		infoHashes = append(infoHashes, infoHash)
+	}
+
+	return infoHashes
+}
+
+// addresses returns the addresses the peer can be reached at
+func (p *peer) addresses() []net.IP {
+	if p.ipv6 != nil {
+		return []net.IP{p.ip, p.ipv6}
+	}
+
+	return []net.IP{p.ip}
+}
+
+// appendCompact appends a peer in the compact format: the 4 or 16 bytes of its IP address and 2 bytes of port
+func appendCompact(data []byte, ip net.IP, port int) []byte {
+	data = append(data, ip...)
+	return append(data, byte(port>>8), byte(port))
+}
+
+func writeBencode(w http.ResponseWriter, v interface{}) {
+	data, err := bencode.EncodeBytes(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write(data)
+}
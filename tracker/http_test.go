@@ -0,0 +1,198 @@
+package tracker
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/zeebo/bencode"
+)
+
+// get sends the request to the tracker from the address, and decodes the bencoded answer
+func get(t *testing.T, tracker *Tracker, target string, remoteAddr string) map[string]interface{} {
+	t.Helper()
+
+	r := httptest.NewRequest("GET", target, nil)
+	r.RemoteAddr = remoteAddr
+	w := httptest.NewRecorder()
+	tracker.ServeHTTP(w, r)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("%s answered with status %v", target, w.Code)
+	}
+
+	var response map[string]interface{}
+	err := bencode.DecodeBytes(w.Body.Bytes(), &response)
+	if err != nil {
+		t.Fatalf("%s answered with %q: %s", target, w.Body.String(), err)
+	}
+
+	return response
+}
+
+// announceQuery is the query of an announce of the peer numbered n, plus the extra parameters
+func announceQuery(n byte, left string, extra ...string) string {
+	peerID := make([]byte, 20)
+	peerID[0] = n
+
+	query := url.Values{
+		"info_hash": {string(testInfoHash[:])},
+		"peer_id":   {string(peerID)},
+		"port":      {"6881"},
+		"left":      {left},
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		query.Set(extra[i], extra[i+1])
+	}
+
+	return "/announce?" + query.Encode()
+}
+
+// splitCompact splits compact peers into entries of the given size, sorted so they compare in any order
+func splitCompact(peers string, size int) []string {
+	var entries []string
+	for i := 0; i+size <= len(peers); i += size {
+		entries = append(entries, peers[i:i+size])
+	}
+	sort.Strings(entries)
+
+	return entries
+}
+
+func TestHTTPAnnounceCompact(t *testing.T) {
+	tracker := New(Config{})
+
+	// An IPv4 peer that also told us its IPv6 address, and a peer that is only reachable over IPv6
+	get(t, tracker, announceQuery(1, "100", "ipv6", "2001:db8::1"), "192.0.2.1:1234")
+	get(t, tracker, announceQuery(2, "0"), "[2001:db8::2]:1234")
+
+	response := get(t, tracker, announceQuery(3, "100", "compact", "1"), "192.0.2.3:1234")
+	if response["interval"] != int64(defaultInterval.Seconds()) || response["min interval"] != int64(defaultMinInterval.Seconds()) {
+		t.Fatalf("intervals are %v and %v", response["interval"], response["min interval"])
+	}
+	if response["complete"] != int64(1) || response["incomplete"] != int64(2) {
+		t.Fatalf("swarm counted as %v complete and %v incomplete", response["complete"], response["incomplete"])
+	}
+
+	peers, _ := response["peers"].(string)
+	if peers != "\xc0\x00\x02\x01\x1a\xe1" {
+		t.Fatalf("compact peers are %x", peers)
+	}
+
+	v6 := func(last byte) string {
+		return "\x20\x01\x0d\xb8" + strings.Repeat("\x00", 11) + string([]byte{last}) + "\x1a\xe1"
+	}
+	peers6, _ := response["peers6"].(string)
+	if got, want := splitCompact(peers6, 18), []string{v6(1), v6(2)}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("compact IPv6 peers are %x", peers6)
+	}
+}
+
+func TestHTTPAnnounceDict(t *testing.T) {
+	tracker := New(Config{})
+	get(t, tracker, announceQuery(1, "100"), "192.0.2.1:1234")
+
+	response := get(t, tracker, announceQuery(2, "100", "compact", "0"), "192.0.2.2:1234")
+	peers, _ := response["peers"].([]interface{})
+	if len(peers) != 1 {
+		t.Fatalf("peers are %v", response["peers"])
+	}
+	peer, _ := peers[0].(map[string]interface{})
+	if peer["ip"] != "192.0.2.1" || peer["port"] != int64(6881) || peer["peer id"] != "\x01"+strings.Repeat("\x00", 19) {
+		t.Fatalf("peer is %q", peer)
+	}
+
+	response = get(t, tracker, announceQuery(2, "100", "compact", "0", "no_peer_id", "1"), "192.0.2.2:1234")
+	peers, _ = response["peers"].([]interface{})
+	if peer, _ := peers[0].(map[string]interface{}); peer["peer id"] != nil {
+		t.Fatalf("peer id was sent though the announce asked for none: %q", peer)
+	}
+}
+
+func TestHTTPAnnounceAddress(t *testing.T) {
+	tracker := New(Config{})
+
+	// A peer may announce another address than the one it connects from
+	get(t, tracker, announceQuery(1, "100", "ip", "198.51.100.7"), "192.0.2.1:1234")
+
+	response := get(t, tracker, announceQuery(2, "100", "compact", "0"), "192.0.2.2:1234")
+	peers, _ := response["peers"].([]interface{})
+	if peer, _ := peers[0].(map[string]interface{}); len(peers) != 1 || peer["ip"] != "198.51.100.7" {
+		t.Fatalf("peers are %q, want the announced address", peers)
+	}
+}
+
+func TestHTTPAnnounceFailures(t *testing.T) {
+	tracker := New(Config{Whitelist: [][20]byte{testInfoHash}})
+	valid := announceQuery(1, "100")
+
+	cases := map[string]string{
+		"short info_hash": strings.Replace(valid, "info_hash=%01%02%03", "info_hash=%01%02", 1),
+		"short peer_id":   strings.Replace(valid, "peer_id=%01%00", "peer_id=%01", 1),
+		"bad port":        announceQuery(1, "100", "port", "70000"),
+		"bad left":        announceQuery(1, "lots"),
+		"not whitelisted": strings.Replace(valid, "info_hash=%01%02%03", "info_hash=%04%05%06", 1),
+	}
+
+	for name, target := range cases {
+		response := get(t, tracker, target, "192.0.2.1:1234")
+		if response["failure reason"] == nil {
+			t.Errorf("%s: announce wasn't refused: %v", name, response)
+		}
+	}
+}
+
+func TestHTTPScrape(t *testing.T) {
+	tracker := New(Config{})
+	get(t, tracker, announceQuery(1, "100"), "192.0.2.1:1234")
+	get(t, tracker, announceQuery(2, "0", "event", "completed"), "192.0.2.2:1234")
+
+	unknown := strings.Repeat("\x09", 20)
+	response := get(t, tracker, "/scrape?info_hash="+url.QueryEscape(string(testInfoHash[:]))+"&info_hash="+url.QueryEscape(unknown), "192.0.2.3:1234")
+	files, _ := response["files"].(map[string]interface{})
+	if len(files) != 2 {
+		t.Fatalf("scrape of 2 info-hashes got %v", response)
+	}
+	file, _ := files[string(testInfoHash[:])].(map[string]interface{})
+	if file["complete"] != int64(1) || file["incomplete"] != int64(1) || file["downloaded"] != int64(1) {
+		t.Fatalf("swarm scraped as %v", file)
+	}
+
+	// Without info-hashes, every swarm is scraped
+	response = get(t, tracker, "/scrape", "192.0.2.3:1234")
+	if files, _ := response["files"].(map[string]interface{}); len(files) != 1 || files[string(testInfoHash[:])] == nil {
+		t.Fatalf("full scrape got %v", response)
+	}
+
+	// Unless the tracker only tracks a whitelist
+	private := New(Config{Whitelist: [][20]byte{testInfoHash}})
+	if response := get(t, private, "/scrape", "192.0.2.3:1234"); response["failure reason"] == nil {
+		t.Fatalf("whitelisted tracker allowed a full scrape: %v", response)
+	}
+}
+
+func TestHTTPPaths(t *testing.T) {
+	tracker := New(Config{})
+
+	for _, target := range []string{"/", "/stats", "/announce/extra"} {
+		w := httptest.NewRecorder()
+		tracker.ServeHTTP(w, httptest.NewRequest("GET", target, nil))
+		if w.Code != http.StatusNotFound {
+			t.Errorf("%s answered with status %v", target, w.Code)
+		}
+	}
+
+	// The tracker can be mounted under any prefix, with a passkey in the path
+	response := get(t, tracker, "/private/abc123/"+strings.TrimPrefix(announceQuery(1, "100"), "/"), "192.0.2.1:1234")
+	if response["failure reason"] != nil || response["interval"] == nil {
+		t.Fatalf("announce under a prefix got %v", response)
+	}
+	response = get(t, tracker, "/private/abc123/scrape.php", "192.0.2.1:1234")
+	if response["files"] == nil {
+		t.Fatalf("scrape under a prefix got %v", response)
+	}
+}
@@ -0,0 +1,254 @@
+// Package tracker is a BitTorrent tracker. It answers announces and scrapes over HTTP and over
+// UDP (BEP 15), keeping the swarms it tracks in memory.
+package tracker
+
+// Will handle the registry of swarms and the peers in them, shared by the HTTP and UDP servers
+
+import (
+	"errors"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	defaultInterval    = 30 * time.Minute
+	defaultMinInterval = 5 * time.Minute
+	defaultNumWant     = 50
+	maxNumWant         = 200
+)
+
+var (
+	errNotRegistered = errors.New("torrent not registered with this tracker")
+	errBadInfoHash   = errors.New("info_hash must be 20 bytes")
+	errBadPeerID     = errors.New("peer_id must be 20 bytes")
+)
+
+// Config holds the settings a tracker runs with. Zero values are replaced by defaults.
+type Config struct {
+	Interval    time.Duration // how long peers are asked to wait between announces
+	MinInterval time.Duration // how long peers must wait between announces
+	PeerTimeout time.Duration // peers that don't announce for this long are dropped. Twice the interval by default
+	NumWant     int           // peers handed out when the announce doesn't say how many it wants
+	Whitelist   [][20]byte    // info-hashes that may be tracked. If empty, every info-hash may
+}
+
+// A Tracker keeps the swarms of the info-hashes peers announce
+type Tracker struct {
+	config    Config
+	whitelist map[[20]byte]bool
+
+	mu        sync.Mutex
+	swarms    map[[20]byte]*swarm
+	random    *rand.Rand
+	lastSweep time.Time // when the peers of every swarm were last checked for expiry
+
+	udpSecret []byte // mixed into the connection IDs of UDP clients
+}
+
+// A swarm holds the peers of one info-hash
+type swarm struct {
+	peers      map[[20]byte]*peer // by peer id
+	downloaded int                // completed events ever received
+}
+
+// A peer is a participant of a swarm, as it last announced itself
+type peer struct {
+	id       [20]byte
+	ip       net.IP
+	ipv6     net.IP // the IPv6 address an IPv4 peer told us it also has (BEP 7)
+	port     int
+	left     int64
+	lastSeen time.Time
+}
+
+// An announce is what a peer tells the tracker, over either protocol
+type announce struct {
+	infoHash [20]byte
+	peerID   [20]byte
+	ip       net.IP
+	ipv6     net.IP
+	port     int
+	left     int64
+	event    string
+	numWant  int
+}
+
+// A swarmState is what an announce or scrape is answered with
+type swarmState struct {
+	seeders    int
+	leechers   int
+	downloaded int
+	peers      []*peer
+}
+
+// New creates a tracker with the given settings
+func New(config Config) *Tracker {
+	if config.Interval <= 0 {
+		config.Interval = defaultInterval
+	}
+	if config.MinInterval <= 0 {
+		config.MinInterval = defaultMinInterval
+	}
+	if config.MinInterval > config.Interval {
+		config.MinInterval = config.Interval
+	}
+	if config.PeerTimeout <= 0 {
+		config.PeerTimeout = 2 * config.Interval
+	}
+	if config.NumWant <= 0 {
+		config.NumWant = defaultNumWant
+	}
+
+	tracker := Tracker{
+		config: config,
+		swarms: map[[20]byte]*swarm{},
+		random: rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+
+	if len(config.Whitelist) > 0 {
+		tracker.whitelist = map[[20]byte]bool{}
+		for _, infoHash := range config.Whitelist {
+			tracker.whitelist[infoHash] = true
+		}
+	}
+
+	tracker.udpSecret = make([]byte, 16)
+	tracker.random.Read(tracker.udpSecret)
+
+	return &tracker
+}
+
+// allowed reports whether the tracker tracks the info-hash
+func (tracker *Tracker) allowed(infoHash [20]byte) bool {
+	return tracker.whitelist == nil || tracker.whitelist[infoHash]
+}
+
+// announce registers the peer in the swarm, or removes it on the stopped event, and returns the
+// state of the swarm with up to numWant other peers
+func (tracker *Tracker) announce(a *announce) (*swarmState, error) {
+	if !tracker.allowed(a.infoHash) {
+		return nil, errNotRegistered
+	}
+
+	tracker.mu.Lock()
+	defer tracker.mu.Unlock()
+
+	now := time.Now()
+	tracker.sweep(now)
+
+	s := tracker.swarms[a.infoHash]
+	if s == nil {
+		s = &swarm{peers: map[[20]byte]*peer{}}
+		tracker.swarms[a.infoHash] = s
+	}
+	tracker.expire(s, now)
+
+	if a.event == "stopped" {
+		delete(s.peers, a.peerID)
+	} else {
+		s.peers[a.peerID] = &peer{id: a.peerID, ip: a.ip, ipv6: a.ipv6, port: a.port, left: a.left, lastSeen: now}
+	}
+
+	if a.event == "completed" {
+		s.downloaded++
+	}
+
+	state := s.state()
+
+	numWant := a.numWant
+	if numWant < 0 {
+		numWant = tracker.config.NumWant
+	}
+	if numWant > maxNumWant {
+		numWant = maxNumWant
+	}
+
+	// Seeders have no use for other seeders
+	seeding := a.left == 0
+	for _, p := range s.peers {
+		if p.id != a.peerID && !(seeding && p.left == 0) {
+			state.peers = append(state.peers, p)
+		}
+	}
+
+	tracker.random.Shuffle(len(state.peers), func(i, j int) {
+		state.peers[i], state.peers[j] = state.peers[j], state.peers[i]
+	})
+	if len(state.peers) > numWant {
+		state.peers = state.peers[:numWant]
+	}
+
+	if len(s.peers) == 0 {
+		delete(tracker.swarms, a.infoHash)
+	}
+
+	return state, nil
+}
+
+// scrape returns the state of the swarm of every info-hash, without peers. Info-hashes that aren't
+// tracked are left out.
+func (tracker *Tracker) scrape(infoHashes [][20]byte) map[[20]byte]*swarmState {
+	tracker.mu.Lock()
+	defer tracker.mu.Unlock()
+
+	now := time.Now()
+	states := map[[20]byte]*swarmState{}
+
+	for _, infoHash := range infoHashes {
+		if !tracker.allowed(infoHash) {
+			continue
+		}
+
+		s := tracker.swarms[infoHash]
+		if s == nil {
+			states[infoHash] = &swarmState{}
+			continue
+		}
+
+		tracker.expire(s, now)
+		states[infoHash] = s.state()
+	}
+
+	return states
+}
+
+// expire drops the peers of the swarm that haven't announced in time. The tracker must be locked.
+func (tracker *Tracker) expire(s *swarm, now time.Time) {
+	for id, p := range s.peers {
+		if now.Sub(p.lastSeen) > tracker.config.PeerTimeout {
+			delete(s.peers, id)
+		}
+	}
+}
+
+// sweep expires the peers of every swarm once per interval, so swarms nobody announces to anymore
+// don't linger. The tracker must be locked.
+func (tracker *Tracker) sweep(now time.Time) {
+	if now.Sub(tracker.lastSweep) < tracker.config.Interval {
+		return
+	}
+	tracker.lastSweep = now
+
+	for infoHash, s := range tracker.swarms {
+		tracker.expire(s, now)
+		if len(s.peers) == 0 {
+			delete(tracker.swarms, infoHash)
+		}
+	}
+}
+
+// state counts the seeders and leechers of the swarm
+func (s *swarm) state() *swarmState {
+	state := swarmState{downloaded: s.downloaded}
+	for _, p := range s.peers {
+		if p.left == 0 {
+			state.seeders++
+		} else {
+			state.leechers++
+		}
+	}
+
+	return &state
+}
@@ -0,0 +1,174 @@
+package tracker
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+var testInfoHash = [20]byte{1, 2, 3}
+
+// testAnnounce is the announce of the peer numbered n, reachable at 10.0.0.n:6881
+func testAnnounce(n byte, left int64, event string) *announce {
+	a := announce{
+		infoHash: testInfoHash,
+		ip:       net.IPv4(10, 0, 0, n).To4(),
+		port:     6881,
+		left:     left,
+		event:    event,
+		numWant:  -1,
+	}
+	a.peerID[0] = n
+
+	return &a
+}
+
+func mustAnnounce(t *testing.T, tracker *Tracker, a *announce) *swarmState {
+	t.Helper()
+
+	state, err := tracker.announce(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return state
+}
+
+// peerNumbers returns the numbers of the peers testAnnounce announced, in any order
+func peerNumbers(peers []*peer) map[byte]bool {
+	numbers := map[byte]bool{}
+	for _, p := range peers {
+		numbers[p.id[0]] = true
+	}
+
+	return numbers
+}
+
+func TestAnnounce(t *testing.T) {
+	tracker := New(Config{})
+
+	state := mustAnnounce(t, tracker, testAnnounce(1, 100, "started"))
+	if state.leechers != 1 || state.seeders != 0 || len(state.peers) != 0 {
+		t.Fatalf("first announce got %v leechers, %v seeders and %v peers", state.leechers, state.seeders, len(state.peers))
+	}
+
+	mustAnnounce(t, tracker, testAnnounce(2, 0, "started"))
+	state = mustAnnounce(t, tracker, testAnnounce(3, 50, "started"))
+	if state.leechers != 2 || state.seeders != 1 {
+		t.Fatalf("swarm has %v leechers and %v seeders, want 2 and 1", state.leechers, state.seeders)
+	}
+	if got := peerNumbers(state.peers); len(got) != 2 || !got[1] || !got[2] {
+		t.Fatalf("leecher was handed peers %v, want everyone else", got)
+	}
+
+	// Seeders aren't handed other seeders
+	state = mustAnnounce(t, tracker, testAnnounce(4, 0, "started"))
+	if got := peerNumbers(state.peers); len(got) != 2 || !got[1] || !got[3] {
+		t.Fatalf("seeder was handed peers %v, want the leechers", got)
+	}
+
+	// Nor more peers than it asked for
+	few := testAnnounce(5, 10, "")
+	few.numWant = 2
+	if state = mustAnnounce(t, tracker, few); len(state.peers) != 2 {
+		t.Fatalf("asked for 2 peers, got %v", len(state.peers))
+	}
+
+	// A leecher that finishes is counted as a download and as a seeder from then on
+	state = mustAnnounce(t, tracker, testAnnounce(1, 0, "completed"))
+	if state.downloaded != 1 || state.seeders != 3 || state.leechers != 2 {
+		t.Fatalf("after completing: %+v", state)
+	}
+
+	// Stopped peers leave the swarm, and the swarm goes once it's empty
+	for n := byte(1); n <= 5; n++ {
+		state = mustAnnounce(t, tracker, testAnnounce(n, 0, "stopped"))
+	}
+	if state.seeders != 0 || state.leechers != 0 || len(state.peers) != 0 {
+		t.Fatalf("swarm isn't empty after everyone stopped: %+v", state)
+	}
+	if len(tracker.swarms) != 0 {
+		t.Fatal("empty swarm was kept")
+	}
+}
+
+func TestScrape(t *testing.T) {
+	tracker := New(Config{})
+	mustAnnounce(t, tracker, testAnnounce(1, 100, "started"))
+	mustAnnounce(t, tracker, testAnnounce(2, 0, "completed"))
+	mustAnnounce(t, tracker, testAnnounce(3, 0, "started"))
+
+	unknown := [20]byte{9}
+	states := tracker.scrape([][20]byte{testInfoHash, unknown})
+	if len(states) != 2 {
+		t.Fatalf("scrape of 2 info-hashes got %v answers", len(states))
+	}
+
+	state := states[testInfoHash]
+	if state.seeders != 2 || state.leechers != 1 || state.downloaded != 1 || state.peers != nil {
+		t.Fatalf("swarm scraped as %+v", state)
+	}
+	if state := states[unknown]; state.seeders != 0 || state.leechers != 0 || state.downloaded != 0 {
+		t.Fatalf("unknown swarm scraped as %+v", state)
+	}
+}
+
+func TestPeerExpiry(t *testing.T) {
+	tracker := New(Config{Interval: time.Minute, PeerTimeout: 2 * time.Minute})
+	mustAnnounce(t, tracker, testAnnounce(1, 100, "started"))
+	mustAnnounce(t, tracker, testAnnounce(2, 100, "started"))
+
+	// Peer 1 stopped announcing a while ago
+	tracker.swarms[testInfoHash].peers[[20]byte{1}].lastSeen = time.Now().Add(-3 * time.Minute)
+
+	if state := tracker.scrape([][20]byte{testInfoHash})[testInfoHash]; state.leechers != 1 {
+		t.Fatalf("scrape counts %v leechers, want the one that didn't expire", state.leechers)
+	}
+	state := mustAnnounce(t, tracker, testAnnounce(3, 100, ""))
+	if got := peerNumbers(state.peers); len(got) != 1 || !got[2] {
+		t.Fatalf("handed peers %v, want only the one that didn't expire", got)
+	}
+}
+
+func TestSweep(t *testing.T) {
+	tracker := New(Config{Interval: time.Minute, PeerTimeout: 2 * time.Minute})
+	mustAnnounce(t, tracker, testAnnounce(1, 100, "started"))
+	tracker.swarms[testInfoHash].peers[[20]byte{1}].lastSeen = time.Now().Add(-3 * time.Minute)
+
+	other := testAnnounce(2, 100, "started")
+	other.infoHash = [20]byte{4, 5, 6}
+
+	// An announce to another swarm within the interval of the last sweep leaves the stale swarm alone
+	tracker.lastSweep = time.Now()
+	mustAnnounce(t, tracker, other)
+	if tracker.swarms[testInfoHash] == nil {
+		t.Fatal("swarm was swept before the interval passed")
+	}
+
+	// Once the interval passed, the swarm nobody announces to anymore is dropped
+	tracker.lastSweep = time.Now().Add(-2 * time.Minute)
+	mustAnnounce(t, tracker, other)
+	if tracker.swarms[testInfoHash] != nil {
+		t.Fatal("swarm of expired peers wasn't swept")
+	}
+	if tracker.swarms[other.infoHash] == nil {
+		t.Fatal("swarm of a live peer was swept")
+	}
+}
+
+func TestWhitelist(t *testing.T) {
+	tracker := New(Config{Whitelist: [][20]byte{testInfoHash}})
+
+	mustAnnounce(t, tracker, testAnnounce(1, 100, "started"))
+
+	other := testAnnounce(1, 100, "started")
+	other.infoHash = [20]byte{4, 5, 6}
+	if _, err := tracker.announce(other); err != errNotRegistered {
+		t.Fatalf("announce of an info-hash that isn't whitelisted got error %v, want %v", err, errNotRegistered)
+	}
+
+	states := tracker.scrape([][20]byte{testInfoHash, other.infoHash})
+	if len(states) != 1 || states[testInfoHash] == nil {
+		t.Fatalf("scrape answered for %v info-hashes, want only the whitelisted one", len(states))
+	}
+}
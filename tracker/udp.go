@@ -0,0 +1,248 @@
+package tracker
+
+// Will handle announces and scrapes over UDP (BEP 15)
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"net"
+	"time"
+)
+
+const (
+	udpProtocolID      = 0x41727101980
+	connectionIDWindow = time.Minute // connection IDs are valid for the window they were handed out in and the next
+	maxScrapeHashes    = 74
+	maxPacket          = 2048
+)
+
+// UDP tracker actions
+const (
+	actionConnect  uint32 = 0
+	actionAnnounce uint32 = 1
+	actionScrape   uint32 = 2
+	actionError    uint32 = 3
+)
+
+// udpEvents maps the event numbers of UDP announces to their names
+var udpEvents = map[uint32]string{0: "", 1: "completed", 2: "started", 3: "stopped"}
+
+// ServeUDP answers the announces and scrapes that arrive on conn, until reading from it fails
+func (tracker *Tracker) ServeUDP(conn net.PacketConn) error {
+	buf := make([]byte, maxPacket)
+
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+
+		udpAddr, ok := addr.(*net.UDPAddr)
+		if !ok || n < 16 {
+			continue
+		}
+
+		response := tracker.handlePacket(buf[:n], udpAddr)
+		if response != nil {
+			conn.WriteTo(response, addr)
+		}
+	}
+}
+
+// handlePacket returns the answer to a request, or nil if it doesn't deserve one
+func (tracker *Tracker) handlePacket(packet []byte, addr *net.UDPAddr) []byte {
+	connectionID := binary.BigEndian.Uint64(packet[0:8])
+	action := binary.BigEndian.Uint32(packet[8:12])
+	transactionID := packet[12:16]
+
+	if action == actionConnect {
+		if connectionID != udpProtocolID {
+			return nil
+		}
+
+		/*
+			Offset  Size            Name            Value
+			0       32-bit integer  action          0 // connect
+			4       32-bit integer  transaction_id
+			8       64-bit integer  connection_id
+			16
+		*/
+		response := udpHeader(actionConnect, transactionID)
+		return appendUint64(response, tracker.connectionID(addr, time.Now()))
+	}
+
+	if !tracker.validConnectionID(connectionID, addr) {
+		return udpError(transactionID, "invalid connection id")
+	}
+
+	switch action {
+	case actionAnnounce:
+		return tracker.handleUDPAnnounce(packet, addr)
+	case actionScrape:
+		return tracker.handleUDPScrape(packet)
+	default:
+		return udpError(transactionID, "unknown action")
+	}
+}
+
+func (tracker *Tracker) handleUDPAnnounce(packet []byte, addr *net.UDPAddr) []byte {
+	transactionID := packet[12:16]
+
+	/*
+		Offset  Size    		Name    		Value
+		16      20-byte string  info_hash
+		36      20-byte string  peer_id
+		56      64-bit integer  downloaded
+		64      64-bit integer  left
+		72      64-bit integer  uploaded
+		80      32-bit integer  event           0 // 0: none; 1: completed; 2: started; 3: stopped
+		84      32-bit integer  IP address      0 // default
+		88      32-bit integer  key
+		92      32-bit integer  num_want        -1 // default
+		96      16-bit integer  port
+		98
+	*/
+	if len(packet) < 98 {
+		return udpError(transactionID, "announce too short")
+	}
+
+	a := announce{
+		ip:      addr.IP,
+		left:    int64(binary.BigEndian.Uint64(packet[64:72])),
+		event:   udpEvents[binary.BigEndian.Uint32(packet[80:84])],
+		numWant: int(int32(binary.BigEndian.Uint32(packet[92:96]))),
+		port:    int(binary.BigEndian.Uint16(packet[96:98])),
+	}
+	copy(a.infoHash[:], packet[16:36])
+	copy(a.peerID[:], packet[36:56])
+
+	if ip4 := addr.IP.To4(); ip4 != nil {
+		a.ip = ip4
+		if ip := binary.BigEndian.Uint32(packet[84:88]); ip != 0 {
+			a.ip = net.IPv4(byte(ip>>24), byte(ip>>16), byte(ip>>8), byte(ip)).To4()
+		}
+	}
+
+	state, err := tracker.announce(&a)
+	if err != nil {
+		return udpError(transactionID, err.Error())
+	}
+
+	/*
+		Offset      Size            Name            Value
+		0           32-bit integer  action          1 // announce
+		4           32-bit integer  transaction_id
+		8           32-bit integer  interval
+		12          32-bit integer  leechers
+		16          32-bit integer  seeders
+		20 + 6 * n  32-bit integer  IP address
+		24 + 6 * n  16-bit integer  TCP port
+		20 + 6 * N
+
+		Peers that announced over IPv6 are sent IPv6 peers, 18 bytes each.
+	*/
+	response := udpHeader(actionAnnounce, transactionID)
+	response = appendUint32(response, uint32(tracker.config.Interval.Seconds()))
+	response = appendUint32(response, uint32(state.leechers))
+	response = appendUint32(response, uint32(state.seeders))
+
+	overIPv6 := addr.IP.To4() == nil
+	for _, p := range state.peers {
+		for _, ip := range p.addresses() {
+			ip4 := ip.To4()
+			if overIPv6 && ip4 == nil {
+				response = appendCompact(response, ip, p.port)
+			} else if !overIPv6 && ip4 != nil {
+				response = appendCompact(response, ip4, p.port)
+			}
+		}
+	}
+
+	return response
+}
+
+func (tracker *Tracker) handleUDPScrape(packet []byte) []byte {
+	transactionID := packet[12:16]
+
+	/*
+		Offset          Size            Name            Value
+		16 + 20 * n     20-byte string  info_hash
+		16 + 20 * N
+	*/
+	var infoHashes [][20]byte
+	for offset := 16; offset+20 <= len(packet) && len(infoHashes) < maxScrapeHashes; offset += 20 {
+		var infoHash [20]byte
+		copy(infoHash[:], packet[offset:offset+20])
+		infoHashes = append(infoHashes, infoHash)
+	}
+
+	states := tracker.scrape(infoHashes)
+
+	/*
+		Offset      Size            Name            Value
+		0           32-bit integer  action          2 // scrape
+		4           32-bit integer  transaction_id
+		8 + 12 * n  32-bit integer  seeders
+		12 + 12 * n 32-bit integer  completed
+		16 + 12 * n 32-bit integer  leechers
+		8 + 12 * N
+
+		Info-hashes we don't track are answered with zeros, as the answers are matched to the request by position.
+	*/
+	response := udpHeader(actionScrape, transactionID)
+	for _, infoHash := range infoHashes {
+		state := states[infoHash]
+		if state == nil {
+			state = &swarmState{}
+		}
+		response = appendUint32(response, uint32(state.seeders))
+		response = appendUint32(response, uint32(state.downloaded))
+		response = appendUint32(response, uint32(state.leechers))
+	}
+
+	return response
+}
+
+// connectionID derives the connection ID of a client from its address and the current window of time, so
+// connection IDs don't need to be stored and can't be guessed by other clients
+func (tracker *Tracker) connectionID(addr *net.UDPAddr, now time.Time) uint64 {
+	window := make([]byte, 8)
+	binary.BigEndian.PutUint64(window, uint64(now.Unix()/int64(connectionIDWindow.Seconds())))
+
+	hash := sha1.New()
+	hash.Write(tracker.udpSecret)
+	hash.Write(window)
+	hash.Write([]byte(addr.String()))
+
+	return binary.BigEndian.Uint64(hash.Sum(nil))
+}
+
+// validConnectionID reports whether the connection ID was handed to the address in this window of time or the last
+func (tracker *Tracker) validConnectionID(connectionID uint64, addr *net.UDPAddr) bool {
+	now := time.Now()
+	return connectionID == tracker.connectionID(addr, now) || connectionID == tracker.connectionID(addr, now.Add(-connectionIDWindow))
+}
+
+// udpHeader starts an answer with its action and the transaction ID of the request
+func udpHeader(action uint32, transactionID []byte) []byte {
+	response := make([]byte, 4, 8)
+	binary.BigEndian.PutUint32(response, action)
+	return append(response, transactionID...)
+}
+
+// udpError is the answer to a request the tracker refuses
+func udpError(transactionID []byte, message string) []byte {
+	return append(udpHeader(actionError, transactionID), message...)
+}
+
+func appendUint32(data []byte, value uint32) []byte {
+	buf := make([]byte, 4)
+	binary.BigEndian.PutUint32(buf, value)
+	return append(data, buf...)
+}
+
+func appendUint64(data []byte, value uint64) []byte {
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, value)
+	return append(data, buf...)
+}
@@ -0,0 +1,191 @@
+package tracker
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+)
+
+var testTransactionID = []byte{0xde, 0xad, 0xbe, 0xef}
+
+// udpRequest builds a request packet: the connection ID, action and transaction ID, then the body
+func udpRequest(connectionID uint64, action uint32, body []byte) []byte {
+	packet := appendUint64(nil, connectionID)
+	packet = appendUint32(packet, action)
+	packet = append(packet, testTransactionID...)
+
+	return append(packet, body...)
+}
+
+// udpAnnounceBody is the body of an announce of the peer numbered n
+func udpAnnounceBody(n byte, left uint64, event uint32) []byte {
+	body := append([]byte(nil), testInfoHash[:]...)
+	body = append(body, n)
+	body = append(body, make([]byte, 19)...)
+	body = appendUint64(body, 0)
+	body = appendUint64(body, left)
+	body = appendUint64(body, 0)
+	body = appendUint32(body, event)
+	body = appendUint32(body, 0)
+	body = appendUint32(body, 0)
+	body = appendUint32(body, 0xffffffff)
+
+	return append(body, 0x1a, 0xe1)
+}
+
+// udpConnect asks the tracker for a connection ID as the address
+func udpConnect(t *testing.T, tracker *Tracker, addr *net.UDPAddr) uint64 {
+	t.Helper()
+
+	response := tracker.handlePacket(udpRequest(udpProtocolID, actionConnect, nil), addr)
+	if len(response) != 16 || binary.BigEndian.Uint32(response) != actionConnect || !bytes.Equal(response[4:8], testTransactionID) {
+		t.Fatalf("connect was answered with %x", response)
+	}
+
+	return binary.BigEndian.Uint64(response[8:16])
+}
+
+// checkUDPError fails the test unless the response refuses the request
+func checkUDPError(t *testing.T, response []byte, what string) {
+	t.Helper()
+
+	if len(response) < 8 || binary.BigEndian.Uint32(response) != actionError || !bytes.Equal(response[4:8], testTransactionID) {
+		t.Fatalf("%s was answered with %x, want an error", what, response)
+	}
+}
+
+func TestUDPConnectionIDs(t *testing.T) {
+	tracker := New(Config{})
+	addr := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 1234}
+	other := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 1235}
+	now := time.Now()
+
+	id := tracker.connectionID(addr, now)
+	if id != tracker.connectionID(addr, now) {
+		t.Fatal("connection ID of the same address in the same window differs")
+	}
+	if id == tracker.connectionID(other, now) {
+		t.Fatal("another address gets the same connection ID")
+	}
+	if id == New(Config{}).connectionID(addr, now) {
+		t.Fatal("another tracker hands out the same connection ID")
+	}
+
+	// IDs of this window and the last one are accepted, older ones aren't
+	if !tracker.validConnectionID(tracker.connectionID(addr, now), addr) {
+		t.Fatal("connection ID of this window was refused")
+	}
+	if !tracker.validConnectionID(tracker.connectionID(addr, now.Add(-connectionIDWindow)), addr) {
+		t.Fatal("connection ID of the last window was refused")
+	}
+	if tracker.validConnectionID(tracker.connectionID(addr, now.Add(-2*connectionIDWindow)), addr) {
+		t.Fatal("connection ID of two windows ago was accepted")
+	}
+	if tracker.validConnectionID(id, other) {
+		t.Fatal("connection ID was accepted from another address")
+	}
+
+	// Nothing but the connect request gets an answer without a valid connection ID
+	checkUDPError(t, tracker.handlePacket(udpRequest(id+1, actionAnnounce, udpAnnounceBody(1, 100, 2)), addr), "announce with a bad connection ID")
+	checkUDPError(t, tracker.handlePacket(udpRequest(udpConnect(t, tracker, other), actionAnnounce, udpAnnounceBody(1, 100, 2)), addr), "announce with the connection ID of another address")
+	if response := tracker.handlePacket(udpRequest(12345, actionConnect, nil), addr); response != nil {
+		t.Fatalf("connect without the protocol ID was answered with %x", response)
+	}
+}
+
+func TestUDPAnnounce(t *testing.T) {
+	tracker := New(Config{Interval: 10 * time.Minute})
+	first := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 1234}
+	second := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 2), Port: 1234}
+
+	tracker.handlePacket(udpRequest(udpConnect(t, tracker, first), actionAnnounce, udpAnnounceBody(1, 100, 2)), first)
+	response := tracker.handlePacket(udpRequest(udpConnect(t, tracker, second), actionAnnounce, udpAnnounceBody(2, 0, 2)), second)
+
+	// The second peer is told about the first
+	want := udpHeader(actionAnnounce, testTransactionID)
+	want = appendUint32(want, 600)
+	want = appendUint32(want, 1)
+	want = appendUint32(want, 1)
+	want = append(want, 192, 0, 2, 1, 0x1a, 0xe1)
+	if !bytes.Equal(response, want) {
+		t.Fatalf("announce was answered with %x, want %x", response, want)
+	}
+
+	checkUDPError(t, tracker.handlePacket(udpRequest(udpConnect(t, tracker, first), actionAnnounce, udpAnnounceBody(1, 100, 2)[:50]), first), "short announce")
+}
+
+func TestUDPAnnounceIPv6(t *testing.T) {
+	tracker := New(Config{})
+	v4 := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 1234}
+	v6 := &net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 1234}
+
+	tracker.handlePacket(udpRequest(udpConnect(t, tracker, v4), actionAnnounce, udpAnnounceBody(1, 100, 2)), v4)
+	tracker.handlePacket(udpRequest(udpConnect(t, tracker, v6), actionAnnounce, udpAnnounceBody(2, 100, 2)), v6)
+
+	// Each family is only sent the peers it can reach, IPv6 peers taking 18 bytes
+	third := &net.UDPAddr{IP: net.ParseIP("2001:db8::3"), Port: 1234}
+	response := tracker.handlePacket(udpRequest(udpConnect(t, tracker, third), actionAnnounce, udpAnnounceBody(3, 100, 2)), third)
+	if want := append(net.ParseIP("2001:db8::1"), 0x1a, 0xe1); !bytes.Equal(response[20:], want) {
+		t.Fatalf("IPv6 peers are %x, want %x", response[20:], want)
+	}
+
+	fourth := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 4), Port: 1234}
+	response = tracker.handlePacket(udpRequest(udpConnect(t, tracker, fourth), actionAnnounce, udpAnnounceBody(4, 100, 2)), fourth)
+	if want := []byte{192, 0, 2, 1, 0x1a, 0xe1}; !bytes.Equal(response[20:], want) {
+		t.Fatalf("IPv4 peers are %x, want %x", response[20:], want)
+	}
+}
+
+func TestUDPScrape(t *testing.T) {
+	tracker := New(Config{Whitelist: [][20]byte{testInfoHash}})
+	addr := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 1234}
+	connectionID := udpConnect(t, tracker, addr)
+
+	tracker.handlePacket(udpRequest(connectionID, actionAnnounce, udpAnnounceBody(1, 0, 1)), addr)
+	tracker.handlePacket(udpRequest(connectionID, actionAnnounce, udpAnnounceBody(2, 100, 2)), addr)
+
+	// The info-hash that isn't tracked is answered with zeros, so the answers line up with the request
+	untracked := bytes.Repeat([]byte{9}, 20)
+	response := tracker.handlePacket(udpRequest(connectionID, actionScrape, append(untracked, testInfoHash[:]...)), addr)
+
+	want := udpHeader(actionScrape, testTransactionID)
+	want = append(want, make([]byte, 12)...)
+	want = appendUint32(want, 1)
+	want = appendUint32(want, 1)
+	want = appendUint32(want, 1)
+	if !bytes.Equal(response, want) {
+		t.Fatalf("scrape was answered with %x, want %x", response, want)
+	}
+}
+
+func TestServeUDP(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tracker := New(Config{})
+	go tracker.ServeUDP(conn)
+	defer conn.Close()
+
+	client, err := net.Dial("udp", conn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// Packets too short to be a request are ignored
+	client.Write([]byte{1, 2, 3})
+	client.Write(udpRequest(udpProtocolID, actionConnect, nil))
+
+	buf := make([]byte, maxPacket)
+	n, err := client.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 16 || binary.BigEndian.Uint32(buf) != actionConnect {
+		t.Fatalf("connect was answered with %x", buf[:n])
+	}
+}